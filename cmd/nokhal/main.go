@@ -2,19 +2,40 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/wesleyyan-sb/nokhal"
+	"github.com/wesleyyan-sb/nokhal/cmd/nokhal/session"
+	"github.com/wesleyyan-sb/nokhal/shell"
 )
 
 func main() {
 	path := flag.String("path", "nokhal.nok", "Path to the database file")
 	password := flag.String("password", "", "Database password")
+	verbose := flag.Bool("v", false, "Print how each database was opened")
+	norc := flag.Bool("norc", false, "Do not run ~/.nokhalrc on startup")
+	kdfMemory := flag.Uint("kdf-memory", 0, "Argon2 memory in MiB when creating a database (default 64)")
+	kdfTime := flag.Uint("kdf-time", 0, "Argon2 passes when creating a database (default 1)")
+	kdfParallel := flag.Uint("kdf-parallel", 0, "Argon2 threads when creating a database (default 4)\nExisting databases keep the parameters they were created with")
 	flag.Parse()
 
+	kdf, err := kdfParams(*kdfMemory, *kdfTime, *kdfParallel)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+	envOpts, err := nokhal.OptionsFromEnv()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+
 	if *password == "" {
 		fmt.Print("Enter password: ")
 		scanner := bufio.NewScanner(os.Stdin)
@@ -28,92 +49,255 @@ func main() {
 		os.Exit(1)
 	}
 
-	db, err := nokhal.Open(*path, *password)
+	// Flags take precedence over the environment
+	sess := session.New()
+	sess.Options = envOpts.Merge(nokhal.Options{KDF: kdf})
+	h, err := sess.Open(*path, "", *password)
 	if err != nil {
 		fmt.Printf("Error opening database: %v\n", err)
 		os.Exit(1)
 	}
-	defer db.Close()
+	if *verbose {
+		fmt.Println(h.Summary())
+	}
+	if sess.Options.KDF != (nokhal.KDFParams{}) {
+		printKDF(sess.Options.KDF, h.Report.KDF)
+	}
+	defer func() {
+		if err := sess.CloseAll(); err != nil {
+			fmt.Printf("Error closing databases: %v\n", err)
+		}
+	}()
 
 	fmt.Println("Nokhal DB Shell")
-	fmt.Println("Commands: put <col> <key> <val>, get <col> <key>, del <col> <key>, list <col>, compact, exit")
+	fmt.Println("Commands: put <col> <key> <val>, get <col> <key>, del <col> <key>, list <col>, scan [prefix], collections [-v], stats [-v | --by-collection], compact, freeze [timeout], unfreeze, reindex, backup <file>, verify-backup [-decrypt] <file>, hint <file>, export [--encrypt] <prefix> <file>, export --resume <prefix> <after-key> <file>, import [--encrypt] [--overwrite] [--keep-expired] [--shift-expiry] [--allow-partial] <file>, open <path> [alias], use <alias>, databases, close <alias>, alias [name [= command]], unalias <name>, set [name value], unset <name>, exit")
 
 	scanner := bufio.NewScanner(os.Stdin)
+	if !*norc && !runStartupScript(sess, scanner, *verbose) {
+		return
+	}
 	for {
-		fmt.Print("> ")
+		fmt.Print(sess.Prompt())
 		if !scanner.Scan() {
 			break
 		}
-		line := strings.TrimSpace(scanner.Text())
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
+		cmd, err := sess.Expand(scanner.Text())
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
 			continue
 		}
+		if !execute(sess, scanner, cmd, *verbose) {
+			return
+		}
+	}
+}
 
-		cmd := strings.ToLower(parts[0])
-		switch cmd {
-		case "put":
-			if len(parts) < 4 {
-				fmt.Println("Usage: put <collection> <key> <value>")
-				continue
-			}
-			col := parts[1]
-			key := parts[2]
-			val := strings.Join(parts[3:], " ")
-			if err := db.Put(col, key, []byte(val)); err != nil {
-				fmt.Printf("Error: %v\n", err)
-			} else {
-				fmt.Println("OK")
-			}
-		case "get":
-			if len(parts) != 3 {
-				fmt.Println("Usage: get <collection> <key>")
-				continue
-			}
-			col := parts[1]
-			key := parts[2]
-			val, err := db.Get(col, key)
-			if err != nil {
-				fmt.Printf("Error: %v\n", err)
-			} else {
-				fmt.Printf("%s\n", val)
-			}
-		case "del":
-			if len(parts) != 3 {
-				fmt.Println("Usage: del <collection> <key>")
-				continue
+// kdfParams checks the -kdf-* flags, where zero keeps the default, and
+// converts them to the options of new databases.
+func kdfParams(memoryMiB, passes, threads uint) (nokhal.KDFParams, error) {
+	switch {
+	case memoryMiB > math.MaxUint32/1024:
+		return nokhal.KDFParams{}, fmt.Errorf("-kdf-memory %d MiB is too large", memoryMiB)
+	case passes > math.MaxUint32:
+		return nokhal.KDFParams{}, fmt.Errorf("-kdf-time %d is too large", passes)
+	case threads > math.MaxUint8:
+		return nokhal.KDFParams{}, fmt.Errorf("-kdf-parallel %d is more than %d threads", threads, math.MaxUint8)
+	}
+	kdf := nokhal.KDFParams{Time: uint32(passes), Memory: uint32(memoryMiB) * 1024, Parallelism: uint8(threads)}
+	return kdf, kdf.Validate()
+}
+
+// printKDF prints the key derivation parameters in effect, and whether the
+// requested ones were ignored because the database already existed.
+func printKDF(requested, effective nokhal.KDFParams) {
+	fmt.Printf("Key derivation: %s\n", effective)
+	if requested.String() != effective.String() {
+		fmt.Println("The database already existed: its own parameters are used and the -kdf flags and NOKHAL_KDF_* variables are ignored")
+	}
+}
+
+// runStartupScript runs the lines of ~/.nokhalrc, if it exists, as if they
+// were typed. It returns false if the script exits the shell.
+func runStartupScript(sess *session.Session, scanner *bufio.Scanner, verbose bool) bool {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return true
+	}
+	path := filepath.Join(home, ".nokhalrc")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return true
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		cmd, err := sess.Expand(line)
+		if err != nil {
+			fmt.Printf("%s:%d: %v\n", path, i+1, err)
+			continue
+		}
+		if !execute(sess, scanner, cmd, verbose) {
+			return false
+		}
+	}
+	return true
+}
+
+// execute runs one command and returns false if it exits the shell.
+func execute(sess *session.Session, scanner *bufio.Scanner, cmd shell.Command, verbose bool) bool {
+	switch cmd.Name {
+	case "":
+	case "exit", "quit":
+		return false
+	case "open", "use", "databases", "close":
+		runSessionCommand(sess, scanner, cmd, verbose)
+	case "alias", "unalias", "set", "unset":
+		runShellCommand(sess, cmd)
+	case "hint":
+		// Reads the file alone, so no database needs to be open
+		report(shell.New(nil).Run(cmd, os.Stdout))
+	default:
+		h, err := sess.Active()
+		if err != nil {
+			fmt.Printf("Error: %v (use: open <path>)\n", err)
+			return true
+		}
+		// Passphrases are read from the same input as commands
+		h.Shell.Prompt = func(label string) (string, error) {
+			return prompt(scanner, label), nil
+		}
+		report(h.Shell.Run(cmd, os.Stdout))
+	}
+	return true
+}
+
+// report prints the error of a shell command, if any.
+func report(err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, shell.ErrUsage):
+		fmt.Println("Usage:", strings.TrimPrefix(err.Error(), shell.ErrUsage.Error()+": "))
+	default:
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// runSessionCommand handles the commands that manage open databases.
+func runSessionCommand(sess *session.Session, scanner *bufio.Scanner, cmd shell.Command, verbose bool) {
+	args := cmd.Args
+	switch cmd.Name {
+	case "open":
+		if len(args) < 1 || len(args) > 2 {
+			fmt.Println("Usage: open <path> [alias]")
+			return
+		}
+		alias := ""
+		if len(args) == 2 {
+			alias = args[1]
+		}
+		password := prompt(scanner, fmt.Sprintf("Password for %s: ", args[0]))
+		if password == "" {
+			fmt.Println("Password is required.")
+			return
+		}
+		h, err := sess.Open(args[0], alias, password)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Opened %s as %s\n", h.Path, h.Alias)
+			if verbose {
+				fmt.Println(h.Summary())
 			}
-			col := parts[1]
-			key := parts[2]
-			if err := db.Delete(col, key); err != nil {
-				fmt.Printf("Error: %v\n", err)
-			} else {
-				fmt.Println("OK")
+		}
+	case "use":
+		if len(args) != 1 {
+			fmt.Println("Usage: use <alias>")
+			return
+		}
+		if err := sess.Use(args[0]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	case "databases":
+		active, _ := sess.Active()
+		for _, h := range sess.Handles() {
+			marker := " "
+			if h == active {
+				marker = "*"
 			}
-		case "list":
-			if len(parts) != 2 {
-				fmt.Println("Usage: list <collection>")
-				continue
+			fmt.Printf("%s %s\t%s\n", marker, h.Alias, h.Path)
+		}
+	case "close":
+		if len(args) != 1 {
+			fmt.Println("Usage: close <alias>")
+			return
+		}
+		if err := sess.Close(args[0]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println("Closed", args[0])
+		}
+	}
+}
+
+// runShellCommand handles the commands that define aliases and variables.
+func runShellCommand(sess *session.Session, cmd shell.Command) {
+	args := cmd.Args
+	var err error
+	switch cmd.Name {
+	case "alias":
+		switch len(args) {
+		case 0:
+			for _, a := range sess.Aliases() {
+				fmt.Printf("alias %s = %s\n", a.Name, a.Value)
 			}
-			col := parts[1]
-			keys, err := db.List(col)
-			if err != nil {
-				fmt.Printf("Error: %v\n", err)
-			} else {
-				for _, k := range keys {
-					fmt.Println(k)
+		case 1:
+			found := false
+			for _, a := range sess.Aliases() {
+				if a.Name == args[0] {
+					fmt.Printf("alias %s = %s\n", a.Name, a.Value)
+					found = true
 				}
 			}
-		case "compact":
-			if err := db.Compact(); err != nil {
-				fmt.Printf("Error: %v\n", err)
-			} else {
-				fmt.Println("Compaction complete")
+			if !found {
+				fmt.Printf("Error: %v: %s\n", shell.ErrUndefined, args[0])
 			}
-		case "exit", "quit":
+		default:
+			err = sess.SetAlias(args[0], args[1])
+		}
+	case "unalias":
+		if len(args) != 1 {
+			fmt.Println("Usage: unalias <name>")
 			return
+		}
+		err = sess.Unalias(args[0])
+	case "set":
+		switch len(args) {
+		case 0:
+			for _, v := range sess.Variables() {
+				fmt.Printf("%s = %q\n", v.Name, v.Value)
+			}
+		case 1:
+			fmt.Println("Usage: set <name> <value>")
 		default:
-			fmt.Println("Unknown command")
+			err = sess.Set(args[0], strings.Join(args[1:], " "))
+		}
+	case "unset":
+		if len(args) != 1 {
+			fmt.Println("Usage: unset <name>")
+			return
 		}
+		err = sess.Unset(args[0])
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+func prompt(scanner *bufio.Scanner, label string) string {
+	fmt.Print(label)
+	if !scanner.Scan() {
+		return ""
 	}
+	return strings.TrimSpace(scanner.Text())
 }
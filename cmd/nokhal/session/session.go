@@ -0,0 +1,199 @@
+// Package session holds the state of the nokhal command line shell: the
+// databases it has open, which of them commands apply to, and the aliases
+// and variables input lines are expanded with. Package shell runs the
+// database commands themselves.
+package session
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wesleyyan-sb/nokhal"
+	"github.com/wesleyyan-sb/nokhal/shell"
+)
+
+var (
+	ErrNoDatabase   = shell.ErrNoDatabase
+	ErrUnknownAlias = errors.New("unknown alias")
+	ErrAliasInUse   = errors.New("alias already in use")
+	ErrAlreadyOpen  = errors.New("database already open")
+)
+
+// Handle is one open database.
+type Handle struct {
+	Alias    string
+	Path     string
+	DB       *nokhal.DB
+	Report   nokhal.OpenReport
+	Shell    *shell.Shell // Runs the database commands against DB
+	password string
+}
+
+// Password returns the password the handle was opened with, for commands
+// such as verify-backup that open files of the same database.
+func (h *Handle) Password() string {
+	return h.password
+}
+
+// Summary describes how the database was opened on one line.
+func (h *Handle) Summary() string {
+	r := h.Report
+	parts := []string{fmt.Sprintf("%s: format v%d, %s", h.Alias, r.Version, r.Cipher)}
+	switch {
+	case r.HintUsed:
+		parts = append(parts, "hint used")
+	case r.HintDiscarded:
+		parts = append(parts, "hint DISCARDED")
+	default:
+		parts = append(parts, "no hint")
+	}
+	parts = append(parts,
+		fmt.Sprintf("%d records scanned", r.RecordsScanned),
+		fmt.Sprintf("flags %05b", r.RecordFlags),
+		fmt.Sprintf("kdf %s (%s)", r.KDF, r.KDFDuration.Round(time.Millisecond)),
+		fmt.Sprintf("index %s", r.IndexDuration.Round(time.Millisecond)),
+	)
+	if r.Features != 0 {
+		parts = append(parts, fmt.Sprintf("features %s", r.Features))
+	}
+	if r.Rotating {
+		parts = append(parts, "key rotation pending")
+	}
+	if r.TruncatedTail > 0 {
+		parts = append(parts, fmt.Sprintf("TORN TAIL %d bytes", r.TruncatedTail))
+	}
+	if len(r.Removed) > 0 {
+		parts = append(parts, fmt.Sprintf("removed %d orphaned files", len(r.Removed)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Session tracks the open databases and the active one, and the command
+// aliases and variables defined in the shell.
+type Session struct {
+	// Options are used to open every database, for example the key
+	// derivation parameters of files the shell creates
+	Options nokhal.Options
+
+	handles map[string]*Handle
+	active  string
+	aliases map[string]string
+	vars    map[string]string
+}
+
+func New() *Session {
+	return &Session{
+		handles: make(map[string]*Handle),
+		aliases: make(map[string]string),
+		vars:    make(map[string]string),
+	}
+}
+
+// Open opens the database at path under alias and makes it active. An empty
+// alias defaults to the file name without its extension.
+func (s *Session) Open(path, alias, password string) (*Handle, error) {
+	if alias == "" {
+		alias = AliasFor(path)
+	}
+	if _, ok := s.handles[alias]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAliasInUse, alias)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range s.handles {
+		if h.Path == abs {
+			return nil, fmt.Errorf("%w as %s", ErrAlreadyOpen, h.Alias)
+		}
+	}
+
+	db, report, err := nokhal.OpenWithReport(path, password, s.Options)
+	if err != nil {
+		return nil, err
+	}
+	sh := shell.New(db)
+	sh.Password = password
+	h := &Handle{Alias: alias, Path: abs, DB: db, Report: report, Shell: sh, password: password}
+	s.handles[alias] = h
+	s.active = alias
+	return h, nil
+}
+
+// Use makes alias the active database.
+func (s *Session) Use(alias string) error {
+	if _, ok := s.handles[alias]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownAlias, alias)
+	}
+	s.active = alias
+	return nil
+}
+
+// Close closes the database open as alias. Closing the active database
+// activates the first remaining alias in sorted order, if any.
+func (s *Session) Close(alias string) error {
+	h, ok := s.handles[alias]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownAlias, alias)
+	}
+	delete(s.handles, alias)
+	if s.active == alias {
+		s.active = ""
+		if rest := s.Handles(); len(rest) > 0 {
+			s.active = rest[0].Alias
+		}
+	}
+	return h.DB.Close()
+}
+
+// CloseAll closes every open database and returns their errors joined.
+func (s *Session) CloseAll() error {
+	var errs []error
+	for _, h := range s.Handles() {
+		if err := h.DB.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.Alias, err))
+		}
+	}
+	s.handles = make(map[string]*Handle)
+	s.active = ""
+	return errors.Join(errs...)
+}
+
+// Active returns the database commands apply to.
+func (s *Session) Active() (*Handle, error) {
+	h, ok := s.handles[s.active]
+	if !ok {
+		return nil, ErrNoDatabase
+	}
+	return h, nil
+}
+
+// Handles returns the open databases sorted by alias.
+func (s *Session) Handles() []*Handle {
+	handles := make([]*Handle, 0, len(s.handles))
+	for _, h := range s.handles {
+		handles = append(handles, h)
+	}
+	slices.SortFunc(handles, func(a, b *Handle) int {
+		return strings.Compare(a.Alias, b.Alias)
+	})
+	return handles
+}
+
+// Prompt returns the shell prompt, showing the active alias.
+func (s *Session) Prompt() string {
+	if s.active == "" {
+		return "> "
+	}
+	return s.active + "> "
+}
+
+// AliasFor derives the default alias of a database file.
+func AliasFor(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSwitching(t *testing.T) {
+	dir := t.TempDir()
+	s := New()
+	defer s.CloseAll()
+
+	if _, err := s.Active(); err != ErrNoDatabase {
+		t.Errorf("Expected ErrNoDatabase, got %v", err)
+	}
+	if s.Prompt() != "> " {
+		t.Errorf("Prompt without database = %q", s.Prompt())
+	}
+
+	dev, err := s.Open(filepath.Join(dir, "dev.nok"), "", "devpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.Alias != "dev" || s.Prompt() != "dev> " {
+		t.Errorf("Alias %q, prompt %q", dev.Alias, s.Prompt())
+	}
+	if _, err := s.Open(filepath.Join(dir, "prod.nok"), "live", "prodpass"); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.Active(); h.Alias != "live" || h.Password() != "prodpass" {
+		t.Errorf("Newly opened database should be active, got %s", h.Alias)
+	}
+
+	if _, err := s.Open(filepath.Join(dir, "other", "dev.nok"), "", "pass"); !errors.Is(err, ErrAliasInUse) {
+		t.Errorf("Expected ErrAliasInUse, got %v", err)
+	}
+	if _, err := s.Open(filepath.Join(dir, "dev.nok"), "again", "devpass"); !errors.Is(err, ErrAlreadyOpen) {
+		t.Errorf("Expected ErrAlreadyOpen, got %v", err)
+	}
+
+	// Commands go to the active handle only
+	h, _ := s.Active()
+	if err := h.DB.Put("env", "name", []byte("prod")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Use("dev"); err != nil {
+		t.Fatal(err)
+	}
+	h, _ = s.Active()
+	if _, err := h.DB.Get("env", "name"); err == nil {
+		t.Error("Write to live leaked into dev")
+	}
+	if err := s.Use("missing"); !errors.Is(err, ErrUnknownAlias) {
+		t.Errorf("Expected ErrUnknownAlias, got %v", err)
+	}
+
+	var aliases []string
+	for _, h := range s.Handles() {
+		aliases = append(aliases, h.Alias)
+	}
+	if !reflect.DeepEqual(aliases, []string{"dev", "live"}) {
+		t.Errorf("Handles = %v", aliases)
+	}
+
+	// Closing the active handle activates the next one
+	if err := s.Close("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.Active(); h == nil || h.Alias != "live" {
+		t.Errorf("Expected live to become active, got %+v", h)
+	}
+	if err := s.Close("dev"); !errors.Is(err, ErrUnknownAlias) {
+		t.Errorf("Expected ErrUnknownAlias on second close, got %v", err)
+	}
+
+	if err := s.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Handles()) != 0 || s.Prompt() != "> " {
+		t.Error("CloseAll left handles open")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.nok")
+	s := New()
+	defer s.CloseAll()
+
+	h, err := s.Open(path, "", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.DB.Put("col", "key", []byte("value"))
+	s.Close("data")
+
+	if h, err = s.Open(path, "", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	summary := h.Summary()
+	for _, want := range []string{"data: format v5, AES-256-GCM", "hint used", "0 records scanned", "kdf argon2id t=1 m=65536KiB p=4"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("Summary %q lacks %q", summary, want)
+		}
+	}
+}
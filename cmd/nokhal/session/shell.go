@@ -0,0 +1,112 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/wesleyyan-sb/nokhal/shell"
+)
+
+var ErrInvalidName = errors.New("invalid name")
+
+// Definition is one command alias or variable.
+type Definition struct {
+	Name  string
+	Value string
+}
+
+// Expand parses an input line the way the shell runs it. A first word that
+// names an alias is replaced by the alias text, then the line is tokenized
+// with the session's variables. Alias definitions are not expanded: "alias
+// name = text" gives the command alias with the arguments name and text,
+// the text kept verbatim so that its quotes and variables apply when the
+// alias is used.
+func (s *Session) Expand(line string) (shell.Command, error) {
+	line = strings.TrimSpace(line)
+	first, rest := line, ""
+	if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+		first, rest = line[:i], line[i:]
+	}
+
+	if strings.ToLower(first) == "alias" {
+		name, body, define := strings.Cut(rest, "=")
+		name, body = strings.TrimSpace(name), strings.TrimSpace(body)
+		switch {
+		case !define && name == "":
+			return shell.Command{Name: "alias", Args: []string{}}, nil
+		case !define:
+			return shell.Command{Name: "alias", Args: []string{name}}, nil
+		case body == "":
+			return shell.Command{}, fmt.Errorf("alias %s needs a command", name)
+		}
+		return shell.Command{Name: "alias", Args: []string{name, body}}, nil
+	}
+	if body, ok := s.aliases[first]; ok {
+		line = body + rest
+	}
+
+	return shell.ParseWith(line, func(name string) (string, bool) {
+		v, ok := s.vars[name]
+		return v, ok
+	})
+}
+
+// SetAlias makes name run body, which is expanded like an input line.
+func (s *Session) SetAlias(name, body string) error {
+	if !shell.ValidName(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	s.aliases[name] = body
+	return nil
+}
+
+// Unalias removes the alias name.
+func (s *Session) Unalias(name string) error {
+	if _, ok := s.aliases[name]; !ok {
+		return fmt.Errorf("%w: %s", shell.ErrUndefined, name)
+	}
+	delete(s.aliases, name)
+	return nil
+}
+
+// Aliases returns the aliases sorted by name.
+func (s *Session) Aliases() []Definition {
+	return sortedDefinitions(s.aliases)
+}
+
+// Set sets the variable name, referenced as $name or ${name}.
+func (s *Session) Set(name, value string) error {
+	if !shell.ValidName(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	s.vars[name] = value
+	return nil
+}
+
+// Unset removes the variable name.
+func (s *Session) Unset(name string) error {
+	if _, ok := s.vars[name]; !ok {
+		return fmt.Errorf("%w: %s", shell.ErrUndefined, name)
+	}
+	delete(s.vars, name)
+	return nil
+}
+
+// Variables returns the variables sorted by name.
+func (s *Session) Variables() []Definition {
+	return sortedDefinitions(s.vars)
+}
+
+func sortedDefinitions(m map[string]string) []Definition {
+	defs := make([]Definition, 0, len(m))
+	for name, value := range m {
+		defs = append(defs, Definition{Name: name, Value: value})
+	}
+	slices.SortFunc(defs, func(a, b Definition) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return defs
+}
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/wesleyyan-sb/nokhal/shell"
+)
+
+func TestExpand(t *testing.T) {
+	s := New()
+	expand := func(line string) shell.Command {
+		t.Helper()
+		cmd, err := s.Expand(line)
+		if err != nil {
+			t.Fatalf("Expand(%q): %v", line, err)
+		}
+		return cmd
+	}
+
+	// Definitions keep the alias text verbatim
+	def := expand(`alias pv = put $col "$key" 'a  b'`)
+	if !reflect.DeepEqual(def, shell.Command{Name: "alias", Args: []string{"pv", `put $col "$key" 'a  b'`}}) {
+		t.Fatalf("Alias definition parsed as %+v", def)
+	}
+	if err := s.SetAlias(def.Args[0], def.Args[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAlias("gu", "get users"); err != nil {
+		t.Fatal(err)
+	}
+	if got := expand("alias gu"); !reflect.DeepEqual(got.Args, []string{"gu"}) {
+		t.Errorf("alias gu = %+v", got)
+	}
+	if _, err := s.Expand("alias gu ="); err == nil {
+		t.Error("Expected an error for an empty alias")
+	}
+
+	s.Set("col", "users")
+	s.Set("key", "two words")
+	if got := expand("pv extra"); !reflect.DeepEqual(got, shell.Command{Name: "put", Args: []string{"users", "two words", "a  b", "extra"}}) {
+		t.Errorf("pv expanded to %+v", got)
+	}
+	if got := expand("gu alice"); !reflect.DeepEqual(got, shell.Command{Name: "get", Args: []string{"users", "alice"}}) {
+		t.Errorf("gu expanded to %+v", got)
+	}
+	if got := expand("get gu"); !reflect.DeepEqual(got.Args, []string{"gu"}) {
+		t.Errorf("Alias expanded outside the first word: %+v", got)
+	}
+
+	want := []Definition{{"gu", "get users"}, {"pv", `put $col "$key" 'a  b'`}}
+	if !reflect.DeepEqual(s.Aliases(), want) {
+		t.Errorf("Aliases = %v", s.Aliases())
+	}
+	if err := s.Unalias("gu"); err != nil {
+		t.Fatal(err)
+	}
+	if got := expand("gu alice"); got.Name != "gu" {
+		t.Errorf("Removed alias still expands: %+v", got)
+	}
+	if err := s.Unalias("gu"); !errors.Is(err, shell.ErrUndefined) {
+		t.Errorf("Expected shell.ErrUndefined, got %v", err)
+	}
+
+	if err := s.Unset("col"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Expand("get $col alice"); !errors.Is(err, shell.ErrUndefined) {
+		t.Errorf("Expected shell.ErrUndefined for an unset variable, got %v", err)
+	}
+	if !reflect.DeepEqual(s.Variables(), []Definition{{"key", "two words"}}) {
+		t.Errorf("Variables = %v", s.Variables())
+	}
+	for _, name := range []string{"", "1st", "a-b", "$x"} {
+		if err := s.Set(name, "v"); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Set(%q): expected ErrInvalidName, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package transforms holds sample nokhal.Transform implementations for
+// collections of JSON objects. They act on top-level fields only and are
+// meant as starting points rather than a complete field-level encryption
+// scheme.
+package transforms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// editFields applies fn to each of fields present in the JSON object doc.
+func editFields(doc []byte, fields []string, fn func(field string, raw json.RawMessage) (json.RawMessage, error)) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &obj); err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		raw, ok := obj[field]
+		if !ok {
+			continue
+		}
+		edited, err := fn(field, raw)
+		if err != nil {
+			return nil, err
+		}
+		obj[field] = edited
+	}
+	return json.Marshal(obj)
+}
+
+func quote(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// HMACMask replaces fields with an HMAC-SHA256 of their JSON value under
+// Key, so they can still be compared for equality, say to look up a user by
+// email hash, but never read back. Masking happens on write; Decode returns
+// the stored document.
+type HMACMask struct {
+	Key    []byte
+	Fields []string
+}
+
+func (m HMACMask) Encode(key string, plaintext []byte) ([]byte, error) {
+	return editFields(plaintext, m.Fields, func(_ string, raw json.RawMessage) (json.RawMessage, error) {
+		mac := hmac.New(sha256.New, m.Key)
+		mac.Write(raw)
+		return quote("hmac:" + base64.RawStdEncoding.EncodeToString(mac.Sum(nil))), nil
+	})
+}
+
+func (m HMACMask) Decode(key string, stored []byte) ([]byte, error) {
+	return stored, nil
+}
+
+const aesPrefix = "aes:"
+
+// FieldAES encrypts fields with AES-GCM under a key of its own, on top of
+// nokhal's encryption of the whole value. Each field is bound to the record
+// key and field name, so ciphertexts cannot be moved between records.
+type FieldAES struct {
+	aead   cipher.AEAD
+	fields []string
+}
+
+// NewFieldAES returns a FieldAES for fields under a 16, 24 or 32-byte key.
+func NewFieldAES(key []byte, fields ...string) (*FieldAES, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &FieldAES{aead: aead, fields: fields}, nil
+}
+
+func fieldAAD(key, field string) []byte {
+	return []byte(key + "\x00" + field)
+}
+
+func (f *FieldAES) Encode(key string, plaintext []byte) ([]byte, error) {
+	return editFields(plaintext, f.fields, func(field string, raw json.RawMessage) (json.RawMessage, error) {
+		nonce := make([]byte, f.aead.NonceSize(), f.aead.NonceSize()+len(raw)+f.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		sealed := f.aead.Seal(nonce, nonce, raw, fieldAAD(key, field))
+		return quote(aesPrefix + base64.RawStdEncoding.EncodeToString(sealed)), nil
+	})
+}
+
+var ErrFieldDecryption = errors.New("field decryption failed")
+
+func (f *FieldAES) Decode(key string, stored []byte) ([]byte, error) {
+	return editFields(stored, f.fields, func(field string, raw json.RawMessage) (json.RawMessage, error) {
+		var s string
+		if json.Unmarshal(raw, &s) != nil || !strings.HasPrefix(s, aesPrefix) {
+			return raw, nil // Written before the field was encrypted
+		}
+		sealed, err := base64.RawStdEncoding.DecodeString(s[len(aesPrefix):])
+		if err != nil || len(sealed) < f.aead.NonceSize() {
+			return nil, ErrFieldDecryption
+		}
+		n := f.aead.NonceSize()
+		opened, err := f.aead.Open(nil, sealed[:n], sealed[n:], fieldAAD(key, field))
+		if err != nil {
+			return nil, ErrFieldDecryption
+		}
+		return opened, nil
+	})
+}
+
+// Redact is for handles of low-privilege code paths: Decode replaces fields
+// with "[redacted]", and Encode refuses to write, so redacted documents are
+// never stored back. Install it instead of the writer's transform.
+type Redact struct {
+	Fields []string
+}
+
+var ErrReadOnly = errors.New("transform is read-only")
+
+func (r Redact) Encode(key string, plaintext []byte) ([]byte, error) {
+	return nil, ErrReadOnly
+}
+
+func (r Redact) Decode(key string, stored []byte) ([]byte, error) {
+	return editFields(stored, r.Fields, func(string, json.RawMessage) (json.RawMessage, error) {
+		return quote("[redacted]"), nil
+	})
+}
@@ -0,0 +1,74 @@
+package transforms
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/wesleyyan-sb/nokhal"
+)
+
+func TestTransforms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := nokhal.Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableFeature(nokhal.FeatureTransforms); err != nil {
+		t.Fatal(err)
+	}
+
+	fieldKey := bytes.Repeat([]byte{7}, 32)
+	pii, err := NewFieldAES(fieldKey, "email", "ssn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetTransform("users", pii)
+	db.SetTransform("logins", HMACMask{Key: []byte("k"), Fields: []string{"email"}})
+
+	doc := []byte(`{"email":"ada@example.com","name":"Ada","ssn":"123"}`)
+	if err := db.Put("users", "ada", doc); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("users", "ada"); err != nil || !jsonEqual(t, v, doc) {
+		t.Errorf("Get through FieldAES = %s, %v", v, err)
+	}
+
+	// A low-privilege handle sees the document with the fields redacted
+	db.SetTransform("users", Redact{Fields: []string{"email", "ssn"}})
+	v, err := db.Get("users", "ada")
+	if err != nil || !jsonEqual(t, v, []byte(`{"email":"[redacted]","name":"Ada","ssn":"[redacted]"}`)) {
+		t.Errorf("Get through Redact = %s, %v", v, err)
+	}
+	if err := db.Put("users", "eve", doc); err != ErrReadOnly {
+		t.Errorf("Put through Redact: %v", err)
+	}
+
+	// Ciphertexts are bound to their record key
+	stored, _ := pii.Encode("ada", doc)
+	if _, err := pii.Decode("eve", stored); err != ErrFieldDecryption {
+		t.Errorf("field moved to another key: %v", err)
+	}
+
+	// Masked fields compare equal but cannot be read back
+	db.Put("logins", "1", []byte(`{"email":"ada@example.com"}`))
+	db.Put("logins", "2", []byte(`{"email":"ada@example.com"}`))
+	a, _ := db.Get("logins", "1")
+	b, _ := db.Get("logins", "2")
+	if !bytes.Equal(a, b) || bytes.Contains(a, []byte("ada@")) {
+		t.Errorf("masked documents %s and %s", a, b)
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y any
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	xs, _ := json.Marshal(x)
+	ys, _ := json.Marshal(y)
+	return bytes.Equal(xs, ys)
+}
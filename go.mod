@@ -2,6 +2,7 @@ module github.com/wesleyyan-sb/nokhal
 
 go 1.25
 
-require golang.org/x/crypto v0.48.0
-
-require golang.org/x/sys v0.41.0 // indirect
+require (
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0
+)
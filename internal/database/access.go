@@ -0,0 +1,129 @@
+package database
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// accessStripes is the number of copies of each collection's counters. An
+// update picks one at random, so that concurrent operations on a hot
+// collection rarely contend for one cache line; reading sums them.
+const accessStripes = 8
+
+// AccessStats counts the operations on one collection since Open or the
+// last ResetStats, to find the collections that dominate I/O. The counters
+// are updated without a lock, so a snapshot taken during writes may count
+// an operation in some of them and not yet in others.
+type AccessStats struct {
+	Gets         uint64  // Get calls, found or not
+	Puts         uint64  // Values written
+	Deletes      uint64  // Tombstones written
+	BytesRead    uint64  // Plaintext bytes returned by Get
+	BytesWritten uint64  // Value bytes written as stored: compressed, encrypted and tagged
+	AvgValueSize float64 // Mean plaintext size of the values written
+}
+
+// accessStripe is one copy of a collection's counters, padded to a cache
+// line.
+type accessStripe struct {
+	gets, puts, deletes     atomic.Uint64
+	bytesRead, bytesWritten atomic.Uint64
+	valueBytes              atomic.Uint64
+	_                       [16]byte
+}
+
+type accessCounters [accessStripes]accessStripe
+
+func (c *accessCounters) stripe() *accessStripe {
+	return &c[rand.Uint32()%accessStripes]
+}
+
+func (c *accessCounters) countGet(n int) {
+	s := c.stripe()
+	s.gets.Add(1)
+	s.bytesRead.Add(uint64(n))
+}
+
+func (c *accessCounters) countPut(plain, stored int) {
+	s := c.stripe()
+	s.puts.Add(1)
+	s.valueBytes.Add(uint64(plain))
+	s.bytesWritten.Add(uint64(stored))
+}
+
+func (c *accessCounters) countDelete() {
+	c.stripe().deletes.Add(1)
+}
+
+func (c *accessCounters) load() AccessStats {
+	var a AccessStats
+	var valueBytes uint64
+	for i := range c {
+		s := &c[i]
+		a.Gets += s.gets.Load()
+		a.Puts += s.puts.Load()
+		a.Deletes += s.deletes.Load()
+		a.BytesRead += s.bytesRead.Load()
+		a.BytesWritten += s.bytesWritten.Load()
+		valueBytes += s.valueBytes.Load()
+	}
+	if a.Puts > 0 {
+		a.AvgValueSize = float64(valueBytes) / float64(a.Puts)
+	}
+	return a
+}
+
+func (c *accessCounters) reset() {
+	for i := range c {
+		s := &c[i]
+		s.gets.Store(0)
+		s.puts.Store(0)
+		s.deletes.Store(0)
+		s.bytesRead.Store(0)
+		s.bytesWritten.Store(0)
+		s.valueBytes.Store(0)
+	}
+}
+
+// access returns the counters of collection, made on its first operation.
+// Operations resolve them once, so the hot path indexes no map of its own.
+func (db *DB) access(collection string) *accessCounters {
+	if c, ok := db.accesses.Load(collection); ok {
+		return c.(*accessCounters)
+	}
+	c, _ := db.accesses.LoadOrStore(collection, new(accessCounters))
+	return c.(*accessCounters)
+}
+
+// collectionAccess returns the counters of collection, zero if it has seen
+// no operation.
+func (db *DB) collectionAccess(collection string) AccessStats {
+	if c, ok := db.accesses.Load(collection); ok {
+		return c.(*accessCounters).load()
+	}
+	return AccessStats{}
+}
+
+// accessByCollection returns the counters of every user collection that
+// has seen an operation.
+func (db *DB) accessByCollection() map[string]AccessStats {
+	stats := make(map[string]AccessStats)
+	db.accesses.Range(func(k, v any) bool {
+		if collection := k.(string); !isInternalCollection(collection) {
+			stats[collection] = v.(*accessCounters).load()
+		}
+		return true
+	})
+	return stats
+}
+
+// ResetStats zeroes the counters of Stats.Access and CollectionInfo.Access,
+// to measure the operations of a period. Operations that race with it may
+// be counted in the new period or lost. Other counters in Stats, such as
+// Churn, run from Open.
+func (db *DB) ResetStats() {
+	db.accesses.Range(func(_, v any) bool {
+		v.(*accessCounters).reset()
+		return true
+	})
+}
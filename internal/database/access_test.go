@@ -0,0 +1,77 @@
+package database
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAccessStats(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("users", "alice", []byte("hello"))
+	db.Put("users", "bob", []byte("0123456789"))
+	db.Get("users", "alice")
+	db.Get("users", "bob")
+	db.Get("users", "missing")
+	db.Delete("users", "alice")
+	b := db.NewBatch()
+	b.Put("orders", "1", []byte("abc"), 0)
+	b.Delete("orders", "2")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.RPush("queue", "jobs", []byte("job"))
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each sealed value carries a 16-byte tag
+	want := map[string]AccessStats{
+		"users":  {Gets: 3, Puts: 2, Deletes: 1, BytesRead: 15, BytesWritten: 15 + 2*16, AvgValueSize: 7.5},
+		"orders": {Puts: 1, Deletes: 1, BytesWritten: 3 + 16, AvgValueSize: 3},
+	}
+	for collection, w := range want {
+		if got := stats.Access[collection]; got != w {
+			t.Errorf("Stats.Access[%s] = %+v, want %+v", collection, got, w)
+		}
+	}
+	if len(stats.Access) != len(want) {
+		t.Errorf("Stats.Access lists %d collections, want %d: %v", len(stats.Access), len(want), stats.Access)
+	}
+	info, err := db.CollectionInfo("users")
+	if err != nil || info.Access != want["users"] {
+		t.Errorf("CollectionInfo.Access = %+v, %v", info.Access, err)
+	}
+
+	// Concurrent updates of one collection are all counted
+	db.Put("hot", "k", []byte("v"))
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				db.Get("hot", "k")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := db.collectionAccess("hot"); got.Gets != 8000 || got.BytesRead != 8000 {
+		t.Errorf("hot after concurrent reads: %+v", got)
+	}
+
+	db.ResetStats()
+	if stats, _ := db.Stats(); stats.Access["users"] != (AccessStats{}) || stats.Access["hot"] != (AccessStats{}) {
+		t.Errorf("Stats.Access after ResetStats: %v", stats.Access)
+	}
+	db.Get("users", "bob")
+	if got := db.collectionAccess("users"); got != (AccessStats{Gets: 1, BytesRead: 10}) {
+		t.Errorf("users after ResetStats and a Get: %+v", got)
+	}
+}
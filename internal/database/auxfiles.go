@@ -0,0 +1,248 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrPendingCompaction = errors.New("completed compaction could not be renamed into place")
+
+// OpenReport describes what Open did besides opening the file.
+type OpenReport struct {
+	// Orphaned auxiliary files that were deleted
+	Removed []string
+
+	// A finished compaction output found without a valid data file, which a
+	// crash while Compact replaced the file leaves behind. Open renames it
+	// over the data file and reports it in RecoveredCompaction, unless the
+	// lease it carries is live. If the rename fails, it is left in place,
+	// reported here, and Open fails with ErrPendingCompaction: rename it over
+	// the data file to recover.
+	RecoveredCompaction string
+	PendingCompaction   string
+
+	// What Open found in the file. A hint that is discarded on every open or
+	// a torn tail after a clean shutdown points at a deployment problem.
+	Version        byte          // File format version
+	Cipher         string        // Value cipher
+	RecordFlags    byte          // Union of the flags of the scanned records
+	Rotating       bool          // A key rotation is in progress
+	Features       Feature       // Optional features the header declares
+	HintUsed       bool          // The index was loaded from the hint
+	HintDiscarded  bool          // A hint existed but was stale or unreadable
+	RecordsScanned int           // Records read from the log, after the hint if used
+	TruncatedTail  int64         // Bytes of a torn record after the last intact one
+	KDF            KDFParams     // Argon2id parameters of the file
+	KDFDuration    time.Duration // Time spent deriving the key encryption key
+	IndexDuration  time.Duration // Time spent loading the hint and scanning the log
+}
+
+// fillScan records how Open loaded the index and warns about what looks off.
+func (r *OpenReport) fillScan(scan indexScan, log *slog.Logger, path string) {
+	r.HintUsed = scan.hinted
+	r.RecordsScanned = scan.records
+	r.RecordFlags = scan.flags
+	r.TruncatedTail = scan.tail
+	if scan.hintErr != nil {
+		r.HintDiscarded = true
+		log.Warn("nokhal: discarded unreadable hint", "path", path, "err", scan.hintErr)
+	}
+	if scan.tail > 0 {
+		log.Warn("nokhal: log ends with a torn record", "path", path, "bytes", scan.tail)
+	}
+}
+
+// Auxiliary files that may belong to the database at path. Nothing that
+// does not match one of these names is ever touched.
+func auxFiles(path string) (compact, hint, hintTmp string) {
+	return path + ".compact", path + ".hint", path + ".hint.tmp"
+}
+
+// Temporary index files of Options.LowMemory are named path + indexFileInfix
+// followed by a random suffix.
+const indexFileInfix = ".index-"
+
+// recoverCompaction renames a compaction that completed but was not renamed
+// into place over an erased data file into place. Compact erases the data
+// file before renaming its output, so a complete output without a valid data
+// file is the only copy left. Until the erase starts, the data file holds
+// everything the output does, which may itself be cut short. The output
+// carries the lease of the writer that made it: while the lease is live, that
+// writer may be between the erase and the rename, and Open fails with
+// ErrDatabaseLocked instead.
+func recoverCompaction(path string, timeout time.Duration, log *slog.Logger, report *OpenReport) error {
+	compactPath, _, _ := auxFiles(path)
+	if !exists(compactPath) {
+		return nil
+	}
+	if dataFile, _, _ := openDataForCheck(path); dataFile != nil {
+		dataFile.Close()
+		return nil
+	}
+
+	f, header, size := openDataForCheck(compactPath)
+	if f == nil {
+		return nil
+	}
+	_, end := walkLog(f, int64(headerSize))
+	f.Close()
+	if end != size {
+		return nil
+	}
+	if liveLease(decodeLease(header.Lease), timeout) {
+		log.Warn("nokhal: compaction output belongs to a writer that holds the lease", "path", compactPath)
+		return ErrDatabaseLocked
+	}
+
+	if err := replaceFile(compactPath, path); err != nil {
+		report.PendingCompaction = compactPath
+		log.Error("nokhal: cannot rename completed compaction into place", "path", compactPath, "err", err)
+		return fmt.Errorf("%w: %w", ErrPendingCompaction, err)
+	}
+	report.RecoveredCompaction = compactPath
+	log.Warn("nokhal: recovered compaction interrupted before its rename", "path", compactPath)
+	return nil
+}
+
+// removeOrphans runs cleanupAuxFiles for a DB being opened, before its index
+// is loaded. The auxiliary files of a writer that holds the lease are in use
+// and left alone: with Options.LeaseTimeout the lease has just been taken by
+// this DB, and without it any lease held in the header counts, since its
+// freshness cannot be judged.
+func (db *DB) removeOrphans(report *OpenReport) error {
+	if db.lease == nil {
+		current, err := db.readLease()
+		if err != nil {
+			return err
+		}
+		if liveLease(current, 0) {
+			db.opts.logger().Info("nokhal: kept auxiliary files of the writer holding the lease", "path", db.path)
+			return nil
+		}
+	}
+	return cleanupAuxFiles(db.path, db.opts.logger(), report)
+}
+
+// cleanupAuxFiles removes files left behind by crashed compactions, hint
+// saves and low-memory opens, and hints that no longer describe the data
+// file. A running writer's files look the same, so it must only run through
+// removeOrphans.
+func cleanupAuxFiles(path string, log *slog.Logger, report *OpenReport) error {
+	compactPath, hintPath, hintTmpPath := auxFiles(path)
+
+	remove := func(p, reason string) error {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		report.Removed = append(report.Removed, p)
+		log.Info("nokhal: removed orphaned file", "path", p, "reason", reason)
+		return nil
+	}
+
+	dataFile, dataHeader, dataSize := openDataForCheck(path)
+	if dataFile != nil {
+		defer dataFile.Close()
+	}
+
+	if exists(compactPath) {
+		if err := remove(compactPath, "interrupted compaction"); err != nil {
+			return err
+		}
+	}
+
+	if exists(hintTmpPath) {
+		if err := remove(hintTmpPath, "interrupted hint save"); err != nil {
+			return err
+		}
+	}
+
+	indexFiles, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*"+indexFileInfix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, p := range indexFiles {
+		if strings.HasPrefix(filepath.Base(p), filepath.Base(path)+indexFileInfix) {
+			if err := remove(p, "index left by a crashed low-memory open"); err != nil {
+				return err
+			}
+		}
+	}
+
+	if f, err := os.Open(hintPath); err == nil {
+		stale := dataFile == nil
+		if !stale {
+			_, _, err := checkHintHeader(f, dataFile, dataHeader, dataSize)
+			stale = err != nil
+		}
+		f.Close()
+		if stale {
+			if err := remove(hintPath, "stale hint"); err != nil {
+				return err
+			}
+			report.HintDiscarded = true
+		}
+	}
+	return nil
+}
+
+// openDataForCheck opens the data file read-only if it has a valid header.
+func openDataForCheck(path string) (*os.File, *fileHeader, int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, 0
+	}
+	header, err := readFileHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0
+	}
+	return f, header, fi.Size()
+}
+
+// moveFile renames src to dst. Across filesystems, where rename fails, dst
+// is written as a synced copy and src removed.
+func moveFile(src, dst string) error {
+	if err := renameReplace(src, dst); err == nil {
+		return syncDir(filepath.Dir(dst))
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
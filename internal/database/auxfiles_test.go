@@ -0,0 +1,368 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenCleansOrphanedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "key", []byte("value"))
+	db.Close()
+
+	compactPath, hintPath, hintTmpPath := auxFiles(path)
+	indexPath := path + indexFileInfix + "12345"
+	unrelated := []string{path + ".backup", path + ".compact.keep", filepath.Join(dir, "other.hint"), filepath.Join(dir, "other.nok"+indexFileInfix+"1")}
+	for _, p := range append([]string{compactPath, hintTmpPath, indexPath}, unrelated...) {
+		if err := os.WriteFile(p, []byte("dropping"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, report, err := OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, p := range []string{compactPath, hintTmpPath, indexPath} {
+		if !slices.Contains(report.Removed, p) || exists(p) {
+			t.Errorf("Expected %s to be removed (report %v)", p, report.Removed)
+		}
+	}
+	if slices.Contains(report.Removed, hintPath) || !exists(hintPath) {
+		t.Error("A valid hint must be kept")
+	}
+	for _, p := range unrelated {
+		if !exists(p) {
+			t.Errorf("File %s does not match an auxiliary name and must not be touched", p)
+		}
+	}
+}
+
+func TestOpenRemovesHintOfReplacedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+	other := filepath.Join(dir, "other.nok")
+
+	for _, p := range []string{path, other} {
+		db, err := Open(p, "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Put("col", filepath.Base(p), []byte("value"))
+		db.Close()
+	}
+
+	// Replace the data file but keep its old hint
+	data, err := os.ReadFile(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, report, err := OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !slices.Contains(report.Removed, path+".hint") {
+		t.Errorf("Expected stale hint to be removed, report %v", report.Removed)
+	}
+	if _, err := db.Get("col", "other.nok"); err != nil {
+		t.Errorf("Replaced file content not visible: %v", err)
+	}
+	if _, err := db.Get("col", "db.nok"); err != ErrNotFound {
+		t.Errorf("Stale hint leaked old keys: %v", err)
+	}
+}
+
+func TestOpenRecoversInterruptedCompact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+	compactPath, hintPath, _ := auxFiles(path)
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 50 {
+		db.Put("col", fmt.Sprint("k", i%10), []byte(fmt.Sprint("v", i)))
+	}
+	db.Delete("col", "k9")
+	db.Close()
+	read := func(p string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	data, hint := read(path), read(hintPath)
+
+	// The output of Compact, which its crashes leave at compactPath
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	compacted := read(path)
+	erased := make([]byte, len(data))
+	rand.Read(erased)
+
+	// What each crash point of Compact leaves behind: a nil data file is
+	// removed, and compact the file at compactPath
+	tests := []struct {
+		name          string
+		data, compact []byte
+		recovered     bool
+	}{
+		{"while writing the output", data, compacted[:len(compacted)-10], false},
+		{"after syncing the output", data, compacted, false},
+		{"while erasing the data file", append(erased[:headerSize:headerSize], data[headerSize:]...), compacted, true},
+		{"after erasing the data file", erased, compacted, true},
+		{"after removing the data file", nil, compacted, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(path)
+			if tt.data != nil {
+				if err := os.WriteFile(path, tt.data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(hintPath, hint, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(compactPath, tt.compact, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db, report, err := OpenWithReport(path, "pass", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if recovered := report.RecoveredCompaction == compactPath; recovered != tt.recovered {
+				t.Errorf("RecoveredCompaction = %q, want recovered %v", report.RecoveredCompaction, tt.recovered)
+			}
+			if exists(compactPath) {
+				t.Error("compaction output left behind")
+			}
+			if tt.recovered && (report.HintUsed || !bytes.Equal(read(path), compacted)) {
+				t.Errorf("data file is not the compaction output: %+v", report)
+			}
+			for i := range 9 {
+				if v, err := db.Get("col", fmt.Sprint("k", i)); err != nil || string(v) != fmt.Sprint("v", 40+i) {
+					t.Errorf("k%d = %q, %v", i, v, err)
+				}
+			}
+			if _, err := db.Get("col", "k9"); err != ErrNotFound {
+				t.Errorf("deleted key after recovery: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenReportIntegrity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		db.Put("col", k, []byte("value"))
+	}
+	db.Close()
+
+	open := func() OpenReport {
+		t.Helper()
+		db, report, err := OpenWithReport(path, "pass", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		return report
+	}
+
+	report := open()
+	if !report.HintUsed || report.HintDiscarded || report.RecordsScanned != 0 || report.TruncatedTail != 0 {
+		t.Errorf("Clean open with hint: %+v", report)
+	}
+	if report.Version != version || report.Cipher != "AES-256-GCM" || report.KDFDuration <= 0 {
+		t.Errorf("File description missing: %+v", report)
+	}
+
+	if err := os.WriteFile(path+".hint", []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report = open()
+	if report.HintUsed || !report.HintDiscarded || report.RecordsScanned != 3 {
+		t.Errorf("Open with a bad hint: %+v", report)
+	}
+	if report.RecordFlags&FlagBoundAAD == 0 {
+		t.Errorf("RecordFlags = %b, want the flags of the scanned records", report.RecordFlags)
+	}
+
+	// A torn write at the tail is reported and warned about
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("partial"))
+	f.Close()
+	var logs bytes.Buffer
+	db, report, err = OpenWithReport(path, "pass", Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if report.TruncatedTail != int64(len("partial")) {
+		t.Errorf("TruncatedTail = %d, want %d", report.TruncatedTail, len("partial"))
+	}
+	if !strings.Contains(logs.String(), "torn record") {
+		t.Errorf("Expected a torn record warning, got %q", logs.String())
+	}
+}
+
+func TestCompactTempDir(t *testing.T) {
+	dir := t.TempDir()
+	tempDir := filepath.Join(dir, "scratch")
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{TempDir: tempDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("col", "a", []byte("v1"))
+	db.Put("col", "a", []byte("v2"))
+	db.Put("col", "b", []byte("v3"))
+	db.Delete("col", "b")
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get("col", "a"); err != nil || string(v) != "v2" {
+		t.Errorf("Get a = %q, %v", v, err)
+	}
+	if _, err := db.Get("col", "b"); err != ErrNotFound {
+		t.Errorf("Deleted key readable after Compact: %v", err)
+	}
+	if leftovers, _ := os.ReadDir(tempDir); len(leftovers) > 0 {
+		t.Errorf("Compact left %d files in TempDir", len(leftovers))
+	}
+	if exists(path + ".compact") {
+		t.Error("Compact left its staged output behind")
+	}
+}
+
+func TestOpenKeepsFilesOfLeaseHolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	compactPath, _, hintTmpPath := auxFiles(path)
+	opts := Options{LeaseTimeout: time.Second, KDF: KDFParams{Memory: 64, Parallelism: 1}}
+
+	db, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := range 500 {
+		db.Put("col", fmt.Sprint("k", i%100), []byte(fmt.Sprint("v", i)))
+	}
+
+	// The files of a running Compact, hint save and low-memory open
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexPath := path + indexFileInfix + "12345"
+	for _, p := range []string{compactPath, hintTmpPath, indexPath} {
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, o := range []Options{opts, {}} {
+		second, report, err := OpenWithReport(path, "pass", o)
+		if err == nil {
+			second.Close()
+		}
+		if o.LeaseTimeout > 0 && err != ErrDatabaseLocked {
+			t.Errorf("Open of a leased file: %v", err)
+		}
+		if len(report.Removed) > 0 {
+			t.Errorf("Open with LeaseTimeout %v removed %v", o.LeaseTimeout, report.Removed)
+		}
+	}
+	for _, p := range []string{compactPath, indexPath} {
+		if !exists(p) {
+			t.Errorf("%s of the lease holder was removed", p)
+		}
+		os.Remove(p)
+	}
+	os.Remove(hintTmpPath)
+
+	// Between erasing the data file and renaming the output over it, the
+	// output is the writer's to rename
+	if err := os.Rename(path, compactPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, report, err := OpenWithReport(path, "pass", opts); err != ErrDatabaseLocked || report.RecoveredCompaction != "" {
+		t.Errorf("Open during the rename of a live writer: %v, %+v", err, report)
+	}
+	if exists(path) || !exists(compactPath) {
+		t.Fatal("Open renamed the output of a live writer")
+	}
+	if err := os.Rename(compactPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Openers racing real compactions never get the file, nor disturb them
+	for range 20 {
+		done := make(chan error)
+		go func() { done <- db.Compact() }()
+		for compacting := true; compacting; {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Compact with a racing opener: %v", err)
+				}
+				compacting = false
+			default:
+				if second, err := OpenWithOptions(path, "pass", opts); err == nil {
+					second.Close()
+					t.Fatal("second writer opened a leased file")
+				}
+			}
+		}
+		db.Put("col", "k0", []byte("v0"))
+	}
+	for i := 1; i < 100; i++ {
+		if v, err := db.Get("col", fmt.Sprint("k", i)); err != nil || string(v) != fmt.Sprint("v", 400+i) {
+			t.Errorf("k%d = %q, %v", i, v, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBackupVerifyAndRestore(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	// Hold a lease so the backup must clear it for the restored copy to open
+	opts := Options{LeaseTimeout: time.Second}
+	db, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put("col", fmt.Sprintf("k%d", i), bytes.Repeat([]byte("v"), 200)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("col", "k0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := db.Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != db.offset || int64(buf.Len()) != n {
+		t.Fatalf("Backup wrote %d bytes (buffer %d), expected %d", n, buf.Len(), db.offset)
+	}
+	stream := buf.Bytes()
+
+	report, err := VerifyBackupWithOptions(bytes.NewReader(stream), "pass", VerifyOptions{Decrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean || !report.Decrypted || report.Puts != 10 || report.Deletes != 1 || report.Bytes != n {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if report.Newest == 0 {
+		t.Error("Expected newest timestamp to be reported")
+	}
+
+	if _, err := VerifyBackup(bytes.NewReader(stream), "wrong"); err != ErrInvalidPassword {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+
+	// Cut inside the last record and inside the header
+	for _, cut := range []int{len(stream) - 5, headerSize - 10} {
+		report, err := VerifyBackup(bytes.NewReader(stream[:cut]), "pass")
+		if err != ErrBackupTruncated || report.Clean {
+			t.Errorf("Cut at %d: expected ErrBackupTruncated, got %v (%+v)", cut, err, report)
+		}
+	}
+
+	// A flipped byte in the tombstone's sealed value fails the CRC
+	corrupt := append([]byte(nil), stream...)
+	corrupt[len(corrupt)-10] ^= 0xFF
+	if _, err := VerifyBackup(bytes.NewReader(corrupt), "pass"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+
+	// A corrupt value size is rejected, or read up to the stream's end,
+	// without allocating what it declares
+	allocs := func(stream []byte) (uint64, error) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := VerifyBackup(bytes.NewReader(stream), "pass")
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc, err
+	}
+	// Deriving the key alone allocates the KDF's memory
+	baseline, _ := allocs(stream)
+	sizeAt := headerSize + crcSize + timestampSize + expiresAtSize + flagsSize + collectionSizeSize + keySizeSize
+	for _, tc := range []struct {
+		size uint32
+		want error
+	}{
+		{0xFFFFFFF0, ErrBackupCorrupt},
+		{maxRecordSize / 2, ErrBackupTruncated},
+	} {
+		corrupt := append([]byte(nil), stream...)
+		binary.BigEndian.PutUint32(corrupt[sizeAt:], tc.size)
+		allocated, err := allocs(corrupt)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("Value size %d: expected %v, got %v", tc.size, tc.want, err)
+		}
+		if allocated > baseline+1<<20 {
+			t.Errorf("Value size %d: allocated %d bytes, %d for the intact stream", tc.size, allocated, baseline)
+		}
+	}
+
+	// The stream restores by writing it to a file
+	restored := path + ".restored"
+	defer os.Remove(restored)
+	defer os.Remove(restored + ".hint")
+	if err := os.WriteFile(restored, stream, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := OpenWithOptions(restored, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if _, err := db2.Get("col", "k0"); err != ErrNotFound {
+		t.Errorf("Deleted key should stay deleted, got %v", err)
+	}
+	if val, err := db2.Get("col", "k9"); err != nil || len(val) != 200 {
+		t.Errorf("Restored Get: %d bytes, %v", len(val), err)
+	}
+}
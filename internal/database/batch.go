@@ -1,7 +1,12 @@
 package database
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -9,7 +14,28 @@ import (
 type Batch struct {
 	db      *DB
 	writes  []batchRecord
+	asserts []batchAssert
+	opts    BatchOptions
 	mu      sync.Mutex
+
+	// Memory held against Options.MaxBatchMemory (batchmemory.go), and the
+	// error of the first operation that did not fit
+	mem *batchReservation
+	err error
+}
+
+// BatchOptions configures a batch created by NewBatchWithOptions.
+type BatchOptions struct {
+	// Coalesce keeps only the last operation on each key when the batch is
+	// committed, so a key put, deleted and put again in one batch is written
+	// once. Surviving operations keep their relative order.
+	Coalesce bool
+}
+
+// DefaultBatchOptions returns the options NewBatchWithOptions callers should
+// start from: coalescing is on. NewBatch writes every operation.
+func DefaultBatchOptions() BatchOptions {
+	return BatchOptions{Coalesce: true}
 }
 
 type batchRecord struct {
@@ -18,6 +44,13 @@ type batchRecord struct {
 	value      []byte
 	ttl        time.Duration
 	op         byte
+
+	// Set by putExpiring: expiresAt is used as is instead of ttl
+	keepExpiry bool
+	expiresAt  int64
+
+	// Flags the caller knows about the value, such as FlagSet
+	flags byte
 }
 
 func (db *DB) NewBatch() *Batch {
@@ -26,9 +59,19 @@ func (db *DB) NewBatch() *Batch {
 	}
 }
 
+func (db *DB) NewBatchWithOptions(opts BatchOptions) *Batch {
+	return &Batch{
+		db:   db,
+		opts: opts,
+	}
+}
+
 func (b *Batch) Put(collection, key string, value []byte, ttl time.Duration) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if !b.stage(batchOpSize(collection, key, value)) {
+		return
+	}
 	b.writes = append(b.writes, batchRecord{
 		collection: collection,
 		key:        key,
@@ -38,9 +81,30 @@ func (b *Batch) Put(collection, key string, value []byte, ttl time.Duration) {
 	})
 }
 
+// putExpiring queues a put that keeps an absolute expiry, zero meaning none,
+// instead of applying a TTL or the collection default.
+func (b *Batch) putExpiring(collection, key string, value []byte, expiresAt int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.stage(batchOpSize(collection, key, value)) {
+		return
+	}
+	b.writes = append(b.writes, batchRecord{
+		collection: collection,
+		key:        key,
+		value:      value,
+		op:         OpPut,
+		keepExpiry: true,
+		expiresAt:  expiresAt,
+	})
+}
+
 func (b *Batch) Delete(collection, key string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if !b.stage(batchOpSize(collection, key, nil)) {
+		return
+	}
 	b.writes = append(b.writes, batchRecord{
 		collection: collection,
 		key:        key,
@@ -48,19 +112,231 @@ func (b *Batch) Delete(collection, key string) {
 	})
 }
 
+// ErrAssertionFailed is returned by Commit when an assertion added with
+// AssertValue or AssertAbsent does not hold. It names the first one that
+// failed, in the order they were added.
+type ErrAssertionFailed struct {
+	Collection string
+	Key        string
+	Absent     bool // Added with AssertAbsent, and the key exists
+}
+
+func (e *ErrAssertionFailed) Error() string {
+	if e.Absent {
+		return fmt.Sprintf("batch assertion failed: %s:%s exists", e.Collection, e.Key)
+	}
+	return fmt.Sprintf("batch assertion failed: %s:%s does not hold the expected value", e.Collection, e.Key)
+}
+
+// batchAssert is a precondition of a batch, checked when it is committed.
+type batchAssert struct {
+	collection string
+	key        string
+	expected   []byte
+	absent     bool
+}
+
+// AssertValue makes Commit fail, writing nothing, unless key holds expected
+// when the batch is committed. A missing or expired key fails it.
+func (b *Batch) AssertValue(collection, key string, expected []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.stage(batchOpSize(collection, key, expected)) {
+		return
+	}
+	b.asserts = append(b.asserts, batchAssert{collection: collection, key: key, expected: expected})
+}
+
+// AssertAbsent makes Commit fail, writing nothing, if key exists when the
+// batch is committed. An expired key counts as absent.
+func (b *Batch) AssertAbsent(collection, key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.stage(batchOpSize(collection, key, nil)) {
+		return
+	}
+	b.asserts = append(b.asserts, batchAssert{collection: collection, key: key, absent: true})
+}
+
+// checkAsserts returns an *ErrAssertionFailed for the first of asserts that
+// does not hold. Only AssertValue decrypts, and only a key that exists.
+// Callers must hold db.mu.
+func (db *DB) checkAsserts(asserts []batchAssert) error {
+	now := db.now().UnixNano()
+	for _, a := range asserts {
+		compKey := compositeKey(a.collection, a.key)
+		rec, _, err := db.readRaw(compKey, now)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		var held bool
+		switch {
+		case a.absent:
+			held = err == ErrNotFound
+		case err == nil:
+			value, err := db.openUserValue(rec, compKey)
+			if err != nil {
+				return err
+			}
+			held = bytes.Equal(value, a.expected)
+		}
+		if !held {
+			return &ErrAssertionFailed{Collection: a.collection, Key: a.key, Absent: a.absent}
+		}
+	}
+	return nil
+}
+
+// CollectionBatch is a Batch whose writes all target one collection.
+type CollectionBatch struct {
+	batch      *Batch
+	collection string
+}
+
+func (db *DB) NewCollectionBatch(collection string) *CollectionBatch {
+	return &CollectionBatch{
+		batch:      db.NewBatch(),
+		collection: collection,
+	}
+}
+
+func (cb *CollectionBatch) Put(key string, value []byte, ttl time.Duration) {
+	cb.batch.Put(cb.collection, key, value, ttl)
+}
+
+func (cb *CollectionBatch) Delete(key string) {
+	cb.batch.Delete(cb.collection, key)
+}
+
+func (cb *CollectionBatch) AssertValue(key string, expected []byte) {
+	cb.batch.AssertValue(cb.collection, key, expected)
+}
+
+func (cb *CollectionBatch) AssertAbsent(key string) {
+	cb.batch.AssertAbsent(cb.collection, key)
+}
+
+func (cb *CollectionBatch) Err() error {
+	return cb.batch.Err()
+}
+
+func (cb *CollectionBatch) Discard() {
+	cb.batch.Discard()
+}
+
+func (cb *CollectionBatch) Commit() error {
+	return cb.batch.Commit()
+}
+
+func (cb *CollectionBatch) CommitContext(ctx context.Context) error {
+	return cb.batch.CommitContext(ctx)
+}
+
+// indexUpdate is the index change for one record of a batch.
+type indexUpdate struct {
+	key       string
+	offset    int64
+	size      int64
+	timestamp int64
+	expiresAt int64
+	op        byte
+}
+
+// indexDelta holds every index change of a committed batch and the log offset
+// after it.
+type indexDelta struct {
+	updates []indexUpdate
+	end     int64
+}
+
+// publish makes all of a batch's effects visible at once: readers observe
+// either none or all of a delta, never a prefix of it. It must stay a single
+// critical section with no I/O, whatever locking the write path uses.
+// Callers must hold db.mu.
+func (db *DB) publish(d *indexDelta) {
+	for _, u := range d.updates {
+		replaced := db.applyRecord(u.key, u.op, u.offset, u.size, u.timestamp, u.expiresAt)
+		db.countChurn(u.key, u.op, u.size, replaced)
+	}
+	db.offset = d.end
+	db.lastWrite.Store(time.Now().UnixNano())
+	db.wakeWatchers()
+}
+
+// Commit writes all operations with a single write and fsync. Readers see
+// either none or all of the batch; GetMulti observes the batch atomically
+// across keys. The records of a batch get strictly increasing timestamps in
+// the order their operations were added. Assertions are checked first,
+// under the same write lock: if one fails, Commit returns an
+// *ErrAssertionFailed, writes nothing and leaves the batch as it was. A
+// batch that an operation did not fit Options.MaxBatchMemory returns that
+// ErrBatchMemory instead, see Err.
 func (b *Batch) Commit() error {
+	return b.commit(b.db.lockWrite)
+}
+
+// CommitContext is Commit giving up with ctx.Err() if ctx ends while it
+// waits for the write lock, as DB.PutContext does. The batch is then left
+// as it was, for a later commit.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	return b.commit(func() error { return b.db.lockWriteContext(ctx) })
+}
+
+// commit commits the batch after taking the write lock with lock.
+func (b *Batch) commit(lock func() error) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if len(b.writes) == 0 {
+	if err := b.err; err != nil {
+		b.reset()
+		return err
+	}
+	if len(b.writes) == 0 && len(b.asserts) == 0 {
 		return nil
 	}
 
-	b.db.mu.Lock()
+	if err := lock(); err != nil {
+		return err
+	}
 	defer b.db.mu.Unlock()
 
+	// Before any write is sealed, so a failed assertion costs no encryption
+	if err := b.db.checkAsserts(b.asserts); err != nil {
+		return err
+	}
+	writes := b.writes
+	if b.opts.Coalesce {
+		writes = coalesce(writes)
+	}
+	if len(writes) > 0 {
+		if err := b.db.commitWrites(writes); err != nil {
+			return err
+		}
+	}
+
+	// Clear batch
+	b.reset()
+	return nil
+}
+
+// commitWrites appends writes with a single write and fsync and publishes
+// their index changes in one step. Callers must hold db.mu.
+func (db *DB) commitWrites(writes []batchRecord) error {
+	if err := db.checkLease(); err != nil {
+		return err
+	}
+	if err := db.checkImmutableWrites(writes); err != nil {
+		return err
+	}
+	if err := db.storeDict(); err != nil {
+		return err
+	}
+	if err := db.declareSets(writes); err != nil {
+		return err
+	}
+
 	// 1. Prepare buffers
-	now := time.Now().UnixNano()
+	now := db.now().UnixNano()
 	
 	// We can write sequentially without calling db.writeRecord repeatedly?
 	// db.writeRecord writes to file and updates index.
@@ -69,98 +345,213 @@ func (b *Batch) Commit() error {
 	
 	var batchBuffer []byte
 	
-	// We need to store offsets to update index later
-	type indexUpdate struct {
-		key    string
-		offset int64
-		op     byte
-	}
-	var updates []indexUpdate
-	startOffset := b.db.offset
+	// Index changes are collected into a delta and published together
+	delta := &indexDelta{}
+	startOffset := db.offset
 
-	for _, w := range b.writes {
-		nonce, err := generateNonce()
-		if err != nil {
-			return err
-		}
+	stored := make([]int, len(writes)) // Sealed value sizes, for the access counters
+
+	for i, w := range writes {
+		// Each record gets its own timestamp so the order of a batch's
+		// writes to one key is never ambiguous
+		ts := now + int64(i)
 
 		// Prepare Record
+		ttl := w.ttl
+		if ttl == 0 {
+			ttl = db.defaultTTL[w.collection]
+		}
 		var expiresAt int64
-		if w.ttl > 0 {
-			expiresAt = time.Now().Add(w.ttl).UnixNano()
+		if w.keepExpiry {
+			expiresAt = w.expiresAt
+		} else if ttl > 0 {
+			expiresAt = now + int64(ttl)
 		}
 
-		flags := FlagNone
-		finalValue := w.value
-
-		// Compression logic
-		if w.op == OpPut && len(w.value) > 128 {
-			compressed, err := compress(w.value)
-			if err == nil && len(compressed) < len(w.value) {
-				finalValue = compressed
-				flags |= FlagCompressed
+		var flags byte
+		var nonce, encryptedValue []byte
+		var err error
+		op := w.op
+		if op == OpPut {
+			op = valueOp(w.collection)
+			var value []byte
+			if value, flags, err = db.transformValue(w.collection, w.key, w.value); err != nil {
+				return err
 			}
+			flags, nonce, encryptedValue, err = db.sealValue(w.collection, w.key, value, ts, flags|w.flags, true)
+		} else {
+			flags, nonce, encryptedValue, err = db.sealTombstone(w.collection, w.key, ts)
 		}
-
-		var encryptedValue []byte
-		if w.op == OpPut {
-			// Richer AAD
-			compKey := compositeKey(w.collection, w.key)
-			aad := make([]byte, len(compKey)+8)
-			copy(aad, compKey)
-			binary.BigEndian.PutUint64(aad[len(compKey):], uint64(now))
-
-			encryptedValue = b.db.aead.Seal(nil, nonce, finalValue, aad)
+		if err != nil {
+			return err
 		}
+		stored[i] = len(encryptedValue)
 
 		rec := &record{
-			Timestamp:  now,
+			Timestamp:  ts,
 			ExpiresAt:  expiresAt,
 			Flags:      flags,
 			Collection: []byte(w.collection),
 			Key:        []byte(w.key),
 			Value:      encryptedValue,
 			Nonce:      nonce,
-			Op:         w.op,
+			Op:         op,
 		}
 
+		if rec.size() > maxRecordSize {
+			return fmt.Errorf("%s:%s: %w", w.collection, w.key, ErrRecordTooLarge)
+		}
 		encoded, size := rec.Encode()
 		batchBuffer = append(batchBuffer, encoded...)
 
 		// Track index update
 		compKey := compositeKey(w.collection, w.key)
-		updates = append(updates, indexUpdate{
-			key:    compKey,
-			offset: startOffset,
-			op:     w.op,
+		delta.updates = append(delta.updates, indexUpdate{
+			key:       compKey,
+			offset:    startOffset,
+			size:      int64(size),
+			timestamp: ts,
+			expiresAt: expiresAt,
+			op:        op,
 		})
 		startOffset += int64(size)
 	}
 
-	// 2. Single Write
-	if _, err := b.db.file.Write(batchBuffer); err != nil {
+	// 2. Single write and sync
+	if err := db.appendLog(batchBuffer, true, true); err != nil {
 		return err
 	}
 
-	// 3. Single Sync
-	if err := b.db.file.Sync(); err != nil {
+	// 3. Publish index, bloom filter and offset in one step
+	delta.end = startOffset
+	db.publish(delta)
+	for i, w := range writes {
+		if w.op == OpPut {
+			db.access(w.collection).countPut(len(w.value), stored[i])
+		} else {
+			db.access(w.collection).countDelete()
+		}
+	}
+	db.storeCompression()
+	return nil
+}
+
+// coalesce returns the last operation on each key of writes, in the order
+// they appear.
+func coalesce(writes []batchRecord) []batchRecord {
+	last := make(map[string]int, len(writes))
+	for i, w := range writes {
+		last[compositeKey(w.collection, w.key)] = i
+	}
+	if len(last) == len(writes) {
+		return writes
+	}
+	kept := make([]batchRecord, 0, len(last))
+	for i, w := range writes {
+		if last[compositeKey(w.collection, w.key)] == i {
+			kept = append(kept, w)
+		}
+	}
+	return kept
+}
+
+// Swap exchanges the values of keyA and keyB in collection. Both records are
+// appended in one write under the write lock, so readers see either the old
+// or the swapped pair. Each value keeps its expiry and is sealed for its new
+// key. A missing or expired key counts as absent: swapping it with a live key
+// moves the live value over and deletes its old key, and swapping two absent
+// keys does nothing.
+func (db *DB) Swap(collection, keyA, keyB string) error {
+	if err := db.lockWrite(); err != nil {
 		return err
 	}
+	defer db.mu.Unlock()
 
-	// 4. Update In-Memory Index & Bloom Filter
-	for _, u := range updates {
-		if u.op == OpPut {
-			b.db.index[u.key] = u.offset
-			b.db.bloom.Add(u.key)
-		} else if u.op == OpDelete {
-			delete(b.db.index, u.key)
+	if keyA == keyB {
+		return nil
+	}
+
+	// read returns nil for an absent key
+	now := db.now().UnixNano()
+	read := func(key string) (*record, error) {
+		compKey := compositeKey(collection, key)
+		rec, _, err := db.readRaw(compKey, now)
+		if err == ErrNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
 		}
+		if rec.Value, err = db.openUserValue(rec, compKey); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+	a, err := read(keyA)
+	if err != nil {
+		return err
+	}
+	b, err := read(keyB)
+	if err != nil {
+		return err
+	}
+	if a == nil && b == nil {
+		return nil
 	}
 
-	// 5. Update Offset
-	b.db.offset = startOffset
+	moveTo := func(key string, src *record) batchRecord {
+		if src == nil {
+			return batchRecord{collection: collection, key: key, op: OpDelete}
+		}
+		return batchRecord{
+			collection: collection,
+			key:        key,
+			value:      src.Value,
+			op:         OpPut,
+			keepExpiry: true,
+			expiresAt:  src.ExpiresAt,
+			flags:      src.Flags & FlagSet,
+		}
+	}
+	return db.commitWrites([]batchRecord{moveTo(keyA, b), moveTo(keyB, a)})
+}
 
-	// Clear batch
-	b.writes = nil
-	return nil
+// ReplaceCollection makes entries the whole content of collection. Every
+// current key that entries lacks is deleted and every entry is put, in one
+// write under the write lock, so readers and snapshots see either the old
+// set or the new one, never an empty or mixed collection. Entries get the
+// collection's default TTL, as with Put. An empty entries deletes the whole
+// collection.
+func (db *DB) ReplaceCollection(collection string, entries map[string][]byte) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	prefix := collection + ":"
+	var stale []string
+	err := db.index.each(func(k string, _ indexEntry) error {
+		if key, ok := strings.CutPrefix(k, prefix); ok {
+			if _, kept := entries[key]; !kept {
+				stale = append(stale, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.Sort(stale)
+
+	writes := make([]batchRecord, 0, len(stale)+len(entries))
+	for _, key := range stale {
+		writes = append(writes, batchRecord{collection: collection, key: key, op: OpDelete})
+	}
+	for _, key := range slices.Sorted(maps.Keys(entries)) {
+		writes = append(writes, batchRecord{collection: collection, key: key, value: entries[key], op: OpPut})
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return db.commitWrites(writes)
 }
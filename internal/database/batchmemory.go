@@ -0,0 +1,101 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+var ErrBatchMemory = errors.New("batch memory limit exceeded")
+
+// batchReservation is the memory one batch holds against the total its
+// database counts. It lives apart from the batch so that a cleanup can give
+// it back once a batch dropped without Commit or Discard is collected.
+type batchReservation struct {
+	db      *DB
+	bytes   atomic.Int64
+	cleanup runtime.Cleanup // Stopped when the batch gives the memory back itself
+}
+
+func (r *batchReservation) release() {
+	r.db.batchMemory.Add(-r.bytes.Swap(0))
+}
+
+// batchOpSize is what an operation counts against Options.MaxBatchMemory:
+// the bytes of its collection, key and value, which the batch holds until
+// it is committed.
+func batchOpSize(collection, key string, value []byte) int64 {
+	return int64(len(collection) + len(key) + len(value))
+}
+
+// reserveBatchMemory counts n more bytes staged in batches, failing with
+// ErrBatchMemory if that would pass Options.MaxBatchMemory.
+func (db *DB) reserveBatchMemory(n int64) error {
+	limit := db.batchLimit.Load()
+	for {
+		staged := db.batchMemory.Load()
+		if limit > 0 && staged+n > limit {
+			return fmt.Errorf("%w: %d bytes staged, %d more would pass the limit of %d", ErrBatchMemory, staged, n, limit)
+		}
+		if db.batchMemory.CompareAndSwap(staged, staged+n) {
+			return nil
+		}
+	}
+}
+
+// stage reserves the memory of an operation of n bytes before it is added
+// to the batch. Callers must hold b.mu. It reports false if the operation
+// must be dropped: the batch failed an earlier reservation, or fails this
+// one, and Commit will return that error.
+func (b *Batch) stage(n int64) bool {
+	if b.err != nil {
+		return false
+	}
+	if err := b.db.reserveBatchMemory(n); err != nil {
+		b.err = err
+		return false
+	}
+	if b.mem == nil {
+		b.mem = &batchReservation{db: b.db}
+		b.mem.cleanup = runtime.AddCleanup(b, (*batchReservation).release, b.mem)
+	}
+	b.mem.bytes.Add(n)
+	return true
+}
+
+// reset empties the batch and gives back its memory. Callers must hold
+// b.mu.
+func (b *Batch) reset() {
+	b.writes = nil
+	b.asserts = nil
+	b.err = nil
+	if b.mem != nil {
+		// The pending cleanup would keep the database reachable
+		b.mem.cleanup.Stop()
+		b.mem.release()
+		b.mem = nil
+	}
+}
+
+// Err returns the error that an operation added past Options.MaxBatchMemory
+// left on the batch, nil if none did. Such an operation is dropped, and so
+// are all later ones, so that a batch missing some of its operations is
+// never committed: Commit returns this error, writes nothing and empties
+// the batch. A loader that hits the limit can build the batch again once
+// other batches have committed, or commit smaller batches.
+func (b *Batch) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// Discard drops the batch's operations and gives back the memory they held
+// against Options.MaxBatchMemory, for a batch that will not be committed.
+// The batch can be reused. A batch that is simply dropped gives its memory
+// back only once the garbage collector finds it.
+func (b *Batch) Discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+}
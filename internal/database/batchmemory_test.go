@@ -0,0 +1,140 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMaxBatchMemory(t *testing.T) {
+	const limit = 1000
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{MaxBatchMemory: limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each op holds 100 bytes: a 4-byte collection, 6-byte key and value
+	value := bytes.Repeat([]byte("v"), 90)
+	fill := func(b *Batch, prefix string, n int) {
+		for i := range n {
+			b.Put("load", fmt.Sprintf("%s-%03d", prefix, i), value, 0)
+		}
+	}
+
+	// Two open batches fill the limit and a third cannot add to it
+	b1, b2, b3 := db.NewBatch(), db.NewBatch(), db.NewBatch()
+	fill(b1, "b1", 6)
+	fill(b2, "b2", 4)
+	if stats, _ := db.Stats(); stats.BatchMemory != limit {
+		t.Errorf("Stats.BatchMemory = %d, want %d", stats.BatchMemory, limit)
+	}
+	b3.Delete("load", "b1-000")
+	if err := b3.Err(); !errors.Is(err, ErrBatchMemory) {
+		t.Fatalf("Err past the limit: %v", err)
+	}
+	if err := b2.Err(); err != nil {
+		t.Fatalf("Err of a batch within the limit: %v", err)
+	}
+
+	// Once b1 commits, b3 has room again, but its dropped delete keeps it
+	// from committing
+	if err := b1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	b3.Put("load", "b3-000", value, 0)
+	if err := b3.Commit(); !errors.Is(err, ErrBatchMemory) {
+		t.Fatalf("Commit after a dropped operation: %v", err)
+	}
+	if _, err := db.Get("load", "b3-000"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("failed batch wrote b3-000: %v", err)
+	}
+	if _, err := db.Get("load", "b1-000"); err != nil {
+		t.Errorf("failed batch deleted b1-000: %v", err)
+	}
+	// The failed Commit emptied b3, which can be reused
+	fill(b3, "b3", 6)
+	if err := b3.Commit(); err != nil {
+		t.Fatalf("Commit of a reused batch: %v", err)
+	}
+	b2.Discard()
+	if got := db.batchMemory.Load(); got != 0 {
+		t.Errorf("%d bytes held after commit and Discard", got)
+	}
+
+	// A batch larger than the limit never fits; raising the limit lets it
+	big := db.NewBatch()
+	fill(big, "big", 11)
+	if err := big.Commit(); !errors.Is(err, ErrBatchMemory) {
+		t.Errorf("Commit of a batch over the limit: %v", err)
+	}
+	if err := db.UpdateOptions(func(o *Options) { o.MaxBatchMemory = 2 * limit }); err != nil {
+		t.Fatal(err)
+	}
+	fill(big, "big", 11)
+	if err := big.Commit(); err != nil {
+		t.Errorf("Commit after raising the limit: %v", err)
+	}
+
+	// Concurrent loaders, yielding between operations so their batches are
+	// open at once, retry until their batch fits. The bytes held never pass
+	// the limit, and every key is written
+	const loaders, chunks, perChunk = 8, 10, 5
+	var peak, refused atomic.Int64
+	var wg sync.WaitGroup
+	for g := range loaders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				for {
+					b := db.NewBatch()
+					for i := range perChunk {
+						b.Put("load", fmt.Sprintf("%d%02d-%03d", g, c, i), value, 0)
+						if n := db.batchMemory.Load(); n > peak.Load() {
+							peak.Store(n)
+						}
+						runtime.Gosched()
+					}
+					err := b.Commit()
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrBatchMemory) {
+						t.Error(err)
+						return
+					}
+					refused.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > 2*limit {
+		t.Errorf("%d bytes held at once, limit %d", p, 2*limit)
+	}
+	if refused.Load() == 0 {
+		t.Errorf("no batch hit the limit; peak %d bytes", peak.Load())
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BatchMemory != 0 {
+		t.Errorf("Stats.BatchMemory = %d after all commits", stats.BatchMemory)
+	}
+	for g := range loaders {
+		for c := range chunks {
+			key := fmt.Sprintf("%d%02d-%03d", g, c, perChunk-1)
+			if _, err := db.Get("load", key); err != nil {
+				t.Errorf("Get %s: %v", key, err)
+			}
+		}
+	}
+}
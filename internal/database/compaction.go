@@ -0,0 +1,294 @@
+package database
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+const (
+	// Compaction is advised once the reclaimable share of the log reaches
+	// adviceThreshold, or adviceFastThreshold if the last one took under a
+	// second, and only for at least adviceMinReclaim bytes
+	adviceThreshold     = 0.5
+	adviceFastThreshold = 0.3
+	adviceMinReclaim    = 1 << 20
+
+	// Auto-compaction is advised when at least adviceChurnRatio of at least
+	// adviceMinWrites writes since Open superseded or deleted a value
+	adviceChurnRatio = 0.25
+	adviceMinWrites  = 1000
+)
+
+// CompactionResult describes a finished Compact. Records count log entries:
+// every version of a key and every tombstone is one record.
+type CompactionResult struct {
+	Duration       time.Duration
+	LiveRecords    int   // Current versions copied to the compacted log
+	DroppedRecords int   // Superseded versions, tombstones and expired records
+	ExpiredRecords int   // Of the dropped, current versions that had expired
+	KeptTombstones int   // Tombstones younger than Options.TombstoneTTL
+	BytesBefore    int64 // Logical size of the log before compaction
+	BytesAfter     int64 // Logical size of the compacted log
+}
+
+// countRecords counts the records of the log image r between start and end
+// from their headers alone, without reading or checking their contents.
+func countRecords(r io.ReaderAt, start, end int64) (int, error) {
+	header := make([]byte, recordHeaderSize)
+	n := 0
+	for offset := start; offset < end; n++ {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			return n, err
+		}
+		_, _, _, collSize, keySize, valSize := decodeRecordHeader(header)
+		offset += int64(recordHeaderSize + opSize + collSize + keySize + nonceSize + valSize)
+	}
+	return n, nil
+}
+
+// recentTombstones returns, in log order, the offsets of the tombstones
+// Compact keeps for Options.TombstoneTTL: those of user keys whose last
+// record is a delete stamped at or after cutoff. Callers must hold db.mu.
+func (db *DB) recentTombstones(cutoff int64) ([]int64, error) {
+	last := make(map[string]int64)
+	r := bufio.NewReaderSize(io.NewSectionReader(db.file, int64(headerSize), db.offset-int64(headerSize)), 128*1024)
+	buf := make([]byte, recordHeaderSize+opSize)
+	for offset := int64(headerSize); offset < db.offset; {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		timestamp, _, _, collSize, keySize, valSize := decodeRecordHeader(buf)
+		op := buf[recordHeaderSize]
+		skip, err := checkOp(op, offset)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]byte, collSize+keySize)
+		if _, err := io.ReadFull(r, names); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(nonceSize + valSize); err != nil {
+			return nil, err
+		}
+		recOffset := offset
+		offset += int64(recordHeaderSize + opSize + collSize + keySize + nonceSize + valSize)
+
+		collection := string(names[:collSize])
+		if skip || isInternalCollection(collection) {
+			continue
+		}
+		compKey := compositeKey(collection, string(names[collSize:]))
+		if op == OpDelete && timestamp >= cutoff {
+			last[compKey] = recOffset
+		} else {
+			delete(last, compKey)
+		}
+	}
+	return slices.Sorted(maps.Values(last)), nil
+}
+
+// CollStats is the fragmentation of one collection's records in the log.
+type CollStats struct {
+	Keys        int   // Live keys
+	LiveBytes   int64 // On-disk bytes of their current versions
+	DeadBytes   int64 // Superseded versions, tombstones and expired records
+	DeadRecords int   // Records making up DeadBytes
+}
+
+// DeadRatio is the share of the collection's bytes in the log that Compact
+// would drop, 0 for a collection without records.
+func (s CollStats) DeadRatio() float64 {
+	if total := s.LiveBytes + s.DeadBytes; total > 0 {
+		return float64(s.DeadBytes) / float64(total)
+	}
+	return 0
+}
+
+// CollectionStats walks the log once and reports, for every user
+// collection with records in it, the bytes of live and dead records. A
+// record is live if the index points at it and it has not expired. Only
+// record headers and keys are read, so values are neither decrypted nor
+// checked. Unlike CollectionInfo, which reports counters kept in memory,
+// the result is measured from the file itself.
+func (db *DB) CollectionStats() (map[string]CollStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := make(map[string]CollStats)
+	now := db.now().UnixNano()
+	r := bufio.NewReaderSize(io.NewSectionReader(db.file, int64(headerSize), db.offset-int64(headerSize)), 128*1024)
+	buf := make([]byte, recordHeaderSize+opSize)
+	for offset := int64(headerSize); offset < db.offset; {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		_, _, _, collSize, keySize, valSize := decodeRecordHeader(buf)
+		op := buf[recordHeaderSize]
+		skip, err := checkOp(op, offset)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]byte, collSize+keySize)
+		if _, err := io.ReadFull(r, names); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(nonceSize + valSize); err != nil {
+			return nil, err
+		}
+		size := int64(recordHeaderSize + opSize + collSize + keySize + nonceSize + valSize)
+		recOffset := offset
+		offset += size
+
+		collection := string(names[:collSize])
+		if isInternalCollection(collection) {
+			continue
+		}
+		s := stats[collection]
+		entry, ok, err := db.index.get(compositeKey(collection, string(names[collSize:])))
+		if err != nil {
+			return nil, err
+		}
+		if !skip && op != OpDelete && ok && entry.Offset == recOffset && !entry.expired(now) {
+			s.Keys++
+			s.LiveBytes += size
+		} else {
+			s.DeadRecords++
+			s.DeadBytes += size
+		}
+		stats[collection] = s
+	}
+	return stats, nil
+}
+
+// Churn counts the writes to a collection since Open.
+type Churn struct {
+	Puts         int64 // Values written
+	Overwrites   int64 // Puts that superseded a current version
+	Deletes      int64 // Tombstones written
+	BytesWritten int64 // Log bytes appended
+}
+
+// countChurn records a write that applyRecord indexed. Records replayed by
+// rebuildIndex are not counted. Callers must hold db.mu.
+func (db *DB) countChurn(compKey string, op byte, size int64, replaced bool) {
+	collection, _ := SplitKey(compKey)
+	c := db.churn[collection]
+	c.BytesWritten += size
+	switch op {
+	case OpPut, OpMeta:
+		c.Puts++
+		if replaced {
+			c.Overwrites++
+		}
+	case OpDelete:
+		c.Deletes++
+	}
+	db.churn[collection] = c
+}
+
+// Recommendation is the verdict of CompactionAdvice.
+type Recommendation int
+
+const (
+	AdviceNotWorthIt  Recommendation = iota // Too little to reclaim to pay for a compaction
+	AdviceCompactNow                        // Enough is reclaimable to compact now
+	AdviceAutoCompact                       // The workload churns: compact whenever Threshold is reached
+)
+
+func (r Recommendation) String() string {
+	switch r {
+	case AdviceCompactNow:
+		return "compact now"
+	case AdviceAutoCompact:
+		return "enable auto-compaction"
+	default:
+		return "not worth it"
+	}
+}
+
+// Advice is what CompactionAdvice recommends and the measurements behind it.
+type Advice struct {
+	Recommendation Recommendation
+	Threshold      float64 // Reclaimable ratio at which to compact
+	Reason         string
+
+	ReclaimableBytes   int64         // Superseded, deleted and expired bytes Compact would drop
+	ReclaimableRatio   float64       // ReclaimableBytes over the size of the log
+	WriteAmplification float64       // Bytes appended since Open per live byte
+	ChurnRatio         float64       // Share of writes since Open that superseded or deleted a value
+	EstimatedDuration  time.Duration // At the throughput of the last Compact; zero before one ran
+}
+
+// CompactionAdvice estimates what a Compact would reclaim and cost, and
+// recommends whether to run one. The estimate of its duration assumes the
+// throughput measured by the last Compact since Open, reading the whole log
+// and writing the live part of it.
+func (db *DB) CompactionAdvice() (Advice, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var a Advice
+	now := db.now().UnixNano()
+	err := db.index.each(func(k string, e indexEntry) error {
+		if e.expired(now) || db.walTruncated(k) {
+			a.ReclaimableBytes += e.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return Advice{}, err
+	}
+	var live int64
+	for _, n := range db.live {
+		live += n
+	}
+	for _, n := range db.dead {
+		a.ReclaimableBytes += n
+	}
+	logBytes := db.offset - int64(headerSize)
+	if logBytes > 0 {
+		a.ReclaimableRatio = float64(a.ReclaimableBytes) / float64(logBytes)
+	}
+
+	var total Churn
+	for _, c := range db.churn {
+		total.Puts += c.Puts
+		total.Overwrites += c.Overwrites
+		total.Deletes += c.Deletes
+		total.BytesWritten += c.BytesWritten
+	}
+	writes := total.Puts + total.Deletes
+	if writes > 0 {
+		a.ChurnRatio = float64(total.Overwrites+total.Deletes) / float64(writes)
+	}
+	if live > 0 {
+		a.WriteAmplification = float64(total.BytesWritten) / float64(live)
+	}
+
+	last := db.lastCompaction
+	if last.Duration > 0 {
+		perByte := float64(last.Duration) / float64(last.BytesBefore+last.BytesAfter)
+		a.EstimatedDuration = time.Duration(perByte * float64(db.offset+live))
+	}
+
+	a.Threshold = adviceThreshold
+	if a.EstimatedDuration > 0 && a.EstimatedDuration < time.Second {
+		a.Threshold = adviceFastThreshold
+	}
+	switch {
+	case a.ReclaimableBytes >= adviceMinReclaim && a.ReclaimableRatio >= a.Threshold:
+		a.Recommendation = AdviceCompactNow
+		a.Reason = fmt.Sprintf("%.0f%% of the log (%d bytes) is reclaimable", 100*a.ReclaimableRatio, a.ReclaimableBytes)
+	case writes >= adviceMinWrites && a.ChurnRatio >= adviceChurnRatio:
+		a.Recommendation = AdviceAutoCompact
+		a.Reason = fmt.Sprintf("%.0f%% of %d writes since open superseded or deleted a value", 100*a.ChurnRatio, writes)
+	default:
+		a.Recommendation = AdviceNotWorthIt
+		a.Reason = fmt.Sprintf("only %d bytes (%.0f%% of the log) are reclaimable", a.ReclaimableBytes, 100*a.ReclaimableRatio)
+	}
+	return a, nil
+}
@@ -0,0 +1,406 @@
+package database
+
+import (
+	"crypto/rand"
+	"fmt"
+	"maps"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactWithResult(t *testing.T) {
+	clock := newTestClock()
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Two superseded versions, a deleted key and its tombstone, and an
+	// expired key: five records to drop, two to keep
+	for _, v := range []string{"v1", "v2", "v3"} {
+		db.Put("col", "k1", []byte(v))
+	}
+	db.Put("col", "k2", []byte("v"))
+	db.Delete("col", "k2")
+	db.PutWithTTL("col", "k3", []byte("v"), time.Millisecond)
+	db.Put("col", "k4", []byte("v"))
+	clock.Advance(time.Second)
+
+	before := db.Offset()
+	result, err := db.CompactWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LiveRecords != 2 || result.DroppedRecords != 5 || result.ExpiredRecords != 1 {
+		t.Errorf("live %d, dropped %d, expired %d; want 2, 5, 1", result.LiveRecords, result.DroppedRecords, result.ExpiredRecords)
+	}
+	if result.BytesBefore != before || result.BytesAfter != db.Offset() || result.BytesAfter >= result.BytesBefore {
+		t.Errorf("bytes %d -> %d, log was %d and is %d", result.BytesBefore, result.BytesAfter, before, db.Offset())
+	}
+	if result.Duration <= 0 {
+		t.Errorf("duration %v", result.Duration)
+	}
+
+	// Compacting again drops nothing
+	result, err = db.CompactWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LiveRecords != 2 || result.DroppedRecords != 0 || result.BytesAfter != result.BytesBefore {
+		t.Errorf("second compaction: %+v", result)
+	}
+}
+
+func TestTombstoneTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	clock := newTestClock()
+	opts := Options{Now: clock.Now, TombstoneTTL: time.Hour, KDF: KDFParams{Memory: 64, Parallelism: 1}}
+	db, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	tombstones := func() []string {
+		t.Helper()
+		var keys []string
+		offsets, _ := walkLog(db.file, int64(headerSize))
+		for _, offset := range offsets {
+			rec, _, err := db.readRecord(offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Op == OpDelete {
+				keys = append(keys, string(rec.Key))
+			}
+		}
+		return keys
+	}
+
+	for _, k := range []string{"old", "recent", "again", "rotated", "live"} {
+		db.Put("col", k, []byte("v"))
+	}
+	db.Delete("col", "old")
+	clock.Advance(2 * time.Hour)
+	db.Delete("col", "rotated")
+	// A tombstone written before a rotation is sealed again under the new key
+	if err := db.BeginKeyRotation(); err != nil {
+		t.Fatal(err)
+	}
+	db.Delete("col", "recent")
+	db.Delete("col", "again")
+	db.Put("col", "again", []byte("back"))
+	db.Append("col", "list", []byte("entry"))
+	db.DeleteList("col", "list")
+
+	result, err := db.CompactWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tombstones(); !slices.Equal(got, []string{"rotated", "recent"}) || result.KeptTombstones != 2 {
+		t.Errorf("tombstones kept: %v, reported %d", got, result.KeptTombstones)
+	}
+	if result.LiveRecords+result.DroppedRecords+result.KeptTombstones != 12 {
+		t.Errorf("result does not account for every record: %+v", result)
+	}
+	if dead := db.dead["col"]; dead == 0 || dead != db.offset-int64(headerSize)-db.live["col"] {
+		t.Errorf("dead bytes %d after compaction, live %d of %d", dead, db.live["col"], db.offset-int64(headerSize))
+	}
+
+	// They stay deleted, also when the log is scanned again
+	db.Close()
+	os.Remove(path + ".hint")
+	if db, err = OpenWithOptions(path, "pass", opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"old", "recent", "rotated"} {
+		if _, err := db.Get("col", k); err != ErrNotFound {
+			t.Errorf("Get(%s): %v", k, err)
+		}
+	}
+
+	// Once older than the TTL they go at the next compaction
+	clock.Advance(2 * time.Hour)
+	if result, err = db.CompactWithResult(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tombstones(); len(got) != 0 || result.KeptTombstones != 0 || result.DroppedRecords != 2 {
+		t.Errorf("aged tombstones kept: %v, %+v", got, result)
+	}
+}
+
+func TestCompactFunc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// Keep only the even values; a key whose old version was odd is kept
+	// by its current one
+	for i := range 20 {
+		db.Put("col", fmt.Sprintf("k%02d", i), []byte(fmt.Sprint(i)))
+	}
+	db.Put("col", "k01", []byte("100"))
+	db.Append("col", "list", []byte("1"))
+	if err := db.SetCollectionImmutable("frozen", true); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("frozen", "k", []byte("1"))
+
+	var offered []string
+	err = db.CompactFunc(func(rec Record) bool {
+		offered = append(offered, compositeKey(rec.Collection, rec.Key))
+		var n int
+		fmt.Sscan(string(rec.Value), &n)
+		return n%2 == 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offered) != 20 {
+		t.Errorf("keep was offered %d keys: %v", len(offered), offered)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for i := range 20 {
+			key := fmt.Sprintf("k%02d", i)
+			_, err := db.Get("col", key)
+			if want := i%2 == 0 || i == 1; (err == nil) != want {
+				t.Errorf("%s: Get(%s) = %v", stage, key, err)
+			}
+		}
+		if v, err := db.Get("frozen", "k"); err != nil || string(v) != "1" {
+			t.Errorf("%s: immutable key = %q, %v", stage, v, err)
+		}
+		if entries, err := db.GetList("col", "list"); err != nil || len(entries) != 1 {
+			t.Errorf("%s: list = %q, %v", stage, entries, err)
+		}
+	}
+	check("after CompactFunc")
+
+	// The rejected keys are gone from the file, not just the index
+	if err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	check("after Reindex")
+	db.Close()
+	if db, err = Open(path, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	check("after reopening")
+}
+
+func TestCollectionStats(t *testing.T) {
+	clock := newTestClock()
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// size returns the bytes a write appended to the log
+	size := func(write func() error) int64 {
+		t.Helper()
+		before := db.Offset()
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		return db.Offset() - before
+	}
+	value := make([]byte, 100)
+
+	// hot: three of four versions of one key are dead
+	var hot [4]int64
+	for i := range hot {
+		hot[i] = size(func() error { return db.Put("hot", "k", value) })
+	}
+	// cold: a deleted key and its tombstone, an expired key, and a live one
+	put := size(func() error { return db.Put("cold", "gone", value) })
+	tombstone := size(func() error { return db.Delete("cold", "gone") })
+	expired := size(func() error { return db.PutWithTTL("cold", "ttl", value, time.Minute) })
+	live := size(func() error { return db.Put("cold", "kept", value) })
+	db.Append("cold", "list", value) // Internal, not reported
+	clock.Advance(time.Hour)
+
+	stats, err := db.CollectionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]CollStats{
+		"hot":  {Keys: 1, LiveBytes: hot[3], DeadBytes: hot[0] + hot[1] + hot[2], DeadRecords: 3},
+		"cold": {Keys: 1, LiveBytes: live, DeadBytes: put + tombstone + expired, DeadRecords: 3},
+	}
+	if len(stats) != len(want) {
+		t.Errorf("stats for %d collections: %+v", len(stats), stats)
+	}
+	for name, w := range want {
+		if stats[name] != w {
+			t.Errorf("%s: %+v, want %+v", name, stats[name], w)
+		}
+	}
+	if r := stats["hot"].DeadRatio(); r != 0.75 {
+		t.Errorf("hot dead ratio %v, want 0.75", r)
+	}
+	dead := put + tombstone + expired
+	if r, w := stats["cold"].DeadRatio(), float64(dead)/float64(dead+live); r != w {
+		t.Errorf("cold dead ratio %v, want %v", r, w)
+	}
+
+	// Live bytes agree with the in-memory counters
+	infos, err := db.CollectionInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if s := stats[info.Name]; s.Keys != info.Keys || s.LiveBytes != info.LiveBytes {
+			t.Errorf("%s: CollectionStats %+v, CollectionInfo %+v", info.Name, s, info)
+		}
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = db.CollectionStats(); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range stats {
+		if s.DeadBytes != 0 || s.DeadRatio() != 0 {
+			t.Errorf("%s after Compact: %+v", name, s)
+		}
+	}
+}
+
+func TestCompactionAdvice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	// Without compression no meta record pauses it for the random values,
+	// and the log holds the writes to col alone
+	db, err := OpenWithOptions(path, "pass", Options{CompressionThreshold: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advise := func(stage string, want Recommendation) Advice {
+		t.Helper()
+		a, err := db.CompactionAdvice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Recommendation != want {
+			t.Fatalf("%s: advised %v (%s), want %v", stage, a.Recommendation, a.Reason, want)
+		}
+		return a
+	}
+	// Random values do not compress, so each version takes its full size
+	writeAll := func() {
+		t.Helper()
+		value := make([]byte, 1500)
+		for i := 0; i < 1000; i++ {
+			rand.Read(value)
+			if err := db.Put("col", fmt.Sprintf("k%d", i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	writeAll()
+	a := advise("fresh keys", AdviceNotWorthIt)
+	if a.ChurnRatio != 0 || a.EstimatedDuration != 0 {
+		t.Errorf("fresh keys: %+v", a)
+	}
+	stats, _ := db.Stats()
+	if c := stats.Churn["col"]; c.Puts != 1000 || c.Overwrites != 0 || c.BytesWritten != stats.LiveBytes {
+		t.Errorf("churn after fresh keys: %+v, live bytes %d", c, stats.LiveBytes)
+	}
+
+	writeAll()
+	writeAll()
+	a = advise("overwritten twice", AdviceCompactNow)
+	if a.ReclaimableRatio < 0.6 || a.ChurnRatio < 0.6 || a.WriteAmplification < 2.9 {
+		t.Errorf("overwritten twice: %+v", a)
+	}
+
+	result, err := db.CompactWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is left to reclaim, but the churn since Open still calls for
+	// regular compactions, whose cost is now known
+	a = advise("compacted", AdviceAutoCompact)
+	if a.ReclaimableBytes != 0 || a.EstimatedDuration <= 0 || a.Threshold != adviceFastThreshold {
+		t.Errorf("compacted: %+v", a)
+	}
+	stats, _ = db.Stats()
+	if stats.LastCompaction != result || stats.Churn["col"].Overwrites != 2000 {
+		t.Errorf("stats after compaction: %+v", stats)
+	}
+	db.Close()
+
+	// Records replayed on Open are not churn
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	advise("reopened", AdviceNotWorthIt)
+	if stats, _ := db.Stats(); len(stats.Churn) != 0 || stats.BytesWritten != 0 {
+		t.Errorf("churn after reopen: %+v, %d bytes", stats.Churn, stats.BytesWritten)
+	}
+}
+
+func TestCompactSortsRecords(t *testing.T) {
+	for _, lowMemory := range []bool{false, true} {
+		t.Run(fmt.Sprintf("LowMemory=%v", lowMemory), func(t *testing.T) {
+			db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{LowMemory: lowMemory})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// The second round writes over a compacted index, so with
+			// LowMemory its changes are merged with the index file
+			rng := mrand.New(mrand.NewSource(1))
+			for round := range 2 {
+				for _, i := range rng.Perm(500) {
+					db.Put([]string{"b", "a", "c"}[i%3], fmt.Sprintf("k%03d", i), []byte(fmt.Sprint(round)))
+				}
+				for i := round; i < 500; i += 7 {
+					db.Delete([]string{"b", "a", "c"}[i%3], fmt.Sprintf("k%03d", i))
+				}
+				db.SetCollectionTTL("a", time.Hour) // A meta record, which goes first
+				if err := db.Compact(); err != nil {
+					t.Fatal(err)
+				}
+
+				entries := make(map[string]indexEntry)
+				db.index.each(func(k string, e indexEntry) error {
+					entries[k] = e
+					return nil
+				})
+				keys := slices.Sorted(maps.Keys(entries))
+				keys = slices.DeleteFunc(keys, func(k string) bool { return strings.HasPrefix(k, metaCollection+":") })
+				if len(keys) < 400 {
+					t.Fatalf("round %d: %d keys", round, len(keys))
+				}
+				for i := 1; i < len(keys); i++ {
+					if entries[keys[i]].Offset <= entries[keys[i-1]].Offset {
+						t.Fatalf("round %d: %s is stored before %s", round, keys[i], keys[i-1])
+					}
+				}
+				for k, e := range entries {
+					if strings.HasPrefix(k, metaCollection+":") && e.Offset > entries[keys[0]].Offset {
+						t.Fatalf("round %d: meta record %s stored after user records", round, k)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package database
+
+// Compression is attempted on every value over the threshold, and an
+// attempt whose output is not smaller is thrown away. For a collection of
+// already-compressed data, such as images, that is CPU spent on every write
+// for nothing, so each collection keeps a rolling success rate and stops
+// attempting once it drops too low, probing now and then to notice when the
+// data changes. The decision is stored in the meta collection.
+const (
+	compressWindow     = 32   // Attempts the rolling success rate mostly reflects
+	compressPauseBelow = 0.1  // Success rate under which attempts stop
+	compressResumeAt   = 0.25 // Success rate at which they start again
+	compressProbeEvery = 256  // Paused writes per probing attempt
+
+	metaIncompressiblePrefix = "incompressible:"
+)
+
+// CompressionStats describes the compression attempts of a collection since
+// Open. Values at or under the compression threshold are not counted. Once
+// the success rate falls under 10%, attempts are paused but for one probe
+// every 256 writes until probes bring it back to 25%. The pause is stored as
+// a setting, so it survives reopening.
+type CompressionStats struct {
+	Attempts       int64   // Values compression was attempted on
+	Compressed     int64   // Of those, values stored compressed
+	Skipped        int64   // Values stored without an attempt while paused
+	SuccessRate    float64 // Rolling rate of attempts that paid off
+	Incompressible bool    // Attempts are paused but for occasional probes
+}
+
+// compressionState is a collection's CompressionStats, whether its
+// Incompressible flag differs from the one in the meta collection, and when
+// to probe.
+type compressionState struct {
+	CompressionStats
+	unsaved bool
+	probe   int64 // Writes while paused, to probe every compressProbeEvery
+}
+
+// compressionFor returns the state of collection, creating it. Callers must
+// hold db.mu for writing.
+func (db *DB) compressionFor(collection string) *compressionState {
+	s, ok := db.compression[collection]
+	if !ok {
+		s = &compressionState{CompressionStats: CompressionStats{SuccessRate: 1}}
+		db.compression[collection] = s
+	}
+	return s
+}
+
+// shouldCompress reports whether to attempt compressing a value of
+// collection over the threshold. Internal collections always attempt.
+// Callers must hold db.mu for writing.
+func (db *DB) shouldCompress(collection string) bool {
+	if isInternalCollection(collection) {
+		return true
+	}
+	s := db.compressionFor(collection)
+	if !s.Incompressible {
+		return true
+	}
+	if s.probe++; s.probe%compressProbeEvery == 0 {
+		return true
+	}
+	s.Skipped++
+	return false
+}
+
+// noteCompression records an attempt on collection and whether its output
+// was kept, pausing or resuming attempts as the success rate crosses the
+// thresholds. Callers must hold db.mu for writing.
+func (db *DB) noteCompression(collection string, compressed bool) {
+	if isInternalCollection(collection) {
+		return
+	}
+	s := db.compressionFor(collection)
+	s.Attempts++
+	outcome := 0.0
+	if compressed {
+		s.Compressed++
+		outcome = 1
+	}
+	s.SuccessRate += (outcome - s.SuccessRate) / compressWindow
+	switch {
+	case !s.Incompressible && s.SuccessRate < compressPauseBelow:
+		s.Incompressible, s.unsaved = true, !s.unsaved
+	case s.Incompressible && s.SuccessRate >= compressResumeAt:
+		s.Incompressible, s.unsaved = false, !s.unsaved
+	}
+	if s.unsaved {
+		db.compressionUnsaved = true
+	}
+}
+
+// storeCompression writes the Incompressible flags that changed to the meta
+// collection. The flags only spare work, so a failure is logged and retried
+// after the next write. Callers must hold db.mu for writing.
+func (db *DB) storeCompression() {
+	if !db.compressionUnsaved {
+		return
+	}
+	db.compressionUnsaved = false
+	for collection, s := range db.compression {
+		if !s.unsaved {
+			continue
+		}
+		value := []byte("0")
+		if s.Incompressible {
+			value = []byte("1")
+		}
+		if err := db.putMeta(metaIncompressiblePrefix+collection, value); err != nil {
+			db.compressionUnsaved = true
+			db.logger().Warn("nokhal: storing compression state failed", "path", db.path, "collection", collection, "err", err)
+			continue
+		}
+		s.unsaved = false
+	}
+}
+
+// applyIncompressible applies the stored Incompressible flag of collection.
+// A collection loaded as paused starts with a success rate of zero, so a
+// few probes must pay off before attempts resume. Callers must hold db.mu or
+// have exclusive access to db.
+func (db *DB) applyIncompressible(collection string, value []byte) {
+	s := db.compressionFor(collection)
+	s.unsaved = false
+	if paused := string(value) == "1"; paused != s.Incompressible {
+		s.Incompressible = paused
+		s.SuccessRate = 0
+		if !paused {
+			s.SuccessRate = 1
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	compression := func(collection string) CompressionStats {
+		t.Helper()
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.Compression[collection]
+	}
+	random := make([]byte, 1024)
+	text := bytes.Repeat([]byte("compressible "), 80)
+	for i := range 300 {
+		rand.Read(random)
+		db.Put("images", fmt.Sprint("img", i), random)
+		db.Put("docs", fmt.Sprint("doc", i), text)
+	}
+
+	// Attempts on random data stop once their success rate drops, but for
+	// probes
+	images := compression("images")
+	if !images.Incompressible || images.Compressed != 0 || images.Attempts+images.Skipped != 300 {
+		t.Fatalf("images: %+v", images)
+	}
+	if images.Attempts > 100 || images.Skipped < 200 {
+		t.Errorf("images kept attempting: %+v", images)
+	}
+	if docs := compression("docs"); docs.Incompressible || docs.Attempts != 300 || docs.Compressed != 300 {
+		t.Errorf("docs: %+v", docs)
+	}
+	if v, err := db.Get("images", "img299"); err != nil || !bytes.Equal(v, random) {
+		t.Errorf("Get of an uncompressed value: %v", err)
+	}
+
+	// The decision survives a reopen
+	db.Close()
+	if db, err = Open(path, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if images := compression("images"); !images.Incompressible || images.Attempts != 0 {
+		t.Fatalf("images after reopen: %+v", images)
+	}
+
+	// Probes notice the data became compressible
+	for i := range 20 * compressProbeEvery {
+		db.Put("images", fmt.Sprint("svg", i), text)
+	}
+	images = compression("images")
+	if images.Incompressible || images.Compressed == 0 {
+		t.Fatalf("images after compressible writes: %+v", images)
+	}
+	db.Close()
+	if db, err = Open(path, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if images := compression("images"); images.Incompressible {
+		t.Errorf("images paused again after reopen: %+v", images)
+	}
+
+	// Compression can be turned off for a write
+	if err := db.PutWithOptions("docs", "raw", text, PutOptions{TTL: time.Hour, DisableCompression: true}); err != nil {
+		t.Fatal(err)
+	}
+	entry := indexed(t, db, "docs:raw")
+	rec, _, err := db.readRecord(entry.Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Flags&FlagCompressed != 0 || entry.ExpiresAt == 0 {
+		t.Errorf("PutWithOptions wrote flags %b, expiry %d", rec.Flags, entry.ExpiresAt)
+	}
+	if v, err := db.Get("docs", "raw"); err != nil || !bytes.Equal(v, text) {
+		t.Errorf("Get(raw) = %v", err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/argon2"
@@ -15,8 +17,54 @@ const (
 	nonceSize = 12
 )
 
-func deriveKey(password string, salt []byte) []byte {
-	return argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, keySize)
+// cipherName names what newCipher builds from a keySize key.
+const cipherName = "AES-256-GCM"
+
+// KDFParams are the Argon2id parameters that derive the key encryption key
+// from the password. Zero fields take their value from DefaultKDF.
+type KDFParams struct {
+	Time        uint32 // Passes over the memory
+	Memory      uint32 // Memory in KiB
+	Parallelism uint8  // Threads
+}
+
+// DefaultKDF are the parameters of files created without Options.KDF and of
+// every file that predates it.
+var DefaultKDF = KDFParams{Time: 1, Memory: 64 * 1024, Parallelism: 4}
+
+var ErrInvalidKDF = errors.New("invalid key derivation parameters")
+
+func (p KDFParams) withDefaults() KDFParams {
+	if p.Time == 0 {
+		p.Time = DefaultKDF.Time
+	}
+	if p.Memory == 0 {
+		p.Memory = DefaultKDF.Memory
+	}
+	if p.Parallelism == 0 {
+		p.Parallelism = DefaultKDF.Parallelism
+	}
+	return p
+}
+
+// Validate reports whether Argon2id accepts p once defaults are filled in:
+// it needs at least 8 KiB of memory per thread.
+func (p KDFParams) Validate() error {
+	p = p.withDefaults()
+	if p.Memory < 8*uint32(p.Parallelism) {
+		return fmt.Errorf("%w: %d KiB is less than 8 KiB for each of %d threads", ErrInvalidKDF, p.Memory, p.Parallelism)
+	}
+	return nil
+}
+
+func (p KDFParams) String() string {
+	p = p.withDefaults()
+	return fmt.Sprintf("argon2id t=%d m=%dKiB p=%d", p.Time, p.Memory, p.Parallelism)
+}
+
+func deriveKey(password string, salt []byte, p KDFParams) []byte {
+	p = p.withDefaults()
+	return argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Parallelism, keySize)
 }
 
 func newCipher(key []byte) (cipher.AEAD, error) {
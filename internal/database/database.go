@@ -4,23 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"compress/flate"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Compression helpers
-func compress(data []byte) ([]byte, error) {
+// Compression helpers. A dictionary, if given, presets the window; flate
+// ignores it at BestSpeed, so dictionary compression uses the default level.
+func compress(data, dict []byte) ([]byte, error) {
 	var b bytes.Buffer
-	w, err := flate.NewWriter(&b, flate.BestSpeed)
+	level := flate.BestSpeed
+	if dict != nil {
+		level = flate.DefaultCompression
+	}
+	w, err := flate.NewWriterDict(&b, level, dict)
 	if err != nil {
 		return nil, err
 	}
@@ -33,32 +41,33 @@ func compress(data []byte) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func decompress(data []byte) ([]byte, error) {
-	r := flate.NewReader(bytes.NewReader(data))
+func decompress(data, dict []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), dict)
 	defer r.Close()
 	return io.ReadAll(r)
 }
 
-func secureDelete(path string) error {
+// secureErase overwrites the file at path with random bytes in place. The
+// file is left where it is, for a rename to replace.
+func secureErase(path string) error {
 	f, err := os.OpenFile(path, os.O_WRONLY, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
-		return os.Remove(path)
+		return err
 	}
+	defer f.Close()
 	
 	info, err := f.Stat()
 	if err != nil {
-		f.Close()
-		return os.Remove(path)
+		return err
 	}
 	
 	size := info.Size()
 	buf := make([]byte, 64*1024)
 	if _, err := rand.Read(buf); err != nil {
-		f.Close()
-		return os.Remove(path)
+		return err
 	}
 
 	for i := int64(0); i < size; i += int64(len(buf)) {
@@ -67,9 +76,7 @@ func secureDelete(path string) error {
 		}
 	}
 	
-	f.Sync()
-	f.Close()
-	return os.Remove(path)
+	return f.Sync()
 }
 
 var (
@@ -78,6 +85,10 @@ var (
 	ErrInvalidFile      = errors.New("invalid file format")
 	ErrDecryption       = errors.New("decryption failed")
 	ErrInvalidPassword  = errors.New("invalid password")
+	ErrInvalidToken     = errors.New("invalid page token")
+	ErrCollectionInUse  = errors.New("collection already has records")
+	ErrContentChecksum  = errors.New("content checksum mismatch")
+	ErrUnknownDict      = errors.New("compression dictionary not found")
 )
 
 var bufferPool = sync.Pool{
@@ -88,176 +99,399 @@ var bufferPool = sync.Pool{
 
 type DB struct {
 	mu     sync.RWMutex
-	file   *os.File
+	file   storageFile
 	offset int64
-	index  map[string]int64
+	index  keyIndex
 	path   string
 	aead   cipher.AEAD // Initialized with DEK
 	salt   []byte
+	kek    cipher.AEAD // Wraps DEKs stored in the header
+	header *fileHeader
 	bloom  *BloomFilter
+	dead   map[string]int64 // Superseded and tombstone bytes per collection
+	live   map[string]int64 // Bytes of current versions per collection
+
+	plaintext  map[string]bool          // Collections stored without encryption (from meta)
+	defaultTTL map[string]time.Duration // Per-collection default TTL (from meta)
+	lists      map[string]listSpan      // Ordinals held by lists changed since Open
+	walNext    uint64                   // Next write-ahead log offset, zero until known
+	walMark    uint64                   // Write-ahead log entries below it are truncated (from meta)
+	immutable  map[string]bool          // Collections whose live keys may not change (from meta)
+	churn      map[string]Churn         // Writes per collection since Open
+	nextAead   cipher.AEAD              // Second DEK while a key rotation is in progress
+
+	dicts      atomic.Pointer[map[uint32][]byte]    // Compression dictionaries by ID (from meta)
+	transforms atomic.Pointer[map[string]Transform] // Value transforms by collection (SetTransform)
+	fastGets   sync.Map                             // Combined key -> *fastGet, for immutable keys
+	accesses   sync.Map                             // Collection -> *accessCounters (access.go)
+	indexGen   uint64                               // Bumped when the index is replaced, for walkIndex
+	expiry     *expiryScheduler                     // Fires OnExpire hooks, once one is registered
+
+	pinMu     sync.Mutex             // Guards handles, snapshots and their state
+	handles   int                    // Open snapshots and iterators (Options.MaxSnapshots)
+	snapshots map[*Snapshot]struct{} // Open snapshots, pinning the records they hold
+
+	prefixes     *BloomFilter  // Collections and short key prefixes ever written (prefixfilter.go)
+	prefixChecks atomic.Uint64 // Scans checked against prefixes
+	prefixSkips  atomic.Uint64 // Scans answered empty by prefixes
+
+	opts   Options
+	lease  *lease  // Ownership lease held by this writer, if enabled
+	mirror *mirror // Write-through mirror, if Options.MirrorPath is set
+	closed bool
+
+	// The one close, which closeDone reports finished with closeErr
+	closeOnce sync.Once
+	closeDone chan struct{}
+	closeErr  error
+
+	thaw      chan struct{} // Closed when the current Freeze ends; nil if not frozen
+	nonceNext uint64        // Next counter nonce; from header.NonceLimit at Open
+
+	// Closed when the log grows, is compacted or closed; made by the first
+	// Subscription to wait since
+	watchMu  sync.Mutex
+	appended chan struct{}
+
+	lastWrite atomic.Int64 // UnixNano of the last append, read without db.mu
+	health    health       // Background work progress reported by Healthy
+
+	// Bytes staged in uncommitted batches, and Options.MaxBatchMemory for
+	// batches to read without db.mu (batchmemory.go)
+	batchMemory atomic.Int64
+	batchLimit  atomic.Int64
+
+	// Hint flush coalescing (FlushHint)
+	lastHintFlush time.Time
+	hintTimer     *time.Timer
+	hintWrites    int
+
+	// End of the space the file holds, past db.offset when preallocated,
+	// and how many writes had to grow it. dirtyTail is set while bytes of
+	// a failed append may lie past db.offset
+	allocated  int64
+	extensions int
+	dirtyTail  bool
+
+	lastCompaction CompactionResult // Zero until Compact runs
+
+	// Compression attempts per collection (compression.go), and whether
+	// a change to their Incompressible flags is not stored yet
+	compression        map[string]*compressionState
+	compressionUnsaved bool
 }
 
 func Open(path, password string) (*DB, error) {
-	var file *os.File
-	var err error
-	var salt []byte
-	var kekNonce []byte
-	var encryptedDek []byte
-	var dek []byte
+	return OpenWithOptions(path, password, Options{})
+}
+
+func OpenWithOptions(path, password string, opts Options) (*DB, error) {
+	db, _, err := OpenWithReport(path, password, opts)
+	return db, err
+}
+
+// OpenWithReport is OpenWithOptions that also reports housekeeping done on
+// open, such as removing files orphaned by a crash, and what it found in the
+// file. Orphans are .compact outputs, .hint.tmp files, low-memory index files
+// and hints that no longer match the data file; they are only removed once
+// this opener holds the lease, or while the header shows none held. A
+// .compact output that is intact while the data file is missing or has no
+// valid header is the only copy left by a crash during Compact, and is
+// renamed into place unless the lease it carries is live.
+func OpenWithReport(path, password string, opts Options) (*DB, OpenReport, error) {
+	var file storageFile
+	var report OpenReport
+
+	if err := recoverCompaction(path, opts.LeaseTimeout, opts.logger(), &report); err != nil {
+		return nil, report, err
+	}
+
+	if err := checkDiskFreeOption(path, opts); err != nil {
+		return nil, report, err
+	}
 
 	stat, err := os.Stat(path)
 	if err != nil && !os.IsNotExist(err) {
-		return nil, err
+		return nil, report, err
+	}
+
+	// A non-empty file too short to hold a header is a truncated or corrupt
+	// header. Never try to unwrap a DEK out of such garbage.
+	truncated := err == nil && stat.Size() > 0 && stat.Size() < int64(headerSize)
+	if truncated && !opts.ForceReinit {
+		return nil, report, ErrInvalidFile
 	}
 
-	if os.IsNotExist(err) || stat.Size() == 0 {
-		file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if os.IsNotExist(err) || stat.Size() == 0 || truncated {
+		kdf := opts.KDF.withDefaults()
+		if err := kdf.Validate(); err != nil {
+			return nil, report, err
+		}
+		file, err = openStorage(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 		if err != nil {
-			return nil, err
+			return nil, report, err
 		}
 
+		// A hint left behind by a previous file at this path is meaningless now
+		_ = os.Remove(path + ".hint")
+
 		// 1. Generate Salt
-		salt, err = generateSalt()
+		salt, err := generateSalt()
 		if err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
 
 		// 2. Derive KEK (Key Encryption Key)
-		kek := deriveKey(password, salt)
+		features := opts.features() | FeatureBoundAAD
+		if kdf != DefaultKDF {
+			features |= FeatureKDFParams
+		}
+		kdfStart := time.Now()
+		kek := deriveKey(password, salt, kdf)
+		report.KDFDuration = time.Since(kdfStart)
 		kekAead, err := newCipher(kek)
 		if err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
 
-		// 3. Generate DEK (Data Encryption Key)
-		dek = make([]byte, dekSize)
-		if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		// 3. Generate DEK (Data Encryption Key) and encrypt it with the KEK
+		dek, kekNonce, encryptedDek, err := newDEK(kekAead)
+		if err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
 
-		// 4. Encrypt DEK
-		kekNonce, err = generateNonce()
-		if err != nil {
+		// 4. Write Header V5
+		header := &fileHeader{
+			Version:      version,
+			Salt:         salt,
+			KEKNonce:     kekNonce,
+			EncryptedDEK: encryptedDek,
+			Features:     features,
+			KDF:          kdf,
+		}
+		report.Version, report.Cipher, report.Features = header.Version, cipherName, header.Features
+		report.KDF = kdf
+		// Synced at once: a crash before the first sync must not leave a
+		// torn header that no later Open accepts
+		if _, err := file.WriteAt(header.encode(), 0); err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
-		// AAD for DEK encryption can be empty or static string
-		encryptedDek = kekAead.Seal(nil, kekNonce, dek, []byte("NOKHAL_DEK"))
-
-		// 5. Write Header V4
-		// Magic(6) + Version(1) + Salt(32) + KEKNonce(12) + EncryptedDEK(48)
-		header := make([]byte, v4HeaderSize)
-		offset := 0
-		copy(header[offset:], magicHeader)
-		offset += len(magicHeader)
-		header[offset] = version
-		offset++
-		copy(header[offset:], salt)
-		offset += len(salt)
-		copy(header[offset:], kekNonce)
-		offset += len(kekNonce)
-		copy(header[offset:], encryptedDek)
-
-		if _, err := file.Write(header); err != nil {
+		if err := file.Sync(); err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
 
-		// 6. Init Data AEAD with DEK
+		// 5. Init Data AEAD with DEK
 		dataAead, err := newCipher(dek)
 		if err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
 
 		db := &DB{
 			file:   file,
-			index:  make(map[string]int64),
+			index:  make(mapIndex),
+			dead:   make(map[string]int64),
+			live:   make(map[string]int64),
 			path:   path,
 			aead:   dataAead,
+			kek:    kekAead,
+			header: header,
 			salt:   salt,
-			offset: int64(v4HeaderSize),
-			bloom:  NewBloomFilter(100000),
-		}
-		return db, nil
+			offset: int64(headerSize),
+			bloom:  NewBloomFilter(defaultBloomSize),
+			opts:   opts,
 
-	} else {
-		file, err = os.OpenFile(path, os.O_APPEND|os.O_RDWR, 0644)
-		if err != nil {
-			return nil, err
+			prefixes: NewBloomFilter(defaultBloomSize),
+
+			plaintext:  make(map[string]bool),
+			immutable:  make(map[string]bool),
+			defaultTTL: make(map[string]time.Duration),
+			lists:      make(map[string]listSpan),
+			churn:      make(map[string]Churn),
+
+			compression: make(map[string]*compressionState),
 		}
 
-		// Read V4 Header
-		header := make([]byte, v4HeaderSize)
-		n, err := io.ReadFull(file, header)
-		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		db.allocated = db.offset
+		db.lastWrite.Store(time.Now().UnixNano())
+		db.batchLimit.Store(opts.MaxBatchMemory)
+
+		if err := db.acquireLease(); err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
+		}
+		if err := db.removeOrphans(&report); err != nil {
+			db.stopLease()
+			db.releaseLease()
+			file.Close()
+			return nil, report, err
 		}
 
-		if n < len(magicHeader) || string(header[:len(magicHeader)]) != magicHeader {
+		if err := db.openMirror(); err != nil {
+			db.stopLease()
+			db.releaseLease()
+			db.closeMirror()
 			file.Close()
-			return nil, ErrInvalidFile
+			return nil, report, err
+		}
+		return db, report, nil
+
+	} else {
+		file, err = openStorage(path, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, report, err
 		}
 
-		fileVersion := header[len(magicHeader)]
-		if fileVersion != version {
+		// Read V5 Header
+		buf := make([]byte, headerSize)
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			file.Close()
-			return nil, fmt.Errorf("unsupported version: %d (expected %d)", fileVersion, version)
+			return nil, report, err
 		}
 
-		if n < v4HeaderSize {
+		if err := checkHeader(buf, n, ErrInvalidFile); err != nil {
 			file.Close()
-			return nil, ErrInvalidFile
+			return nil, report, err
 		}
 
-		offset := len(magicHeader) + 1
-		salt = header[offset : offset+saltSize]
-		offset += saltSize
-		kekNonce = header[offset : offset+authNonceSize]
-		offset += authNonceSize
-		encryptedDek = header[offset : offset+encryptedDekSize]
+		header := decodeHeader(buf)
+		report.Version, report.Cipher, report.Rotating = header.Version, cipherName, header.Rotating
+		report.Features, report.KDF = header.Features, header.KDF
+		if err := checkFeatures(header.Features, opts); err != nil {
+			file.Close()
+			return nil, report, err
+		}
 
-		// Derive KEK
-		kek := deriveKey(password, salt)
+		// Derive KEK with the file's parameters; Options.KDF only applies to new files
+		kdfStart := time.Now()
+		kek := deriveKey(password, header.Salt, header.KDF)
+		report.KDFDuration = time.Since(kdfStart)
 		kekAead, err := newCipher(kek)
 		if err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
 
 		// Decrypt DEK
-		dek, err = kekAead.Open(nil, kekNonce, encryptedDek, []byte("NOKHAL_DEK"))
+		dek, err := kekAead.Open(nil, header.KEKNonce, header.EncryptedDEK, dekAAD)
 		if err != nil {
 			file.Close()
-			return nil, ErrInvalidPassword
+			return nil, report, ErrInvalidPassword
 		}
 
 		// Init Data AEAD
 		dataAead, err := newCipher(dek)
 		if err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
 		}
 
 		db := &DB{
-			file:  file,
-			index: make(map[string]int64),
-			path:  path,
-			aead:  dataAead,
-			salt:  salt,
-			bloom: NewBloomFilter(100000),
+			file:   file,
+			index:  make(mapIndex),
+			dead:   make(map[string]int64),
+			live:   make(map[string]int64),
+			path:   path,
+			aead:   dataAead,
+			kek:    kekAead,
+			header: header,
+			salt:   header.Salt,
+			bloom:  NewBloomFilter(defaultBloomSize),
+			opts:   opts,
+
+			prefixes: NewBloomFilter(defaultBloomSize),
+
+			plaintext:  make(map[string]bool),
+			immutable:  make(map[string]bool),
+			defaultTTL: make(map[string]time.Duration),
+			lists:      make(map[string]listSpan),
+			churn:      make(map[string]Churn),
+
+			compression: make(map[string]*compressionState),
 		}
 
-		if err := db.loadIndexes(); err != nil {
+		// Counters below the reserved limit may have been used before. The
+		// limit is only trusted sealed under the DEK: lowered, it would hand
+		// out used counters again
+		if err := header.checkNonces(dataAead); err != nil {
 			file.Close()
-			return nil, err
+			return nil, report, err
+		}
+		db.nonceNext = header.NonceLimit
+		db.batchLimit.Store(opts.MaxBatchMemory)
+
+		if fi, err := file.Stat(); err == nil {
+			db.lastWrite.Store(fi.ModTime().UnixNano())
 		}
 
-		return db, nil
+		// Claim the file before reading the log so a fenced-out writer
+		// cannot race us
+		if err := db.acquireLease(); err != nil {
+			file.Close()
+			return nil, report, err
+		}
+		if err := db.removeOrphans(&report); err != nil {
+			db.stopLease()
+			db.releaseLease()
+			file.Close()
+			return nil, report, err
+		}
+
+		// Resume an interrupted key rotation
+		if header.Rotating {
+			nextDek, err := kekAead.Open(nil, header.NextKEKNonce, header.NextEncryptedDEK, dekAAD)
+			if err != nil {
+				file.Close()
+				return nil, report, ErrInvalidPassword
+			}
+			if db.nextAead, err = newCipher(nextDek); err != nil {
+				file.Close()
+				return nil, report, err
+			}
+		}
+
+		indexStart := time.Now()
+		scan, err := db.loadIndexes()
+		if err != nil {
+			db.stopLease()
+			db.releaseLease()
+			file.Close()
+			return nil, report, err
+		}
+		report.IndexDuration = time.Since(indexStart)
+		report.fillScan(scan, opts.logger(), path)
+
+		if err := db.loadMeta(); err != nil {
+			db.stopLease()
+			db.releaseLease()
+			file.Close()
+			return nil, report, err
+		}
+		db.mu.RLock()
+		err = db.checkUnsealed(scan.unsealed)
+		db.mu.RUnlock()
+		if err != nil {
+			db.stopLease()
+			db.releaseLease()
+			file.Close()
+			return nil, report, err
+		}
+
+		if err := db.openMirror(); err != nil {
+			db.stopLease()
+			db.releaseLease()
+			db.closeMirror()
+			file.Close()
+			return nil, report, err
+		}
+
+		return db, report, nil
 	}
 }
 
@@ -266,39 +500,109 @@ func (db *DB) Put(collection, key string, value []byte) error {
 }
 
 func (db *DB) PutWithTTL(collection, key string, value []byte, ttl time.Duration) error {
-	db.mu.Lock()
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
 	defer db.mu.Unlock()
+	return db.put(collection, key, value, ttl)
+}
 
-	nonce, err := generateNonce()
-	if err != nil {
+// PutExpired writes value with an expiry already in the past. The record
+// takes its place in the log, so WatchFrom subscribers, the mirror and
+// backups see it in order, but Get returns ErrNotFound for the key from
+// the start, as for any expired key. Unlike Delete, which appends a
+// tombstone that hides earlier versions until Compact drops them all, it
+// is a put: the value is stored, sealed like any other, and Compact drops
+// it and the versions before it without keeping a tombstone. A zero TTL
+// cannot express this, as it means the collection default or no expiry.
+func (db *DB) PutExpired(collection, key string, value []byte) error {
+	if err := db.lockWrite(); err != nil {
 		return err
 	}
+	defer db.mu.Unlock()
+	now := db.now().UnixNano()
+	return db.putAt(collection, key, value, now, now-1)
+}
 
-	flags := FlagNone
-	finalValue := value
+// PutContext is Put giving up with ctx.Err() if ctx ends while it waits for
+// the write lock, held by a long Compact or a large batch, or for a freeze to
+// end. Nothing has been written then. Once the lock is held, the write
+// completes regardless of ctx.
+func (db *DB) PutContext(ctx context.Context, collection, key string, value []byte) error {
+	if err := db.lockWriteContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	return db.put(collection, key, value, 0)
+}
 
-	// Compress if larger than 128 bytes
-	if len(value) > 128 {
-		compressed, err := compress(value)
-		if err == nil && len(compressed) < len(value) {
-			finalValue = compressed
-			flags |= FlagCompressed
-		}
+// PutOptions configures PutWithOptions.
+type PutOptions struct {
+	TTL time.Duration // Zero means the collection's default TTL, if any
+
+	// DisableCompression stores the value without attempting to compress
+	// it, for data known not to compress, such as images.
+	DisableCompression bool
+}
+
+// PutWithOptions adds a key-value pair to a collection as configured by opts.
+func (db *DB) PutWithOptions(collection, key string, value []byte, opts PutOptions) error {
+	if err := db.lockWrite(); err != nil {
+		return err
 	}
+	defer db.mu.Unlock()
+	now, expiresAt := db.expiryFor(collection, opts.TTL)
+	return db.putValue(collection, key, value, now, expiresAt, !opts.DisableCompression)
+}
 
-	now := time.Now().UnixNano()
-	var expiresAt int64
+// put appends a new version of a key. Callers must hold db.mu.
+func (db *DB) put(collection, key string, value []byte, ttl time.Duration) error {
+	now, expiresAt := db.expiryFor(collection, ttl)
+	return db.putAt(collection, key, value, now, expiresAt)
+}
+
+// expiryFor returns the timestamp of a write to collection now and when it
+// expires with ttl, or the collection's default TTL if ttl is zero. Callers
+// must hold db.mu.
+func (db *DB) expiryFor(collection string, ttl time.Duration) (now, expiresAt int64) {
+	if ttl == 0 {
+		ttl = db.defaultTTL[collection]
+	}
+	now = db.now().UnixNano()
 	if ttl > 0 {
-		expiresAt = time.Now().Add(ttl).UnixNano()
+		expiresAt = now + int64(ttl)
 	}
+	return now, expiresAt
+}
 
-	// Richer AAD: Collection:Key + Timestamp
-	compKey := compositeKey(collection, key)
-	aad := make([]byte, len(compKey)+8)
-	copy(aad, compKey)
-	binary.BigEndian.PutUint64(aad[len(compKey):], uint64(now))
+// putAt writes value stamped with the timestamp now and expiring at
+// expiresAt, zero for never, which may already have passed. Callers must
+// hold db.mu.
+func (db *DB) putAt(collection, key string, value []byte, now, expiresAt int64) error {
+	return db.putValue(collection, key, value, now, expiresAt, true)
+}
+
+// putValue is putAt that attempts compression only if tryCompress is set.
+// Callers must hold db.mu.
+func (db *DB) putValue(collection, key string, value []byte, now, expiresAt int64, tryCompress bool) error {
+	if err := db.checkImmutable(collection, key); err != nil {
+		return err
+	}
+	if collection != metaCollection {
+		if err := db.storeDict(); err != nil {
+			return err
+		}
+	}
 
-	encryptedValue := db.aead.Seal(nil, nonce, finalValue, aad)
+	plain := len(value)
+	value, flags, err := db.transformValue(collection, key, value)
+	if err != nil {
+		return err
+	}
+	flags, nonce, storedValue, err := db.sealValue(collection, key, value, now, flags, tryCompress)
+	if err != nil {
+		return err
+	}
 
 	rec := &record{
 		Timestamp:  now,
@@ -306,359 +610,570 @@ func (db *DB) PutWithTTL(collection, key string, value []byte, ttl time.Duration
 		Flags:      flags,
 		Collection: []byte(collection),
 		Key:        []byte(key),
-		Value:      encryptedValue,
+		Value:      storedValue,
 		Nonce:      nonce,
-		Op:         OpPut,
+		Op:         valueOp(collection),
 	}
 
 	if err := db.writeRecord(rec); err != nil {
 		return err
 	}
-	
-	db.bloom.Add(compKey)
+	db.access(collection).countPut(plain, len(storedValue))
+	if collection != metaCollection {
+		db.storeCompression()
+	}
 	return nil
 }
 
-func (db *DB) Get(collection, key string) ([]byte, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// sealValue compresses and encrypts a value for storage, returning the record
+// flags, nonce and the bytes to be written. The flags start from flags, those
+// the caller knows about the value, such as FlagTransformed. Compression is
+// attempted if tryCompress is set and the collection is not paused as
+// incompressible. Callers must hold db.mu.
+func (db *DB) sealValue(collection, key string, value []byte, timestamp int64, flags byte, tryCompress bool) (byte, []byte, []byte, error) {
+	finalValue := value
 
-	compKey := compositeKey(collection, key)
-	if !db.bloom.Contains(compKey) {
-		return nil, ErrNotFound
+	// Compress if larger than the threshold (128 bytes by default)
+	if threshold := db.compressionThreshold(); tryCompress && threshold >= 0 && len(value) > threshold && db.shouldCompress(collection) {
+		id, dict := db.compressionDict(collection)
+		compressed, err := compress(value, dict)
+		if dict != nil {
+			compressed = append(binary.BigEndian.AppendUint32(nil, id), compressed...)
+		}
+		if err == nil && len(compressed) < len(value) {
+			finalValue = compressed
+			flags |= FlagCompressed
+			if dict != nil {
+				flags |= FlagDict
+			}
+		}
+		db.noteCompression(collection, flags&FlagCompressed != 0)
 	}
 
-	offset, ok := db.index[compKey]
-	if !ok {
-		return nil, ErrNotFound
+	if db.opts.ContentChecksums {
+		payload := make([]byte, contentSumSize, contentSumSize+len(finalValue))
+		binary.BigEndian.PutUint32(payload, crc32.ChecksumIEEE(value))
+		finalValue = append(payload, finalValue...)
+		flags |= FlagChecksum
+	}
+
+	if db.plaintext[collection] {
+		// Plaintext collections are protected by the record CRC only
+		return flags | FlagPlaintext, make([]byte, nonceSize), finalValue, nil
 	}
 
-	rec, _, err := db.readRecord(offset)
+	nonce, err := db.newNonce()
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
 
-	// Check Expiration
-	if rec.ExpiresAt > 0 && rec.ExpiresAt < time.Now().UnixNano() {
-		return nil, ErrNotFound
+	aead, keyFlag := db.writeCipher()
+	flags |= keyFlag | FlagBoundAAD
+
+	// Richer AAD: Collection:Key + Timestamp + Op + Flags
+	aad := recordAAD(compositeKey(collection, key), timestamp, valueOp(collection), flags)
+	return flags, nonce, aead.Seal(nil, nonce, finalValue, aad), nil
+}
+
+// sealTombstone authenticates a delete record by sealing an empty value, so
+// that a Put rewritten as a Delete fails verification. Deletes in plaintext
+// collections stay unsealed. Callers must hold db.mu.
+func (db *DB) sealTombstone(collection, key string, timestamp int64) (byte, []byte, []byte, error) {
+	if db.plaintext[collection] {
+		return FlagNone, make([]byte, nonceSize), nil, nil
 	}
 
-	// Reconstruct AAD with stored timestamp
-	aad := make([]byte, len(compKey)+8)
+	nonce, err := db.newNonce()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	aead, keyFlag := db.writeCipher()
+	flags := keyFlag | FlagBoundAAD
+	aad := recordAAD(compositeKey(collection, key), timestamp, OpDelete, flags)
+	return flags, nonce, aead.Seal(nil, nonce, nil, aad), nil
+}
+
+// recordAAD binds a sealed value to its key and timestamp. Records carrying
+// FlagBoundAAD also bind the op and flags bytes, which sit outside the
+// ciphertext and are otherwise protected by the CRC only.
+func recordAAD(compKey string, timestamp int64, op, flags byte) []byte {
+	size := len(compKey) + 8
+	if flags&FlagBoundAAD != 0 {
+		size += opSize + flagsSize
+	}
+	aad := make([]byte, size)
 	copy(aad, compKey)
-	binary.BigEndian.PutUint64(aad[len(compKey):], uint64(rec.Timestamp))
+	binary.BigEndian.PutUint64(aad[len(compKey):], uint64(timestamp))
+	if flags&FlagBoundAAD != 0 {
+		aad[size-2] = op
+		aad[size-1] = flags
+	}
+	return aad
+}
 
-	plaintext, err := db.aead.Open(nil, rec.Nonce, rec.Value, aad)
+func (db *DB) Get(collection, key string) ([]byte, error) {
+	access := db.access(collection)
+	compKey := compositeKey(collection, key)
+	if value, ok := db.getFast(compKey); ok {
+		access.countGet(len(value))
+		return value, nil
+	}
+	rec, err := db.getRecord(compKey)
+	access.countGet(len(rec.Value))
 	if err != nil {
-		return nil, ErrDecryption
+		return nil, err
 	}
+	return rec.Value, nil
+}
 
-	// Decompress if needed
-	if rec.Flags&FlagCompressed != 0 {
-		decompressed, err := decompress(plaintext)
-		if err != nil {
-			return nil, err
-		}
-		return decompressed, nil
+func (db *DB) getRecord(compKey string) (Record, error) {
+	rec, offset, reseal, err := db.readLive(compKey)
+	if err == ErrNotFound {
+		db.deleteExpired(compKey)
+	}
+	if err != nil {
+		return Record{}, err
 	}
 
-	return plaintext, nil
+	// Lazily migrate records still sealed under a DEK being rotated out.
+	// The read already succeeded, so a failed migration is left for Compact.
+	if reseal {
+		_ = db.resealRecord(compKey, offset)
+	}
+	return rec, nil
 }
 
-func (db *DB) List(collection string) ([]string, error) {
+// deleteExpired tombstones compKey if its current version has expired, for
+// Options.LazyExpireDelete. The read lock Get holds cannot be upgraded, so
+// Get calls this after releasing it. The option and the expiry are checked
+// under the read lock first, so that misses never take the write lock, and
+// again under the write lock, since a writer may have rewritten the key in
+// between. As with re-sealing, a frozen database is left alone rather than
+// making Get wait, and a failed tombstone is left for Compact.
+func (db *DB) deleteExpired(compKey string) {
 	db.mu.RLock()
-	defer db.mu.RUnlock()
+	due := db.opts.LazyExpireDelete && db.indexedExpired(compKey)
+	db.mu.RUnlock()
+	if !due {
+		return
+	}
 
-	var keys []string
-	prefix := collection + ":"
-	for k := range db.index {
-		if strings.HasPrefix(k, prefix) {
-			keys = append(keys, strings.TrimPrefix(k, prefix))
-		}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed || db.thaw != nil || !db.indexedExpired(compKey) {
+		return
 	}
-	return keys, nil
+	collection, key := SplitKey(compKey)
+	_ = db.delete(collection, key)
 }
 
-func (db *DB) ScanPrefix(prefix string) ([]Record, error) {
+// indexedExpired reports whether the index holds an expired version of
+// compKey. Callers must hold db.mu.
+func (db *DB) indexedExpired(compKey string) bool {
+	if !db.bloom.Contains(compKey) {
+		return false
+	}
+	entry, ok, err := db.index.get(compKey)
+	return err == nil && ok && entry.expired(db.now().UnixNano())
+}
+
+// readLive reads and decrypts the current version of a key, also returning
+// its offset and whether it should be re-sealed under a new DEK.
+func (db *DB) readLive(compKey string) (Record, int64, bool, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	limit := db.offset
-	results := make(map[string]Record)
-
-	secReader := io.NewSectionReader(db.file, int64(v4HeaderSize), limit-int64(v4HeaderSize))
-	bufReader := bufio.NewReaderSize(secReader, 128*1024)
-
-	buf := bufferPool.Get().([]byte)
-	defer bufferPool.Put(buf)
+	rec, offset, err := db.readRaw(compKey, db.now().UnixNano())
+	if err != nil {
+		return Record{}, 0, false, err
+	}
 
-	aadBuf := make([]byte, 0, 256)
-	decBuf := make([]byte, 0, 1024)
+	value, err := db.openUserValue(rec, compKey)
+	if err != nil {
+		return Record{}, 0, false, err
+	}
+	db.noteFastGet(compKey, offset, rec)
+
+	return Record{
+		Timestamp:  rec.Timestamp,
+		ExpiresAt:  rec.ExpiresAt,
+		Collection: string(rec.Collection),
+		Key:        string(rec.Key),
+		Value:      value,
+		Op:         rec.Op,
+	}, offset, db.needsReseal(rec.Flags), nil
+}
 
-	for {
-		header := buf[:recordHeaderSize]
-		_, err := io.ReadFull(bufReader, header)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
+// readRaw reads the current on-disk version of a key without opening its
+// value. The key counts as expired by the read timestamp now, which an
+// operation takes once from db.now so that all its reads agree. Callers must
+// hold db.mu.
+func (db *DB) readRaw(compKey string, now int64) (*record, int64, error) {
+	if !db.bloom.Contains(compKey) {
+		return nil, 0, ErrNotFound
+	}
 
-		timestamp, expiresAt, flags, collSize, keySize, valSize := decodeRecordHeader(header)
+	entry, ok, err := db.index.get(compKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
 
-		dataSize := opSize + collSize + keySize + nonceSize + valSize
-		totalSize := recordHeaderSize + dataSize
+	rec, _, err := db.readRecord(entry.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		var dataBuf []byte
-		if totalSize > len(buf) {
-			dataBuf = make([]byte, totalSize)
-			copy(dataBuf, header)
-		} else {
-			dataBuf = buf[:totalSize]
-		}
+	// Check Expiration
+	if rec.ExpiresAt > 0 && rec.ExpiresAt < now {
+		return nil, 0, ErrNotFound
+	}
+	return rec, entry.Offset, nil
+}
 
-		_, err = io.ReadFull(bufReader, dataBuf[recordHeaderSize:])
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
+// openValue decrypts and, if needed, decompresses the value of an on-disk record.
+func (db *DB) openValue(rec *record, compKey string) ([]byte, error) {
+	plaintext, err := db.decrypt(nil, rec, compKey)
+	if err != nil {
+		return nil, err
+	}
+	return db.decodeValue(rec.Flags, plaintext)
+}
 
-		// Verify CRC
-		storedCRC := binary.BigEndian.Uint32(dataBuf[:crcSize])
-		calculatedCRC := crc32.ChecksumIEEE(dataBuf[crcSize:])
-		if storedCRC != calculatedCRC {
-			return nil, ErrChecksumMismatch
+// decrypt opens the sealed payload of rec, appending it to dst. Records of
+// plaintext collections give back their payload itself.
+func (db *DB) decrypt(dst []byte, rec *record, compKey string) ([]byte, error) {
+	if rec.Flags&FlagPlaintext != 0 {
+		if !db.trustPlaintext(rec.Flags, string(rec.Collection)) {
+			return nil, ErrDecryption
 		}
+		return rec.Value, nil
+	}
+	aead := db.cipherFor(rec.Flags)
+	if aead == nil {
+		return nil, ErrDecryption
+	}
 
-		dataOffset := recordHeaderSize
-		op := dataBuf[dataOffset]
-		dataOffset++
-
-		recColl := dataBuf[dataOffset : dataOffset+collSize]
-		dataOffset += collSize
-
-		recKey := dataBuf[dataOffset : dataOffset+keySize]
-		dataOffset += keySize
+	// Reconstruct AAD with stored timestamp
+	plaintext, err := aead.Open(dst, rec.Nonce, rec.Value, recordAAD(compKey, rec.Timestamp, rec.Op, rec.Flags))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
 
-		fullKey := string(recColl) + ":" + string(recKey)
-		if !strings.HasPrefix(fullKey, prefix) {
-			continue
-		}
+// trustUnsealed reports whether a tombstone of collection without
+// FlagBoundAAD may be honored. A file that declares FeatureBoundAAD only
+// writes those in collections that are or were plaintext, which have a
+// plaintext setting; anywhere else one is a Put or sealed Delete with its op
+// or flags rewritten. Callers must hold db.mu.
+func (db *DB) trustUnsealed(collection string) (bool, error) {
+	if !db.hasFeature(FeatureBoundAAD) || db.plaintext == nil || db.plaintext[collection] {
+		return true, nil
+	}
+	_, ok, err := db.index.get(compositeKey(metaCollection, metaPlaintextPrefix+collection))
+	return ok, err
+}
 
-		if op == OpDelete {
-			delete(results, fullKey)
-			continue
+// verifySkipped authenticates a record whose skippable op is about to be
+// honored. Skipped whole, a Put rewritten to such an op would roll its key
+// back to the version before, so a sealed one must open under its op, and in
+// a file that declares FeatureBoundAAD every one must be sealed: later
+// versions seal the records they mean older builds to skip. Callers must
+// hold db.mu.
+func (db *DB) verifySkipped(rec *record) error {
+	if rec.Flags&FlagBoundAAD == 0 {
+		if db.header != nil && db.hasFeature(FeatureBoundAAD) {
+			return ErrDecryption
 		}
+		return nil
+	}
+	_, err := db.decrypt(nil, rec, compositeKey(string(rec.Collection), string(rec.Key)))
+	return err
+}
 
-		// Check Expiration
-		if expiresAt > 0 && expiresAt < time.Now().UnixNano() {
-			delete(results, fullKey) // Ensure expired key is removed if previously added
-			continue
+// checkUnsealed fails with ErrDecryption unless trustUnsealed accepts the
+// tombstones of each of collections, which a scan found unsealed. Scans run
+// before the collection settings are loaded, so Open checks them after.
+// Callers must hold db.mu.
+func (db *DB) checkUnsealed(collections map[string]bool) error {
+	for collection := range collections {
+		if ok, err := db.trustUnsealed(collection); err != nil {
+			return err
+		} else if !ok {
+			return ErrDecryption
 		}
+	}
+	return nil
+}
 
-		nonce := dataBuf[dataOffset : dataOffset+nonceSize]
-		dataOffset += nonceSize
-		val := dataBuf[dataOffset : dataOffset+valSize]
-
-		// Construct AAD
-		aadBuf = aadBuf[:0]
-		aadBuf = append(aadBuf, recColl...)
-		aadBuf = append(aadBuf, ':')
-		aadBuf = append(aadBuf, recKey...)
-		// Append Timestamp
-		tsBuf := make([]byte, 8)
-		binary.BigEndian.PutUint64(tsBuf, uint64(timestamp))
-		aadBuf = append(aadBuf, tsBuf...)
+// trustPlaintext reports whether a record flagged as plaintext may be read
+// without decryption. The flag is only genuine on unsealed records of a
+// plaintext collection; anywhere else it was set to bypass the AEAD.
+// Databases without collection settings, such as the key holder used by
+// VerifyBackup, only apply the first check. Callers must hold db.mu.
+func (db *DB) trustPlaintext(flags byte, collection string) bool {
+	if flags&FlagBoundAAD != 0 {
+		return false
+	}
+	return db.plaintext == nil || db.plaintext[collection]
+}
 
-		// Decrypt
-		var errOpen error
-		plaintext, errOpen := db.aead.Open(decBuf[:0], nonce, val, aadBuf)
-		if errOpen != nil {
-			return nil, ErrDecryption
+// decodeValue undoes the encoding sealValue applies before encryption: it
+// strips the content checksum, decompresses, and verifies the checksum
+// against the result.
+func (db *DB) decodeValue(flags byte, payload []byte) ([]byte, error) {
+	var sum uint32
+	if flags&FlagChecksum != 0 {
+		if len(payload) < contentSumSize {
+			return nil, ErrContentChecksum
 		}
-		decBuf = plaintext
+		sum = binary.BigEndian.Uint32(payload)
+		payload = payload[contentSumSize:]
+	}
 
-		// Decompress if needed
-		finalVal := plaintext
-		if flags&FlagCompressed != 0 {
-			decompressed, err := decompress(plaintext)
-			if err != nil {
+	value := payload
+	if flags&FlagCompressed != 0 {
+		var dict []byte
+		if flags&FlagDict != 0 {
+			var err error
+			if dict, payload, err = db.dictFor(payload); err != nil {
 				return nil, err
 			}
-			finalVal = decompressed
 		}
-
-		valCopy := make([]byte, len(finalVal))
-		copy(valCopy, finalVal)
-
-		results[fullKey] = Record{
-			Timestamp:  timestamp,
-			ExpiresAt:  expiresAt,
-			Collection: string(recColl),
-			Key:        string(recKey),
-			Value:      valCopy,
-			Op:         op,
+		decompressed, err := decompress(payload, dict)
+		if err != nil {
+			return nil, err
 		}
+		value = decompressed
 	}
 
-	final := make([]Record, 0, len(results))
-	for _, v := range results {
-		final = append(final, v)
+	if flags&FlagChecksum != 0 && crc32.ChecksumIEEE(value) != sum {
+		return nil, ErrContentChecksum
 	}
-
-	return final, nil
+	return value, nil
 }
 
-func (db *DB) FilterPrefix(prefix string, fn func(key string, value []byte) bool) ([][]byte, error) {
-	// Re-implementing for early exit and efficiency instead of calling ScanPrefix
+// List returns the live keys of collection. Expired keys are left out.
+func (db *DB) List(collection string) ([]string, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	limit := db.offset
-	results := make(map[string][]byte)
-
-	secReader := io.NewSectionReader(db.file, int64(v4HeaderSize), limit-int64(v4HeaderSize))
-	bufReader := bufio.NewReaderSize(secReader, 128*1024)
-
-	buf := bufferPool.Get().([]byte)
-	defer bufferPool.Put(buf)
-
-	aadBuf := make([]byte, 0, 256)
-	decBuf := make([]byte, 0, 1024)
-
-	for {
-		header := buf[:recordHeaderSize]
-		_, err := io.ReadFull(bufReader, header)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+	now := db.now().UnixNano()
+	var keys []string
+	prefix := collection + ":"
+	err := db.walkIndex(func() { keys = nil }, func(k string, e indexEntry) error {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			keys = append(keys, strings.TrimPrefix(k, prefix))
 		}
+		return nil
+	})
+	return keys, err
+}
 
-		timestamp, expiresAt, flags, collSize, keySize, valSize := decodeRecordHeader(header)
-
-		dataSize := opSize + collSize + keySize + nonceSize + valSize
-		totalSize := recordHeaderSize + dataSize
-
-		var dataBuf []byte
-		if totalSize > len(buf) {
-			dataBuf = make([]byte, totalSize)
-			copy(dataBuf, header)
-		} else {
-			dataBuf = buf[:totalSize]
-		}
+// IsEmpty reports whether collection has no live keys, the keys List would
+// return, without collecting them: the walk stops at the first one.
+func (db *DB) IsEmpty(collection string) (bool, error) {
+	_, found, err := db.AnyKeyWithPrefix(collection, "")
+	return !found, err
+}
 
-		_, err = io.ReadFull(bufReader, dataBuf[recordHeaderSize:])
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
+// AnyKeyWithPrefix returns a live key of collection starting with keyPrefix,
+// and whether there is one. Which key is returned when several match is
+// unspecified. The walk stops at the first match, and a prefix the prefix
+// filter rules out costs no walk at all. Expired keys are left out, as in
+// List.
+func (db *DB) AnyKeyWithPrefix(collection, keyPrefix string) (string, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-		// Verify CRC
-		storedCRC := binary.BigEndian.Uint32(dataBuf[:crcSize])
-		calculatedCRC := crc32.ChecksumIEEE(dataBuf[crcSize:])
-		if storedCRC != calculatedCRC {
-			return nil, ErrChecksumMismatch
+	prefix := collection + ":" + keyPrefix
+	if !db.mayMatchPrefix(prefix) {
+		return "", false, nil
+	}
+	now := db.now().UnixNano()
+	var key string
+	err := db.walkIndex(func() {}, func(k string, e indexEntry) error {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			key = k[len(collection)+1:]
+			return errStopEach
 		}
+		return nil
+	})
+	if err == errStopEach {
+		return key, true, nil
+	}
+	return "", false, err
+}
 
-		dataOffset := recordHeaderSize
-		op := dataBuf[dataOffset]
-		dataOffset++
-
-		recColl := dataBuf[dataOffset : dataOffset+collSize]
-		dataOffset += collSize
-
-		recKey := dataBuf[dataOffset : dataOffset+keySize]
-		dataOffset += keySize
-
-		fullKey := string(recColl) + ":" + string(recKey)
-		if !strings.HasPrefix(fullKey, prefix) {
-			continue
-		}
+// AllKeys returns the combined key (collection:key) of every live key, in
+// sorted order. Expired keys and internal collections are left out.
+func (db *DB) AllKeys() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-		if op == OpDelete {
-			delete(results, fullKey)
-			continue
+	now := db.now().UnixNano()
+	keys := make([]string, 0)
+	err := db.walkIndex(func() { keys = keys[:0] }, func(k string, e indexEntry) error {
+		collection, _ := SplitKey(k)
+		if !isInternalCollection(collection) && !e.expired(now) {
+			keys = append(keys, k)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
 
-		// Check Expiration
-		if expiresAt > 0 && expiresAt < time.Now().UnixNano() {
-			delete(results, fullKey)
-			continue
+// AllKeysFunc calls fn with each key AllKeys returns, in the same order,
+// until fn returns false. The keys are collected and sorted first, so fn runs
+// without the database lock held and may call back into the DB; keys it
+// writes are not visited.
+func (db *DB) AllKeysFunc(fn func(composite string) bool) error {
+	keys, err := db.AllKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !fn(k) {
+			break
 		}
+	}
+	return nil
+}
 
-		nonce := dataBuf[dataOffset : dataOffset+nonceSize]
-		dataOffset += nonceSize
-		val := dataBuf[dataOffset : dataOffset+valSize]
+// ScanPrefix returns the latest live version of every record whose combined
+// key (collection:key) starts with prefix, in key order.
+func (db *DB) ScanPrefix(prefix string) ([]Record, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if !db.mayMatchPrefix(prefix) {
+		return []Record{}, nil
+	}
+	return db.scanLive(prefixMatcher(prefix))
+}
 
-		// Construct AAD
-		aadBuf = aadBuf[:0]
-		aadBuf = append(aadBuf, recColl...)
-		aadBuf = append(aadBuf, ':')
-		aadBuf = append(aadBuf, recKey...)
-		tsBuf := make([]byte, 8)
-		binary.BigEndian.PutUint64(tsBuf, uint64(timestamp))
-		aadBuf = append(aadBuf, tsBuf...)
+// ScanPrefixMeta is ScanPrefix without the values: each record's CRC is
+// verified and its header decoded, but nothing is decrypted or
+// decompressed, and every Record has a nil Value. It is for finding which
+// keys exist, with their timestamps and expiry, where the file is trusted:
+// without the AEAD tag check, a record altered along with its CRC goes
+// unnoticed.
+func (db *DB) ScanPrefixMeta(prefix string) ([]Record, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if !db.mayMatchPrefix(prefix) {
+		return []Record{}, nil
+	}
+	return db.scanLiveRecords(prefixMatcher(prefix), db.now().UnixNano(), false)
+}
 
-		// Decrypt
-		var errOpen error
-		plaintext, errOpen := db.aead.Open(decBuf[:0], nonce, val, aadBuf)
-		if errOpen != nil {
-			return nil, ErrDecryption
-		}
-		decBuf = plaintext
+// FilterPrefix returns the values of records under prefix accepted by fn,
+// in key order.
+//
+// fn runs without the database lock held, so it may call back into the DB,
+// including writes. The log is scanned in chunks, each opened and passed to
+// fn before the next is read, so only the accepted values are kept; fn sees
+// the keys in log order, in chunks of about 1 MiB. A key that fn or any
+// other writer rewrites before the scan reaches it is returned in its new
+// version, and one rewritten after as it was. Keys created after the scan
+// began are left out, unless a Compact or Reindex restarts the scan
+// meanwhile: it then sees every key it has not visited yet in its latest
+// version.
+func (db *DB) FilterPrefix(prefix string, fn func(key string, value []byte) bool) ([][]byte, error) {
+	db.mu.RLock()
+	if !db.mayMatchPrefix(prefix) {
+		db.mu.RUnlock()
+		return [][]byte{}, nil
+	}
+	db.mu.RUnlock()
+	return db.filterLive(prefixMatcher(prefix), func(rec Record) bool {
+		return fn(compositeKey(rec.Collection, rec.Key), rec.Value)
+	})
+}
 
-		// Decompress if needed
-		finalVal := plaintext
-		if flags&FlagCompressed != 0 {
-			decompressed, err := decompress(plaintext)
-			if err != nil {
-				return nil, err
-			}
-			finalVal = decompressed
-		}
+// Filter returns the values of records in collection accepted by fn. As with
+// FilterPrefix, fn runs without the database lock held.
+func (db *DB) Filter(collection string, fn func(key string, value []byte) bool) ([][]byte, error) {
+	collBytes := []byte(collection)
 
-		if fn(fullKey, finalVal) {
-			valCopy := make([]byte, len(finalVal))
-			copy(valCopy, finalVal)
-			results[fullKey] = valCopy
-		} else {
-			delete(results, fullKey)
+	db.mu.RLock()
+	if !db.mayMatchPrefix(collection + ":") {
+		db.mu.RUnlock()
+		return [][]byte{}, nil
+	}
+	db.mu.RUnlock()
+	return db.filterLive(func(recColl, recKey []byte) bool {
+		return bytes.Equal(recColl, collBytes)
+	}, func(rec Record) bool {
+		return fn(rec.Key, rec.Value)
+	})
+}
+
+// filterLive returns the values of the live records accepted by match and
+// then by fn, sorted by combined key. See scanLiveFunc.
+func (db *DB) filterLive(match func(collection, key []byte) bool, fn func(rec Record) bool) ([][]byte, error) {
+	var accepted []Record
+	err := db.scanLiveFunc(match, func(rec Record) error {
+		if fn(rec) {
+			accepted = append(accepted, rec)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	sortRecords(accepted)
 
-	final := make([][]byte, 0, len(results))
-	for _, v := range results {
-		final = append(final, v)
+	final := make([][]byte, len(accepted))
+	for i, rec := range accepted {
+		final[i] = rec.Value
 	}
-
 	return final, nil
 }
 
-func (db *DB) Filter(collection string, fn func(key string, value []byte) bool) ([][]byte, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+func prefixMatcher(prefix string) func(collection, key []byte) bool {
+	return func(collection, key []byte) bool {
+		fullKey := string(collection) + ":" + string(key)
+		return strings.HasPrefix(fullKey, prefix) && !hiddenFromPrefix(string(collection), prefix)
+	}
+}
+
+// scanLive walks the log sequentially and returns the latest live version of
+// every record accepted by match, decrypted and sorted by combined key.
+// Callers must hold db.mu.
+func (db *DB) scanLive(match func(collection, key []byte) bool) ([]Record, error) {
+	return db.scanLiveAt(match, db.now().UnixNano())
+}
+
+// scanLiveAt is scanLive with expiry judged by the read timestamp now, one
+// for the whole scan. Callers must hold db.mu.
+func (db *DB) scanLiveAt(match func(collection, key []byte) bool, now int64) ([]Record, error) {
+	return db.scanLiveRecords(match, now, true)
+}
 
+// scanLiveRecords is scanLiveAt that, unless values is set, leaves values
+// unopened: records are checked against their CRC only and come back with
+// a nil Value. Callers must hold db.mu.
+func (db *DB) scanLiveRecords(match func(collection, key []byte) bool, now int64, values bool) ([]Record, error) {
 	limit := db.offset
-	results := make(map[string][]byte)
-	collBytes := []byte(collection)
+	results := make(map[string]Record)
 
-	secReader := io.NewSectionReader(db.file, int64(v4HeaderSize), limit-int64(v4HeaderSize))
+	secReader := io.NewSectionReader(db.file, int64(headerSize), limit-int64(headerSize))
 	bufReader := bufio.NewReaderSize(secReader, 128*1024)
 
 	buf := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buf)
 
-	// Reuse buffers for AAD and decryption
 	aadBuf := make([]byte, 0, 256)
 	decBuf := make([]byte, 0, 1024)
 
+	next := int64(headerSize)
 	for {
 		header := buf[:recordHeaderSize]
 		_, err := io.ReadFull(bufReader, header)
@@ -673,6 +1188,8 @@ func (db *DB) Filter(collection string, fn func(key string, value []byte) bool)
 
 		dataSize := opSize + collSize + keySize + nonceSize + valSize
 		totalSize := recordHeaderSize + dataSize
+		offset := next
+		next += int64(totalSize)
 
 		var dataBuf []byte
 		if totalSize > len(buf) {
@@ -697,30 +1214,62 @@ func (db *DB) Filter(collection string, fn func(key string, value []byte) bool)
 			return nil, ErrChecksumMismatch
 		}
 
-		// Extract fields
 		dataOffset := recordHeaderSize
 		op := dataBuf[dataOffset]
 		dataOffset++
+		if skip, err := checkOp(op, offset); err != nil {
+			return nil, err
+		} else if skip {
+			rec, err := parseRecord(dataBuf, offset)
+			if err == nil {
+				err = db.verifySkipped(rec)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 
 		recColl := dataBuf[dataOffset : dataOffset+collSize]
 		dataOffset += collSize
 
-		if !bytes.Equal(recColl, collBytes) {
-			continue
-		}
-
 		recKey := dataBuf[dataOffset : dataOffset+keySize]
 		dataOffset += keySize
-		keyStr := string(recKey)
 
-		if op == OpDelete {
-			delete(results, keyStr)
+		if !match(recColl, recKey) {
+			continue
+		}
+		fullKey := string(recColl) + ":" + string(recKey)
+
+		// Unsealed tombstones have nothing to verify but where they are
+		if op == OpDelete && flags&FlagBoundAAD == 0 {
+			if ok, err := db.trustUnsealed(string(recColl)); err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, ErrDecryption
+			}
+			delete(results, fullKey)
 			continue
 		}
 
 		// Check Expiration
-		if expiresAt > 0 && expiresAt < time.Now().UnixNano() {
-			delete(results, keyStr)
+		if expiresAt > 0 && expiresAt < now {
+			delete(results, fullKey) // Ensure expired key is removed if previously added
+			continue
+		}
+
+		if !values {
+			if op == OpDelete {
+				delete(results, fullKey)
+			} else {
+				results[fullKey] = Record{
+					Timestamp:  timestamp,
+					ExpiresAt:  expiresAt,
+					Collection: string(recColl),
+					Key:        string(recKey),
+					Op:         op,
+				}
+			}
 			continue
 		}
 
@@ -733,128 +1282,309 @@ func (db *DB) Filter(collection string, fn func(key string, value []byte) bool)
 		aadBuf = append(aadBuf, recColl...)
 		aadBuf = append(aadBuf, ':')
 		aadBuf = append(aadBuf, recKey...)
+		// Append Timestamp
 		tsBuf := make([]byte, 8)
 		binary.BigEndian.PutUint64(tsBuf, uint64(timestamp))
 		aadBuf = append(aadBuf, tsBuf...)
-
-		// Decrypt
-		var errOpen error
-		plaintext, errOpen := db.aead.Open(decBuf[:0], nonce, val, aadBuf)
-		if errOpen != nil {
-			return nil, ErrDecryption
+		if flags&FlagBoundAAD != 0 {
+			aadBuf = append(aadBuf, op, flags)
 		}
-		decBuf = plaintext
 
-		// Decompress if needed
-		finalVal := plaintext
-		if flags&FlagCompressed != 0 {
-			decompressed, err := decompress(plaintext)
-			if err != nil {
-				return nil, err
+		// Decrypt unless the record was stored in a plaintext collection
+		plaintext := val
+		if flags&FlagPlaintext != 0 {
+			if !db.trustPlaintext(flags, string(recColl)) {
+				return nil, ErrDecryption
+			}
+		} else {
+			aead := db.cipherFor(flags)
+			if aead == nil {
+				return nil, ErrDecryption
 			}
-			finalVal = decompressed
+			var errOpen error
+			plaintext, errOpen = aead.Open(decBuf[:0], nonce, val, aadBuf)
+			if errOpen != nil {
+				return nil, ErrDecryption
+			}
+			decBuf = plaintext
 		}
 
-		// Apply filter
-		if fn(keyStr, finalVal) {
-			valCopy := make([]byte, len(finalVal))
-			copy(valCopy, finalVal)
-			results[keyStr] = valCopy
-		} else {
-			delete(results, keyStr)
+		if op == OpDelete {
+			delete(results, fullKey)
+			continue
+		}
+
+		finalVal, err := db.decodeValue(flags, plaintext)
+		if err == nil {
+			finalVal, err = db.untransform(string(recColl), string(recKey), flags, finalVal)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		valCopy := make([]byte, len(finalVal))
+		copy(valCopy, finalVal)
+
+		results[fullKey] = Record{
+			Timestamp:  timestamp,
+			ExpiresAt:  expiresAt,
+			Collection: string(recColl),
+			Key:        string(recKey),
+			Value:      valCopy,
+			Op:         op,
 		}
 	}
 
-	final := make([][]byte, 0, len(results))
+	final := make([]Record, 0, len(results))
 	for _, v := range results {
 		final = append(final, v)
 	}
+	sortRecords(final)
 
 	return final, nil
 }
 
+// sortRecords sorts records by combined key.
+func sortRecords(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Collection != records[j].Collection {
+			return records[i].Collection < records[j].Collection
+		}
+		return records[i].Key < records[j].Key
+	})
+}
+
+
 func (db *DB) Delete(collection, key string) error {
-	db.mu.Lock()
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	return db.delete(collection, key)
+}
+
+// DeleteContext is Delete giving up with ctx.Err() if ctx ends while it
+// waits for the write lock, as PutContext does.
+func (db *DB) DeleteContext(ctx context.Context, collection, key string) error {
+	if err := db.lockWriteContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	return db.delete(collection, key)
+}
+
+// GetAndDelete returns the value of a key and deletes it in one step under
+// the write lock, for values consumed once such as one-time tokens: of
+// concurrent calls for a key, one gets the value and the others
+// ErrNotFound. An expired key is not found, and is tombstoned on the way.
+func (db *DB) GetAndDelete(collection, key string) ([]byte, error) {
+	if err := db.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer db.mu.Unlock()
+
+	compKey := compositeKey(collection, key)
+	rec, _, err := db.readRaw(compKey, db.now().UnixNano())
+	if err == ErrNotFound {
+		if err := db.delete(collection, key); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := db.openUserValue(rec, compKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.delete(collection, key); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// PutIfAbsent stores value under key unless the key holds an unexpired
+// value, and reports whether it did. ttl works as in PutWithTTL.
+func (db *DB) PutIfAbsent(collection, key string, value []byte, ttl time.Duration) (bool, error) {
+	if err := db.lockWrite(); err != nil {
+		return false, err
+	}
 	defer db.mu.Unlock()
 
+	entry, ok, err := db.index.get(compositeKey(collection, key))
+	if err != nil {
+		return false, err
+	}
+	if ok && !entry.expired(db.now().UnixNano()) {
+		return false, nil
+	}
+	if err := db.put(collection, key, value, ttl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// delete appends a tombstone for a key, if it has a version in the index.
+// Callers must hold db.mu.
+func (db *DB) delete(collection, key string) error {
+	if err := db.checkImmutable(collection, key); err != nil {
+		return err
+	}
 	idxKey := compositeKey(collection, key)
-	if _, ok := db.index[idxKey]; !ok {
-		return nil
+	if _, ok, err := db.index.get(idxKey); err != nil || !ok {
+		return err
+	}
+
+	now := db.now().UnixNano()
+	flags, nonce, tag, err := db.sealTombstone(collection, key, now)
+	if err != nil {
+		return err
 	}
 
 	rec := &record{
-		Timestamp:  time.Now().UnixNano(),
+		Timestamp:  now,
 		ExpiresAt:  0,
-		Flags:      FlagNone,
+		Flags:      flags,
 		Collection: []byte(collection),
 		Key:        []byte(key),
-		Value:      nil,
-		Nonce:      make([]byte, nonceSize),
+		Value:      tag,
+		Nonce:      nonce,
 		Op:         OpDelete,
 	}
 
 	if err := db.writeRecord(rec); err != nil {
 		return err
 	}
-
-	delete(db.index, idxKey)
+	db.access(collection).countDelete()
 	return nil
 }
 
+// writeRecord appends r to the log and indexes it. The record is in the file
+// before the index points at it and nothing is buffered in between, so a
+// read that follows a write sees it whether or not SyncWrites flushed it to
+// disk. Any write buffering must keep that read-your-writes guarantee.
 func (db *DB) writeRecord(r *record) error {
-	encoded, size := r.Encode()
-	if _, err := db.file.Write(encoded); err != nil {
+	if err := db.checkLease(); err != nil {
 		return err
 	}
 
-	if r.Op == OpPut {
-		db.index[compositeKey(string(r.Collection), string(r.Key))] = db.offset
+	if r.size() > maxRecordSize {
+		return ErrRecordTooLarge
+	}
+	encoded, size := r.Encode()
+	compKey := compositeKey(string(r.Collection), string(r.Key))
+	if err := db.appendLog(encoded, db.opts.SyncWrites, false); err != nil {
+		return err
 	}
 
+	replaced := db.applyRecord(compKey, r.Op, db.offset, int64(size), r.Timestamp, r.ExpiresAt)
+	db.countChurn(compKey, r.Op, int64(size), replaced)
+	db.lastWrite.Store(time.Now().UnixNano())
+
 	db.offset += int64(size)
+	db.wakeWatchers()
 	return nil
 }
 
+// appendLog writes data at db.offset, syncs it if sync is set, and copies it
+// to the mirror, syncing that if syncMirror is set. It leaves db.offset to
+// the caller. A step that fails, including the mirror write with
+// MirrorRequired, may leave a whole record or part of one past db.offset.
+// Those bytes are trimmed at once, or before the next append if that fails
+// too: left in place, they could come back after a crash, or a shorter
+// append could leave their rest behind as garbage that fails the next Open.
+// Callers must hold db.mu.
+func (db *DB) appendLog(data []byte, sync, syncMirror bool) error {
+	if db.dirtyTail {
+		if err := db.trimAllocation(); err != nil {
+			return err
+		}
+		db.dirtyTail = false
+	}
+	if err := db.ensureAllocated(db.offset + int64(len(data))); err != nil {
+		return err
+	}
+
+	_, err := db.file.WriteAt(data, db.offset)
+	if err == nil {
+		db.checkWritten(db.offset, data)
+		if sync {
+			err = db.file.Sync()
+		}
+	}
+	if err == nil {
+		err = db.mirrorWrite(data, db.offset, syncMirror)
+	}
+	if err != nil {
+		db.dirtyTail = db.trimAllocation() != nil
+	}
+	return err
+}
+
 func (db *DB) readRecord(offset int64) (*record, int64, error) {
+	return readRecordAt(db.file, offset)
+}
+
+// readRecordAt reads and CRC-checks the record at offset of any log image.
+func readRecordAt(r io.ReaderAt, offset int64) (*record, int64, error) {
 	headerBuf := make([]byte, recordHeaderSize)
-	if _, err := db.file.ReadAt(headerBuf, offset); err != nil {
+	if _, err := r.ReadAt(headerBuf, offset); err != nil {
 		return nil, 0, err
 	}
 
-	timestamp, expiresAt, flags, collSize, keySize, valSize := decodeRecordHeader(headerBuf)
+	_, _, _, collSize, keySize, valSize := decodeRecordHeader(headerBuf)
 
 	dataSize := opSize + collSize + keySize + nonceSize + valSize
 	totalSize := recordHeaderSize + dataSize
 
 	fullBuf := make([]byte, totalSize)
-	if _, err := db.file.ReadAt(fullBuf, offset); err != nil {
+	if _, err := r.ReadAt(fullBuf, offset); err != nil {
 		return nil, 0, err
 	}
+	rec, err := parseRecord(fullBuf, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rec, int64(totalSize), nil
+}
 
-	storedCRC := binary.BigEndian.Uint32(fullBuf[:crcSize])
-	calculatedCRC := crc32.ChecksumIEEE(fullBuf[crcSize:])
+// parseRecord CRC-checks and decodes the whole record in buf, read from
+// offset. The record's fields point into buf, capped so that appending to
+// one never overwrites the next.
+func parseRecord(buf []byte, offset int64) (*record, error) {
+	if len(buf) < recordHeaderSize {
+		return nil, ErrChecksumMismatch
+	}
+	timestamp, expiresAt, flags, collSize, keySize, valSize := decodeRecordHeader(buf)
+	if len(buf) != recordHeaderSize+opSize+collSize+keySize+nonceSize+valSize {
+		return nil, ErrChecksumMismatch
+	}
+
+	storedCRC := binary.BigEndian.Uint32(buf[:crcSize])
+	calculatedCRC := crc32.ChecksumIEEE(buf[crcSize:])
 	if storedCRC != calculatedCRC {
-		return nil, 0, ErrChecksumMismatch
+		return nil, ErrChecksumMismatch
 	}
 
 	dataOffset := recordHeaderSize
-	op := fullBuf[dataOffset]
+	op := buf[dataOffset]
 	dataOffset++
+	// Skippable records are returned for the caller to skip
+	if _, err := checkOp(op, offset); err != nil {
+		return nil, err
+	}
 
-	coll := make([]byte, collSize)
-	copy(coll, fullBuf[dataOffset:dataOffset+collSize])
+	coll := buf[dataOffset : dataOffset+collSize : dataOffset+collSize]
 	dataOffset += collSize
 
-	key := make([]byte, keySize)
-	copy(key, fullBuf[dataOffset:dataOffset+keySize])
+	key := buf[dataOffset : dataOffset+keySize : dataOffset+keySize]
 	dataOffset += keySize
 
-	nonce := make([]byte, nonceSize)
-	copy(nonce, fullBuf[dataOffset:dataOffset+nonceSize])
+	nonce := buf[dataOffset : dataOffset+nonceSize : dataOffset+nonceSize]
 	dataOffset += nonceSize
 
-	val := make([]byte, valSize)
-	copy(val, fullBuf[dataOffset:dataOffset+valSize])
+	val := buf[dataOffset : dataOffset+valSize]
 
 	return &record{
 		Timestamp:  timestamp,
@@ -865,53 +1595,239 @@ func (db *DB) readRecord(offset int64) (*record, int64, error) {
 		Value:      val,
 		Nonce:      nonce,
 		Op:         op,
-	}, int64(totalSize), nil
+	}, nil
+}
+
+// Offset returns the current append position: the end of the last committed
+// record. Everything before it is immutable until the next Compact.
+func (db *DB) Offset() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.offset
+}
+
+// FileSize returns the size of the database file on disk. It can exceed
+// Offset if a torn write was left behind by a crash.
+func (db *DB) FileSize() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	fi, err := db.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
 }
 
+// Close saves the hint and closes the file, waiting as long as that takes.
 func (db *DB) Close() error {
+	return db.CloseWithContext(context.Background())
+}
+
+// CloseWithContext is Close giving up with ctx.Err() if ctx ends before the
+// close finishes, so that a shutdown does not hang on a hint save or file
+// close stuck on a failing disk or network filesystem. The close goes on in
+// the background: the database stays closing, and every other call waits for
+// it as it would during Close, then fails on the closed file. Close and
+// CloseWithContext close the database once; a later call waits for that
+// close again and returns its result.
+func (db *DB) CloseWithContext(ctx context.Context) error {
+	db.closeOnce.Do(func() {
+		db.closeDone = make(chan struct{})
+		go func() {
+			db.closeErr = db.close()
+			close(db.closeDone)
+		}()
+	})
+	select {
+	case <-db.closeDone:
+		return db.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close persists the hint and closes the file.
+func (db *DB) close() error {
+	db.stopLease()
+	db.stopExpiry()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	_ = db.saveHint()
+
+	db.closed = true
+	// Writers held by a freeze and waiting subscriptions wake up to find
+	// the database closed
+	db.unfreeze(db.thaw)
+	db.wakeWatchers()
+	if db.hintTimer != nil {
+		db.hintTimer.Stop()
+		db.hintTimer = nil
+	}
+
+	// A writer that lost its lease must not publish a hint for a log it no longer owns
+	if db.checkLease() == nil {
+		_ = db.saveHint()
+		_ = db.trimAllocation()
+		db.releaseLease()
+	}
+	db.closeMirror()
+	db.index.close()
 	return db.file.Close()
 }
 
+// Compact rewrites the log with only the current version of each live key,
+// in key order after the database's settings, so the same data always
+// compacts to the same layout. Tombstones are dropped, except those
+// Options.TombstoneTTL keeps. The new file is written next to the database,
+// or in Options.TempDir, and renamed over it once the old file is erased;
+// on Unix the directory is synced after the rename. Compact fails with
+// ErrSnapshotOpen while a Snapshot is open.
 func (db *DB) Compact() error {
-	db.mu.Lock()
+	_, err := db.CompactWithResult()
+	return err
+}
+
+// CompactWithResult is Compact, also reporting what the compaction did.
+func (db *DB) CompactWithResult() (CompactionResult, error) {
+	var result CompactionResult
+	if err := db.compact(&result, nil); err != nil {
+		return CompactionResult{}, err
+	}
+	return result, nil
+}
+
+// CompactFunc is Compact that also drops every live record for which keep
+// returns false, as if it had been deleted, without writing a tombstone.
+// keep is called once per live key with its decrypted current version.
+// Keys of internal and immutable collections are always kept and not
+// passed to keep. keep runs with the database locked and must not call it.
+func (db *DB) CompactFunc(keep func(rec Record) bool) error {
+	var result CompactionResult
+	return db.compact(&result, keep)
+}
+
+// compact rewrites the log, dropping the live user records keep rejects if
+// keep is not nil.
+func (db *DB) compact(result *CompactionResult, keep func(rec Record) bool) error {
+	start := time.Now()
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
 	defer db.mu.Unlock()
 
-	tempPath := db.path + ".compact"
-	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err := db.checkLease(); err != nil {
+		return err
+	}
+	if err := db.checkPinned(nil); err != nil {
+		return err
+	}
+	// The compacted log holds at most the current versions
+	liveBytes := int64(headerSize)
+	for _, n := range db.live {
+		liveBytes += n
+	}
+	if err := db.checkCompactSpace(liveBytes); err != nil {
+		return err
+	}
+
+	records, err := countRecords(db.file, int64(headerSize), db.offset)
+	if err != nil {
+		return err
+	}
+	result.BytesBefore = db.offset
+
+	// With Options.TempDir the output is written there and staged at
+	// compactPath before the old file is erased, so a crash in between still
+	// leaves a copy where Open looks for it
+	compactPath, _, _ := auxFiles(db.path)
+	tempPath := compactPath
+	var tempFile storageFile
+	if db.opts.TempDir != "" {
+		var f *os.File
+		if f, err = os.CreateTemp(db.opts.TempDir, filepath.Base(db.path)+".compact-*"); err == nil {
+			tempFile = f
+		}
+	} else {
+		tempFile, err = openStorage(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	}
 	if err != nil {
 		return err
 	}
+	tempPath = tempFile.Name()
 	defer func() {
 		tempFile.Close()
 		os.Remove(tempPath)
+		os.Remove(compactPath)
 	}()
 
-	// Read original header (V4 size)
-	originalHeader := make([]byte, v4HeaderSize)
-	if _, err := db.file.ReadAt(originalHeader, 0); err != nil {
+	// Finishing a key rotation promotes the new DEK to the primary slot
+	header := *db.header
+	if db.nextAead != nil {
+		header.KEKNonce = header.NextKEKNonce
+		header.EncryptedDEK = header.NextEncryptedDEK
+		header.Rotating = false
+		header.NextKEKNonce = nil
+		header.NextEncryptedDEK = nil
+	}
+	// The compacted log is a new one for subscriptions; its Start is
+	// written once the live records are copied
+	header.Horizon = logHorizon{Epoch: header.LogEpoch, End: db.offset}
+	if header.LogEpoch, err = newLogEpoch(); err != nil {
 		return err
 	}
 
-	if _, err := tempFile.Write(originalHeader); err != nil {
+	if _, err := tempFile.Write(header.encode()); err != nil {
 		return err
 	}
 
-	newOffset := int64(v4HeaderSize)
-	newIndex := make(map[string]int64)
+	newOffset := int64(headerSize)
+	build := db.newIndexBuilder()
+	defer build.discard()
 
-	now := time.Now().UnixNano()
-	for keyStr, oldOffset := range db.index {
-		rec, _, err := db.readRecord(oldOffset)
+	now := db.now().UnixNano()
+	var expired []string // Dropped user keys to report to OnExpire hooks
+	copyRecord := func(keyStr string, entry indexEntry) error {
+		rec, _, err := db.readRecord(entry.Offset)
 		if err != nil {
-			continue
+			return nil
+		}
+
+		// Write-ahead log entries below the truncation mark are dropped
+		if db.walTruncated(keyStr) {
+			return nil
 		}
 
 		// Skip expired records during compaction
 		if rec.ExpiresAt > 0 && rec.ExpiresAt < now {
-			continue
+			result.ExpiredRecords++
+			if db.expiry != nil && !isInternalCollection(string(rec.Collection)) {
+				expired = append(expired, keyStr)
+			}
+			return nil
+		}
+
+		collection := string(rec.Collection)
+		if keep != nil && !isInternalCollection(collection) && !db.immutable[collection] {
+			value, err := db.openUserValue(rec, keyStr)
+			if err != nil {
+				return err
+			}
+			if !keep(Record{
+				Timestamp:  rec.Timestamp,
+				ExpiresAt:  rec.ExpiresAt,
+				Collection: collection,
+				Key:        string(rec.Key),
+				Value:      value,
+				Op:         rec.Op,
+			}) {
+				return nil
+			}
+		}
+
+		if db.nextAead != nil {
+			if rec, err = db.rekeyForCompaction(rec); err != nil {
+				return err
+			}
 		}
 
 		encoded, size := rec.Encode()
@@ -919,14 +1835,100 @@ func (db *DB) Compact() error {
 			return err
 		}
 
-		newIndex[keyStr] = newOffset
+		entry.Offset = newOffset
+		entry.Size = int64(size)
 		newOffset += int64(size)
+		result.LiveRecords++
+		return build.add(keyStr, entry, false)
+	}
+
+	// Settings go first so a reader of the new log, such as VerifyBackup,
+	// has the compression dictionaries before the values that need them.
+	// Records are written in key order, so the compacted log is the same
+	// for the same data and keys near each other are read together.
+	metaPrefix := metaCollection + ":"
+	err = db.index.eachSorted(func(keyStr string, entry indexEntry) error {
+		if !strings.HasPrefix(keyStr, metaPrefix) {
+			return nil
+		}
+		return copyRecord(keyStr, entry)
+	})
+	if err == nil {
+		err = db.index.eachSorted(func(keyStr string, entry indexEntry) error {
+			if strings.HasPrefix(keyStr, metaPrefix) {
+				return nil
+			}
+			return copyRecord(keyStr, entry)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Recent tombstones follow, in log order, so that the deletes they
+	// record outlive the compaction
+	kept := make(map[string]int64) // Tombstone bytes per collection
+	if ttl := db.opts.TombstoneTTL; ttl > 0 {
+		offsets, err := db.recentTombstones(now - int64(ttl))
+		if err != nil {
+			return err
+		}
+		for _, offset := range offsets {
+			rec, _, err := db.readRecord(offset)
+			if err != nil {
+				return err
+			}
+			if db.nextAead != nil {
+				if rec, err = db.rekeyForCompaction(rec); err != nil {
+					return err
+				}
+			}
+			encoded, size := rec.Encode()
+			if _, err := tempFile.Write(encoded); err != nil {
+				return err
+			}
+			newOffset += int64(size)
+			kept[string(rec.Collection)] += int64(size)
+			result.KeptTombstones++
+		}
+	}
+	if db.nextAead != nil {
+		// Rekeying may have reserved counter nonces since the header was
+		// written, and the seal must be under the DEK being promoted
+		header.NoncePrefix, header.NonceLimit = db.header.NoncePrefix, db.header.NonceLimit
+		if err := header.sealNonces(db.nextAead); err != nil {
+			return err
+		}
+		if _, err := tempFile.WriteAt(header.encodeNonceSpan(), int64(extNonceOffset)); err != nil {
+			return err
+		}
+	}
+	header.Horizon.Start = newOffset
+	if _, err := tempFile.WriteAt(header.encodeLog(), int64(extLogOffset)); err != nil {
+		return err
+	}
+	result.DroppedRecords = records - result.LiveRecords - result.KeptTombstones
+	result.BytesAfter = newOffset
+	newIndex, err := build.finish()
+	if err != nil {
+		return err
 	}
+	installed := false
+	defer func() {
+		if !installed {
+			newIndex.close()
+		}
+	}()
 
 	if err := tempFile.Sync(); err != nil {
 		return err
 	}
 	tempFile.Close()
+	if tempPath != compactPath {
+		if err := moveFile(tempPath, compactPath); err != nil {
+			return err
+		}
+	}
 	db.file.Close()
 
 	// Secure Erase old file before Rename?
@@ -941,25 +1943,53 @@ func (db *DB) Compact() error {
 	// BUT `Rename` on Windows/Linux replaces the pointer. The old blocks are freed.
 	// To secure erase the *old* blocks, we must open `db.path`, overwrite, close, then Rename `tempPath` to `db.path`.
 	
-	// Secure Erase Logic:
-	if err := secureDelete(db.path); err != nil {
+	// Secure Erase Logic: the file stays in place until the rename, so an
+	// Open racing it finds an erased file, never a missing one it would
+	// create a new database in
+	if err := secureErase(db.path); err != nil {
 		// Log error?
 	}
 
-	if err := os.Rename(tempPath, db.path); err != nil {
+	if err := replaceFile(compactPath, db.path); err != nil {
 		return err
 	}
 
 	// Remove hint file as offsets have changed
 	_ = os.Remove(db.path + ".hint")
 
-	db.file, err = os.OpenFile(db.path, os.O_APPEND|os.O_RDWR, 0644)
+	db.file, err = openStorage(db.path, os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
 
 	db.offset = newOffset
+	db.allocated = newOffset
+	db.index.close()
 	db.index = newIndex
+	db.indexGen++
+	db.fastGets.Clear()
+	db.noteExpired(expired)
+	installed = true
+	db.dead = kept
+	if err := db.recountLive(); err != nil {
+		return err
+	}
+	if err := db.resizeBloom(); err != nil {
+		return err
+	}
 
+	if db.nextAead != nil {
+		db.aead = db.nextAead
+		db.nextAead = nil
+	}
+	db.header = &header
+	db.wakeWatchers()
+
+	// The mirror must twin the compacted file, not the old one
+	if err := db.resetMirror(); err != nil {
+		return err
+	}
+	result.Duration = time.Since(start)
+	db.lastCompaction = *result
 	return nil
 }
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func BenchmarkPut(b *testing.B) {
@@ -67,3 +69,310 @@ func BenchmarkGet(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkDecrypt10k(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{{"Single", 1}, {"Parallel", 0}} {
+		b.Run(bc.name, func(b *testing.B) {
+			file, err := os.CreateTemp("", "nokhal_bench_decrypt_*.nok")
+			if err != nil {
+				b.Fatal(err)
+			}
+			path := file.Name()
+			file.Close()
+			defer os.Remove(path)
+			defer os.Remove(path + ".hint")
+
+			db, err := OpenWithOptions(path, "bench_pass", Options{DecryptWorkers: bc.workers})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			val := make([]byte, 1024)
+			io.ReadFull(rand.Reader, val)
+
+			batch := db.NewBatch()
+			keys := make([]string, 10000)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key_%05d", i)
+				batch.Put("col", keys[i], val, 0)
+			}
+			if err := batch.Commit(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetMulti("col", keys); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPutPreallocate reports how often appends have to grow the file,
+// each of which is a metadata update and a chance for a new extent.
+func BenchmarkPutPreallocate(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		chunk int64
+	}{{"Off", 0}, {"1MiB", 1 << 20}} {
+		b.Run(bc.name, func(b *testing.B) {
+			file, err := os.CreateTemp("", "nokhal_bench_prealloc_*.nok")
+			if err != nil {
+				b.Fatal(err)
+			}
+			path := file.Name()
+			file.Close()
+			defer os.Remove(path)
+			defer os.Remove(path + ".hint")
+
+			db, err := OpenWithOptions(path, "bench_pass", Options{PreallocateBytes: bc.chunk})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			val := make([]byte, 100)
+			io.ReadFull(rand.Reader, val)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Put("col", fmt.Sprintf("key_%d", i), val); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(db.extensions)/float64(b.N), "extends/op")
+		})
+	}
+}
+
+// BenchmarkScanPrefixMeta compares a scan that opens every value with one
+// that only checks CRCs and decodes headers.
+func BenchmarkScanPrefixMeta(b *testing.B) {
+	file, err := os.CreateTemp("", "nokhal_bench_scan_*.nok")
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "bench_pass")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	val := make([]byte, 1024)
+	io.ReadFull(rand.Reader, val)
+	batch := db.NewBatch()
+	for i := range 10000 {
+		batch.Put("col", fmt.Sprintf("key_%05d", i), val, 0)
+	}
+	if err := batch.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		scan func(prefix string) ([]Record, error)
+	}{{"Values", db.ScanPrefix}, {"Meta", db.ScanPrefixMeta}, {"Func", func(prefix string) ([]Record, error) {
+		return nil, db.ScanPrefixFunc(prefix, func(rec *Record) error { return nil })
+	}}} {
+		b.Run(bc.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := bc.scan("col:"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPutIncompressible writes 10k random values, as JPEG data is to
+// the compressor. Adaptive pauses compression after a warm-up and should
+// come close to Disabled, which never attempts it.
+func BenchmarkPutIncompressible(b *testing.B) {
+	values := make([][]byte, 10000)
+	for i := range values {
+		values[i] = make([]byte, 2048)
+		io.ReadFull(rand.Reader, values[i])
+	}
+	for _, bc := range []struct {
+		name string
+		opts PutOptions
+	}{{"Adaptive", PutOptions{}}, {"Disabled", PutOptions{DisableCompression: true}}} {
+		b.Run(bc.name, func(b *testing.B) {
+			file, err := os.CreateTemp("", "nokhal_bench_incompressible_*.nok")
+			if err != nil {
+				b.Fatal(err)
+			}
+			path := file.Name()
+			file.Close()
+			defer os.Remove(path)
+			defer os.Remove(path + ".hint")
+
+			db, err := Open(path, "bench_pass")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.SetBytes(int64(len(values) * len(values[0])))
+			for b.Loop() {
+				for i, v := range values {
+					if err := db.PutWithOptions("images", fmt.Sprintf("img_%05d", i), v, bc.opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkOpenIndexLoad opens a 200k-record file without its hint, scanning
+// the log sequentially and with 8 workers.
+func BenchmarkOpenIndexLoad(b *testing.B) {
+	file, err := os.CreateTemp("", "nokhal_bench_open_*.nok")
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+	defer os.Remove(path + ".hint")
+
+	// A cheap key derivation keeps the KDF out of the open time
+	kdf := KDFParams{Memory: 8 * 1024, Parallelism: 1}
+	db, err := OpenWithOptions(path, "bench_pass", Options{KDF: kdf})
+	if err != nil {
+		b.Fatal(err)
+	}
+	val := make([]byte, 200)
+	io.ReadFull(rand.Reader, val)
+	for chunk := range 20 {
+		batch := db.NewBatch()
+		for i := range 10000 {
+			batch.Put("col", fmt.Sprintf("key_%06d", chunk*10000+i), val, 0)
+		}
+		if err := batch.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.Close()
+
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{{"Sequential", 0}, {"Parallel", 8}} {
+		b.Run(bc.name, func(b *testing.B) {
+			for b.Loop() {
+				b.StopTimer()
+				os.Remove(path + ".hint")
+				b.StartTimer()
+				db, err := OpenWithOptions(path, "bench_pass", Options{IndexLoadWorkers: bc.workers})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkOpenMappedHint opens a 1M-key database from a gob hint and from a
+// mapped one.
+func BenchmarkOpenMappedHint(b *testing.B) {
+	file, err := os.CreateTemp("", "nokhal_bench_hint_*.nok")
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+	defer os.Remove(path + ".hint")
+
+	kdf := KDFParams{Memory: 8 * 1024, Parallelism: 1}
+	db, err := OpenWithOptions(path, "bench_pass", Options{KDF: kdf})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for chunk := range 100 {
+		batch := db.NewBatch()
+		for i := range 10000 {
+			batch.Put("col", fmt.Sprintf("key_%07d", chunk*10000+i), []byte("value"), 0)
+		}
+		if err := batch.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.Close()
+
+	for _, bc := range []struct {
+		name   string
+		mapped bool
+	}{{"Gob", false}, {"Mapped", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			opts := Options{MmapHint: bc.mapped}
+			// Closing writes the hint in the format to open from
+			db, err := OpenWithOptions(path, "bench_pass", opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			db.Close()
+			for b.Loop() {
+				db, err := OpenWithOptions(path, "bench_pass", opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkAccessStats times resolving and updating the access counters of
+// a collection, the work Get and Put add to count themselves, and reports
+// it as a share of a Get and a Put, which should stay under 1%.
+func BenchmarkAccessStats(b *testing.B) {
+	db, err := OpenWithOptions(filepath.Join(b.TempDir(), "db.nok"), "bench_pass", Options{KDF: KDFParams{Memory: 64, Parallelism: 1}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	val := make([]byte, 100)
+	io.ReadFull(rand.Reader, val)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		db.Put("col", keys[i], val)
+	}
+	perOp := func(n int, op func(i int)) float64 {
+		start := time.Now()
+		for i := range n {
+			op(i)
+		}
+		return float64(time.Since(start)) / float64(n)
+	}
+	get := perOp(20000, func(i int) { db.Get("col", keys[i%len(keys)]) })
+	put := perOp(2000, func(i int) { db.Put("col", keys[i%len(keys)], val) })
+
+	b.ResetTimer()
+	for b.Loop() {
+		db.access("col").countGet(len(val))
+	}
+	count := float64(b.Elapsed()) / float64(b.N)
+	b.ReportMetric(100*count/get, "%get")
+	b.ReportMetric(100*count/put, "%put")
+}
@@ -2,9 +2,19 @@ package database
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func tempFile() (string, func()) {
@@ -21,6 +31,38 @@ func tempFile() (string, func()) {
 	return path, cleanup
 }
 
+// testClock is a manually advanced clock for Options.Now, so TTL tests
+// reach expiry without sleeping.
+type testClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	tick time.Duration // Added to now after every read
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.tick)
+	return now
+}
+
+func (c *testClock) Set(now time.Time, tick time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now, c.tick = now, tick
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func TestPutGet(t *testing.T) {
 	path, cleanup := tempFile()
 	defer cleanup()
@@ -229,6 +271,90 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestIsEmpty(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.Put("users", "alice", []byte("v"))
+	db.Put("users", "bob", []byte("v"))
+	db.Put("gone", "k", []byte("v"))
+	db.Delete("gone", "k")
+	db.PutWithTTL("expired", "k", []byte("v"), time.Millisecond)
+	db.Append("lists", "k", []byte("list entries live in an internal collection"))
+	clock.Advance(time.Second)
+
+	for col, want := range map[string]bool{"users": false, "none": true, "gone": true, "expired": true, "lists": true, "user": true} {
+		if empty, err := db.IsEmpty(col); err != nil || empty != want {
+			t.Errorf("IsEmpty(%q) = %v, %v; want %v", col, empty, err, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		col, prefix string
+		want        []string
+	}{
+		{"users", "", []string{"alice", "bob"}},
+		{"users", "b", []string{"bob"}},
+		{"users", "bob", []string{"bob"}},
+		{"users", "bobby", nil},
+		{"users", "c", nil},
+		{"expired", "", nil},
+		{"use", "rs:alice", nil},
+	} {
+		key, ok, err := db.AnyKeyWithPrefix(tc.col, tc.prefix)
+		if err != nil || ok != (tc.want != nil) || ok && !slices.Contains(tc.want, key) {
+			t.Errorf("AnyKeyWithPrefix(%q, %q) = %q, %v, %v; want one of %v", tc.col, tc.prefix, key, ok, err, tc.want)
+		}
+	}
+}
+
+func TestAllKeys(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.Put("users", "bob", []byte("v"))
+	db.Put("users", "alice", []byte("v"))
+	db.Put("orders", "2", []byte("v"))
+	db.Put("orders", "1", []byte("v"))
+	db.Put("logs", "gone", []byte("v"))
+	db.Delete("logs", "gone")
+	db.PutWithTTL("logs", "expired", []byte("v"), time.Millisecond)
+	db.Append("users", "alice", []byte("list entries live in an internal collection"))
+	clock.Advance(time.Second)
+
+	want := []string{"orders:1", "orders:2", "users:alice", "users:bob"}
+	keys, err := db.AllKeys()
+	if err != nil {
+		t.Fatalf("AllKeys failed: %v", err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("AllKeys = %v, want %v", keys, want)
+	}
+
+	var visited []string
+	err = db.AllKeysFunc(func(k string) bool {
+		visited = append(visited, k)
+		return len(visited) < 3
+	})
+	if err != nil || !reflect.DeepEqual(visited, want[:3]) {
+		t.Errorf("AllKeysFunc visited %v, %v; want %v", visited, err, want[:3])
+	}
+}
+
 func TestFilter(t *testing.T) {
 	path, cleanup := tempFile()
 	defer cleanup()
@@ -284,4 +410,412 @@ func TestFilter(t *testing.T) {
 	if len(results) != 0 {
 		t.Errorf("Expected 0 results for '35' after delete, got %d", len(results))
 	}
-}
\ No newline at end of file
+}
+
+func TestTruncatedHeader(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+
+	// Build a valid header to truncate
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	db.Close()
+	os.Remove(path + ".hint")
+	full, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{1, len(magicHeader), headerSize - 1} {
+		if err := os.WriteFile(path, full[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(path, "pass"); err != ErrInvalidFile {
+			t.Errorf("Size %d: expected ErrInvalidFile, got %v", size, err)
+		}
+	}
+
+	// ForceReinit turns the truncated file into an empty database
+	db, err = OpenWithOptions(path, "pass", Options{ForceReinit: true})
+	if err != nil {
+		t.Fatalf("ForceReinit failed: %v", err)
+	}
+	defer db.Close()
+	defer os.Remove(path + ".hint")
+	if err := db.Put("col", "k", []byte("v")); err != nil {
+		t.Fatalf("Put after reinit failed: %v", err)
+	}
+}
+
+func TestReindexCorruptHint(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for _, k := range keys {
+		if err := db.Put("col", k, []byte("val-"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Corrupt the hint on disk and drop a key from the in-memory index
+	if err := os.WriteFile(path+".hint", []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db.index.remove(compositeKey("col", "c"))
+
+	if err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		val, err := db.Get("col", k)
+		if err != nil || string(val) != "val-"+k {
+			t.Errorf("Get %s after Reindex: %q, %v", k, val, err)
+		}
+	}
+
+	// The fresh hint must load and match the rebuilt state
+	probe := &DB{path: path, file: db.file, header: db.header, aead: db.aead}
+	offset, err := probe.loadHint()
+	if err != nil {
+		t.Fatalf("Hint written by Reindex is invalid: %v", err)
+	}
+	if offset != db.offset || len(probe.index.(mapIndex)) != len(keys) {
+		t.Errorf("Hint mismatch: offset %d (want %d), %d keys", offset, db.offset, len(probe.index.(mapIndex)))
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+
+	buf := make([]byte, headerSize)
+	copy(buf, magicHeader)
+	buf[len(magicHeader)] = 3
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Open(path, "pass")
+	var verErr *ErrUnsupportedVersion
+	if !errors.As(err, &verErr) {
+		t.Fatalf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+	if verErr.Found != 3 || verErr.Expected != version {
+		t.Errorf("Unexpected versions: %+v", verErr)
+	}
+	if err.Error() != "unsupported version: 3 (expected 5)" {
+		t.Errorf("Unexpected message: %q", err.Error())
+	}
+}
+
+func TestOffsetAdvances(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	before := db.Offset()
+	if before != headerSize {
+		t.Errorf("Expected empty database to end at %d, got %d", headerSize, before)
+	}
+
+	value := []byte("small value")
+	if err := db.Put("col", "key", value); err != nil {
+		t.Fatal(err)
+	}
+	want := int64(recordHeaderSize + opSize + len("col") + len("key") + nonceSize + len(value) + authTagSize)
+	if got := db.Offset() - before; got != want {
+		t.Errorf("Offset advanced by %d, expected %d", got, want)
+	}
+
+	size, err := db.FileSize()
+	if err != nil || size != db.Offset() {
+		t.Errorf("FileSize = %d, %v; expected %d", size, err, db.Offset())
+	}
+}
+
+func TestFlushHintCoalesced(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	interval := 100 * time.Millisecond
+	db, err := OpenWithOptions(path, "pass", Options{HintFlushInterval: interval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		if err := db.Put("col", fmt.Sprintf("k%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.FlushHint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// Wait for the trailing deferred flush
+	time.Sleep(2 * interval)
+
+	db.mu.RLock()
+	writes := db.hintWrites
+	db.mu.RUnlock()
+	if limit := 2 + int(elapsed/interval); writes > limit {
+		t.Errorf("200 FlushHint calls wrote %d hints, expected at most %d", writes, limit)
+	}
+
+	// The deferred flush captured the latest state
+	probe := &DB{path: path, file: db.file, header: db.header, aead: db.aead}
+	offset, err := probe.loadHint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != db.Offset() || len(probe.index.(mapIndex)) != 200 {
+		t.Errorf("Hint is stale: offset %d (want %d), %d keys", offset, db.Offset(), len(probe.index.(mapIndex)))
+	}
+	if _, err := os.Stat(path + ".hint.tmp"); !os.IsNotExist(err) {
+		t.Error("Temporary hint file left behind")
+	}
+}
+
+// indexed returns the index entry of a composite key.
+func indexed(t *testing.T, db *DB, compKey string) indexEntry {
+	t.Helper()
+	e, _, err := db.index.get(compKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// tamperRecord rewrites one byte of the record at offset and recomputes its
+// CRC, as an attacker with write access to the file could.
+func tamperRecord(t *testing.T, db *DB, offset int64, pos int, mutate func(byte) byte) {
+	t.Helper()
+	_, size, err := db.readRecord(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	if _, err := db.file.ReadAt(buf, offset); err != nil {
+		t.Fatal(err)
+	}
+	buf[pos] = mutate(buf[pos])
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[crcSize:]))
+	if _, err := db.file.WriteAt(buf, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTamperedOpAndFlags(t *testing.T) {
+	const (
+		opPos    = recordHeaderSize
+		flagsPos = crcSize + timestampSize + expiresAtSize
+	)
+	cases := []struct {
+		name   string
+		pos    int
+		mutate func(byte) byte
+		delete bool // Tamper with a tombstone instead of a put
+		clear  bool // Also clear the flags, making it look unsealed
+	}{
+		{"PutToDelete", opPos, func(byte) byte { return OpDelete }, false, false},
+		{"PutToDeleteClearFlags", opPos, func(byte) byte { return OpDelete }, false, true},
+		{"PutToSkippable", opPos, func(byte) byte { return opSkippable | 0x01 }, false, false},
+		{"PutToSkippableClearFlags", opPos, func(byte) byte { return opSkippable | 0x01 }, false, true},
+		{"DeleteToPut", opPos, func(byte) byte { return OpPut }, true, false},
+		{"ClearCompressed", flagsPos, func(b byte) byte { return b &^ FlagCompressed }, false, false},
+		{"SetPlaintext", flagsPos, func(b byte) byte { return b | FlagPlaintext }, false, false},
+		{"ClearBoundAAD", flagsPos, func(b byte) byte { return b &^ FlagBoundAAD }, false, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tamper.nok")
+			db, err := Open(path, "pass")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("col", "other", []byte("untouched")); err != nil {
+				t.Fatal(err)
+			}
+			offset := db.offset
+			if err := db.Put("col", "key", bytes.Repeat([]byte("compressible "), 20)); err != nil {
+				t.Fatal(err)
+			}
+			if tc.delete {
+				offset = db.offset
+				if err := db.Delete("col", "key"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tamperRecord(t, db, offset, tc.pos, tc.mutate)
+			if tc.clear {
+				tamperRecord(t, db, offset, flagsPos, func(byte) byte { return FlagNone })
+			}
+
+			if !tc.delete {
+				if _, err := db.Get("col", "key"); err != ErrDecryption {
+					t.Errorf("Get: expected ErrDecryption, got %v", err)
+				}
+				if _, err := db.ScanPrefix("col:"); err != ErrDecryption {
+					t.Errorf("ScanPrefix: expected ErrDecryption, got %v", err)
+				}
+			}
+			db.Close()
+
+			// A full scan must not accept the tampered record either
+			os.Remove(path + ".hint")
+			db, err = Open(path, "pass")
+			if err == nil {
+				_, err = db.Get("col", "key")
+				db.Close()
+			}
+			if err != ErrDecryption {
+				t.Errorf("After reopen: expected ErrDecryption, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUnsealedTombstonesOfPlaintextCollections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "was" stops being plaintext once its keys are deleted, leaving its
+	// unsealed tombstones behind
+	for _, c := range []string{"plain", "was"} {
+		if err := db.SetCollectionPlaintext(c, true); err != nil {
+			t.Fatal(err)
+		}
+		db.Put(c, "key", []byte("value"))
+		if err := db.Delete(c, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetCollectionPlaintext("was", false); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("was", "other", []byte("sealed"))
+	db.Close()
+
+	os.Remove(path + ".hint")
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatalf("Open with unsealed tombstones of plaintext collections: %v", err)
+	}
+	defer db.Close()
+	if err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"plain", "was"} {
+		if _, err := db.Get(c, "key"); err != ErrNotFound {
+			t.Errorf("Get %s:key = %v, want ErrNotFound", c, err)
+		}
+	}
+	if v, err := db.Get("was", "other"); err != nil || string(v) != "sealed" {
+		t.Errorf("Get was:other = %q, %v", v, err)
+	}
+	if records, err := db.ScanPrefix("plain:"); err != nil || len(records) != 0 {
+		t.Errorf("ScanPrefix = %v, %v", records, err)
+	}
+}
+
+// stuckFile is a data file whose Close hangs until release is closed, like
+// one on an unreachable network filesystem.
+type stuckFile struct {
+	storageFile
+	release chan struct{}
+}
+
+func (f stuckFile) Close() error {
+	<-f.release
+	return f.storageFile.Close()
+}
+
+func TestCloseWithContext(t *testing.T) {
+	release := make(chan struct{})
+	open := openStorage
+	openStorage = func(name string, flag int, perm os.FileMode) (storageFile, error) {
+		f, err := open(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return stuckFile{f, release}, nil
+	}
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	openStorage = open
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "key", []byte("value"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.CloseWithContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("CloseWithContext on a stuck file: %v", err)
+	}
+
+	// Still closing: calls wait for the close, and so does a second close
+	got := make(chan error, 1)
+	go func() {
+		_, err := db.Get("col", "key")
+		got <- err
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.CloseWithContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("second CloseWithContext: %v", err)
+	}
+	select {
+	case err := <-got:
+		t.Fatalf("Get returned %v while the database was closing", err)
+	default:
+	}
+
+	close(release)
+	if err := db.Close(); err != nil {
+		t.Errorf("Close after the file came unstuck: %v", err)
+	}
+	if err := <-got; err == nil {
+		t.Error("Get succeeded on a closed database")
+	}
+
+	db, report, err := OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !report.HintUsed {
+		t.Error("hint saved by the interrupted close not used")
+	}
+	if v, err := db.Get("col", "key"); err != nil || string(v) != "value" {
+		t.Errorf("Get after reopening = %q, %v", v, err)
+	}
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// Compression dictionaries are stored as meta records keyed by the CRC32 of
+// their bytes, which compressed values reference in their first four bytes.
+// A dictionary is never removed, so values compressed with one that is no
+// longer configured stay readable.
+const (
+	metaDictPrefix = "dict:"
+	dictIDSize     = 4
+)
+
+// compressionDict returns the configured dictionary and its ID if it may be
+// used for a value of collection, that is once it has been stored. Meta
+// records are never compressed with one so loadMeta can read them in any
+// order. Callers must hold db.mu.
+func (db *DB) compressionDict(collection string) (uint32, []byte) {
+	dict := db.opts.CompressionDict
+	if len(dict) == 0 || collection == metaCollection || !db.hasFeature(FeatureCompressionDict) {
+		return 0, nil
+	}
+	id := crc32.ChecksumIEEE(dict)
+	if !bytes.Equal(db.dictMap()[id], dict) {
+		return 0, nil
+	}
+	return id, dict
+}
+
+// storeDict persists the configured dictionary the first time a write may
+// compress with it, ahead of the records that do. Callers must hold db.mu.
+func (db *DB) storeDict() error {
+	dict := db.opts.CompressionDict
+	if len(dict) == 0 || !db.hasFeature(FeatureCompressionDict) {
+		return nil
+	}
+	id := crc32.ChecksumIEEE(dict)
+	if _, ok := db.dictMap()[id]; ok {
+		return nil
+	}
+	return db.putMeta(fmt.Sprintf("%s%08x", metaDictPrefix, id), bytes.Clone(dict))
+}
+
+// dictMap returns the stored dictionaries by ID. The map is replaced rather
+// than changed, so it may be read without db.mu.
+func (db *DB) dictMap() map[uint32][]byte {
+	if dicts := db.dicts.Load(); dicts != nil {
+		return *dicts
+	}
+	return nil
+}
+
+// addDict registers a dictionary read from the meta record with key. Callers
+// must hold db.mu or have exclusive access to db.
+func (db *DB) addDict(key string, value []byte) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(key, metaDictPrefix), 16, 32)
+	if err != nil {
+		return
+	}
+	dicts := maps.Clone(db.dictMap())
+	if dicts == nil {
+		dicts = make(map[uint32][]byte)
+	}
+	dicts[uint32(id)] = value
+	db.dicts.Store(&dicts)
+}
+
+// dictFor splits the dictionary ID off a payload flagged FlagDict and
+// returns the dictionary with the rest of the payload. It needs no lock.
+func (db *DB) dictFor(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < dictIDSize {
+		return nil, nil, ErrUnknownDict
+	}
+	dict, ok := db.dictMap()[binary.BigEndian.Uint32(payload)]
+	if !ok {
+		return nil, nil, ErrUnknownDict
+	}
+	return dict, payload[dictIDSize:], nil
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// similarDocs returns small JSON documents that share most of their bytes.
+func similarDocs(n int) [][]byte {
+	docs := make([][]byte, n)
+	for i := range docs {
+		docs[i] = []byte(fmt.Sprintf(`{"id":%d,"type":"customer","name":"user-%d","email":"user-%d@example.com","plan":"standard","country":"NL","active":true,"tags":["newsletter","beta"]}`, i, i, i))
+	}
+	return docs
+}
+
+func TestCompressionDict(t *testing.T) {
+	dict := []byte(`{"id":0,"type":"customer","name":"user-","email":"user-@example.com","plan":"standard","country":"NL","active":true,"tags":["newsletter","beta"]}`)
+	docs := similarDocs(50)
+
+	// storedSize writes docs and returns the bytes of their records
+	storedSize := func(db *DB) int64 {
+		t.Helper()
+		start := db.Offset()
+		for i, doc := range docs {
+			if err := db.Put("docs", fmt.Sprint(i), doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db.Offset() - start
+	}
+
+	plain, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{CompressionThreshold: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	without := storedSize(plain)
+
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{CompressionThreshold: 64, CompressionDict: dict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedSize(db) // Also stores the dictionary
+	with := storedSize(db)
+	if with*2 > without {
+		t.Errorf("%d bytes with a dictionary, %d without; want less than half", with, without)
+	}
+	rec, _, err := db.readRecord(indexed(t, db, "docs:7").Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Flags&(FlagCompressed|FlagDict) != FlagCompressed|FlagDict {
+		t.Errorf("record flags %08b, want compressed with a dictionary", rec.Flags)
+	}
+
+	// A new dictionary applies to new values; old ones stay readable
+	if err := db.UpdateOptions(func(o *Options) { o.CompressionDict = []byte(`{"kind":"order","total":0}`) }); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("orders", "1", bytes.Repeat([]byte(`{"kind":"order","total":12}`), 4))
+	if len(db.dictMap()) != 2 {
+		t.Errorf("%d dictionaries stored, want 2", len(db.dictMap()))
+	}
+	db.Close()
+
+	// Reopened without the option, the stored dictionaries are loaded
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check := func() {
+		t.Helper()
+		for _, i := range []int{0, 7, 49} {
+			if v, err := db.Get("docs", fmt.Sprint(i)); err != nil || !bytes.Equal(v, docs[i]) {
+				t.Fatalf("Get(%d) = %q, %v", i, v, err)
+			}
+		}
+		if _, err := db.Get("orders", "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+
+	// Compaction writes the dictionaries ahead of the values using them
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	var backup bytes.Buffer
+	if _, err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyBackupWithOptions(&backup, "pass", VerifyOptions{Decrypt: true}); err != nil {
+		t.Errorf("VerifyBackup: %v", err)
+	}
+
+	// A value whose dictionary is missing fails to decode
+	db.dicts.Store(&map[uint32][]byte{})
+	if _, err := db.Get("docs", "7"); err != ErrUnknownDict {
+		t.Errorf("Get without the dictionary: %v, want ErrUnknownDict", err)
+	}
+}
@@ -0,0 +1,458 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// keyIndex maps composite keys to the latest record of each key. The default
+// is an in-memory map; Options.LowMemory keeps it in a sorted file next to
+// the database instead.
+type keyIndex interface {
+	get(key string) (indexEntry, bool, error)
+	set(key string, e indexEntry)
+	remove(key string)
+	// each calls fn for every key, in no particular order, and stops at the
+	// first error fn returns
+	each(fn func(key string, e indexEntry) error) error
+	// eachSorted is each in key order
+	eachSorted(fn func(key string, e indexEntry) error) error
+	close() error
+}
+
+// errStopEach is returned by an each callback to end the walk early.
+var errStopEach = errors.New("stop")
+
+// indexBuilder collects the entries of a new index in log order: a later
+// entry for a key replaces an earlier one.
+type indexBuilder interface {
+	add(key string, e indexEntry, deleted bool) error
+	finish() (keyIndex, error)
+	discard()
+}
+
+func (db *DB) newIndexBuilder() indexBuilder {
+	if db.opts.LowMemory {
+		return &diskIndexBuilder{path: db.path, chunk: make(map[string]diskEntry)}
+	}
+	return make(mapIndex)
+}
+
+// mapIndex is the in-memory index. It is also what hint files encode.
+type mapIndex map[string]indexEntry
+
+func (m mapIndex) get(key string) (indexEntry, bool, error) {
+	e, ok := m[key]
+	return e, ok, nil
+}
+
+func (m mapIndex) set(key string, e indexEntry) { m[key] = e }
+func (m mapIndex) remove(key string)            { delete(m, key) }
+func (m mapIndex) close() error                 { return nil }
+
+func (m mapIndex) each(fn func(key string, e indexEntry) error) error {
+	for k, e := range m {
+		if err := fn(k, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m mapIndex) eachSorted(fn func(key string, e indexEntry) error) error {
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		if err := fn(k, m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m mapIndex) add(key string, e indexEntry, deleted bool) error {
+	if deleted {
+		delete(m, key)
+	} else {
+		m[key] = e
+	}
+	return nil
+}
+
+func (m mapIndex) finish() (keyIndex, error) { return m, nil }
+func (m mapIndex) discard()                  {}
+
+const (
+	// Entries between two keys of a diskIndex kept in memory
+	diskIndexFenceEvery = 64
+
+	// Entries a diskIndexBuilder holds before spilling them to a run
+	diskIndexRunSize = 1 << 14
+)
+
+// diskIndex is the index of a database opened with Options.LowMemory: a
+// temporary file of entries sorted by key, plus every diskIndexFenceEvery-th
+// key in memory to find the block that may hold a key, so a lookup costs one
+// read. Changes made after the file was built are held in memory until the
+// next Compact or Reindex builds a new one.
+type diskIndex struct {
+	file    *os.File
+	size    int64
+	fences  []indexFence
+	overlay map[string]indexEntry
+	removed map[string]struct{}
+}
+
+type indexFence struct {
+	key    string
+	offset int64
+}
+
+func (d *diskIndex) get(key string) (indexEntry, bool, error) {
+	if e, ok := d.overlay[key]; ok {
+		return e, true, nil
+	}
+	if _, ok := d.removed[key]; ok {
+		return indexEntry{}, false, nil
+	}
+
+	i := sort.Search(len(d.fences), func(i int) bool { return d.fences[i].key > key }) - 1
+	if i < 0 {
+		return indexEntry{}, false, nil
+	}
+	end := d.size
+	if i+1 < len(d.fences) {
+		end = d.fences[i+1].offset
+	}
+	block := make([]byte, end-d.fences[i].offset)
+	if _, err := d.file.ReadAt(block, d.fences[i].offset); err != nil {
+		return indexEntry{}, false, err
+	}
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		e, err := readDiskEntry(r)
+		if err != nil {
+			return indexEntry{}, false, err
+		}
+		if e.key == key {
+			return e.indexEntry, true, nil
+		}
+		if e.key > key {
+			break
+		}
+	}
+	return indexEntry{}, false, nil
+}
+
+func (d *diskIndex) set(key string, e indexEntry) {
+	d.overlay[key] = e
+	delete(d.removed, key)
+}
+
+func (d *diskIndex) remove(key string) {
+	delete(d.overlay, key)
+	d.removed[key] = struct{}{}
+}
+
+func (d *diskIndex) each(fn func(key string, e indexEntry) error) error {
+	r := bufio.NewReader(io.NewSectionReader(d.file, 0, d.size))
+	for {
+		e, err := readDiskEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := d.overlay[e.key]; ok {
+			continue
+		}
+		if _, ok := d.removed[e.key]; ok {
+			continue
+		}
+		if err := fn(e.key, e.indexEntry); err != nil {
+			return err
+		}
+	}
+	for k, e := range d.overlay {
+		if err := fn(k, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachSorted merges the file, which is in key order, with the overlay.
+func (d *diskIndex) eachSorted(fn func(key string, e indexEntry) error) error {
+	overlay := slices.Sorted(maps.Keys(d.overlay))
+	emitOverlay := func(before string, all bool) error {
+		for len(overlay) > 0 && (all || overlay[0] < before) {
+			if err := fn(overlay[0], d.overlay[overlay[0]]); err != nil {
+				return err
+			}
+			overlay = overlay[1:]
+		}
+		return nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(d.file, 0, d.size))
+	for {
+		e, err := readDiskEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := emitOverlay(e.key, false); err != nil {
+			return err
+		}
+		if _, ok := d.overlay[e.key]; ok {
+			continue
+		}
+		if _, ok := d.removed[e.key]; ok {
+			continue
+		}
+		if err := fn(e.key, e.indexEntry); err != nil {
+			return err
+		}
+	}
+	return emitOverlay("", true)
+}
+
+func (d *diskIndex) close() error {
+	err := d.file.Close()
+	if rmErr := os.Remove(d.file.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// diskEntry is the encoded form of an index entry in a diskIndex file or a
+// builder run: key length, key, deleted flag and the indexEntry fields.
+type diskEntry struct {
+	key string
+	indexEntry
+	deleted bool
+}
+
+const diskEntryFixedSize = 4 + 1 + 4*8
+
+func appendDiskEntry(buf []byte, e diskEntry) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(e.key)))
+	buf = append(buf, e.key...)
+	var deleted byte
+	if e.deleted {
+		deleted = 1
+	}
+	buf = append(buf, deleted)
+	for _, v := range []int64{e.Offset, e.Size, e.Timestamp, e.ExpiresAt} {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(v))
+	}
+	return buf
+}
+
+// readDiskEntry returns io.EOF only if r ends exactly before an entry.
+func readDiskEntry(r io.Reader) (diskEntry, error) {
+	var keyLen [4]byte
+	if _, err := io.ReadFull(r, keyLen[:]); err != nil {
+		return diskEntry{}, err
+	}
+	buf := make([]byte, int(binary.BigEndian.Uint32(keyLen[:]))+diskEntryFixedSize-4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return diskEntry{}, err
+	}
+	n := len(buf) - (diskEntryFixedSize - 4)
+	fields := buf[n+1:]
+	return diskEntry{
+		key: string(buf[:n]),
+		indexEntry: indexEntry{
+			Offset:    int64(binary.BigEndian.Uint64(fields[0:])),
+			Size:      int64(binary.BigEndian.Uint64(fields[8:])),
+			Timestamp: int64(binary.BigEndian.Uint64(fields[16:])),
+			ExpiresAt: int64(binary.BigEndian.Uint64(fields[24:])),
+		},
+		deleted: buf[n] != 0,
+	}, nil
+}
+
+// diskIndexBuilder builds a diskIndex with bounded memory: entries are
+// collected in a map of at most diskIndexRunSize keys, which is sorted and
+// spilled to a temporary run when full. finish merges the runs, the newest
+// entry of each key winning, into the index file.
+type diskIndexBuilder struct {
+	path  string
+	chunk map[string]diskEntry
+	runs  []*os.File
+}
+
+// createIndexFile creates a temporary file next to the database at path.
+// Open removes any left behind by a crash.
+func createIndexFile(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), filepath.Base(path)+indexFileInfix+"*")
+}
+
+func (b *diskIndexBuilder) add(key string, e indexEntry, deleted bool) error {
+	b.chunk[key] = diskEntry{key: key, indexEntry: e, deleted: deleted}
+	if len(b.chunk) >= diskIndexRunSize {
+		return b.spill()
+	}
+	return nil
+}
+
+func (b *diskIndexBuilder) spill() error {
+	f, err := createIndexFile(b.path)
+	if err != nil {
+		return err
+	}
+	b.runs = append(b.runs, f)
+
+	keys := make([]string, 0, len(b.chunk))
+	for k := range b.chunk {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	w := bufio.NewWriter(f)
+	var buf []byte
+	for _, k := range keys {
+		buf = appendDiskEntry(buf[:0], b.chunk[k])
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	clear(b.chunk)
+	return w.Flush()
+}
+
+func (b *diskIndexBuilder) finish() (keyIndex, error) {
+	if len(b.chunk) > 0 {
+		if err := b.spill(); err != nil {
+			return nil, err
+		}
+	}
+	defer b.discard()
+
+	f, err := createIndexFile(b.path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &diskIndex{
+		file:    f,
+		overlay: make(map[string]indexEntry),
+		removed: make(map[string]struct{}),
+	}
+	if err := b.merge(idx); err != nil {
+		idx.close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// merge writes the live entries of all runs to idx.file in key order.
+func (b *diskIndexBuilder) merge(idx *diskIndex) error {
+	var cursors runHeap
+	for i, f := range b.runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		c := &runCursor{r: bufio.NewReader(f), run: i}
+		if ok, err := c.next(); err != nil {
+			return err
+		} else if ok {
+			cursors = append(cursors, c)
+		}
+	}
+	heap.Init(&cursors)
+
+	w := bufio.NewWriter(idx.file)
+	var buf []byte
+	var count int
+	for len(cursors) > 0 {
+		// The heap yields the newest run first among equal keys
+		top := cursors[0].entry
+		for len(cursors) > 0 && cursors[0].entry.key == top.key {
+			c := cursors[0]
+			if ok, err := c.next(); err != nil {
+				return err
+			} else if ok {
+				heap.Fix(&cursors, 0)
+			} else {
+				heap.Pop(&cursors)
+			}
+		}
+		if top.deleted {
+			continue
+		}
+
+		if count%diskIndexFenceEvery == 0 {
+			idx.fences = append(idx.fences, indexFence{key: top.key, offset: idx.size})
+		}
+		buf = appendDiskEntry(buf[:0], top)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		idx.size += int64(len(buf))
+		count++
+	}
+	return w.Flush()
+}
+
+func (b *diskIndexBuilder) discard() {
+	for _, f := range b.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	b.runs = nil
+	clear(b.chunk)
+}
+
+type runCursor struct {
+	r     *bufio.Reader
+	run   int
+	entry diskEntry
+}
+
+func (c *runCursor) next() (bool, error) {
+	e, err := readDiskEntry(c.r)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	c.entry = e
+	return true, nil
+}
+
+type runHeap []*runCursor
+
+func (h runHeap) Len() int { return len(h) }
+
+func (h runHeap) Less(i, j int) bool {
+	if c := strings.Compare(h[i].entry.key, h[j].entry.key); c != 0 {
+		return c < 0
+	}
+	return h[i].run > h[j].run
+}
+
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.(*runCursor)) }
+
+func (h *runHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLowMemoryOpen(t *testing.T) {
+	const keys = 50000 // Several builder runs
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < keys; start += 1000 {
+		b := db.NewBatch()
+		for i := start; i < start+1000; i++ {
+			b.Put("col", fmt.Sprintf("key-%06d", i), []byte("v1"), 0)
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwrites and deletes land in later runs than the keys they replace
+	db.Put("col", "key-000001", []byte("v2"))
+	db.Delete("col", "key-000002")
+	db.Close()
+
+	heapGrowth := func(opts Options) uint64 {
+		t.Helper()
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		db, err := OpenWithOptions(path, "pass", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		db.Close()
+		return after.HeapAlloc - min(after.HeapAlloc, before.HeapAlloc)
+	}
+	inMemory := heapGrowth(Options{})
+	lowMemory := heapGrowth(Options{LowMemory: true})
+	if lowMemory > inMemory/2 {
+		t.Errorf("LowMemory open retained %d heap bytes, in-memory open %d", lowMemory, inMemory)
+	}
+
+	db, err = OpenWithOptions(path, "pass", Options{LowMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		t.Helper()
+		for _, i := range []int{0, 3, diskIndexRunSize, keys - 1} {
+			key := fmt.Sprintf("key-%06d", i)
+			if v, err := db.Get("col", key); err != nil || string(v) != "v1" {
+				t.Errorf("%s: Get %s = %q, %v", stage, key, v, err)
+			}
+		}
+		if v, err := db.Get("col", "key-000001"); err != nil || string(v) != "v2" {
+			t.Errorf("%s: overwrite lost: %q, %v", stage, v, err)
+		}
+		if _, err := db.Get("col", "key-000002"); err != ErrNotFound {
+			t.Errorf("%s: deleted key readable: %v", stage, err)
+		}
+		if _, err := db.Get("col", "missing"); err != ErrNotFound {
+			t.Errorf("%s: missing key: %v", stage, err)
+		}
+		if list, _ := db.List("col"); len(list) != keys-1 {
+			t.Errorf("%s: List returned %d keys, want %d", stage, len(list), keys-1)
+		}
+	}
+	check("open")
+
+	// Writes after open are indexed in memory until Compact
+	db.Delete("col", "key-000003")
+	db.Put("col", "key-000003", []byte("v1"))
+	check("overlay")
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DeadBytes == 0 || stats.LiveBytes == 0 {
+		t.Errorf("Space accounting not derived: %+v", stats)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("compact")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(path + ".hint") {
+		t.Error("LowMemory must not leave a hint behind")
+	}
+	if leftovers, _ := filepath.Glob(path + indexFileInfix + "*"); len(leftovers) > 0 {
+		t.Errorf("Close left index files behind: %v", leftovers)
+	}
+
+	db, err = OpenWithOptions(path, "pass", Options{LowMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("reopen")
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+var ErrDiskFull = errors.New("not enough free disk space")
+
+// diskFree returns the bytes available to unprivileged users on the volume
+// holding path. Tests replace it to fake a filling disk.
+var diskFree = statFree
+
+// checkDiskFree fails with ErrDiskFull if writing need more bytes to the
+// volume holding path would leave less than Options.MinFreeBytes free.
+func (db *DB) checkDiskFree(path string, need int64) error {
+	floor := db.opts.MinFreeBytes
+	if floor <= 0 || need <= 0 {
+		return nil
+	}
+	free, err := diskFree(path)
+	if err != nil {
+		return err
+	}
+	if free-need < floor {
+		return fmt.Errorf("%w: %d bytes free on %s, writing %d would leave less than %d", ErrDiskFull, free, path, need, floor)
+	}
+	return nil
+}
+
+// checkCompactSpace checks that the volumes Compact writes to have room for
+// the compacted log of size bytes: the output directory, and the database's
+// own volume too when the output is copied there from Options.TempDir.
+// Callers must hold db.mu.
+func (db *DB) checkCompactSpace(size int64) error {
+	dirs := []string{filepath.Dir(db.path)}
+	if db.opts.TempDir != "" {
+		dirs = append(dirs, db.opts.TempDir)
+	}
+	for _, dir := range dirs {
+		if err := db.checkDiskFree(dir, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDiskFreeOption fails if opts set MinFreeBytes on a platform where
+// free space cannot be measured, so the barrier is never silently off.
+func checkDiskFreeOption(path string, opts Options) error {
+	if opts.MinFreeBytes <= 0 {
+		return nil
+	}
+	if _, err := diskFree(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("MinFreeBytes: %w", err)
+	}
+	return nil
+}
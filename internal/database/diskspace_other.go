@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package database
+
+import "errors"
+
+// statFree is not implemented here, so Options.MinFreeBytes cannot be used.
+func statFree(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
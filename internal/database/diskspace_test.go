@@ -0,0 +1,81 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMinFreeBytes(t *testing.T) {
+	free := int64(1 << 20)
+	diskFree = func(string) (int64, error) { return free, nil }
+	t.Cleanup(func() { diskFree = statFree })
+
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{MinFreeBytes: 1<<20 - 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Free space shrinks as the file grows, until a write would cross the floor
+	value := make([]byte, 100)
+	var written int
+	for ; ; written++ {
+		before := db.Offset()
+		err := db.Put("col", "k", value)
+		if errors.Is(err, ErrDiskFull) {
+			if db.Offset() != before {
+				t.Errorf("a refused Put moved the log from %d to %d", before, db.Offset())
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		free -= db.Offset() - before
+	}
+	if written == 0 || free < 1<<20-1000 {
+		t.Errorf("%d writes fitted, leaving %d bytes free", written, free)
+	}
+
+	batch := db.NewBatch()
+	batch.Put("col", "k2", value, 0)
+	if err := batch.Commit(); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Batch.Commit with the disk full: %v", err)
+	}
+	if err := db.Compact(); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Compact with the disk full: %v", err)
+	}
+
+	// Room for the compacted log lets Compact reclaim the superseded values
+	free += 1000
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("col", "k2", value); err != nil {
+		t.Errorf("Put after Compact: %v", err)
+	}
+}
+
+func TestMinFreeBytesStatfs(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := statFree(dir); errors.Is(err, errors.ErrUnsupported) {
+		if _, err := OpenWithOptions(filepath.Join(dir, "db.nok"), "pass", Options{MinFreeBytes: 1}); err == nil {
+			t.Error("Open with MinFreeBytes succeeded where free space cannot be measured")
+		}
+		t.Skip("free space cannot be measured here")
+	}
+
+	db, err := OpenWithOptions(filepath.Join(dir, "db.nok"), "pass", Options{MinFreeBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("col", "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.UpdateOptions(func(o *Options) { o.MinFreeBytes = 1 << 62 })
+	if err := db.Put("col", "k", []byte("v")); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Put with an unreachable floor: %v", err)
+	}
+}
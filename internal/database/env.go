@@ -0,0 +1,161 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidEnv = errors.New("invalid environment variable")
+
+// envOption is an option OptionsFromEnv reads from the variable name.
+// format gives back the value parse read, for tests.
+type envOption struct {
+	name   string
+	parse  func(o *Options, value string) error
+	format func(o Options) string
+}
+
+// envField is an envOption for the field of Options that field returns.
+func envField[T any](name string, field func(o *Options) *T, parse func(string) (T, error), format func(T) string) envOption {
+	return envOption{
+		name: name,
+		parse: func(o *Options, value string) error {
+			v, err := parse(value)
+			if err != nil {
+				return err
+			}
+			*field(o) = v
+			return nil
+		},
+		format: func(o Options) string { return format(*field(&o)) },
+	}
+}
+
+func envBool(name string, field func(o *Options) *bool) envOption {
+	return envField(name, field, strconv.ParseBool, strconv.FormatBool)
+}
+
+func envInt(name string, field func(o *Options) *int) envOption {
+	return envField(name, field, strconv.Atoi, strconv.Itoa)
+}
+
+func envInt64(name string, field func(o *Options) *int64) envOption {
+	parse := func(s string) (int64, error) { return strconv.ParseInt(s, 10, 64) }
+	format := func(v int64) string { return strconv.FormatInt(v, 10) }
+	return envField(name, field, parse, format)
+}
+
+func envDuration(name string, field func(o *Options) *time.Duration) envOption {
+	return envField(name, field, time.ParseDuration, time.Duration.String)
+}
+
+func envString(name string, field func(o *Options) *string) envOption {
+	parse := func(s string) (string, error) { return s, nil }
+	format := func(s string) string { return s }
+	return envField(name, field, parse, format)
+}
+
+func envUint[T uint8 | uint32](name string, field func(o *Options) *T) envOption {
+	bits := int(reflect.TypeFor[T]().Bits())
+	parse := func(s string) (T, error) {
+		v, err := strconv.ParseUint(s, 10, bits)
+		return T(v), err
+	}
+	format := func(v T) string { return strconv.FormatUint(uint64(v), 10) }
+	return envField(name, field, parse, format)
+}
+
+// envOptions are the variables OptionsFromEnv reads. ForceReinit, which
+// destroys data, and the options that are not plain values are left out.
+var envOptions = []envOption{
+	envDuration("NOKHAL_LEASE_TIMEOUT", func(o *Options) *time.Duration { return &o.LeaseTimeout }),
+	envInt("NOKHAL_INFO_SAMPLE_SIZE", func(o *Options) *int { return &o.InfoSampleSize }),
+	envInt("NOKHAL_DECRYPT_WORKERS", func(o *Options) *int { return &o.DecryptWorkers }),
+	envInt("NOKHAL_INDEX_LOAD_WORKERS", func(o *Options) *int { return &o.IndexLoadWorkers }),
+	envString("NOKHAL_MIRROR_PATH", func(o *Options) *string { return &o.MirrorPath }),
+	envBool("NOKHAL_MIRROR_REQUIRED", func(o *Options) *bool { return &o.MirrorRequired }),
+	envDuration("NOKHAL_HINT_FLUSH_INTERVAL", func(o *Options) *time.Duration { return &o.HintFlushInterval }),
+	envBool("NOKHAL_CONTENT_CHECKSUMS", func(o *Options) *bool { return &o.ContentChecksums }),
+	envInt("NOKHAL_COMPRESSION_THRESHOLD", func(o *Options) *int { return &o.CompressionThreshold }),
+	{
+		// false disables compression, as a negative threshold does
+		name: "NOKHAL_COMPRESSION",
+		parse: func(o *Options, value string) error {
+			on, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			if !on {
+				if o.CompressionThreshold != 0 {
+					return errors.New("conflicts with NOKHAL_COMPRESSION_THRESHOLD")
+				}
+				o.CompressionThreshold = -1
+			}
+			return nil
+		},
+		format: func(o Options) string { return strconv.FormatBool(o.CompressionThreshold >= 0) },
+	},
+	envBool("NOKHAL_SYNC_WRITES", func(o *Options) *bool { return &o.SyncWrites }),
+	envInt64("NOKHAL_PREALLOCATE_BYTES", func(o *Options) *int64 { return &o.PreallocateBytes }),
+	envString("NOKHAL_TEMP_DIR", func(o *Options) *string { return &o.TempDir }),
+	envInt64("NOKHAL_MIN_FREE_BYTES", func(o *Options) *int64 { return &o.MinFreeBytes }),
+	envBool("NOKHAL_PARANOID", func(o *Options) *bool { return &o.Paranoid }),
+	envBool("NOKHAL_COUNTER_NONCES", func(o *Options) *bool { return &o.CounterNonces }),
+	envBool("NOKHAL_FAIL_WHEN_FROZEN", func(o *Options) *bool { return &o.FailWhenFrozen }),
+	envBool("NOKHAL_LOW_MEMORY", func(o *Options) *bool { return &o.LowMemory }),
+	envBool("NOKHAL_MMAP_HINT", func(o *Options) *bool { return &o.MmapHint }),
+	envBool("NOKHAL_LAZY_EXPIRE_DELETE", func(o *Options) *bool { return &o.LazyExpireDelete }),
+	envDuration("NOKHAL_TOMBSTONE_TTL", func(o *Options) *time.Duration { return &o.TombstoneTTL }),
+	envInt("NOKHAL_INDEX_WALK_CHUNK", func(o *Options) *int { return &o.IndexWalkChunk }),
+	envInt("NOKHAL_MAX_SNAPSHOTS", func(o *Options) *int { return &o.MaxSnapshots }),
+	envInt64("NOKHAL_MAX_BATCH_MEMORY", func(o *Options) *int64 { return &o.MaxBatchMemory }),
+	envUint("NOKHAL_KDF_TIME", func(o *Options) *uint32 { return &o.KDF.Time }),
+	envUint("NOKHAL_KDF_MEMORY_KIB", func(o *Options) *uint32 { return &o.KDF.Memory }),
+	envUint("NOKHAL_KDF_PARALLELISM", func(o *Options) *uint8 { return &o.KDF.Parallelism }),
+}
+
+// OptionsFromEnv reads options from NOKHAL_* environment variables, for
+// deployments configured through the environment. Unset and empty
+// variables leave their option zero; other NOKHAL_ variables are ignored. A
+// value that does not parse fails with ErrInvalidEnv, naming the variable.
+// Combine the result with options set in code using Merge.
+func OptionsFromEnv() (Options, error) {
+	var o Options
+	for _, opt := range envOptions {
+		value := os.Getenv(opt.name)
+		if value == "" {
+			continue
+		}
+		if err := opt.parse(&o, value); err != nil {
+			return Options{}, fmt.Errorf("%w %s=%q: %w", ErrInvalidEnv, opt.name, value, err)
+		}
+	}
+	if err := o.KDF.Validate(); err != nil {
+		return Options{}, fmt.Errorf("%w NOKHAL_KDF_*: %w", ErrInvalidEnv, err)
+	}
+	return o, nil
+}
+
+// Merge returns o with every non-zero field of overrides set over it.
+// Structs such as KDF are merged field by field. A zero value cannot
+// override: to turn off a bool that o sets, change it on the result.
+func (o Options) Merge(overrides Options) Options {
+	mergeStruct(reflect.ValueOf(&o).Elem(), reflect.ValueOf(overrides))
+	return o
+}
+
+func mergeStruct(dst, src reflect.Value) {
+	for i := range src.NumField() {
+		f := src.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+			mergeStruct(dst.Field(i), f)
+		case !f.IsZero():
+			dst.Field(i).Set(f)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	// A value for every variable, as it formats back
+	samples := map[string]string{
+		"NOKHAL_LEASE_TIMEOUT":         "30s",
+		"NOKHAL_INFO_SAMPLE_SIZE":      "5",
+		"NOKHAL_DECRYPT_WORKERS":       "2",
+		"NOKHAL_INDEX_LOAD_WORKERS":    "8",
+		"NOKHAL_MIRROR_PATH":           "/mnt/mirror/db.nok",
+		"NOKHAL_MIRROR_REQUIRED":       "true",
+		"NOKHAL_HINT_FLUSH_INTERVAL":   "1m0s",
+		"NOKHAL_CONTENT_CHECKSUMS":     "true",
+		"NOKHAL_COMPRESSION_THRESHOLD": "512",
+		"NOKHAL_COMPRESSION":           "true",
+		"NOKHAL_SYNC_WRITES":           "true",
+		"NOKHAL_PREALLOCATE_BYTES":     "4194304",
+		"NOKHAL_TEMP_DIR":              "/tmp",
+		"NOKHAL_MIN_FREE_BYTES":        "1048576",
+		"NOKHAL_PARANOID":              "true",
+		"NOKHAL_COUNTER_NONCES":        "true",
+		"NOKHAL_FAIL_WHEN_FROZEN":      "true",
+		"NOKHAL_LOW_MEMORY":            "true",
+		"NOKHAL_MMAP_HINT":             "true",
+		"NOKHAL_LAZY_EXPIRE_DELETE":    "true",
+		"NOKHAL_TOMBSTONE_TTL":         "168h0m0s",
+		"NOKHAL_INDEX_WALK_CHUNK":      "-1",
+		"NOKHAL_MAX_SNAPSHOTS":         "16",
+		"NOKHAL_MAX_BATCH_MEMORY":      "67108864",
+		"NOKHAL_KDF_TIME":              "3",
+		"NOKHAL_KDF_MEMORY_KIB":        "16384",
+		"NOKHAL_KDF_PARALLELISM":       "2",
+	}
+	for _, opt := range envOptions {
+		t.Setenv(opt.name, "")
+	}
+	for _, opt := range envOptions {
+		sample, ok := samples[opt.name]
+		if !ok {
+			t.Errorf("no sample for %s", opt.name)
+			continue
+		}
+		t.Setenv(opt.name, sample)
+		o, err := OptionsFromEnv()
+		if err != nil {
+			t.Fatalf("%s=%s: %v", opt.name, sample, err)
+		}
+		if got := opt.format(o); got != sample {
+			t.Errorf("%s=%s read back as %s", opt.name, sample, got)
+		}
+		t.Setenv(opt.name, "")
+	}
+	if len(samples) != len(envOptions) {
+		t.Errorf("%d samples for %d variables", len(samples), len(envOptions))
+	}
+
+	// All at once
+	for name, value := range samples {
+		t.Setenv(name, value)
+	}
+	o, err := OptionsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.SyncWrites || o.LeaseTimeout != 30*time.Second || o.KDF != (KDFParams{Time: 3, Memory: 16384, Parallelism: 2}) {
+		t.Errorf("options from the environment: %+v", o)
+	}
+
+	// Values that do not parse name their variable
+	for name, value := range map[string]string{
+		"NOKHAL_SYNC_WRITES":         "yes",
+		"NOKHAL_INFO_SAMPLE_SIZE":    "5.5",
+		"NOKHAL_PREALLOCATE_BYTES":   "4M",
+		"NOKHAL_HINT_FLUSH_INTERVAL": "60",
+		"NOKHAL_KDF_PARALLELISM":     "256",
+		"NOKHAL_COMPRESSION":         "false", // With a threshold set
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			_, err := OptionsFromEnv()
+			if !errors.Is(err, ErrInvalidEnv) || !strings.Contains(err.Error(), name) {
+				t.Errorf("%s=%s: %v", name, value, err)
+			}
+		})
+	}
+	t.Setenv("NOKHAL_KDF_MEMORY_KIB", "8")
+	if _, err := OptionsFromEnv(); !errors.Is(err, ErrInvalidKDF) {
+		t.Errorf("too little KDF memory: %v", err)
+	}
+}
+
+func TestOptionsMerge(t *testing.T) {
+	base := Options{SyncWrites: true, CompressionThreshold: 256, KDF: KDFParams{Time: 2, Memory: 32768}}
+	got := base.Merge(Options{CompressionThreshold: -1, TempDir: "/tmp", KDF: KDFParams{Memory: 16384}})
+	want := Options{SyncWrites: true, CompressionThreshold: -1, TempDir: "/tmp", KDF: KDFParams{Time: 2, Memory: 16384}}
+	if got.SyncWrites != want.SyncWrites || got.CompressionThreshold != want.CompressionThreshold || got.TempDir != want.TempDir || got.KDF != want.KDF {
+		t.Errorf("Merge = %+v, want %+v", got, want)
+	}
+	if base.CompressionThreshold != 256 {
+		t.Error("Merge changed its receiver")
+	}
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Passphrase envelope used by ExportEncrypted:
+//
+//	Magic(13) + Salt(32) + Chunks...
+//	Chunk: Length(4) + AES-GCM(plaintext up to envelopeChunkSize)
+//
+// The key is derived from the passphrase with the same Argon2id parameters as
+// the database KEK. Each chunk nonce is an 11-byte counter followed by a byte
+// set to 1 on the final chunk, so reordered, dropped or truncated chunks fail
+// authentication. The magic and salt are bound as AAD.
+const (
+	envelopeMagic     = "NOKHAL_XENC1:"
+	envelopeChunkSize = 64 * 1024
+)
+
+var ErrInvalidEnvelope = errors.New("invalid or truncated encrypted export")
+
+func envelopeNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	counter uint64
+}
+
+func newSealWriter(w io.Writer, passphrase string) (*sealWriter, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newCipher(deriveKey(passphrase, salt, DefaultKDF))
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(envelopeMagic), salt...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, aad: header, buf: make([]byte, 0, envelopeChunkSize)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Keep a full buffer until more data arrives so the last chunk
+		// can always be marked final on Close
+		if len(s.buf) == envelopeChunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):envelopeChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the buffered data as the final chunk. It does not close the
+// underlying writer.
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(final bool) error {
+	sealed := s.aead.Seal(nil, envelopeNonce(s.counter, final), s.buf, s.aad)
+	s.counter++
+	s.buf = s.buf[:0]
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := s.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+type openReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+// newOpenReader reads the envelope header and opens the first chunk, so a
+// wrong passphrase is reported before the caller consumes anything.
+func newOpenReader(r io.Reader, passphrase string) (*openReader, error) {
+	header := make([]byte, len(envelopeMagic)+saltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	if string(header[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, ErrInvalidEnvelope
+	}
+	aead, err := newCipher(deriveKey(passphrase, header[len(envelopeMagic):], DefaultKDF))
+	if err != nil {
+		return nil, err
+	}
+
+	or := &openReader{r: r, aead: aead, aad: header}
+	if err := or.next(); err != nil {
+		if err == ErrDecryption {
+			return nil, ErrInvalidPassword
+		}
+		return nil, err
+	}
+	return or, nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(o.r, length[:]); err != nil {
+		return ErrInvalidEnvelope
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < authTagSize || size > envelopeChunkSize+authTagSize {
+		return ErrInvalidEnvelope
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		return ErrInvalidEnvelope
+	}
+
+	// Try as a regular chunk first, then as the final one
+	plain, err := o.aead.Open(nil, envelopeNonce(o.counter, false), sealed, o.aad)
+	if err != nil {
+		plain, err = o.aead.Open(nil, envelopeNonce(o.counter, true), sealed, o.aad)
+		if err != nil {
+			return ErrDecryption
+		}
+		o.done = true
+	}
+	o.counter++
+	o.buf = plain
+	return nil
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+)
+
+// DeletePrefix deletes every key whose combined key (collection:key) starts
+// with prefix in one batch. Like ScanPrefix, internal collections are only
+// matched when the prefix names them. The values stay on disk until Compact.
+func (db *DB) DeletePrefix(prefix string) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	_, err := db.deletePrefix(prefix)
+	return err
+}
+
+// SecureDeletePrefix is DeletePrefix followed by an immediate overwrite of
+// every earlier version of the matched keys, so their values cannot be
+// recovered from the file without waiting for Compact. Each erased record
+// keeps its place and its key but becomes a tombstone whose nonce and
+// value are replaced, sealed over random bytes outside plaintext
+// collections; the holes are reclaimed by the next Compact. The mirror is overwritten too while it is in sync. Overwriting in
+// place does not reach the old blocks on copy-on-write filesystems or
+// wear-leveled flash, where only Compact and full-disk encryption help.
+// It fails with ErrSnapshotOpen, deleting nothing, while an open Snapshot
+// holds a matched key.
+func (db *DB) SecureDeletePrefix(prefix string) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	match := prefixMatcher(prefix)
+	if err := db.checkPinned(match); err != nil {
+		return err
+	}
+	end, err := db.deletePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	for offset := int64(headerSize); offset < end; {
+		rec, size, err := db.readRecord(offset)
+		if err != nil {
+			return err
+		}
+		if rec.Op != OpDelete && match(rec.Collection, rec.Key) {
+			if err := db.eraseRecord(offset, size, rec); err != nil {
+				return err
+			}
+		}
+		offset += size
+	}
+
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	if m := db.mirror; m != nil && !m.diverged && m.file != nil {
+		if err := m.file.Sync(); err != nil {
+			return db.mirrorFailed(err)
+		}
+	}
+	return nil
+}
+
+// deletePrefix tombstones the keys matching prefix and returns the log
+// offset the tombstones start at. Callers must hold db.mu.
+func (db *DB) deletePrefix(prefix string) (int64, error) {
+	var writes []batchRecord
+	err := db.index.each(func(k string, _ indexEntry) error {
+		collection, key := SplitKey(k)
+		if strings.HasPrefix(k, prefix) && !hiddenFromPrefix(collection, prefix) {
+			writes = append(writes, batchRecord{collection: collection, key: key, op: OpDelete})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	end := db.offset
+	if len(writes) == 0 {
+		return end, nil
+	}
+	return end, db.commitWrites(writes)
+}
+
+// eraseRecord overwrites the nonce and value of the record at offset and
+// turns it into a tombstone of the same size, so the log still parses and
+// scans skip it. Outside plaintext collections the tombstone seals random
+// bytes under a fresh nonce, so it verifies like any other; in them, where
+// tombstones are unsealed, the bytes are random. Callers must hold db.mu.
+func (db *DB) eraseRecord(offset, size int64, rec *record) error {
+	buf := make([]byte, size)
+	if _, err := db.file.ReadAt(buf, offset); err != nil {
+		return err
+	}
+
+	payload := recordHeaderSize + opSize + len(rec.Collection) + len(rec.Key)
+	if _, err := rand.Read(buf[payload:]); err != nil {
+		return err
+	}
+	flags := FlagNone
+	if aead, keyFlag := db.writeCipher(); !db.plaintext[string(rec.Collection)] && len(rec.Value) >= aead.Overhead() {
+		nonce, err := db.newNonce()
+		if err != nil {
+			return err
+		}
+		flags = keyFlag | FlagBoundAAD
+		aad := recordAAD(compositeKey(string(rec.Collection), string(rec.Key)), rec.Timestamp, OpDelete, flags)
+		value := buf[payload+nonceSize:]
+		copy(buf[payload:], nonce)
+		aead.Seal(value[:0], nonce, value[:len(value)-aead.Overhead()], aad)
+	}
+	buf[crcSize+timestampSize+expiresAtSize] = flags
+	buf[recordHeaderSize] = OpDelete
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[crcSize:]))
+
+	if _, err := db.file.WriteAt(buf, offset); err != nil {
+		return err
+	}
+	db.checkWritten(offset, buf)
+	return db.mirrorPatch(buf, offset)
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureDeletePrefix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{MirrorPath: filepath.Join(dir, "mirror.nok")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := db.Offset()
+	db.Put("secrets", "a", []byte("first version"))
+	db.Put("secrets", "a", []byte("second version"))
+	db.Put("secrets", "b", []byte("b"))
+	db.Delete("secrets", "b") // Already deleted keys are erased too
+	db.Put("public", "c", []byte("c"))
+	offsets, _ := walkLog(db.file, start)
+
+	raw := func(f io.ReaderAt, offset int64) []byte {
+		t.Helper()
+		_, size, err := readRecordAt(f, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, size)
+		f.ReadAt(buf, offset)
+		return buf
+	}
+	var before [][]byte
+	for _, off := range offsets {
+		before = append(before, raw(db.file, off))
+	}
+
+	if err := db.SecureDeletePrefix("secrets:"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, true, true, false, false} {
+		after := raw(db.file, offsets[i])
+		if erased := !bytes.Equal(after, before[i]); erased != want {
+			t.Errorf("Record %d erased = %v, want %v", i, erased, want)
+		}
+		if mirrored := raw(db.mirror.file, offsets[i]); !bytes.Equal(mirrored, after) {
+			t.Errorf("Mirror copy of record %d differs from the primary", i)
+		}
+	}
+	// The ciphertext is replaced, the key is kept
+	payload := len(before[0]) - len("first version") - 16 - nonceSize
+	if bytes.Equal(raw(db.file, offsets[0])[payload:], before[0][payload:]) {
+		t.Error("Ciphertext bytes unchanged")
+	}
+
+	if _, err := db.Get("secrets", "a"); err != ErrNotFound {
+		t.Errorf("Erased key readable: %v", err)
+	}
+	if v, err := db.Get("public", "c"); err != nil || string(v) != "c" {
+		t.Errorf("Unrelated key damaged: %q, %v", v, err)
+	}
+	if recs, err := db.ScanPrefix(""); err != nil || len(recs) != 1 {
+		t.Errorf("Scan after erase: %v, %v", recs, err)
+	}
+	db.Close()
+
+	// A full scan still parses the log
+	os.Remove(path + ".hint")
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if keys, _ := db.List("secrets"); len(keys) != 0 {
+		t.Errorf("Erased keys came back: %v", keys)
+	}
+}
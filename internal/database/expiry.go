@@ -0,0 +1,309 @@
+package database
+
+import (
+	"cmp"
+	"container/heap"
+	"math"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	// expiryHeapSize bounds the expirations the scheduler tracks. Later ones
+	// are found in the index once the tracked ones have fired.
+	expiryHeapSize = 4096
+
+	// expiryRetry is how long the scheduler waits after failing to tombstone
+	// expired keys, or while writes are frozen
+	expiryRetry = time.Second
+)
+
+// expiration is a key due to expire at expiresAt. It is stale once the
+// key's index entry no longer expires at that instant: the key was
+// rewritten, deleted or already purged.
+type expiration struct {
+	compKey   string
+	expiresAt int64
+}
+
+// expiryHeap orders expirations soonest first.
+type expiryHeap []expiration
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiration)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// expiryScheduler fires the OnExpire hooks. Every user key expiring at or
+// before horizon is in the heap; later ones are found in the index again
+// once the heap is empty.
+type expiryScheduler struct {
+	hooks   []func(collection, key string)
+	heap    expiryHeap
+	horizon int64
+	pending []string // Expired keys already gone from the index, to report
+	purging bool     // The scheduler is writing tombstones for expired keys
+
+	wake chan struct{} // Signals a new soonest expiration or pending keys
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OnExpire registers fn to be called with the collection and key of every
+// user key that expires, once per expiry, shortly after it does. The first
+// call starts a goroutine that sleeps until the soonest expiration; it also
+// reports keys that expired while no hook was registered, such as during
+// downtime. Hooks run one at a time on that goroutine, outside the database
+// lock, so they may read and write the database but must not Close it.
+//
+// A due key is tombstoned before its hooks run. A key rewritten before it
+// expires is rescheduled by its new TTL, or not at all without one. A key
+// that expired but was rewritten, deleted or compacted away before the
+// scheduler got to it is still reported. While writes are frozen,
+// expirations wait for the database to be unfrozen.
+func (db *DB) OnExpire(fn func(collection, key string)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return os.ErrClosed
+	}
+	if db.expiry != nil {
+		db.expiry.hooks = append(db.expiry.hooks, fn)
+		return nil
+	}
+	s := &expiryScheduler{
+		hooks: []func(collection, key string){fn},
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	db.expiry = s
+	if err := db.refillExpiry(); err != nil {
+		db.expiry = nil
+		return err
+	}
+	go db.runExpiry(s)
+	return nil
+}
+
+// noteExpiry is called by applyRecord for every change to the index. It
+// schedules keys written with an expiry and remembers expired keys that are
+// replaced before the scheduler reported them. Callers must hold db.mu.
+func (db *DB) noteExpiry(compKey string, old indexEntry, replaced bool, op byte, expiresAt int64) {
+	s := db.expiry
+	if s == nil {
+		return
+	}
+	if collection, _ := SplitKey(compKey); isInternalCollection(collection) {
+		return
+	}
+	if replaced && !s.purging && old.expired(db.now().UnixNano()) {
+		s.pending = append(s.pending, compKey)
+		s.signal()
+	}
+	if op != OpPut || expiresAt == 0 || expiresAt > s.horizon {
+		return
+	}
+	heap.Push(&s.heap, expiration{compKey: compKey, expiresAt: expiresAt})
+	if s.heap[0].compKey == compKey && s.heap[0].expiresAt == expiresAt {
+		s.signal()
+	}
+	if len(s.heap) > 2*expiryHeapSize {
+		s.truncate()
+	}
+}
+
+// noteExpired reports keys that Compact dropped because they had expired.
+// Callers must hold db.mu.
+func (db *DB) noteExpired(compKeys []string) {
+	if s := db.expiry; s != nil && len(compKeys) > 0 {
+		s.pending = append(s.pending, compKeys...)
+		s.signal()
+	}
+}
+
+func (s *expiryScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// truncate keeps the expiryHeapSize soonest expirations, and any that tie
+// with the last of them, and lowers the horizon to the last one kept.
+func (s *expiryScheduler) truncate() {
+	// A sorted slice is a valid heap
+	slices.SortFunc(s.heap, func(a, b expiration) int {
+		return cmp.Compare(a.expiresAt, b.expiresAt)
+	})
+	last := s.heap[expiryHeapSize-1].expiresAt
+	n := expiryHeapSize
+	for n < len(s.heap) && s.heap[n].expiresAt == last {
+		n++
+	}
+	if n < len(s.heap) {
+		s.heap, s.horizon = s.heap[:n], last
+	}
+}
+
+// stale reports whether keys expiring before the soonest tracked one may be
+// missing from the heap, after it drained or a purge failed.
+func (s *expiryScheduler) stale() bool {
+	if len(s.heap) == 0 {
+		return s.horizon != math.MaxInt64
+	}
+	return s.heap[0].expiresAt > s.horizon
+}
+
+// refillExpiry rebuilds the heap from the index. Callers must hold db.mu.
+func (db *DB) refillExpiry() error {
+	s := db.expiry
+	s.heap = s.heap[:0]
+	s.horizon = math.MaxInt64
+	err := db.index.each(func(k string, e indexEntry) error {
+		if collection, _ := SplitKey(k); e.ExpiresAt > 0 && !isInternalCollection(collection) {
+			s.heap = append(s.heap, expiration{compKey: k, expiresAt: e.ExpiresAt})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(s.heap) > expiryHeapSize {
+		s.truncate()
+	} else {
+		heap.Init(&s.heap)
+	}
+	return nil
+}
+
+// runExpiry is the scheduler's goroutine. It fires what is due, then sleeps
+// until the next expiration or a wake-up.
+func (db *DB) runExpiry(s *expiryScheduler) {
+	defer close(s.done)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		_, wait := db.fireExpired()
+		timer.Reset(wait)
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// FireExpired reports the keys that have expired by the database's clock
+// to the OnExpire hooks right away, as the scheduler does when their time
+// comes, and returns how many there were. It is for tests that move the
+// clock with Options.Now rather than wait.
+func (db *DB) FireExpired() int {
+	n, _ := db.fireExpired()
+	return n
+}
+
+// fireExpired tombstones the due keys and calls the hooks for them and the
+// pending keys. It returns how many keys it reported and how long the
+// scheduler may sleep.
+func (db *DB) fireExpired() (int, time.Duration) {
+	db.mu.Lock()
+	s := db.expiry
+	if s == nil || db.closed {
+		db.mu.Unlock()
+		return 0, time.Hour
+	}
+	if db.thaw != nil {
+		db.mu.Unlock()
+		return 0, expiryRetry
+	}
+
+	failed := false
+	if s.stale() {
+		if err := db.refillExpiry(); err != nil {
+			db.logger().Warn("nokhal: scheduling expirations failed", "path", db.path, "err", err)
+			failed = true
+		}
+	}
+
+	now := db.now().UnixNano()
+	var due []batchRecord
+	var first int64 // Expiry of the first due key
+	seen := make(map[string]bool)
+	for len(s.heap) > 0 && s.heap[0].expiresAt < now {
+		x := heap.Pop(&s.heap).(expiration)
+		entry, ok, err := db.index.get(x.compKey)
+		if err != nil || !ok || entry.ExpiresAt != x.expiresAt || seen[x.compKey] {
+			continue // Stale, or scheduled twice by writes expiring at once
+		}
+		seen[x.compKey] = true
+		if len(due) == 0 {
+			first = x.expiresAt
+		}
+		collection, key := SplitKey(x.compKey)
+		due = append(due, batchRecord{collection: collection, key: key, op: OpDelete})
+	}
+	if len(due) > 0 {
+		s.purging = true
+		err := db.commitWrites(due)
+		s.purging = false
+		if err != nil {
+			// The keys are still indexed, so the next refill retries them
+			db.logger().Warn("nokhal: tombstoning expired keys failed", "path", db.path, "keys", len(due), "err", err)
+			s.horizon = min(s.horizon, first-1)
+			due, failed = nil, true
+		}
+	}
+	var expired []string
+	for _, w := range due {
+		expired = append(expired, compositeKey(w.collection, w.key))
+	}
+	expired = append(expired, s.pending...)
+	s.pending = nil
+
+	wait := time.Hour
+	switch {
+	case failed:
+		wait = expiryRetry
+	case s.stale():
+		wait = 0 // Refill from the index at once
+	case len(s.heap) > 0:
+		wait = max(time.Duration(s.heap[0].expiresAt-now+1), 0)
+	}
+	hooks := slices.Clone(s.hooks)
+	db.mu.Unlock()
+
+	for _, k := range expired {
+		collection, key := SplitKey(k)
+		for _, fn := range hooks {
+			fn(collection, key)
+		}
+	}
+	return len(expired), wait
+}
+
+// stopExpiry ends the scheduler's goroutine, waiting for hooks in progress
+// to return.
+func (db *DB) stopExpiry() {
+	db.mu.Lock()
+	s := db.expiry
+	db.mu.Unlock()
+	if s == nil {
+		return
+	}
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	<-s.done
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// expiryLog records OnExpire calls.
+type expiryLog struct {
+	mu    sync.Mutex
+	fired map[string][]time.Time
+}
+
+func newExpiryLog() *expiryLog {
+	return &expiryLog{fired: make(map[string][]time.Time)}
+}
+
+func (l *expiryLog) hook(collection, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := collection + ":" + key
+	l.fired[k] = append(l.fired[k], time.Now())
+}
+
+// wait waits for every one of keys to have been reported, since the
+// scheduler's goroutine may be the one reporting them.
+func (l *expiryLog) wait(t *testing.T, keys ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		missing := ""
+		for _, k := range keys {
+			if len(l.fired[k]) == 0 {
+				missing = k
+				break
+			}
+		}
+		l.mu.Unlock()
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was never reported expired", missing)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := newExpiryLog()
+	if err := db.OnExpire(log.hook); err != nil {
+		t.Fatal(err)
+	}
+
+	db.PutWithTTL("col", "a", []byte("a"), time.Minute)
+	db.PutWithTTL("col", "b", []byte("b"), time.Minute)
+	db.PutWithTTL("col", "c", []byte("c"), 10*time.Minute)
+	db.PutWithTTL("col", "e", []byte("e"), 10*time.Minute)
+	db.Put("col", "d", []byte("d"))
+	// Rewriting before expiry reschedules
+	db.PutWithTTL("col", "b", []byte("b"), 5*time.Minute)
+
+	clock.Advance(2 * time.Minute)
+	db.FireExpired()
+	log.wait(t, "col:a")
+	if _, err := db.Get("col", "a"); err != ErrNotFound {
+		t.Errorf("Get of a reported key: %v", err)
+	}
+	if _, err := db.Get("col", "b"); err != nil {
+		t.Errorf("rescheduled key expired early: %v", err)
+	}
+
+	// A key that expired and was rewritten before the scheduler got to it
+	clock.Advance(4 * time.Minute)
+	db.Put("col", "b", []byte("b2"))
+	log.wait(t, "col:b")
+	if v, err := db.Get("col", "b"); err != nil || string(v) != "b2" {
+		t.Errorf("rewritten key = %q, %v", v, err)
+	}
+
+	// One dropped by Compact, and one left to the scheduler
+	clock.Advance(5 * time.Minute)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.FireExpired()
+	log.wait(t, "col:c", "col:e")
+
+	// Keys that expire while the database is closed are reported on the
+	// first OnExpire after it reopens
+	db.PutWithTTL("col", "f", []byte("f"), time.Minute)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.OnExpire(log.hook); err != os.ErrClosed {
+		t.Errorf("OnExpire after Close: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	db, err = OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.OnExpire(log.hook); err != nil {
+		t.Fatal(err)
+	}
+	log.wait(t, "col:f")
+
+	db.FireExpired()
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for _, k := range []string{"col:a", "col:b", "col:c", "col:e", "col:f"} {
+		if n := len(log.fired[k]); n != 1 {
+			t.Errorf("%s reported %d times", k, n)
+		}
+	}
+	if len(log.fired) != 5 {
+		t.Errorf("reported %v", log.fired)
+	}
+}
+
+func TestOnExpireTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for real expirations")
+	}
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	log := newExpiryLog()
+	if err := db.OnExpire(log.hook); err != nil {
+		t.Fatal(err)
+	}
+
+	// More keys than the scheduler tracks at once, expiring over half a
+	// second, in no particular order
+	const n = 2*expiryHeapSize + 500
+	ttl := func(i int) time.Duration {
+		return 10*time.Millisecond + time.Duration(i*7919%n)*490*time.Millisecond/n
+	}
+	due := make(map[string]time.Time, n)
+	for i := range n {
+		key := fmt.Sprintf("k%05d", i)
+		due["col:"+key] = time.Now().Add(ttl(i))
+		if err := db.PutWithTTL("col", key, nil, ttl(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := make([]string, 0, n)
+	for k := range due {
+		keys = append(keys, k)
+	}
+	log.wait(t, keys...)
+	time.Sleep(50 * time.Millisecond)
+
+	const tolerance = 250 * time.Millisecond
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for k, when := range due {
+		fired := log.fired[k]
+		if len(fired) != 1 {
+			t.Errorf("%s reported %d times", k, len(fired))
+			continue
+		}
+		if fired[0].Before(when) || fired[0].After(when.Add(tolerance)) {
+			t.Errorf("%s reported %v after it was due", k, fired[0].Sub(when))
+		}
+	}
+}
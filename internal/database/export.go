@@ -0,0 +1,605 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exportVersion is the format of the header line Export starts with.
+// Version 2 added checkpoint and footer lines, which earlier versions would
+// import as records.
+const exportVersion = 2
+
+// exportCheckpointEvery is the number of records between checkpoint lines.
+// Tests lower it.
+var exportCheckpointEvery = 10000
+
+var (
+	// ErrExportUndated is returned by ImportWithOptions when ShiftExpiry is
+	// set for an export without a header line, written before exports
+	// carried their creation time.
+	ErrExportUndated = errors.New("export has no creation time to shift expiry by")
+
+	// ErrExportTruncated is returned when an export ends before its footer
+	// line, as one cut short by a failed write does.
+	ErrExportTruncated = errors.New("export ends before its footer")
+
+	// ErrExportChecksum is returned for a checkpoint or footer line that does
+	// not match the records before it.
+	ErrExportChecksum = errors.New("export does not match its checksum")
+)
+
+// exportRecord is one line of a JSON-lines export. Value is base64 encoded.
+type exportRecord struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Value      []byte `json:"value"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+}
+
+// exportHeader is the first line of an export. CreatedAt is the read
+// timestamp of the scan, by the database clock. ResumeAfter is the combined
+// key an ExportResume continued after.
+type exportHeader struct {
+	Version     int    `json:"nokhal_export"`
+	CreatedAt   int64  `json:"created_at"`
+	ResumeAfter string `json:"resume_after,omitempty"`
+}
+
+// exportMark is a checkpoint or footer line: the number of records before
+// it and the SHA-256 of their lines, each without its newline, in hex. A
+// checkpoint also names the combined key of the last of those records.
+type exportMark struct {
+	Count   int    `json:"count"`
+	Hash    string `json:"hash"`
+	LastKey string `json:"last_key,omitempty"`
+}
+
+// ErrExportInterrupted is returned by Export and ExportResume when writing
+// fails. ResumeAfter is the combined key to pass to ExportResume to continue
+// in a new file, and Written the number of records in the file up to its last
+// checkpoint, which ImportOptions.AllowPartial imports.
+type ErrExportInterrupted struct {
+	ResumeAfter string
+	Written     int
+	Err         error
+}
+
+func (e *ErrExportInterrupted) Error() string {
+	return fmt.Sprintf("export interrupted after %d records (resume after %q): %v", e.Written, e.ResumeAfter, e.Err)
+}
+
+func (e *ErrExportInterrupted) Unwrap() error {
+	return e.Err
+}
+
+// Export writes every live record whose combined key starts with prefix to w
+// as JSON lines, in key order, after a header line with the time of the
+// export. Values are written decrypted. The records are read in one scan
+// under the read lock, so the export is a consistent snapshot as of that
+// time, and expiry is judged by it.
+//
+// Every exportCheckpointEvery records a checkpoint line carries the count
+// and a running hash of the records so far, and w is flushed; a footer line
+// with the totals ends the export, so that a cut-short file is detected. If
+// a write fails, the error is an *ErrExportInterrupted telling where to
+// resume.
+func (db *DB) Export(w io.Writer, prefix string) (int, error) {
+	return db.export(w, prefix, "")
+}
+
+// ExportResume continues an interrupted Export: it writes a new export of
+// the records under prefix whose combined key comes after afterKey, the
+// ResumeAfter of the *ErrExportInterrupted. The records are read anew, so
+// the two files together hold the data as of two points in time. Import the
+// interrupted file with ImportOptions.AllowPartial, then this one.
+func (db *DB) ExportResume(w io.Writer, prefix string, afterKey string) (int, error) {
+	return db.export(w, prefix, afterKey)
+}
+
+func (db *DB) export(w io.Writer, prefix, afterKey string) (int, error) {
+	db.mu.RLock()
+	now := db.now().UnixNano()
+	records := []Record{}
+	var err error
+	if db.mayMatchPrefix(prefix) {
+		records, err = db.scanLiveAt(prefixMatcher(prefix), now)
+	}
+	db.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if afterKey != "" {
+		// Records are sorted by collection, then key
+		collection, key := SplitKey(afterKey)
+		i, found := slices.BinarySearchFunc(records, Record{Collection: collection, Key: key}, func(a, b Record) int {
+			return cmp.Or(strings.Compare(a.Collection, b.Collection), strings.Compare(a.Key, b.Key))
+		})
+		if found {
+			i++
+		}
+		records = records[i:]
+	}
+
+	ew := exportWriter{bw: bufio.NewWriter(w), hash: sha256.New(), resume: afterKey}
+	fail := func(err error) (int, error) {
+		return ew.checkpointed, &ErrExportInterrupted{ResumeAfter: ew.resume, Written: ew.checkpointed, Err: err}
+	}
+	if err := ew.line(exportHeader{Version: exportVersion, CreatedAt: now, ResumeAfter: afterKey}); err != nil {
+		return fail(err)
+	}
+	for i, rec := range records {
+		line := exportRecord{
+			Collection: rec.Collection,
+			Key:        rec.Key,
+			Value:      rec.Value,
+			ExpiresAt:  rec.ExpiresAt,
+		}
+		if err := ew.record(&line); err != nil {
+			return fail(err)
+		}
+		if (i+1)%exportCheckpointEvery == 0 {
+			if err := ew.checkpoint(i+1, compositeKey(rec.Collection, rec.Key)); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	end := struct {
+		End exportMark `json:"end"`
+	}{exportMark{Count: len(records), Hash: hex.EncodeToString(ew.hash.Sum(nil))}}
+	if err := ew.line(end); err != nil {
+		return fail(err)
+	}
+	if err := ew.bw.Flush(); err != nil {
+		return fail(err)
+	}
+	return len(records), nil
+}
+
+// exportWriter writes the lines of an export and keeps the running hash of
+// its records.
+type exportWriter struct {
+	bw   *bufio.Writer
+	hash hash.Hash
+
+	resume       string // Combined key to resume after
+	checkpointed int    // Records written up to the last checkpoint
+}
+
+func (ew *exportWriter) line(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := ew.bw.Write(data); err != nil {
+		return err
+	}
+	return ew.bw.WriteByte('\n')
+}
+
+func (ew *exportWriter) record(line *exportRecord) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	ew.hash.Write(data)
+	if _, err := ew.bw.Write(data); err != nil {
+		return err
+	}
+	return ew.bw.WriteByte('\n')
+}
+
+// checkpoint writes a checkpoint line after count records, the last of them
+// lastKey, and flushes, so that the records before it are in w.
+func (ew *exportWriter) checkpoint(count int, lastKey string) error {
+	mark := struct {
+		Checkpoint exportMark `json:"checkpoint"`
+	}{exportMark{Count: count, Hash: hex.EncodeToString(ew.hash.Sum(nil)), LastKey: lastKey}}
+	if err := ew.line(mark); err != nil {
+		return err
+	}
+	if err := ew.bw.Flush(); err != nil {
+		return err
+	}
+	ew.resume, ew.checkpointed = lastKey, count
+	return nil
+}
+
+// ImportOptions configures ImportWithOptions.
+type ImportOptions struct {
+	// Overwrite replaces keys that exist in the database. Without it they
+	// are kept and counted in ImportReport.SkippedExisting.
+	Overwrite bool
+
+	// KeepExpired imports records that have expired by the time of the
+	// import, keeping their expiry, so they are written already expired:
+	// reads do not find them, but the records are in the log, for forensic
+	// restores. Without it they are skipped and listed in
+	// ImportReport.SkippedExpired.
+	KeepExpired bool
+
+	// ShiftExpiry moves every expiry forward by the time elapsed since the
+	// export was taken, so records keep the TTL they had left then, for
+	// cloning a database into a test environment. It needs the creation
+	// time in the export's header line, and fails with ErrExportUndated on
+	// exports that lack one.
+	ShiftExpiry bool
+
+	// AllowPartial imports an export that ends before its footer line, as an
+	// interrupted Export leaves it, up to its last checkpoint. Without it
+	// such an export fails with ErrExportTruncated and nothing is applied.
+	AllowPartial bool
+}
+
+// ImportReport accounts for every record of an import.
+type ImportReport struct {
+	Applied         int              // Records written
+	SkippedExpired  []string         // Combined keys of expired records, in stream order
+	SkippedExisting int              // Records whose key exists, without Overwrite
+	SkippedInternal int              // Records of internal collections, which are never imported
+	Errors          []*ErrImportLine // Malformed lines, or the line whose write failed
+	ExportedAt      time.Time        // When the export was taken, zero if it has no header
+	Shift           time.Duration    // Added to each expiry by ShiftExpiry
+	Partial         bool             // The export had no footer and was read up to its last checkpoint
+}
+
+// ErrImportLine is an import failure at line Line of the stream, counting
+// from 1.
+type ErrImportLine struct {
+	Line int
+	Err  error
+}
+
+func (e *ErrImportLine) Error() string {
+	return fmt.Sprintf("import line %d: %v", e.Line, e.Err)
+}
+
+func (e *ErrImportLine) Unwrap() error {
+	return e.Err
+}
+
+// Import reads a JSON-lines export and writes its records, returning how many
+// were written. Existing keys are kept unless overwrite is set; records that
+// have expired in the meantime and internal collections are skipped. See
+// ImportWithOptions.
+func (db *DB) Import(r io.Reader, overwrite bool) (int, error) {
+	report, err := db.ImportWithOptions(r, ImportOptions{Overwrite: overwrite})
+	return report.Applied, err
+}
+
+// ImportWithOptions reads a JSON-lines export and writes its records,
+// reporting what it did with each. The whole stream is parsed before
+// anything is applied, so a malformed export changes nothing: every bad line
+// is listed in the report's Errors and the first is returned. A write that
+// fails stops the import there and is reported the same way; the records
+// before it stay written. Expiry is judged by one read of the database clock
+// when the import starts, and imported records are stamped with it.
+func (db *DB) ImportWithOptions(r io.Reader, opts ImportOptions) (ImportReport, error) {
+	var report ImportReport
+	var lines []exportRecord
+	var numbers []int
+	stream, err := readExport(r, &report, func(line exportRecord, n int) {
+		lines = append(lines, line)
+		numbers = append(numbers, n)
+	})
+	if err != nil {
+		return report, err
+	}
+	if stream.truncated() {
+		if !opts.AllowPartial {
+			return report, fmt.Errorf("%w: %d of %d records are covered by a checkpoint", ErrExportTruncated, stream.verified, len(lines))
+		}
+		lines = lines[:stream.verified]
+		report.Partial = true
+	}
+	header := stream.header
+	if header != nil {
+		report.ExportedAt = time.Unix(0, header.CreatedAt)
+	} else if opts.ShiftExpiry {
+		return report, ErrExportUndated
+	}
+
+	if err := db.lockWrite(); err != nil {
+		return report, err
+	}
+	defer db.mu.Unlock()
+
+	now := db.now().UnixNano()
+	if opts.ShiftExpiry {
+		report.Shift = time.Duration(now - header.CreatedAt)
+	}
+	for i, line := range lines {
+		if isInternalCollection(line.Collection) {
+			report.SkippedInternal++
+			continue
+		}
+		compKey := compositeKey(line.Collection, line.Key)
+		_, exists, err := db.index.get(compKey)
+		if err != nil {
+			return report, report.fail(numbers[i], err)
+		}
+		if exists && !opts.Overwrite {
+			report.SkippedExisting++
+			continue
+		}
+
+		expiresAt := line.ExpiresAt
+		if expiresAt > 0 {
+			expiresAt += int64(report.Shift)
+			if expiresAt < now && !opts.KeepExpired {
+				report.SkippedExpired = append(report.SkippedExpired, compKey)
+				continue
+			}
+		} else if ttl := db.defaultTTL[line.Collection]; ttl > 0 {
+			expiresAt = now + int64(ttl)
+		}
+		if err := db.putAt(line.Collection, line.Key, line.Value, now, expiresAt); err != nil {
+			return report, report.fail(numbers[i], err)
+		}
+		report.Applied++
+	}
+	return report, nil
+}
+
+// fail records err at line in the report and returns it.
+func (r *ImportReport) fail(line int, err error) error {
+	e := &ErrImportLine{Line: line, Err: err}
+	r.Errors = append(r.Errors, e)
+	return e
+}
+
+// exportStream is what readExport finds in an export besides its records.
+type exportStream struct {
+	header   *exportHeader // Nil for exports without a header line
+	end      *exportMark   // The footer
+	verified int           // Records covered by the last matching checkpoint or footer
+}
+
+// truncated reports whether an export that should end with a footer lacks
+// one. Exports from before version 2 have none.
+func (s exportStream) truncated() bool {
+	return s.header != nil && s.header.Version >= 2 && s.end == nil
+}
+
+// readExport parses an export, calling record with each record and its line
+// number, and checks every checkpoint and the footer against the records
+// before them. Malformed lines are added to the report, and the first is
+// returned once the whole stream has been read.
+func readExport(r io.Reader, report *ImportReport, record func(line exportRecord, n int)) (exportStream, error) {
+	var stream exportStream
+	h := sha256.New()
+	count := 0
+	check := func(n int, mark *exportMark) bool {
+		if mark.Count != count || mark.Hash != hex.EncodeToString(h.Sum(nil)) {
+			report.fail(n, ErrExportChecksum)
+			return false
+		}
+		stream.verified = count
+		return true
+	}
+
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return exportStream{}, err
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 {
+			var line struct {
+				exportHeader
+				exportRecord
+				Checkpoint *exportMark `json:"checkpoint"`
+				End        *exportMark `json:"end"`
+			}
+			jerr := json.Unmarshal(trimmed, &line)
+			switch {
+			case jerr != nil && err == io.EOF && stream.truncated():
+				// A last line without its newline is where a cut-short
+				// export stops, and the missing footer tells as much
+			case jerr != nil:
+				report.fail(n, jerr)
+			case stream.end != nil:
+				report.fail(n, errors.New("line after the footer"))
+			case line.Version != 0:
+				switch {
+				case stream.header != nil || count > 0:
+					report.fail(n, errors.New("header line is not the first line"))
+				case line.Version > exportVersion:
+					report.fail(n, fmt.Errorf("unsupported export version %d", line.Version))
+				default:
+					stream.header = &line.exportHeader
+				}
+			case line.Checkpoint != nil:
+				check(n, line.Checkpoint)
+			case line.End != nil:
+				if check(n, line.End) {
+					stream.end = line.End
+				}
+			default:
+				h.Write(trimmed)
+				count++
+				record(line.exportRecord, n)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(report.Errors) > 0 {
+		return exportStream{}, report.Errors[0]
+	}
+	return stream, nil
+}
+
+// VerifyExport reads an export without importing it and checks each
+// checkpoint and the footer against the records before them, returning the
+// number of records they cover. A mismatch fails with an *ErrImportLine
+// wrapping ErrExportChecksum, and an export that ends before its footer with
+// ErrExportTruncated. Exports written before footers existed are only
+// checked to parse.
+func VerifyExport(r io.Reader) (int, error) {
+	var report ImportReport
+	count := 0
+	stream, err := readExport(r, &report, func(exportRecord, int) { count++ })
+	if err != nil {
+		return 0, err
+	}
+	if stream.truncated() {
+		return stream.verified, fmt.Errorf("%w: %d of %d records are covered by a checkpoint", ErrExportTruncated, stream.verified, count)
+	}
+	if stream.end == nil {
+		return count, nil
+	}
+	return stream.verified, nil
+}
+
+// ExportEncrypted is Export wrapped in a passphrase-sealed envelope, for
+// handing a subset of records to someone who must not learn the database
+// password.
+func (db *DB) ExportEncrypted(w io.Writer, prefix string, passphrase string) (int, error) {
+	sw, err := newSealWriter(w, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	n, err := db.Export(sw, prefix)
+	if err != nil {
+		return n, err
+	}
+	return n, sw.Close()
+}
+
+// ImportEncrypted imports a stream written by ExportEncrypted. A wrong
+// passphrase or a tampered or truncated envelope fails before any record is
+// applied.
+func (db *DB) ImportEncrypted(r io.Reader, passphrase string, overwrite bool) (int, error) {
+	report, err := db.ImportEncryptedWithOptions(r, passphrase, ImportOptions{Overwrite: overwrite})
+	return report.Applied, err
+}
+
+// ImportEncryptedWithOptions is ImportWithOptions for a stream written by
+// ExportEncrypted.
+func (db *DB) ImportEncryptedWithOptions(r io.Reader, passphrase string, opts ImportOptions) (ImportReport, error) {
+	or, err := newOpenReader(r, passphrase)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	return db.ImportWithOptions(or, opts)
+}
+
+// ExportCollection copies the live records of collection, and the lists
+// stored under its keys, into a new database at destPath encrypted with
+// destPassword, with its own salt and keys, for splitting a collection off
+// into a file of its own. The collection's plaintext, TTL and
+// immutable settings are carried over. Values are written as callers read
+// them, so a collection transform is not applied in the new file. destPath
+// must not exist, and on failure nothing is left there. The records are read
+// under the read lock throughout, so the copy is a consistent snapshot, and
+// the source is not changed.
+func (db *DB) ExportCollection(collection, destPath, destPassword string) (err error) {
+	if isInternalCollection(collection) {
+		return ErrCollectionInUse
+	}
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("export collection to %s: %w", destPath, os.ErrExist)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	dest, err := OpenWithOptions(destPath, destPassword, Options{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dest.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(destPath)
+			os.Remove(destPath + ".hint")
+		}
+	}()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	now := db.now().UnixNano()
+
+	// Plaintext has to be set before the collection has records, the other
+	// settings after, so that the copy is not held to them
+	if err := dest.SetCollectionPlaintext(collection, db.plaintext[collection]); err != nil {
+		return err
+	}
+
+	keyPrefix := compositeKey(collection, "")
+	listsPrefix := compositeKey(listCollection, fmt.Sprintf("%d:%s", len(collection), collection))
+	var keys []string
+	err = db.index.each(func(k string, _ indexEntry) error {
+		if strings.HasPrefix(k, keyPrefix) || strings.HasPrefix(k, listsPrefix) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.Sort(keys)
+
+	for batch := range slices.Chunk(keys, mapValuesBatchSize) {
+		writes := make([]batchRecord, 0, len(batch))
+		for _, compKey := range batch {
+			rec, _, err := db.readRaw(compKey, now)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if rec.Op != OpPut {
+				continue
+			}
+			value, err := db.openUserValue(rec, compKey)
+			if err != nil {
+				return fmt.Errorf("export collection: %s: %w", compKey, err)
+			}
+			coll, key := SplitKey(compKey)
+			writes = append(writes, batchRecord{
+				collection: coll,
+				key:        key,
+				value:      value,
+				op:         OpPut,
+				flags:      rec.Flags & FlagSet,
+				keepExpiry: true,
+				expiresAt:  rec.ExpiresAt,
+			})
+		}
+		if len(writes) == 0 {
+			continue
+		}
+		if err := dest.lockWrite(); err != nil {
+			return err
+		}
+		err := dest.commitWrites(writes)
+		dest.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if ttl := db.defaultTTL[collection]; ttl > 0 {
+		if err := dest.SetCollectionTTL(collection, ttl); err != nil {
+			return err
+		}
+	}
+	return dest.SetCollectionImmutable(collection, db.immutable[collection])
+}
@@ -0,0 +1,373 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportEncrypted(t *testing.T) {
+	src, cleanupSrc := tempFile()
+	defer cleanupSrc()
+	defer os.Remove(src + ".hint")
+	dst, cleanupDst := tempFile()
+	defer cleanupDst()
+	defer os.Remove(dst + ".hint")
+
+	db, err := Open(src, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Large enough to span several envelope chunks
+	big := bytes.Repeat([]byte("0123456789"), 20000)
+	db.Put("share", "big", big)
+	db.PutWithTTL("share", "ttl", []byte("short-lived"), time.Hour)
+	db.Put("share", "a", []byte("new"))
+	db.Put("private", "secret", []byte("keep"))
+
+	var buf bytes.Buffer
+	n, err := db.ExportEncrypted(&buf, "share:", "team-pass")
+	if err != nil || n != 3 {
+		t.Fatalf("ExportEncrypted: %d, %v", n, err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("short-lived")) {
+		t.Fatal("Export leaked plaintext")
+	}
+	stream := buf.Bytes()
+
+	target, err := Open(dst, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	target.Put("share", "a", []byte("old"))
+
+	// Wrong passphrase and truncation fail before anything is applied
+	if _, err := target.ImportEncrypted(bytes.NewReader(stream), "wrong", true); err != ErrInvalidPassword {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	if _, err := target.ImportEncrypted(bytes.NewReader(stream[:len(stream)-10]), "team-pass", true); err == nil {
+		t.Error("Truncated envelope should fail")
+	}
+	if _, err := target.Get("share", "big"); err != ErrNotFound {
+		t.Errorf("Failed import applied records: %v", err)
+	}
+
+	n, err = target.ImportEncrypted(bytes.NewReader(stream), "team-pass", false)
+	if err != nil || n != 2 {
+		t.Fatalf("ImportEncrypted: %d, %v", n, err)
+	}
+	if val, _ := target.Get("share", "a"); string(val) != "old" {
+		t.Errorf("Existing key overwritten without overwrite: %q", val)
+	}
+	if val, _ := target.Get("share", "big"); !bytes.Equal(val, big) {
+		t.Error("Big value mismatch after import")
+	}
+	if _, err := target.Get("private", "secret"); err != ErrNotFound {
+		t.Error("Record outside the prefix was exported")
+	}
+
+	n, err = target.ImportEncrypted(bytes.NewReader(stream), "team-pass", true)
+	if err != nil || n != 3 {
+		t.Fatalf("ImportEncrypted overwrite: %d, %v", n, err)
+	}
+	if val, _ := target.Get("share", "a"); string(val) != "new" {
+		t.Errorf("Expected overwrite, got %q", val)
+	}
+	info, _ := target.CollectionInfo("share")
+	if info.Keys != 3 {
+		t.Errorf("Expected 3 keys, got %d", info.Keys)
+	}
+}
+
+func TestImportReport(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	exported := clock.Now()
+	open := func(name string) *DB {
+		t.Helper()
+		db, err := OpenWithOptions(filepath.Join(dir, name), "pass", Options{Now: clock.Now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	src := open("src.nok")
+	src.Put("share", "a", []byte("a"))
+	src.PutWithTTL("share", "b", []byte("b"), time.Hour)
+	src.PutWithTTL("share", "c", []byte("c"), 2*time.Hour)
+	var buf bytes.Buffer
+	if n, err := src.Export(&buf, "share:"); err != nil || n != 3 {
+		t.Fatalf("Export: %d, %v", n, err)
+	}
+	stream := buf.String()
+	clock.Advance(90 * time.Minute)
+
+	dst := open("dst.nok")
+	dst.Put("share", "a", []byte("existing"))
+	report, err := dst.ImportWithOptions(strings.NewReader(stream), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Applied != 1 || report.SkippedExisting != 1 || fmt.Sprint(report.SkippedExpired) != "[share:b]" {
+		t.Errorf("report %+v", report)
+	}
+	if !report.ExportedAt.Equal(exported) || report.Shift != 0 {
+		t.Errorf("exported at %v, shift %v", report.ExportedAt, report.Shift)
+	}
+
+	// Expired records written as such, for forensics
+	forensic := open("forensic.nok")
+	report, err = forensic.ImportWithOptions(strings.NewReader(stream), ImportOptions{KeepExpired: true})
+	if err != nil || report.Applied != 3 || len(report.SkippedExpired) != 0 {
+		t.Fatalf("KeepExpired: %+v, %v", report, err)
+	}
+	if _, err := forensic.Get("share", "b"); err != ErrNotFound {
+		t.Errorf("Get of an expired import: %v", err)
+	}
+	now := clock.Now()
+	clock.Set(exported, 0)
+	if v, err := forensic.Get("share", "b"); err != nil || string(v) != "b" {
+		t.Errorf("expired import before its expiry = %q, %v", v, err)
+	}
+	clock.Set(now, 0)
+
+	// Shifted, the TTLs left at export time start over
+	clone := open("clone.nok")
+	report, err = clone.ImportWithOptions(strings.NewReader(stream), ImportOptions{ShiftExpiry: true})
+	if err != nil || report.Applied != 3 || report.Shift != 90*time.Minute {
+		t.Fatalf("ShiftExpiry: %+v, %v", report, err)
+	}
+	clock.Advance(59 * time.Minute)
+	if _, err := clone.Get("share", "b"); err != nil {
+		t.Errorf("shifted key expired early: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if _, err := clone.Get("share", "b"); err != ErrNotFound {
+		t.Errorf("shifted key did not expire: %v", err)
+	}
+
+	// Exports from before the header line import, but cannot be shifted
+	undated := stream[strings.Index(stream, "\n")+1:]
+	if _, err := open("undated.nok").ImportWithOptions(strings.NewReader(undated), ImportOptions{ShiftExpiry: true}); err != ErrExportUndated {
+		t.Errorf("shifting an undated export: %v", err)
+	}
+	if report, err := open("undated2.nok").ImportWithOptions(strings.NewReader(undated), ImportOptions{}); err != nil || report.Applied != 1 {
+		t.Errorf("undated export: %+v, %v", report, err)
+	}
+
+	// Every malformed line is reported, and nothing is applied
+	lines := strings.SplitAfter(stream, "\n")
+	bad := lines[0] + "{\n" + lines[1] + stream[:len(lines[0])] + lines[2]
+	target := open("bad.nok")
+	report, err = target.ImportWithOptions(strings.NewReader(bad), ImportOptions{})
+	var lineErr *ErrImportLine
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 {
+		t.Fatalf("malformed import: %v", err)
+	}
+	if len(report.Errors) != 2 || report.Errors[1].Line != 4 || report.Applied != 0 {
+		t.Errorf("malformed import report %+v", report)
+	}
+	if keys, _ := target.List("share"); len(keys) != 0 {
+		t.Errorf("malformed import applied %v", keys)
+	}
+}
+
+// failingWriter takes limit bytes, then fails as a full disk does.
+type failingWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if room := w.limit - w.buf.Len(); len(p) > room {
+		w.buf.Write(p[:room])
+		return room, errors.New("no space left on device")
+	}
+	return w.buf.Write(p)
+}
+
+func TestExportCheckpoints(t *testing.T) {
+	defer func(every int) { exportCheckpointEvery = every }(exportCheckpointEvery)
+	exportCheckpointEvery = 2
+
+	dir := t.TempDir()
+	open := func(name string) *DB {
+		t.Helper()
+		db, err := OpenWithOptions(filepath.Join(dir, name), "pass", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	src := open("src.nok")
+	for i := range 5 {
+		src.Put("col", fmt.Sprint("k", i), []byte(fmt.Sprint("v", i)))
+	}
+	var buf bytes.Buffer
+	if n, err := src.Export(&buf, "col:"); err != nil || n != 5 {
+		t.Fatalf("Export: %d, %v", n, err)
+	}
+	stream := buf.String()
+	lines := strings.SplitAfter(stream, "\n")
+	if len(lines) != 10 || !strings.HasPrefix(lines[3], `{"checkpoint":{"count":2,`) ||
+		!strings.HasPrefix(lines[6], `{"checkpoint":{"count":4,`) || !strings.HasPrefix(lines[8], `{"end":{"count":5,`) {
+		t.Fatalf("export lines:\n%s", stream)
+	}
+	if n, err := VerifyExport(strings.NewReader(stream)); err != nil || n != 5 {
+		t.Errorf("VerifyExport: %d, %v", n, err)
+	}
+
+	// A changed record no longer matches the checkpoint after it
+	tampered := strings.Replace(stream, base64.StdEncoding.EncodeToString([]byte("v1")), base64.StdEncoding.EncodeToString([]byte("v9")), 1)
+	var lineErr *ErrImportLine
+	if _, err := VerifyExport(strings.NewReader(tampered)); !errors.Is(err, ErrExportChecksum) || !errors.As(err, &lineErr) || lineErr.Line != 4 {
+		t.Errorf("VerifyExport of a changed record: %v", err)
+	}
+
+	// Cut short, it is refused unless partial imports are allowed, which
+	// take the records up to the last checkpoint
+	cut := strings.Join(lines[:7], "") + lines[7][:10]
+	if n, err := VerifyExport(strings.NewReader(cut)); !errors.Is(err, ErrExportTruncated) || n != 4 {
+		t.Errorf("VerifyExport of a truncated export: %d, %v", n, err)
+	}
+	dst := open("dst.nok")
+	if _, err := dst.ImportWithOptions(strings.NewReader(cut), ImportOptions{}); !errors.Is(err, ErrExportTruncated) {
+		t.Errorf("importing a truncated export: %v", err)
+	}
+	if keys, _ := dst.List("col"); len(keys) != 0 {
+		t.Errorf("truncated import applied %v", keys)
+	}
+	report, err := dst.ImportWithOptions(strings.NewReader(cut), ImportOptions{AllowPartial: true})
+	if err != nil || report.Applied != 4 || !report.Partial {
+		t.Errorf("AllowPartial: %+v, %v", report, err)
+	}
+
+	// A failed write reports where to resume, and the two files together
+	// hold every record
+	w := &failingWriter{limit: len(strings.Join(lines[:4], "")) + 5}
+	_, err = src.Export(w, "col:")
+	var interrupted *ErrExportInterrupted
+	if !errors.As(err, &interrupted) || interrupted.ResumeAfter != "col:k1" || interrupted.Written != 2 {
+		t.Fatalf("interrupted Export: %v", err)
+	}
+	var rest bytes.Buffer
+	if n, err := src.ExportResume(&rest, "col:", interrupted.ResumeAfter); err != nil || n != 3 {
+		t.Fatalf("ExportResume: %d, %v", n, err)
+	}
+	resumed := open("resumed.nok")
+	if report, err := resumed.ImportWithOptions(&w.buf, ImportOptions{AllowPartial: true}); err != nil || report.Applied != 2 {
+		t.Fatalf("importing an interrupted export: %+v, %v", report, err)
+	}
+	if report, err := resumed.ImportWithOptions(&rest, ImportOptions{}); err != nil || report.Applied != 3 {
+		t.Fatalf("importing the resumed export: %+v, %v", report, err)
+	}
+	for i := range 5 {
+		if v, err := resumed.Get("col", fmt.Sprint("k", i)); err != nil || string(v) != fmt.Sprint("v", i) {
+			t.Errorf("k%d after resuming = %q, %v", i, v, err)
+		}
+	}
+}
+
+func TestExportCollection(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	db, err := OpenWithOptions(filepath.Join(dir, "src.nok"), "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := range 300 {
+		db.Put("users", fmt.Sprintf("u%03d", i), []byte(fmt.Sprint("user ", i)))
+	}
+	db.Put("users", "u000", []byte("updated"))
+	db.Delete("users", "u001")
+	db.PutWithTTL("users", "gone", []byte("x"), time.Minute)
+	db.PutWithTTL("users", "later", []byte("y"), time.Hour)
+	db.SAdd("users", "tags", []byte("a"), []byte("b"))
+	db.RPush("users", "log", []byte("1"), []byte("2"))
+	db.Put("orders", "o1", []byte("order"))
+	db.RPush("orders", "log", []byte("3"))
+	db.Put("users2", "u000", []byte("other"))
+	db.SetCollectionImmutable("users", true)
+	clock.Advance(2 * time.Minute)
+
+	destPath := filepath.Join(dir, "users.nok")
+	if err := db.ExportCollection("users", destPath, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ExportCollection("users", destPath, "other"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("export over an existing file: %v", err)
+	}
+	if err := db.ExportCollection("__nokhal_meta", filepath.Join(dir, "meta.nok"), "other"); err != ErrCollectionInUse {
+		t.Errorf("export of an internal collection: %v", err)
+	}
+
+	if _, err := OpenWithOptions(destPath, "pass", Options{}); err != ErrInvalidPassword {
+		t.Errorf("open with the source password: %v", err)
+	}
+	dest, err := OpenWithOptions(destPath, "other", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+
+	keys, err := dest.List("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 301 { // 299 of the loop, later and tags
+		t.Errorf("%d keys in the copy, want 301", len(keys))
+	}
+	if keys, _ := dest.List("orders"); len(keys) != 0 {
+		t.Errorf("other collection copied: %v", keys)
+	}
+	if keys, _ := dest.List("users2"); len(keys) != 0 {
+		t.Errorf("collection sharing the prefix copied: %v", keys)
+	}
+	for key, want := range map[string]string{"u000": "updated", "u299": "user 299", "later": "y"} {
+		if v, err := dest.Get("users", key); err != nil || string(v) != want {
+			t.Errorf("Get(%s) = %q, %v", key, v, err)
+		}
+	}
+	for _, key := range []string{"u001", "gone"} {
+		if _, err := dest.Get("users", key); err != ErrNotFound {
+			t.Errorf("Get(%s): %v", key, err)
+		}
+	}
+	if got := setString(t, dest, "users", "tags"); got != `["a" "b"]` {
+		t.Errorf("set in the copy = %s", got)
+	}
+	if got, _ := dest.GetList("users", "log"); fmt.Sprintf("%q", got) != `["1" "2"]` {
+		t.Errorf("list in the copy = %q", got)
+	}
+	if got, _ := dest.GetList("orders", "log"); len(got) != 0 {
+		t.Errorf("other collection's list copied: %q", got)
+	}
+
+	// Settings are carried over, and expiry is kept
+	if err := dest.Put("users", "u000", []byte("x")); err != ErrImmutableKey {
+		t.Errorf("overwrite in the copy: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := dest.Get("users", "later"); err != ErrNotFound {
+		t.Errorf("expiry not kept: %v", err)
+	}
+
+	// The source is unchanged
+	if v, err := db.Get("users", "u000"); err != nil || string(v) != "updated" {
+		t.Errorf("source Get = %q, %v", v, err)
+	}
+}
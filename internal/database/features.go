@@ -0,0 +1,130 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Feature is an optional capability that writes records an older build
+// cannot read. The header declares the features a file may contain: those
+// requested by the options it was created with, plus any turned on later
+// with EnableFeature. Writes never use a feature the header does not
+// declare, so a file only stops being readable by older builds when someone
+// asks for it.
+type Feature uint32
+
+const (
+	// FeatureCompressionDict allows values compressed with
+	// Options.CompressionDict.
+	FeatureCompressionDict Feature = 1 << iota
+
+	// FeatureTransforms allows values encoded by a Transform.
+	FeatureTransforms
+
+	// FeatureKDFParams marks a file whose key is derived with parameters
+	// other than DefaultKDF. Open declares it when creating a file with
+	// such Options.KDF; older builds would derive the wrong key.
+	FeatureKDFParams
+
+	// FeatureBoundAAD marks a file whose tombstones are all sealed, except
+	// in plaintext collections. Open declares it when creating a file; an
+	// unsealed tombstone anywhere else in it is a rewritten record.
+	FeatureBoundAAD
+
+	// FeatureSets allows the set values of SAdd. The first write of a set
+	// declares it.
+	FeatureSets
+)
+
+var featureNames = []string{"compression-dict", "transforms", "kdf-params", "bound-aad", "sets"}
+
+// supportedFeatures are the features this build can read. Tests narrow it
+// to stand in for an older build.
+var supportedFeatures = FeatureCompressionDict | FeatureTransforms | FeatureKDFParams | FeatureBoundAAD | FeatureSets
+
+var (
+	ErrFeatureNotEnabled = errors.New("feature not enabled for this file")
+	ErrUnknownFeature    = errors.New("file uses features this version cannot read")
+)
+
+func (f Feature) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+			f &^= 1 << i
+		}
+	}
+	if f != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+	return strings.Join(names, "|")
+}
+
+// features returns the features the options make writes use.
+func (o Options) features() Feature {
+	var f Feature
+	if len(o.CompressionDict) > 0 {
+		f |= FeatureCompressionDict
+	}
+	return f
+}
+
+// checkFeatures verifies that this build reads every feature declared by
+// the header and that opts only use declared ones.
+func checkFeatures(declared Feature, opts Options) error {
+	if unknown := declared &^ supportedFeatures; unknown != 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownFeature, unknown)
+	}
+	if missing := opts.features() &^ declared; missing != 0 {
+		return fmt.Errorf("%w: %s (see EnableFeature)", ErrFeatureNotEnabled, missing)
+	}
+	return nil
+}
+
+// hasFeature reports whether the header declares f. Callers must hold db.mu.
+func (db *DB) hasFeature(f Feature) bool {
+	return db.header.Features&f == f
+}
+
+// Features returns the features the file's header declares.
+func (db *DB) Features() Feature {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.header.Features
+}
+
+// EnableFeature declares f in the header, allowing options that use it.
+// Builds that do not know f refuse to open the file afterwards, and there
+// is no way back, so the change is logged. Enabling a declared feature is a
+// no-op.
+func (db *DB) EnableFeature(f Feature) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	if unknown := f &^ supportedFeatures; unknown != 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownFeature, unknown)
+	}
+	return db.enableFeature(f)
+}
+
+// enableFeature declares f in the header. Callers must hold the write lock.
+func (db *DB) enableFeature(f Feature) error {
+	if db.hasFeature(f) {
+		return nil
+	}
+	features := db.header.Features | f
+	buf := make([]byte, extFeaturesSize)
+	binary.BigEndian.PutUint32(buf, uint32(features))
+	if err := db.writeHeaderAt(buf, extFeaturesOffset); err != nil {
+		return err
+	}
+	db.header.Features = features
+	db.logger().Warn("nokhal: enabled file features older versions cannot read",
+		"path", db.path, "enabled", f, "features", features)
+	return nil
+}
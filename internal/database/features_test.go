@@ -2,7 +2,15 @@ package database
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -45,7 +53,8 @@ func TestTTL(t *testing.T) {
 	path, cleanup := tempFile()
 	defer cleanup()
 
-	db, err := Open(path, "pass")
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -59,18 +68,199 @@ func TestTTL(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Should exist now
+	// Should exist now, and up to the nanosecond it expires at
 	if _, err := db.Get(col, key); err != nil {
 		t.Errorf("Key should exist immediately")
 	}
+	clock.Advance(100 * time.Millisecond)
+	if _, err := db.Get(col, key); err != nil {
+		t.Errorf("Key should exist at its expiry time, got: %v", err)
+	}
 
-	// Wait for expiration
-	time.Sleep(200 * time.Millisecond)
-
-	// Should not exist
+	// Should not exist a nanosecond later
+	clock.Advance(time.Nanosecond)
 	if _, err := db.Get(col, key); err != ErrNotFound {
 		t.Errorf("Key should have expired, got: %v", err)
 	}
+	if found, _ := db.HasMulti(col, []string{key}); found[key] {
+		t.Error("HasMulti reports an expired key")
+	}
+}
+
+func TestPutExpired(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// Expired even when read at the instant it was written
+	db.Put("cache", "shadowed", []byte("old"))
+	if err := db.PutExpired("cache", "shadowed", []byte("negative")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutExpired("cache", "miss", []byte("negative")); err != nil {
+		t.Fatal(err)
+	}
+	expectGone := func() {
+		t.Helper()
+		for _, key := range []string{"shadowed", "miss"} {
+			if v, err := db.Get("cache", key); err != ErrNotFound {
+				t.Errorf("Get(%s) = %q, %v; want ErrNotFound", key, v, err)
+			}
+		}
+		if keys, _ := db.List("cache"); len(keys) != 0 {
+			t.Errorf("List = %v", keys)
+		}
+	}
+	expectGone()
+
+	// The log holds both as puts with their values, in write order
+	sub, err := db.WatchFrom(Checkpoint{}, "cache:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []string
+	for range 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ev, _, err := sub.Next(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Op != OpPut || ev.Expired(clock.Now()) != (string(ev.Value) == "negative") {
+			t.Errorf("event %+v", ev)
+		}
+		seen = append(seen, ev.Key+"="+string(ev.Value))
+	}
+	if !slices.Equal(seen, []string{"shadowed=old", "shadowed=negative", "miss=negative"}) {
+		t.Errorf("WatchFrom replayed %v", seen)
+	}
+
+	// No earlier version comes back after a reopen or a Compact
+	db.Close()
+	if db, err = OpenWithOptions(path, "pass", Options{Now: clock.Now}); err != nil {
+		t.Fatal(err)
+	}
+	expectGone()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	expectGone()
+}
+
+// Every record is judged by one read timestamp per operation, even when the
+// clock moves on between the records it reads.
+func TestReadTimestamp(t *testing.T) {
+	clock := newTestClock()
+	start := clock.Now()
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var keys []string
+	for i := 0; i < 8; i++ {
+		keys = append(keys, fmt.Sprint(i))
+		if err := db.PutWithTTL("col", keys[i], []byte("v"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each read of the clock moves it 1ns, so the keys expire partway
+	// through an operation that reads it per record
+	expiry := start.Add(time.Minute)
+	count := func(op string, fn func() (int, error)) {
+		t.Helper()
+		for _, at := range []time.Time{expiry.Add(-3), expiry.Add(1)} {
+			clock.Set(at, 1)
+			n, err := fn()
+			if err != nil && !errors.As(err, new(*ErrMissingKeys)) {
+				t.Fatalf("%s: %v", op, err)
+			}
+			want := len(keys)
+			if at.After(expiry) {
+				want = 0
+			}
+			if n != want {
+				t.Errorf("%s at expiry%+d: %d of %d keys live, want %d", op, at.Sub(expiry), n, len(keys), want)
+			}
+		}
+	}
+	count("ScanPrefix", func() (int, error) {
+		records, err := db.ScanPrefix("col:")
+		return len(records), err
+	})
+	count("GetMulti", func() (int, error) {
+		values, err := db.GetMulti("col", keys)
+		n := 0
+		for _, v := range values {
+			if v != nil {
+				n++
+			}
+		}
+		return n, err
+	})
+	count("GetAtomic", func() (int, error) {
+		values, err := db.GetAtomicWithOptions("col", keys, AtomicGetOptions{AllowMissing: true})
+		return len(values), err
+	})
+	count("List", func() (int, error) {
+		listed, err := db.List("col")
+		return len(listed), err
+	})
+	count("AllKeys", func() (int, error) {
+		all, err := db.AllKeys()
+		return len(all), err
+	})
+}
+
+func TestLazyExpireDelete(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		clock := newTestClock()
+		start := clock.Now()
+		db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now, LazyExpireDelete: lazy})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db.PutWithTTL("col", "a", []byte("a"), time.Minute)
+		db.Put("col", "b", []byte("b"))
+		clock.Advance(2 * time.Minute)
+		offset := db.Offset()
+		if _, err := db.Get("col", "a"); err != ErrNotFound {
+			t.Fatalf("lazy %v: Get of an expired key: %v", lazy, err)
+		}
+		if _, err := db.Get("col", "missing"); err != ErrNotFound {
+			t.Fatalf("lazy %v: Get of a missing key: %v", lazy, err)
+		}
+		if wrote := db.Offset() != offset; wrote != lazy {
+			t.Errorf("lazy %v: Get wrote a tombstone: %v", lazy, wrote)
+		}
+
+		// Turning the clock back shows whether the key was deleted or only
+		// hidden by its expiry
+		clock.Set(start, 0)
+		keys, err := db.List("col")
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(keys)
+		want := []string{"a", "b"}
+		if lazy {
+			want = []string{"b"}
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(want) {
+			t.Errorf("lazy %v: List = %v, want %v", lazy, keys, want)
+		}
+		db.Close()
+	}
 }
 
 func TestIterator(t *testing.T) {
@@ -149,6 +339,53 @@ func TestIndexHint(t *testing.T) {
 	}
 }
 
+func TestHintEncrypted(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("payroll", "ceo-salary-2024", []byte("v"))
+	db.Close()
+
+	hint, err := os.ReadFile(path + ".hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"payroll", "ceo-salary-2024"} {
+		if bytes.Contains(hint, []byte(name)) {
+			t.Errorf("hint holds %q in the clear", name)
+		}
+	}
+
+	db, report, err := OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.HintUsed {
+		t.Error("encrypted hint was not loaded")
+	}
+	db.Close()
+
+	// A hint that does not decrypt is discarded for a full scan
+	hint, _ = os.ReadFile(path + ".hint")
+	hint[len(hint)-1] ^= 0xff
+	os.WriteFile(path+".hint", hint, 0644)
+	db, report, err = OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if report.HintUsed || !report.HintDiscarded {
+		t.Errorf("tampered hint: %+v", report)
+	}
+	if v, err := db.Get("payroll", "ceo-salary-2024"); err != nil || string(v) != "v" {
+		t.Errorf("Get after full scan = %q, %v", v, err)
+	}
+}
+
 func TestBatch(t *testing.T) {
 	path, cleanup := tempFile()
 	defer cleanup()
@@ -184,3 +421,1402 @@ func TestBatch(t *testing.T) {
 		t.Errorf("Batch delete failed")
 	}
 }
+
+func TestBatchCoalesce(t *testing.T) {
+	for _, coalesce := range []bool{true, false} {
+		path, cleanup := tempFile()
+		defer cleanup()
+		db, err := Open(path, "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		start := db.Offset()
+		batch := db.NewBatchWithOptions(BatchOptions{Coalesce: coalesce})
+		batch.Put("c", "k", []byte("v1"), 0)
+		batch.Delete("c", "k")
+		batch.Put("c", "k", []byte("v2"), 0)
+		batch.Put("c", "other", []byte("o"), 0)
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		var ops []byte
+		var last int64
+		offsets, _ := walkLog(db.file, start)
+		for _, off := range offsets {
+			rec, _, err := db.readRecord(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Timestamp <= last {
+				t.Errorf("Coalesce=%v: timestamp %d not after %d", coalesce, rec.Timestamp, last)
+			}
+			last = rec.Timestamp
+			if string(rec.Key) == "k" {
+				ops = append(ops, rec.Op)
+			}
+		}
+		want := []byte{OpPut}
+		if !coalesce {
+			want = []byte{OpPut, OpDelete, OpPut}
+		}
+		if string(ops) != string(want) {
+			t.Errorf("Coalesce=%v: records for k have ops %v, want %v", coalesce, ops, want)
+		}
+		if v, err := db.Get("c", "k"); err != nil || string(v) != "v2" {
+			t.Errorf("Coalesce=%v: Get = %q, %v", coalesce, v, err)
+		}
+	}
+	if !DefaultBatchOptions().Coalesce {
+		t.Error("DefaultBatchOptions must coalesce")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expect := func(key, want string) {
+		t.Helper()
+		v, err := db.Get("buf", key)
+		if want == "" {
+			if err != ErrNotFound {
+				t.Errorf("%s: expected ErrNotFound, got %q, %v", key, v, err)
+			}
+			return
+		}
+		if err != nil || string(v) != want {
+			t.Errorf("%s = %q, %v; want %q", key, v, err, want)
+		}
+	}
+
+	db.Put("buf", "front", []byte("frame-1"))
+	db.PutWithTTL("buf", "back", []byte("frame-2"), time.Hour)
+	expiry := indexed(t, db, "buf:back").ExpiresAt
+
+	if err := db.Swap("buf", "front", "back"); err != nil {
+		t.Fatal(err)
+	}
+	expect("front", "frame-2")
+	expect("back", "frame-1")
+	if indexed(t, db, "buf:front").ExpiresAt != expiry || indexed(t, db, "buf:back").ExpiresAt != 0 {
+		t.Error("Expiries must move with their values")
+	}
+
+	// A missing key is absent: the live value moves and its old key goes
+	if err := db.Swap("buf", "back", "spare"); err != nil {
+		t.Fatal(err)
+	}
+	expect("back", "")
+	expect("spare", "frame-1")
+
+	offset := db.Offset()
+	if err := db.Swap("buf", "missing", "gone"); err != nil || db.Offset() != offset {
+		t.Errorf("Swapping two absent keys must write nothing (err %v)", err)
+	}
+
+	// The swap survives a reopen
+	db.Close()
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	expect("front", "frame-2")
+	expect("spare", "frame-1")
+}
+
+func TestReplaceCollection(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Two daily datasets sharing the key "shared"
+	sets := [2]map[string][]byte{{}, {}}
+	for i := range 40 {
+		sets[0][fmt.Sprintf("a%02d", i)] = []byte("day-a")
+	}
+	for i := range 25 {
+		sets[1][fmt.Sprintf("b%02d", i)] = []byte("day-b")
+	}
+	sets[0]["shared"], sets[1]["shared"] = []byte("day-a"), []byte("day-b")
+	var all []string
+	for _, set := range sets {
+		for key := range set {
+			if !slices.Contains(all, key) {
+				all = append(all, key)
+			}
+		}
+	}
+	db.Put("other", "a00", []byte("untouched"))
+	if err := db.ReplaceCollection("daily", sets[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshots taken while the collection is replaced over and over see
+	// one whole dataset each
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := range 50 {
+			if err := db.ReplaceCollection("daily", sets[(i+1)%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for replacing := true; replacing; {
+		select {
+		case <-done:
+			replacing = false
+		default:
+		}
+		snap, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, key := range all {
+			if v, err := snap.Get("daily", key); err == nil {
+				got[key] = string(v)
+			} else if err != ErrNotFound {
+				t.Fatal(err)
+			}
+		}
+		snap.Close()
+		if !sameSet(got, sets[0]) && !sameSet(got, sets[1]) {
+			t.Fatalf("snapshot saw %d keys of a mixed or empty collection", len(got))
+		}
+	}
+	wg.Wait()
+
+	// 50 replacements end on the first dataset
+	keys, err := db.List("daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(sets[0]) {
+		t.Errorf("List after the replacements: %d keys, want %d", len(keys), len(sets[0]))
+	}
+	if v, _ := db.Get("other", "a00"); string(v) != "untouched" {
+		t.Error("ReplaceCollection touched another collection")
+	}
+
+	if err := db.ReplaceCollection("daily", nil); err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := db.IsEmpty("daily"); err != nil || !empty {
+		t.Errorf("IsEmpty after replacing with nothing = %v, %v", empty, err)
+	}
+	offset := db.Offset()
+	if err := db.ReplaceCollection("daily", nil); err != nil || db.Offset() != offset {
+		t.Errorf("Replacing an empty collection with nothing must write nothing (err %v)", err)
+	}
+}
+
+func sameSet(got map[string]string, want map[string][]byte) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for key, v := range want {
+		if got[key] != string(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPage(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 25; i++ {
+		db.Put("items", fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%02d", i)))
+	}
+	db.Put("other", "k00", []byte("x"))
+
+	seen := make(map[string]bool)
+	var order []string
+	token := ""
+	calls := 0
+	for {
+		records, next, err := db.Page("items:", token, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		for _, rec := range records {
+			if seen[rec.Key] {
+				t.Errorf("Duplicate key %s", rec.Key)
+			}
+			seen[rec.Key] = true
+			order = append(order, rec.Key)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if calls != 3 {
+		t.Errorf("Expected 3 pages, got %d", calls)
+	}
+	if len(order) != 25 {
+		t.Fatalf("Expected 25 keys, got %d", len(order))
+	}
+	for i, k := range order {
+		if k != fmt.Sprintf("k%02d", i) {
+			t.Errorf("Gap or misorder at %d: got %s", i, k)
+		}
+	}
+
+	if _, _, err := db.Page("items:", "!!not-base64!!", 10); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+
+	// A page ending on the last live key has no next page, also when keys
+	// after it are still indexed but expired
+	_, after09, err := db.Page("items:", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, next, err := db.Page("items:", after09, 15); err != nil || len(records) != 15 || next != "" {
+		t.Errorf("Page ending on the final key = %d records, next %q, %v", len(records), next, err)
+	}
+	for i := 20; i < 25; i++ {
+		db.PutWithTTL("items", fmt.Sprintf("k%02d", i), []byte("short"), time.Minute)
+	}
+	clock.Advance(time.Hour)
+	if records, next, err := db.Page("items:", after09, 10); err != nil || len(records) != 10 || next != "" {
+		t.Errorf("Page before expired keys = %d records, next %q, %v", len(records), next, err)
+	}
+}
+
+func TestPlaintextCollection(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetCollectionPlaintext("reference", true); err != nil {
+		t.Fatal(err)
+	}
+
+	public := "PUBLIC_REFERENCE_VALUE"
+	secret := "VERY_SECRET_VALUE"
+	db.Put("reference", "k1", []byte(public))
+	db.Put("secrets", "k1", []byte(secret))
+
+	batch := db.NewBatch()
+	batch.Put("reference", "k2", []byte(public+"_BATCH"), 0)
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetCollectionPlaintext("reference", false); err != ErrCollectionInUse {
+		t.Errorf("Expected ErrCollectionInUse for non-empty collection, got %v", err)
+	}
+	db.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(content, []byte(public)) || !bytes.Contains(content, []byte(public+"_BATCH")) {
+		t.Error("Plaintext collection value should be readable in the file")
+	}
+	if bytes.Contains(content, []byte(secret)) {
+		t.Error("Encrypted collection value found in plaintext")
+	}
+
+	// Setting must survive a reopen
+	os.Remove(path + ".hint")
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if !db.plaintext["reference"] {
+		t.Error("Plaintext setting was not persisted")
+	}
+	val, err := db.Get("reference", "k1")
+	if err != nil || string(val) != public {
+		t.Errorf("Get on plaintext collection failed: %q, %v", val, err)
+	}
+	records, err := db.ScanPrefix("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Errorf("Expected 3 user records from full scan, got %d", len(records))
+	}
+}
+
+func TestLazyKeyRotation(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("col", "hot", []byte("hot-value"))
+	db.Put("col", "cold", []byte("cold-value"))
+
+	if err := db.BeginKeyRotation(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BeginKeyRotation(); err != ErrRotationInProgress {
+		t.Errorf("Expected ErrRotationInProgress, got %v", err)
+	}
+
+	// Reading an old-key record re-seals it under the new DEK
+	if val, err := db.Get("col", "hot"); err != nil || string(val) != "hot-value" {
+		t.Fatalf("Get during rotation failed: %q, %v", val, err)
+	}
+	rec, _, err := db.readRecord(indexed(t, db, "col:hot").Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Flags&FlagKeyID == 0 {
+		t.Error("Record read during rotation was not re-sealed under the new DEK")
+	}
+
+	cold, _, _ := db.readRecord(indexed(t, db, "col:cold").Offset)
+	if cold.Flags&FlagKeyID != 0 {
+		t.Error("Unread record should still be sealed under the old DEK")
+	}
+	db.Close()
+
+	// Rotation state survives a reopen
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.RotationActive() {
+		t.Error("Rotation state was not persisted in the header")
+	}
+
+	// Compaction finishes the cold tail and promotes the new key
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if db.RotationActive() {
+		t.Error("Compaction should finish the rotation")
+	}
+	db.Close()
+
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"hot": "hot-value", "cold": "cold-value"} {
+		if val, err := db.Get("col", key); err != nil || string(val) != want {
+			t.Errorf("Get %s after rotation: %q, %v", key, val, err)
+		}
+	}
+}
+
+func TestWriteInsideFilterCallback(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := db.Put("src", fmt.Sprintf("k%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writing from the callback used to deadlock on db.mu
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Filter("src", func(key string, value []byte) bool {
+			return db.Put("dst", key, value) == nil
+		})
+		if err == nil {
+			_, err = db.FilterPrefix("src:", func(key string, value []byte) bool {
+				return db.Delete("src", key[len("src:"):]) == nil
+			})
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write from a filter callback deadlocked")
+	}
+
+	if recs, _ := db.ScanPrefix("dst:"); len(recs) != 3 {
+		t.Errorf("Expected 3 copied records, got %d", len(recs))
+	}
+	if recs, _ := db.ScanPrefix("src:"); len(recs) != 0 {
+		t.Errorf("Expected source records to be deleted, got %d", len(recs))
+	}
+}
+
+func TestFilterChunks(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// One record per chunk
+	defer func(n int64) { scanChunkBytes = n }(scanChunkBytes)
+	scanChunkBytes = 1
+
+	for i := range 20 {
+		db.Put("col", fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	db.Put("col", "k05", []byte("new5"))
+	db.Delete("col", "k07")
+
+	calls := make(map[string]int)
+	values, err := db.Filter("col", func(key string, value []byte) bool {
+		if len(calls) == 0 {
+			// The lock is released between chunks, so Compact can run.
+			// The scan starts over on the compacted log, which has zz
+			if !db.mu.TryLock() {
+				t.Error("Filter callback runs with the lock held")
+			} else {
+				db.mu.Unlock()
+			}
+			if err := db.Compact(); err != nil {
+				t.Error(err)
+			}
+			db.Put("col", "zz", []byte("late"))
+		}
+		calls[key]++
+		return key != "k03"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for i := range 20 {
+		switch i {
+		case 3, 7:
+		case 5:
+			want = append(want, "new5")
+		default:
+			want = append(want, fmt.Sprintf("v%d", i))
+		}
+	}
+	want = append(want, "late")
+	var got []string
+	for _, v := range values {
+		got = append(got, string(v))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Filter = %v, want %v", got, want)
+	}
+	if len(calls) != 20 {
+		t.Errorf("callback saw %d keys: %v", len(calls), calls)
+	}
+	for key, n := range calls {
+		if n != 1 {
+			t.Errorf("callback saw %s %d times", key, n)
+		}
+	}
+}
+
+func TestFilterSeesConcurrentRewrites(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// One record per chunk
+	defer func(n int64) { scanChunkBytes = n }(scanChunkBytes)
+	scanChunkBytes = 1
+
+	for i := range 10 {
+		db.Put("col", fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+	}
+
+	// Another writer rewrites a key the scan has not reached, and one it
+	// has, and adds one, between the first two chunks
+	var once sync.Once
+	values, err := db.Filter("col", func(key string, value []byte) bool {
+		once.Do(func() {
+			done := make(chan error, 1)
+			go func() {
+				b := db.NewBatch()
+				b.Put("col", "k8", []byte("new8"), 0)
+				b.Put("col", "k0", []byte("new0"), 0)
+				b.Put("col", "k9a", []byte("late"), 0)
+				done <- b.Commit()
+			}()
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+		})
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"v0", "v1", "v2", "v3", "v4", "v5", "v6", "v7", "new8", "v9"}
+	var got []string
+	for _, v := range values {
+		got = append(got, string(v))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Filter = %v, want %v", got, want)
+	}
+}
+
+func TestGetMultiAndNextN(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	for _, workers := range []int{1, 4} {
+		os.Remove(path)
+		os.Remove(path + ".hint")
+		db, err := OpenWithOptions(path, "pass", Options{DecryptWorkers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			keys = append(keys, key)
+			if err := db.Put("col", key, []byte("val-"+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Delete("col", "k10")
+
+		vals, err := db.GetMulti("col", append([]string{"missing"}, keys...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vals[0] != nil || vals[11] != nil {
+			t.Errorf("workers=%d: missing keys should yield nil", workers)
+		}
+		for i, key := range keys {
+			if i != 10 && string(vals[i+1]) != "val-"+key {
+				t.Errorf("workers=%d: GetMulti[%d] = %q", workers, i+1, vals[i+1])
+			}
+		}
+
+		it := db.NewIterator("col:")
+		var got []string
+		for {
+			recs, err := it.NextN(7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recs) == 0 {
+				break
+			}
+			for _, rec := range recs {
+				got = append(got, rec.Key)
+			}
+		}
+		it.Close()
+		if len(got) != 49 || got[0] != "k00" || got[10] != "k11" || got[48] != "k49" {
+			t.Errorf("workers=%d: NextN returned %d keys out of order: %v", workers, len(got), got)
+		}
+		db.Close()
+	}
+}
+
+func TestBatchVisibleAtomically(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stop := make(chan struct{})
+	torn := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(torn)
+				return
+			default:
+			}
+			vals, err := db.GetMulti("pair", []string{"a", "b"})
+			if err != nil {
+				torn <- err.Error()
+				return
+			}
+			if !bytes.Equal(vals[0], vals[1]) {
+				torn <- fmt.Sprintf("a=%q b=%q", vals[0], vals[1])
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		v := []byte(fmt.Sprintf("v%d", i))
+		batch := db.NewBatch()
+		if i%2 == 0 {
+			batch.Put("pair", "a", v, 0)
+			batch.Put("pair", "b", v, 0)
+		} else {
+			batch.Delete("pair", "b")
+			batch.Delete("pair", "a")
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+
+	if msg, ok := <-torn; ok {
+		t.Fatalf("Reader observed a partial batch: %s", msg)
+	}
+}
+
+func TestBatchAssert(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("orders", "123", []byte("pending"))
+	ship := db.NewBatch()
+	ship.AssertValue("orders", "123", []byte("pending"))
+	ship.AssertAbsent("orders_by_customer", "c1:123")
+	ship.Put("orders", "123", []byte("shipped"), 0)
+	ship.Put("orders_by_customer", "c1:123", nil, 0)
+
+	// Another writer invalidates the assertion between staging and commit
+	db.Put("orders", "123", []byte("cancelled"))
+	offset := db.Offset()
+	var failed *ErrAssertionFailed
+	if err := ship.Commit(); !errors.As(err, &failed) || failed.Collection != "orders" || failed.Key != "123" || failed.Absent {
+		t.Fatalf("Commit after the value changed: %v", err)
+	}
+	if db.Offset() != offset {
+		t.Error("a failed assertion wrote to the log")
+	}
+	if v, _ := db.Get("orders", "123"); string(v) != "cancelled" {
+		t.Errorf("orders:123 = %q after a failed commit", v)
+	}
+
+	// The batch is left as it was, to commit once its assertions hold
+	db.Put("orders", "123", []byte("pending"))
+	db.Put("orders_by_customer", "c1:123", nil)
+	if err := ship.Commit(); !errors.As(err, &failed) || failed.Key != "c1:123" || !failed.Absent {
+		t.Fatalf("Commit after the index entry appeared: %v", err)
+	}
+	db.Delete("orders_by_customer", "c1:123")
+	if err := ship.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.Get("orders", "123"); string(v) != "shipped" {
+		t.Errorf("orders:123 = %q after the commit", v)
+	}
+	if err := ship.Commit(); err != nil {
+		t.Errorf("Commit of an emptied batch: %v", err)
+	}
+
+	// The first violated assertion is named; a missing key fails AssertValue
+	b := db.NewCollectionBatch("orders")
+	b.AssertAbsent("missing")
+	b.AssertValue("missing", nil)
+	b.AssertAbsent("123")
+	if err := b.Commit(); !errors.As(err, &failed) || failed.Key != "missing" || failed.Absent {
+		t.Errorf("Commit with two violated assertions: %v", err)
+	}
+
+	// Concurrent compare-and-swap increments lose no update
+	db.Put("stats", "counter", []byte("0"))
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				old, err := db.Get("stats", "counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var n int
+				fmt.Sscan(string(old), &n)
+				b := db.NewBatch()
+				b.AssertValue("stats", "counter", old)
+				b.Put("stats", "counter", []byte(fmt.Sprint(n+1)), 0)
+				switch err := b.Commit(); {
+				case err == nil:
+					i++
+				case !errors.As(err, new(*ErrAssertionFailed)):
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := db.Get("stats", "counter"); string(v) != fmt.Sprint(workers*increments) {
+		t.Errorf("counter = %s, want %d", v, workers*increments)
+	}
+}
+
+func TestUserVersion(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.UserVersion(); err != nil || v != 0 {
+		t.Errorf("New database UserVersion = %d, %v", v, err)
+	}
+	if err := db.SetUserVersion(42); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "key", []byte("value"))
+	db.Close()
+
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, _ := db.UserVersion(); v != 42 {
+		t.Errorf("UserVersion after reopen = %d, want 42", v)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.UserVersion(); v != 42 {
+		t.Errorf("UserVersion after compaction = %d, want 42", v)
+	}
+	if val, err := db.Get("col", "key"); err != nil || string(val) != "value" {
+		t.Errorf("Get after compaction: %q, %v", val, err)
+	}
+}
+
+func TestHasMulti(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("col", "present", []byte("value"))
+	db.Put("col", "deleted", []byte("value"))
+	db.Delete("col", "deleted")
+	db.PutWithTTL("col", "expired", []byte("value"), time.Millisecond)
+	db.PutWithTTL("col", "fresh", []byte("value"), time.Hour)
+	db.Put("other", "absent", []byte("wrong collection"))
+	clock.Advance(time.Second)
+
+	got, err := db.HasMulti("col", []string{"present", "deleted", "expired", "fresh", "absent", "present"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"present": true, "deleted": false, "expired": false, "fresh": true, "absent": false}
+	if len(got) != len(want) {
+		t.Errorf("HasMulti returned %d entries, want %d: %v", len(got), len(want), got)
+	}
+	for k, w := range want {
+		if v, ok := got[k]; !ok || v != w {
+			t.Errorf("HasMulti[%s] = %v (reported %v), want %v", k, v, ok, w)
+		}
+	}
+}
+
+func TestGetAtomic(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	parts := []string{"order:1:header", "order:1:lines", "order:1:totals"}
+	for _, k := range parts {
+		db.Put("orders", k, []byte("v0"))
+	}
+
+	got, err := db.GetAtomic("orders", parts)
+	if err != nil || len(got) != 3 || string(got["order:1:lines"]) != "v0" {
+		t.Fatalf("GetAtomic = %q, %v", got, err)
+	}
+
+	var missing *ErrMissingKeys
+	_, err = db.GetAtomic("orders", append(parts, "order:1:notes", "order:2:header"))
+	if !errors.As(err, &missing) || len(missing.Keys) != 2 || missing.Keys[0] != "order:1:notes" {
+		t.Errorf("missing keys: %v", err)
+	}
+	got, err = db.GetAtomicWithOptions("orders", append(parts, "order:1:notes"), AtomicGetOptions{AllowMissing: true})
+	if err != nil || len(got) != 3 {
+		t.Errorf("AllowMissing: %q, %v", got, err)
+	}
+
+	var tooMany *ErrTooManyKeys
+	_, err = db.GetAtomicWithOptions("orders", parts, AtomicGetOptions{MaxKeys: 2})
+	if !errors.As(err, &tooMany) || tooMany.Count != 3 || tooMany.Max != 2 {
+		t.Errorf("MaxKeys: %v", err)
+	}
+
+	// Readers never see a batch half applied
+	stop := make(chan struct{})
+	torn := make(chan string, 1)
+	go func() {
+		defer close(torn)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			vals, err := db.GetAtomic("orders", parts)
+			if err != nil {
+				torn <- err.Error()
+				return
+			}
+			for _, k := range parts[1:] {
+				if !bytes.Equal(vals[k], vals[parts[0]]) {
+					torn <- fmt.Sprintf("%s=%q %s=%q", parts[0], vals[parts[0]], k, vals[k])
+					return
+				}
+			}
+		}
+	}()
+	for i := 1; i <= 200; i++ {
+		batch := db.NewBatch()
+		for _, k := range parts {
+			batch.Put("orders", k, []byte(fmt.Sprintf("v%d", i)), 0)
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if msg, ok := <-torn; ok {
+		t.Fatalf("GetAtomic observed a partial batch: %s", msg)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	// Without SyncWrites nothing is flushed to disk between a write and the
+	// read that follows it
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		want := []byte(fmt.Sprintf("v%d", i))
+		if i%2 == 0 {
+			if err := db.Put("col", key, want); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			batch := db.NewBatch()
+			batch.Put("col", key, want, 0)
+			if err := batch.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got, err := db.Get("col", key); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("Get(%s) right after the write = %q, %v", key, got, err)
+		}
+		if present, err := db.HasMulti("col", []string{key}); err != nil || !present[key] {
+			t.Fatalf("HasMulti(%s) right after the write = %v, %v", key, present, err)
+		}
+		it := db.NewIterator("col:" + key)
+		if !it.Next() {
+			t.Fatalf("iterator missed %s right after the write", key)
+		}
+		if got, err := it.Value(); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("iterator value of %s right after the write = %q, %v", key, got, err)
+		}
+		it.Close()
+
+		if err := db.Delete("col", key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("col", key); err != ErrNotFound {
+			t.Fatalf("Get(%s) right after the delete: %v", key, err)
+		}
+		db.Put("col", key, want)
+	}
+
+	values, err := db.Filter("col", func(string, []byte) bool { return true })
+	if err != nil || len(values) != 100 {
+		t.Fatalf("Filter after the writes: %d values, %v", len(values), err)
+	}
+}
+
+func TestContentChecksum(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := OpenWithOptions(path, "pass", Options{ContentChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	original := bytes.Repeat([]byte("A"), 1000)
+	if err := db.Put("col", "key", original); err != nil {
+		t.Fatal(err)
+	}
+	rec, _, err := db.readRecord(indexed(t, db, "col:key").Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Flags&FlagChecksum == 0 || rec.Flags&FlagCompressed == 0 {
+		t.Fatalf("Expected a compressed, checksummed record, flags %b", rec.Flags)
+	}
+	if val, err := db.Get("col", "key"); err != nil || !bytes.Equal(val, original) {
+		t.Fatalf("Get = %d bytes, %v", len(val), err)
+	}
+
+	// Simulate a codec that decompresses to the wrong content: keep the
+	// checksum of the original but seal a payload that inflates to other bytes
+	payload, err := db.cipherFor(rec.Flags).Open(nil, rec.Nonce, rec.Value, recordAAD("col:key", rec.Timestamp, rec.Op, rec.Flags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := compress(bytes.Repeat([]byte("B"), 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = append(payload[:contentSumSize:contentSumSize], wrong...)
+	aead, keyFlag := db.writeCipher()
+	nonce, _ := generateNonce()
+	db.mu.Lock()
+	err = db.writeRecord(&record{
+		Timestamp:  rec.Timestamp,
+		Flags:      rec.Flags | keyFlag,
+		Collection: rec.Collection,
+		Key:        rec.Key,
+		Value:      aead.Seal(nil, nonce, payload, recordAAD("col:key", rec.Timestamp, rec.Op, rec.Flags)),
+		Nonce:      nonce,
+		Op:         OpPut,
+	})
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("col", "key"); err != ErrContentChecksum {
+		t.Errorf("Get: expected ErrContentChecksum, got %v", err)
+	}
+	if _, err := db.ScanPrefix("col:"); err != ErrContentChecksum {
+		t.Errorf("ScanPrefix: expected ErrContentChecksum, got %v", err)
+	}
+
+	// Records without a checksum still read, and checksummed ones are
+	// verified even when the option is off
+	if err := db.Put("col", "key", []byte("fixed")); err != nil {
+		t.Fatal(err)
+	}
+	db.opts.ContentChecksums = false
+	if err := db.Put("col", "plain", []byte("no checksum")); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"key": "fixed", "plain": "no checksum"} {
+		if val, err := db.Get("col", key); err != nil || string(val) != want {
+			t.Errorf("Get %s = %q, %v", key, val, err)
+		}
+	}
+}
+
+func TestMapValues(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const total = mapValuesBatchSize + 50
+	for i := 0; i < total; i++ {
+		if err := db.Put("col", fmt.Sprintf("k%03d", i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutWithTTL("col", "ttl", []byte("t"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("other", "k000", []byte("untouched"))
+	expiresAt := indexed(t, db, "col:ttl").ExpiresAt
+
+	double := func(key string, old []byte) ([]byte, error) {
+		return append(old, old...), nil
+	}
+	n, err := db.MapValues("col", double)
+	if err != nil || n != total+1 {
+		t.Fatalf("MapValues = %d, %v; want %d", n, err, total+1)
+	}
+	for i := 0; i < total; i++ {
+		want := fmt.Sprintf("v%dv%d", i, i)
+		if val, err := db.Get("col", fmt.Sprintf("k%03d", i)); err != nil || string(val) != want {
+			t.Fatalf("k%03d = %q, %v; want %q", i, val, err, want)
+		}
+	}
+	if val, _ := db.Get("other", "k000"); string(val) != "untouched" {
+		t.Errorf("Other collection was rewritten: %q", val)
+	}
+	if got := indexed(t, db, "col:ttl").ExpiresAt; got != expiresAt {
+		t.Errorf("Expiry changed from %d to %d", expiresAt, got)
+	}
+
+	// An error keeps the batches committed before it and drops the rest
+	errStop := errors.New("stop")
+	n, err = db.MapValues("col", func(key string, old []byte) ([]byte, error) {
+		if key == fmt.Sprintf("k%03d", mapValuesBatchSize+10) {
+			return nil, errStop
+		}
+		return []byte("migrated"), nil
+	})
+	if err != errStop || n != mapValuesBatchSize {
+		t.Fatalf("MapValues = %d, %v; want %d, errStop", n, err, mapValuesBatchSize)
+	}
+	if val, _ := db.Get("col", fmt.Sprintf("k%03d", mapValuesBatchSize-1)); string(val) != "migrated" {
+		t.Errorf("Committed batch lost: %q", val)
+	}
+	if val, _ := db.Get("col", fmt.Sprintf("k%03d", mapValuesBatchSize)); string(val) == "migrated" {
+		t.Error("Aborted batch was partially committed")
+	}
+}
+
+func TestMapValuesConcurrentWrites(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		db.Put("col", k, []byte(k))
+	}
+
+	// While fn runs on a, another writer rewrites b, whose old value was
+	// already read, and deletes c
+	calls := make(map[string]int)
+	n, err := db.MapValues("col", func(key string, old []byte) ([]byte, error) {
+		calls[key]++
+		if key == "a" && calls[key] == 1 {
+			done := make(chan error, 1)
+			go func() {
+				b := db.NewBatch()
+				b.Put("col", "b", []byte("fresh"), 0)
+				b.Delete("col", "c")
+				done <- b.Commit()
+			}()
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+		}
+		return append(old, '!'), nil
+	})
+	if err != nil || n != 3 {
+		t.Fatalf("MapValues = %d, %v; want 3", n, err)
+	}
+	for key, want := range map[string]string{"a": "a!", "b": "fresh!", "d": "d!"} {
+		if val, err := db.Get("col", key); err != nil || string(val) != want {
+			t.Errorf("%s = %q, %v; want %q", key, val, err, want)
+		}
+	}
+	if _, err := db.Get("col", "c"); err != ErrNotFound {
+		t.Errorf("deleted key brought back: %v", err)
+	}
+	if calls["b"] != 2 {
+		t.Errorf("fn ran %d times on the rewritten key, want 2", calls["b"])
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if stored, err := db.PutIfAbsent("tokens", "t1", []byte("secret"), time.Hour); err != nil || !stored {
+		t.Fatalf("PutIfAbsent = %v, %v", stored, err)
+	}
+	if stored, err := db.PutIfAbsent("tokens", "t1", []byte("other"), time.Hour); err != nil || stored {
+		t.Fatalf("PutIfAbsent over a live token = %v, %v", stored, err)
+	}
+
+	// Exactly one of the racing consumers gets the token
+	const consumers = 32
+	var wg sync.WaitGroup
+	values := make(chan []byte, consumers)
+	errs := make(chan error, consumers)
+	for i := 0; i < consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := db.GetAndDelete("tokens", "t1")
+			if err != nil {
+				errs <- err
+				return
+			}
+			values <- v
+		}()
+	}
+	wg.Wait()
+	close(values)
+	close(errs)
+	if len(values) != 1 {
+		t.Fatalf("%d consumers got the token, want 1", len(values))
+	}
+	if v := <-values; string(v) != "secret" {
+		t.Errorf("winner got %q", v)
+	}
+	for err := range errs {
+		if err != ErrNotFound {
+			t.Errorf("loser got %v, want ErrNotFound", err)
+		}
+	}
+	if _, err := db.Get("tokens", "t1"); err != ErrNotFound {
+		t.Errorf("Get after GetAndDelete: %v", err)
+	}
+
+	// An expired token is not found, and its entry is tombstoned
+	db.PutWithTTL("tokens", "t2", []byte("stale"), time.Millisecond)
+	clock.Advance(time.Second)
+	if _, err := db.GetAndDelete("tokens", "t2"); err != ErrNotFound {
+		t.Errorf("GetAndDelete of an expired token: %v", err)
+	}
+	if _, ok, _ := db.index.get(compositeKey("tokens", "t2")); ok {
+		t.Error("expired token still indexed")
+	}
+
+	// An expired value counts as absent
+	db.PutWithTTL("tokens", "t3", []byte("stale"), time.Millisecond)
+	clock.Advance(time.Second)
+	if stored, err := db.PutIfAbsent("tokens", "t3", []byte("fresh"), 0); err != nil || !stored {
+		t.Fatalf("PutIfAbsent over an expired value = %v, %v", stored, err)
+	}
+	if _, err := db.GetAndDelete("tokens", "missing"); err != ErrNotFound {
+		t.Errorf("GetAndDelete of a missing key: %v", err)
+	}
+}
+
+func TestFeaturePolicy(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+	dict := []byte(`{"type":"customer","plan":"standard"}`)
+	value := bytes.Repeat([]byte(`{"type":"customer","plan":"standard"}`), 8)
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A file created without dictionaries does not take one
+	if _, err := OpenWithOptions(path, "pass", Options{CompressionDict: dict}); !errors.Is(err, ErrFeatureNotEnabled) {
+		t.Fatalf("Open with a dictionary = %v, want ErrFeatureNotEnabled", err)
+	}
+	var logs bytes.Buffer
+	db, err = OpenWithOptions(path, "pass", Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateOptions(func(o *Options) { o.CompressionDict = dict }); !errors.Is(err, ErrFeatureNotEnabled) {
+		t.Fatalf("UpdateOptions with a dictionary = %v, want ErrFeatureNotEnabled", err)
+	}
+
+	// Even set behind the checks' back, the dictionary is not used
+	db.opts.CompressionDict = dict
+	db.Put("col", "before", value)
+	if flags := indexedFlags(t, db, "col:before"); flags&FlagDict != 0 || len(db.dictMap()) != 0 {
+		t.Errorf("undeclared feature used: flags %08b, %d dictionaries", flags, len(db.dictMap()))
+	}
+	db.opts.CompressionDict = nil
+
+	if err := db.EnableFeature(FeatureCompressionDict); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "compression-dict") {
+		t.Errorf("EnableFeature was not logged: %q", logs.String())
+	}
+	if err := db.UpdateOptions(func(o *Options) { o.CompressionDict = dict }); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "after", value)
+	if flags := indexedFlags(t, db, "col:after"); flags&FlagDict == 0 {
+		t.Errorf("record flags %08b, want FlagDict", flags)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// An older build, which does not know the feature, refuses the file
+	supported := supportedFeatures
+	supportedFeatures = 0
+	_, err = Open(path, "pass")
+	supportedFeatures = supported
+	if !errors.Is(err, ErrUnknownFeature) {
+		t.Fatalf("Open by an older build = %v, want ErrUnknownFeature", err)
+	}
+
+	db, report, err := OpenWithReport(path, "pass", Options{CompressionDict: dict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if want := FeatureCompressionDict | FeatureBoundAAD; report.Features != want || db.Features() != want {
+		t.Errorf("features %s in the report, %s on the handle", report.Features, db.Features())
+	}
+	if v, err := db.Get("col", "after"); err != nil || !bytes.Equal(v, value) {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+}
+
+// indexedFlags returns the flags of the current record of compKey.
+func indexedFlags(t *testing.T, db *DB, compKey string) byte {
+	t.Helper()
+	rec, _, err := db.readRecord(indexed(t, db, compKey).Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Flags
+}
+
+func TestKDFParams(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "small.nok")
+	small := KDFParams{Time: 2, Memory: 8 * 1024, Parallelism: 1}
+
+	if _, err := OpenWithOptions(path, "pass", Options{KDF: KDFParams{Memory: 16, Parallelism: 4}}); !errors.Is(err, ErrInvalidKDF) {
+		t.Fatalf("Open with 4 KiB per thread = %v, want ErrInvalidKDF", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("failed Open left a file behind: %v", err)
+	}
+	db, report, err := OpenWithReport(path, "pass", Options{KDF: small})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.KDF != small || report.Features&FeatureKDFParams == 0 {
+		t.Errorf("created with %v, features %s", report.KDF, report.Features)
+	}
+	db.Put("col", "key", []byte("value"))
+	if err := db.UpdateOptions(func(o *Options) { o.KDF = DefaultKDF }); err == nil {
+		t.Error("UpdateOptions changed KDF")
+	}
+	db.Close()
+
+	// The header's parameters win over the options of a later Open
+	for _, opts := range []Options{{}, {KDF: KDFParams{Memory: 32 * 1024}}} {
+		db, report, err = OpenWithReport(path, "pass", opts)
+		if err != nil {
+			t.Fatalf("reopen with %v: %v", opts.KDF, err)
+		}
+		if v, err := db.Get("col", "key"); err != nil || string(v) != "value" || report.KDF != small {
+			t.Errorf("reopen with %v: Get = %q, %v; KDF %v", opts.KDF, v, err, report.KDF)
+		}
+		db.Close()
+	}
+	if _, err := OpenWithOptions(path, "wrong", Options{}); err != ErrInvalidPassword {
+		t.Errorf("wrong password: %v", err)
+	}
+
+	// A build that predates the parameters refuses the file
+	supported := supportedFeatures
+	supportedFeatures &^= FeatureKDFParams
+	_, err = Open(path, "pass")
+	supportedFeatures = supported
+	if !errors.Is(err, ErrUnknownFeature) {
+		t.Errorf("Open by an older build = %v, want ErrUnknownFeature", err)
+	}
+
+	// Default parameters need no KDF feature
+	db, report, err = OpenWithReport(filepath.Join(dir, "default.nok"), "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if report.KDF != DefaultKDF || report.Features&FeatureKDFParams != 0 {
+		t.Errorf("default file: KDF %v, features %s", report.KDF, report.Features)
+	}
+}
@@ -0,0 +1,19 @@
+package database
+
+import "path/filepath"
+
+// File replacement and locking differ by platform. On Unix a rename over an
+// open file succeeds and the old file lives on until its last handle is
+// closed, but the rename is only durable once the directory is synced. On
+// Windows a file another handle has open cannot be replaced or removed
+// until that handle is closed, and directories cannot be synced; the rename
+// is written through instead.
+
+// replaceFile renames src to dst, replacing dst if it exists, and makes the
+// rename durable.
+func replaceFile(src, dst string) error {
+	if err := renameReplace(src, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package database
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func renameReplace(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// syncDir flushes the entries of dir, such as a rename into it, to disk.
+// Filesystems that cannot sync a directory report EINVAL, which is ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReplaceFileWhileOpen(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.WriteFile(src, []byte("new"), 0644)
+	os.WriteFile(dst, []byte("old"), 0644)
+
+	// A reader holds dst open, and closes it shortly. Unix replaces the file
+	// under it; Windows waits for it to be closed.
+	held, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if runtime.GOOS != "windows" {
+			buf := make([]byte, 3)
+			if _, err := held.ReadAt(buf, 0); err != nil || string(buf) != "old" {
+				t.Errorf("replaced file read through an old handle = %q, %v", buf, err)
+			}
+		}
+		held.Close()
+		close(closed)
+	}()
+	if err := replaceFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	<-closed
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "new" {
+		t.Errorf("dst after replaceFile = %q, %v", got, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("src left behind: %v", err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	if !fileLocking {
+		t.Skipf("no file locking on %s", runtime.GOOS)
+	}
+	path := filepath.Join(t.TempDir(), "db.nok")
+	os.WriteFile(path, []byte("data"), 0644)
+	a, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := lockFile(a); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- lockFile(b) }()
+	select {
+	case err := <-locked:
+		t.Fatalf("second handle locked the file while the first held it: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The lock leaves the file readable and writable through other handles
+	buf := make([]byte, 4)
+	if _, err := b.ReadAt(buf, 0); err != nil || string(buf) != "data" {
+		t.Errorf("read through another handle under the lock = %q, %v", buf, err)
+	}
+
+	if err := unlockFile(a); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second handle did not get the lock once it was released")
+	}
+	unlockFile(b)
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// replaceRetry bounds how long renameReplace waits for other handles on the
+// files, such as a virus scanner's, to be closed.
+const replaceRetry = 2 * time.Second
+
+// renameReplace replaces dst with src, written through to disk. A file
+// another handle has open cannot be replaced, so sharing violations are
+// retried for up to replaceRetry.
+func renameReplace(src, dst string) error {
+	from, err := windows.UTF16PtrFromString(src)
+	if err != nil {
+		return err
+	}
+	to, err := windows.UTF16PtrFromString(dst)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(replaceRetry)
+	for wait := time.Millisecond; ; wait = min(2*wait, 100*time.Millisecond) {
+		err = windows.MoveFileEx(from, to, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH)
+		if err == nil {
+			return nil
+		}
+		if !sharingViolation(err) || time.Now().After(deadline) {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+		}
+		time.Sleep(wait)
+	}
+}
+
+func sharingViolation(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) ||
+		errors.Is(err, windows.ERROR_ACCESS_DENIED) ||
+		errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
+
+// syncDir does nothing: Windows cannot sync a directory, and renameReplace
+// writes the rename through instead.
+func syncDir(dir string) error {
+	return nil
+}
+
+// lockOffset is where the lock range starts, far past the end of any file:
+// Windows locks are mandatory, so locking bytes in the file would block
+// other handles from reading them.
+const lockOffset = 1 << 62
+
+const fileLocking = true
+
+// lockFile takes an exclusive lock on f, waiting for other handles to
+// release theirs.
+func lockFile(f storageFile) error {
+	ol := &windows.Overlapped{Offset: lockOffset & 0xffffffff, OffsetHigh: lockOffset >> 32}
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, ol)
+}
+
+func unlockFile(f storageFile) error {
+	ol := &windows.Overlapped{Offset: lockOffset & 0xffffffff, OffsetHigh: lockOffset >> 32}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, ol)
+}
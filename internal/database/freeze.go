@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrFrozen = errors.New("database is frozen")
+
+// Freeze holds all writes, for example while a filesystem snapshot of the
+// volume is taken. It waits for the write in progress, if any, fsyncs the
+// data file and the mirror and persists the hint; from then on writes,
+// compactions and other file changes block until unfreeze is called, or fail
+// with ErrFrozen if Options.FailWhenFrozen is set. Reads continue normally,
+// but do not re-seal records for a key rotation. When ctx ends the database
+// is unfrozen as a safety valve. unfreeze may be called any number of times.
+// Freezing a frozen database fails with ErrFrozen.
+func (db *DB) Freeze(ctx context.Context) (unfreeze func(), err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if db.thaw != nil {
+		return nil, ErrFrozen
+	}
+	if err := db.file.Sync(); err != nil {
+		return nil, err
+	}
+	if db.mirror != nil && db.mirror.file != nil {
+		if err := db.mirror.file.Sync(); err != nil {
+			return nil, db.mirrorFailed(err)
+		}
+	}
+	// Nothing changes while frozen, so the hint written now stays current
+	if db.hintTimer != nil {
+		db.hintTimer.Stop()
+		db.hintTimer = nil
+		db.health.hintDue.Store(0)
+	}
+	if err := db.flushHint(); err != nil {
+		return nil, err
+	}
+
+	thaw := make(chan struct{})
+	db.thaw = thaw
+	unfreeze = func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.unfreeze(thaw)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.logger().Warn("nokhal: freeze expired", "path", db.path, "err", ctx.Err())
+			unfreeze()
+		case <-thaw:
+		}
+	}()
+	return unfreeze, nil
+}
+
+// unfreeze releases the writers held by the freeze thaw belongs to, unless
+// that freeze already ended. Callers must hold db.mu.
+func (db *DB) unfreeze(thaw chan struct{}) {
+	if thaw != nil && db.thaw == thaw {
+		db.thaw = nil
+		close(thaw)
+	}
+}
+
+// lockWrite takes db.mu for a write. While the database is frozen it waits
+// for the freeze to end without holding the lock, or fails with ErrFrozen if
+// Options.FailWhenFrozen is set.
+func (db *DB) lockWrite() error {
+	for {
+		db.mu.Lock()
+		thaw := db.thaw
+		if thaw == nil {
+			return nil
+		}
+		fail := db.opts.FailWhenFrozen
+		db.mu.Unlock()
+		if fail {
+			return ErrFrozen
+		}
+		<-thaw
+	}
+}
+
+// lockWriteContext is lockWrite giving up with ctx.Err() if ctx ends first,
+// without having taken the lock. The lock is then still taken in the
+// background, by the waiter already queued for it, and released at once.
+func (db *DB) lockWriteContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- db.lockWrite() }()
+	select {
+	case err := <-locked:
+		return err
+	case <-ctx.Done():
+		go func() {
+			if err := <-locked; err == nil {
+				db.mu.Unlock()
+			}
+		}()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFreeze(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("col", "k", []byte("v1"))
+
+	unfreeze, err := db.Freeze(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := db.Stats(); !stats.Frozen {
+		t.Error("Stats does not report the freeze")
+	}
+	if _, err := db.Freeze(context.Background()); !errors.Is(err, ErrFrozen) {
+		t.Errorf("second Freeze: %v, want ErrFrozen", err)
+	}
+
+	done := make(chan error, 2)
+	go func() { done <- db.Put("col", "k", []byte("v2")) }()
+	go func() {
+		batch := db.NewBatch()
+		batch.Put("col", "b", []byte("batched"), 0)
+		done <- batch.Commit()
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("write finished while frozen: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Reads are not held
+	if v, err := db.Get("col", "k"); err != nil || string(v) != "v1" {
+		t.Fatalf("Get while frozen = %q, %v", v, err)
+	}
+
+	unfreeze()
+	unfreeze()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("writes still held after unfreeze")
+		}
+	}
+	if v, _ := db.Get("col", "k"); string(v) != "v2" {
+		t.Errorf("k = %q after unfreeze, want v2", v)
+	}
+	if v, _ := db.Get("col", "b"); string(v) != "batched" {
+		t.Errorf("b = %q after unfreeze, want batched", v)
+	}
+	if stats, _ := db.Stats(); stats.Frozen {
+		t.Error("Stats reports a freeze after unfreeze")
+	}
+}
+
+func TestFreezeFailWhenFrozen(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{FailWhenFrozen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	unfreeze, err := db.Freeze(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("col", "k", []byte("v")); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Put while frozen: %v, want ErrFrozen", err)
+	}
+	if err := db.Compact(); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Compact while frozen: %v, want ErrFrozen", err)
+	}
+	unfreeze()
+	if err := db.Put("col", "k", []byte("v")); err != nil {
+		t.Errorf("Put after unfreeze: %v", err)
+	}
+}
+
+func TestFreezeExpires(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stale, err := db.Freeze(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The write waits for the context to end, then goes through
+	start := time.Now()
+	if err := db.Put("col", "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 25*time.Millisecond {
+		t.Errorf("Put returned after %v, before the freeze expired", waited)
+	}
+
+	// The expired freeze's unfreeze does not end a later one
+	unfreeze, err := db.Freeze(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unfreeze()
+	stale()
+	if stats, _ := db.Stats(); !stats.Frozen {
+		t.Error("a stale unfreeze ended the current freeze")
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("col", "kept", []byte("v"))
+
+	// A long Compact or batch holds the lock
+	db.mu.Lock()
+	b := db.NewBatch()
+	b.Put("col", "batched", []byte("v"), 0)
+	writes := map[string]func(ctx context.Context) error{
+		"PutContext":    func(ctx context.Context) error { return db.PutContext(ctx, "col", "k", []byte("v")) },
+		"DeleteContext": func(ctx context.Context) error { return db.DeleteContext(ctx, "col", "kept") },
+		"CommitContext": b.CommitContext,
+	}
+	for name, write := range writes {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := write(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("%s under a held lock: %v", name, err)
+		}
+		if waited := time.Since(start); waited > time.Second {
+			t.Errorf("%s returned after %v", name, waited)
+		}
+	}
+	offset := db.offset
+	db.mu.Unlock()
+
+	// Nothing was written, and the lock was released by the waiters
+	if db.Offset() != offset {
+		t.Errorf("log grew from %d to %d", offset, db.Offset())
+	}
+	if _, err := db.Get("col", "k"); err != ErrNotFound {
+		t.Errorf("Get(k) = %v", err)
+	}
+	if _, err := db.Get("col", "kept"); err != nil {
+		t.Errorf("Get(kept) = %v", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("col", "batched"); err != nil {
+		t.Errorf("Get(batched) after a later Commit = %v", err)
+	}
+
+	// A freeze is waited for the same way; an ended context writes nothing
+	unfreeze, err := db.Freeze(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := db.PutContext(ctx, "col", "k", []byte("v")); err != context.DeadlineExceeded {
+		t.Errorf("PutContext while frozen: %v", err)
+	}
+	unfreeze()
+	if err := db.PutContext(ctx, "col", "k", []byte("v")); err != context.DeadlineExceeded {
+		t.Errorf("PutContext with an ended context: %v", err)
+	}
+	if err := db.PutContext(context.Background(), "col", "k", []byte("v")); err != nil {
+		t.Errorf("PutContext = %v", err)
+	}
+}
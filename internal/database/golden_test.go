@@ -0,0 +1,274 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// goldenManifest mirrors the manifest written by internal/gengolden.
+type goldenManifest struct {
+	Password   string            `json:"password"`
+	Records    map[string][]byte `json:"records"`
+	Absent     []string          `json:"absent"`
+	Plaintext  []string          `json:"plaintext"`
+	Rotating   bool              `json:"rotating"`
+	Features   string            `json:"features"`
+	Flags      byte              `json:"flags"`
+	KDF        *KDFParams        `json:"kdf"`
+	Hint       bool              `json:"hint"`
+	Checkpoint *Checkpoint       `json:"checkpoint"`
+	Events     []string          `json:"events"`
+}
+
+// copyFixture copies a fixture, and the hint shipped with it, into a
+// temporary directory so opening it cannot modify the checked-in corpus.
+func copyFixture(t *testing.T, src string) string {
+	dst := filepath.Join(t.TempDir(), filepath.Base(src))
+	for _, ext := range []string{"", ".hint"} {
+		data, err := os.ReadFile(src + ext)
+		if ext != "" && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst+ext, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+// verifyReport checks what Open found in the file against m.
+func verifyReport(t *testing.T, report OpenReport, m *goldenManifest) {
+	t.Helper()
+	if m.Hint && !report.HintUsed {
+		t.Errorf("Shipped hint was not used (discarded: %v)", report.HintDiscarded)
+	}
+	if m.Features != "" && report.Features.String() != m.Features {
+		t.Errorf("Features = %s, want %s", report.Features, m.Features)
+	}
+	if report.RecordFlags&m.Flags != m.Flags {
+		t.Errorf("Scanned record flags = %#x, want %#x among them", report.RecordFlags, m.Flags)
+	}
+	if m.KDF != nil && report.KDF != *m.KDF {
+		t.Errorf("KDF = %+v, want %+v", report.KDF, *m.KDF)
+	}
+}
+
+// verifyEvents checks that a watch resumed from m.Checkpoint yields exactly
+// the changes made after it.
+func verifyEvents(t *testing.T, db *DB, m *goldenManifest) {
+	t.Helper()
+	sub, err := db.WatchFrom(*m.Checkpoint, "")
+	if err != nil {
+		t.Fatalf("WatchFrom %+v: %v", *m.Checkpoint, err)
+	}
+	for _, want := range m.Events {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ev, _, err := sub.Next(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Next: %v, want %s", err, want)
+		}
+		if got := compositeKey(ev.Collection, ev.Key); got != want {
+			t.Fatalf("Event for %s, want %s", got, want)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if ev, _, err := sub.Next(ctx); err == nil {
+		t.Errorf("Unexpected event for %s:%s", ev.Collection, ev.Key)
+	}
+}
+
+// verifyContents checks that db holds exactly the records of m.
+func verifyContents(t *testing.T, db *DB, m *goldenManifest) {
+	t.Helper()
+	for fullKey, want := range m.Records {
+		coll, key := SplitKey(fullKey)
+		got, err := db.Get(coll, key)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Get %s = %q, %v; want %q", fullKey, got, err, want)
+		}
+	}
+	for _, fullKey := range m.Absent {
+		coll, key := SplitKey(fullKey)
+		if _, err := db.Get(coll, key); err != ErrNotFound {
+			t.Errorf("Get %s: expected ErrNotFound, got %v", fullKey, err)
+		}
+	}
+
+	recs, err := db.ScanPrefix("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != len(m.Records) {
+		t.Errorf("Scan found %d records, manifest has %d", len(recs), len(m.Records))
+	}
+	for _, coll := range m.Plaintext {
+		if !db.plaintext[coll] {
+			t.Errorf("Collection %s lost its plaintext setting", coll)
+		}
+	}
+	if db.RotationActive() != m.Rotating {
+		t.Errorf("RotationActive = %v, want %v", db.RotationActive(), m.Rotating)
+	}
+}
+
+func TestGoldenFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "golden", "*.nok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("No golden fixtures found; run go run ./internal/gengolden")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".nok")
+		t.Run(name, func(t *testing.T) {
+			js, err := os.ReadFile(strings.TrimSuffix(fixture, ".nok") + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m goldenManifest
+			if err := json.Unmarshal(js, &m); err != nil {
+				t.Fatal(err)
+			}
+
+			path := copyFixture(t, fixture)
+			db, report, err := OpenWithReport(path, m.Password, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyReport(t, report, &m)
+			verifyContents(t, db, &m)
+			if m.Checkpoint != nil {
+				verifyEvents(t, db, &m)
+			}
+
+			// The hint written on close must agree with the log
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = Open(path, m.Password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			verifyContents(t, db, &m)
+		})
+	}
+}
+
+// TestRoundTripOptions writes with each optional feature enabled and checks
+// that a reopen with default options reads everything back, from the hint
+// and from a full scan of the log.
+func TestRoundTripOptions(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  Options
+		setup func(db *DB) error
+		flags byte // Some record must carry each of these
+	}{
+		{"Default", Options{}, nil, FlagCompressed | FlagBoundAAD},
+		{"Lease", Options{LeaseTimeout: 300 * time.Millisecond}, nil, 0},
+		{"DecryptWorkers", Options{DecryptWorkers: 4, InfoSampleSize: -1}, nil, 0},
+		{"ContentChecksums", Options{ContentChecksums: true}, nil, FlagChecksum},
+		{"Plaintext", Options{}, func(db *DB) error { return db.SetCollectionPlaintext("col", true) }, FlagPlaintext},
+		{"CollectionTTL", Options{}, func(db *DB) error { return db.SetCollectionTTL("col", time.Hour) }, 0},
+		{"Rotation", Options{}, func(db *DB) error { return db.BeginKeyRotation() }, 0},
+		{"CounterNonces", Options{CounterNonces: true}, nil, 0},
+		{"CompressionDict", Options{CompressionDict: []byte("value k00 value k05 value k10")}, nil, FlagCompressed | FlagDict},
+		{"KDFParams", Options{KDF: KDFParams{Time: 2, Memory: 64, Parallelism: 1}}, nil, 0},
+		{"MmapHint", Options{MmapHint: true}, nil, 0},
+		{"PreallocateBytes", Options{PreallocateBytes: 4096}, nil, 0},
+		{"LogEpoch", Options{}, func(db *DB) error { return db.Compact() }, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "roundtrip.nok")
+			db, err := OpenWithOptions(path, "pass", tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup != nil {
+				if err := tc.setup(db); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m := &goldenManifest{Password: "pass", Records: make(map[string][]byte)}
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("k%02d", i)
+				val := []byte("value " + key)
+				if i%5 == 0 {
+					val = bytes.Repeat(val, 40) // Compressed
+				}
+				if err := db.Put("col", key, val); err != nil {
+					t.Fatal(err)
+				}
+				m.Records["col:"+key] = val
+			}
+			batch := db.NewCollectionBatch("col")
+			batch.Delete("k01")
+			batch.Put("k20", []byte("batched"), 0)
+			if err := batch.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			delete(m.Records, "col:k01")
+			m.Records["col:k20"] = []byte("batched")
+			m.Absent = []string{"col:k01"}
+			if tc.name == "Plaintext" {
+				m.Plaintext = []string{"col"}
+			}
+			m.Rotating = db.RotationActive()
+			m.Features = db.Features().String()
+			if tc.opts.KDF != (KDFParams{}) {
+				m.KDF = &tc.opts.KDF
+			}
+			header := *db.header
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m.Hint = true
+			db, report, err := OpenWithReport(path, "pass", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyReport(t, report, m)
+			verifyContents(t, db, m)
+			if db.header.LogEpoch != header.LogEpoch || db.header.Horizon != header.Horizon {
+				t.Errorf("Log epoch %d, horizon %+v; want %d, %+v",
+					db.header.LogEpoch, db.header.Horizon, header.LogEpoch, header.Horizon)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Without the hint every record is read from the log
+			if err := os.Remove(path + ".hint"); err != nil {
+				t.Fatal(err)
+			}
+			m.Hint, m.Flags = false, tc.flags
+			db, report, err = OpenWithReport(path, "pass", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			verifyReport(t, report, m)
+			verifyContents(t, db, m)
+		})
+	}
+}
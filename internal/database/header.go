@@ -0,0 +1,310 @@
+package database
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// File header layout (V5):
+//
+//	Magic(6) + Version(1) + Salt(32) + KEKNonce(12) + EncryptedDEK(48)
+//	+ Extension area up to headerSize bytes
+//
+// The extension area holds fixed-offset fields that can be rewritten in place
+// without touching the record log that starts right after the header.
+const (
+	headerSize = 512
+
+	headerSaltOffset     = len(magicHeader) + 1
+	headerKEKNonceOffset = headerSaltOffset + saltSize
+	headerDEKOffset      = headerKEKNonceOffset + authNonceSize
+	headerExtOffset      = headerDEKOffset + encryptedDekSize
+
+	// Key rotation: State(1) + KEKNonce(12) + EncryptedDEK(48)
+	extRotationOffset = headerExtOffset
+	extRotationSize   = 1 + authNonceSize + encryptedDekSize
+
+	// Writer lease: Token(16) + Timestamp(8) + PID(4) + HostLen(1) + Host(63)
+	extLeaseOffset = extRotationOffset + extRotationSize
+	extLeaseSize   = leaseTokenSize + 8 + 4 + 1 + leaseHostSize
+
+	// Application schema version: uint32, zero in files that predate it
+	extUserVersionOffset = extLeaseOffset + extLeaseSize
+	extUserVersionSize   = 4
+
+	// Counter nonces: Prefix(4) + reserved counter limit(8), zero until the
+	// first counter nonce is used
+	extNonceOffset = extUserVersionOffset + extUserVersionSize
+	extNonceSize   = noncePrefixSize + 8
+
+	// Optional features the file may contain: uint32 bitmask of Feature
+	extFeaturesOffset = extNonceOffset + extNonceSize
+	extFeaturesSize   = 4
+
+	// Argon2id parameters: Time(4) + Memory(4) + Parallelism(1), zero in
+	// files that predate them
+	extKDFOffset = extFeaturesOffset + extFeaturesSize
+	extKDFSize   = 4 + 4 + 1
+
+	// Log identity, for Subscription checkpoints: Epoch(8), then the
+	// Epoch(8) and End(8) of the log the last Compact replaced and the
+	// Start(8) of writes after it; zero in files never compacted
+	extLogOffset = extKDFOffset + extKDFSize
+	extLogSize   = 4 * 8
+
+	// Counter nonce seal: Nonce(12) + Tag(16) sealing nothing under the DEK
+	// with the counter nonce field as AAD, so the reserved limit cannot be
+	// lowered to hand out used counters again; zero while the field is
+	extNonceSealOffset = extLogOffset + extLogSize
+	extNonceSealSize   = authNonceSize + authTagSize
+)
+
+// AAD used when wrapping a DEK with the KEK
+var dekAAD = []byte("NOKHAL_DEK")
+
+type fileHeader struct {
+	Version      byte
+	Salt         []byte
+	KEKNonce     []byte
+	EncryptedDEK []byte
+
+	// Key rotation in progress: records flagged with FlagKeyID are sealed
+	// with this second DEK.
+	Rotating         bool
+	NextKEKNonce     []byte
+	NextEncryptedDEK []byte
+
+	// Raw writer lease area, carried over verbatim by compaction
+	Lease []byte
+
+	UserVersion uint32
+
+	// Counter nonces: the database's prefix and the end of the counters
+	// reserved so far, and the seal authenticating both
+	NoncePrefix []byte
+	NonceLimit  uint64
+	NonceSeal   []byte
+
+	Features Feature
+
+	// KDF derives the KEK from the password; zero fields mean DefaultKDF
+	KDF KDFParams
+
+	// LogEpoch identifies the log; each Compact draws a new one. Horizon
+	// describes the log the last Compact replaced.
+	LogEpoch uint64
+	Horizon  logHorizon
+}
+
+func (h *fileHeader) encode() []byte {
+	buf := make([]byte, headerSize)
+	copy(buf, magicHeader)
+	buf[len(magicHeader)] = h.Version
+	copy(buf[headerSaltOffset:], h.Salt)
+	copy(buf[headerKEKNonceOffset:], h.KEKNonce)
+	copy(buf[headerDEKOffset:], h.EncryptedDEK)
+	copy(buf[extRotationOffset:], h.encodeRotation())
+	copy(buf[extLeaseOffset:], h.Lease)
+	binary.BigEndian.PutUint32(buf[extUserVersionOffset:], h.UserVersion)
+	copy(buf[extNonceOffset:], h.encodeNonces())
+	binary.BigEndian.PutUint32(buf[extFeaturesOffset:], uint32(h.Features))
+	binary.BigEndian.PutUint32(buf[extKDFOffset:], h.KDF.Time)
+	binary.BigEndian.PutUint32(buf[extKDFOffset+4:], h.KDF.Memory)
+	buf[extKDFOffset+8] = h.KDF.Parallelism
+	copy(buf[extLogOffset:], h.encodeLog())
+	copy(buf[extNonceSealOffset:], h.NonceSeal)
+	return buf
+}
+
+func (h *fileHeader) encodeLog() []byte {
+	buf := make([]byte, 0, extLogSize)
+	buf = binary.BigEndian.AppendUint64(buf, h.LogEpoch)
+	buf = binary.BigEndian.AppendUint64(buf, h.Horizon.Epoch)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Horizon.End))
+	return binary.BigEndian.AppendUint64(buf, uint64(h.Horizon.Start))
+}
+
+func (h *fileHeader) encodeRotation() []byte {
+	buf := make([]byte, extRotationSize)
+	if h.Rotating {
+		buf[0] = 1
+		copy(buf[1:], h.NextKEKNonce)
+		copy(buf[1+authNonceSize:], h.NextEncryptedDEK)
+	}
+	return buf
+}
+
+// ErrUnsupportedVersion is returned when a file was written with a format
+// version this build cannot open. Match it with errors.As.
+type ErrUnsupportedVersion struct {
+	Found    byte
+	Expected byte
+}
+
+func (e *ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("unsupported version: %d (expected %d)", e.Found, e.Expected)
+}
+
+// checkHeader validates the magic and version of the first n bytes read into
+// buf. short is returned when the magic matches but the header is incomplete.
+func checkHeader(buf []byte, n int, short error) error {
+	if n < len(magicHeader) || string(buf[:len(magicHeader)]) != magicHeader {
+		return ErrInvalidFile
+	}
+
+	fileVersion := buf[len(magicHeader)]
+	if fileVersion != version {
+		return &ErrUnsupportedVersion{Found: fileVersion, Expected: version}
+	}
+
+	if n < headerSize {
+		return short
+	}
+	return nil
+}
+
+// IsNokhalFile reports whether the file at path starts with the nokhal
+// magic, and if so its format version, which may be one this build cannot
+// open. It reads only those bytes, so it needs no password and costs no key
+// derivation. Files too short to hold the magic and version are not nokhal
+// files; only failing to open or read the file is an error.
+func IsNokhalFile(path string) (version byte, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(magicHeader)+1)
+	if _, err := io.ReadFull(f, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	if string(buf[:len(magicHeader)]) != magicHeader {
+		return 0, false, nil
+	}
+	return buf[len(magicHeader)], true, nil
+}
+
+// decodeHeader parses a full header. The magic and version must already have
+// been validated by the caller.
+func decodeHeader(buf []byte) *fileHeader {
+	h := &fileHeader{
+		Version:      buf[len(magicHeader)],
+		Salt:         append([]byte(nil), buf[headerSaltOffset:headerKEKNonceOffset]...),
+		KEKNonce:     append([]byte(nil), buf[headerKEKNonceOffset:headerDEKOffset]...),
+		EncryptedDEK: append([]byte(nil), buf[headerDEKOffset:headerExtOffset]...),
+	}
+
+	rot := buf[extRotationOffset : extRotationOffset+extRotationSize]
+	if rot[0] == 1 {
+		h.Rotating = true
+		h.NextKEKNonce = append([]byte(nil), rot[1:1+authNonceSize]...)
+		h.NextEncryptedDEK = append([]byte(nil), rot[1+authNonceSize:]...)
+	}
+
+	h.Lease = append([]byte(nil), buf[extLeaseOffset:extLeaseOffset+extLeaseSize]...)
+	h.UserVersion = binary.BigEndian.Uint32(buf[extUserVersionOffset:])
+	if h.NonceLimit = binary.BigEndian.Uint64(buf[extNonceOffset+noncePrefixSize:]); h.NonceLimit > 0 {
+		h.NoncePrefix = append([]byte(nil), buf[extNonceOffset:extNonceOffset+noncePrefixSize]...)
+	}
+	h.Features = Feature(binary.BigEndian.Uint32(buf[extFeaturesOffset:]))
+	h.KDF = KDFParams{
+		Time:        binary.BigEndian.Uint32(buf[extKDFOffset:]),
+		Memory:      binary.BigEndian.Uint32(buf[extKDFOffset+4:]),
+		Parallelism: buf[extKDFOffset+8],
+	}.withDefaults()
+	h.LogEpoch = binary.BigEndian.Uint64(buf[extLogOffset:])
+	h.Horizon = logHorizon{
+		Epoch: binary.BigEndian.Uint64(buf[extLogOffset+8:]),
+		End:   int64(binary.BigEndian.Uint64(buf[extLogOffset+16:])),
+		Start: int64(binary.BigEndian.Uint64(buf[extLogOffset+24:])),
+	}
+	if seal := buf[extNonceSealOffset : extNonceSealOffset+extNonceSealSize]; !bytes.Equal(seal, make([]byte, extNonceSealSize)) {
+		h.NonceSeal = append([]byte(nil), seal...)
+	}
+	return h
+}
+
+// newDEK generates a random data encryption key and wraps it with kek.
+func newDEK(kek cipher.AEAD) (dek, nonce, wrapped []byte, err error) {
+	dek = make([]byte, dekSize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, nil, err
+	}
+	nonce, wrapped, err = wrapDEK(kek, dek)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dek, nonce, wrapped, nil
+}
+
+// wrapDEK seals dek with kek under a fresh nonce.
+func wrapDEK(kek cipher.AEAD, dek []byte) (nonce, wrapped []byte, err error) {
+	nonce, err = generateNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, kek.Seal(nil, nonce, dek, dekAAD), nil
+}
+
+// writeHeaderAt rewrites part of the on-disk header in place and syncs it.
+// Callers must hold db.mu.
+func (db *DB) writeHeaderAt(data []byte, offset int) error {
+	if err := db.checkLease(); err != nil {
+		return err
+	}
+	if err := db.writeHeaderRaw(data, offset); err != nil {
+		return err
+	}
+	return db.mirrorHeader(data, offset)
+}
+
+// headerCopy returns the on-disk header with the writer lease cleared, for
+// copies of the database that must not look owned by this process.
+func (db *DB) headerCopy() ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := db.file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	clear(header[extLeaseOffset : extLeaseOffset+extLeaseSize])
+	return header, nil
+}
+
+func (db *DB) writeHeaderRaw(data []byte, offset int) error {
+	if _, err := db.file.WriteAt(data, int64(offset)); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+// SetUserVersion stores an application-defined schema version in the file
+// header, independent of the format version. It is written in place and
+// survives compaction.
+func (db *DB) SetUserVersion(n uint32) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	buf := make([]byte, extUserVersionSize)
+	binary.BigEndian.PutUint32(buf, n)
+	if err := db.writeHeaderAt(buf, extUserVersionOffset); err != nil {
+		return err
+	}
+	db.header.UserVersion = n
+	return nil
+}
+
+// UserVersion returns the value set by SetUserVersion, 0 if never set.
+func (db *DB) UserVersion() (uint32, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.header.UserVersion, nil
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsNokhalFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "a", []byte("1"))
+	db.Close()
+	if v, ok, err := IsNokhalFile(path); err != nil || !ok || v != version {
+		t.Errorf("database: version %d, %v, %v", v, ok, err)
+	}
+
+	// An older format is still recognized, with its version
+	old := filepath.Join(dir, "old.nok")
+	os.WriteFile(old, []byte(magicHeader+"\x03"), 0600)
+	if v, ok, err := IsNokhalFile(old); err != nil || !ok || v != 3 {
+		t.Errorf("version 3 file: version %d, %v, %v", v, ok, err)
+	}
+
+	noise := make([]byte, headerSize)
+	rand.Read(noise)
+	noise[0] = 0 // Cannot start with the magic by chance
+	for name, data := range map[string][]byte{
+		"random": noise,
+		"empty":  nil,
+		"magic":  []byte(magicHeader), // No version byte
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := IsNokhalFile(p); err != nil || ok {
+			t.Errorf("%s file: %v, %v", name, ok, err)
+		}
+	}
+
+	if _, _, err := IsNokhalFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestRotateSalt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	opts := Options{KDF: KDFParams{Memory: 64, Parallelism: 1}, MirrorPath: path + ".mirror"}
+	db, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "old", []byte("sealed under the old key"))
+	if err := db.BeginKeyRotation(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "new", []byte("sealed under the next key"))
+
+	salt := func(p string) []byte {
+		t.Helper()
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		h, err := readFileHeader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.Salt
+	}
+	before := salt(path)
+
+	if err := db.RotateSalt("wrong"); err != ErrInvalidPassword {
+		t.Fatalf("RotateSalt with a wrong password: %v", err)
+	}
+	if !bytes.Equal(salt(path), before) {
+		t.Fatal("salt changed by a failed RotateSalt")
+	}
+	if err := db.RotateSalt("pass"); err != nil {
+		t.Fatal(err)
+	}
+	after := salt(path)
+	if bytes.Equal(after, before) {
+		t.Fatal("salt on disk unchanged")
+	}
+	if !bytes.Equal(salt(path+".mirror"), after) {
+		t.Error("mirror header not rotated")
+	}
+	// The rotation in progress keeps going under the new KEK
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if db.RotationActive() {
+		t.Error("key rotation not finished by Compact")
+	}
+	db.Put("col", "later", []byte("written after"))
+	db.Close()
+
+	if _, err := OpenWithOptions(path, "wrong", opts); err != ErrInvalidPassword {
+		t.Fatalf("open with a wrong password: %v", err)
+	}
+	db, report, err := OpenWithReport(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !report.HintUsed {
+		t.Error("hint not used after a salt rotation")
+	}
+	if !bytes.Equal(salt(path), after) {
+		t.Error("salt not kept by Compact")
+	}
+	for key, want := range map[string]string{"old": "sealed under the old key", "new": "sealed under the next key", "later": "written after"} {
+		if v, err := db.Get("col", key); err != nil || string(v) != want {
+			t.Errorf("Get(%s) = %q, %v", key, v, err)
+		}
+	}
+}
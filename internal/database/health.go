@@ -0,0 +1,165 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrPingWrite   = errors.New("health check write failed")
+	ErrPingRead    = errors.New("health check read failed")
+	ErrPingTimeout = errors.New("health check timed out")
+)
+
+const (
+	// Ping writes its record here, hidden from prefix scans and statistics
+	healthCollection = internalPrefix + "_health"
+	healthKey        = "ping"
+	healthTTL        = time.Minute
+
+	// How late a background task may run before Healthy reports it stalled
+	healthStallGrace = 5 * time.Second
+)
+
+// HealthStatus summarizes whether the database and its background work are
+// making progress. Times are zero for what never happened.
+type HealthStatus struct {
+	OK       bool     // Nothing listed in Problems
+	Problems []string // Stalled or failed background work
+
+	LastWrite    time.Time // Last append to the log
+	LastPing     time.Time // Last successful Ping
+	PingFailures int64     // Failed or timed out Pings since Open
+
+	Leasing        bool      // Options.LeaseTimeout is set
+	LeaseRefreshed time.Time // Last refresh of the ownership lease
+	LeaseFailures  int64     // Failed lease refreshes since Open
+	LeaseLost      bool      // Another writer took the lease over
+
+	HintFlushed  time.Time // Last hint written by FlushHint
+	HintDue      time.Time // When a deferred hint flush is due, if one is pending
+	HintFailures int64     // Failed deferred hint flushes since Open
+}
+
+// health holds what Healthy reports. It is updated with atomics rather than
+// under db.mu, so Healthy answers even while a stuck write holds the lock.
+type health struct {
+	lastPing     atomic.Int64
+	pingFailures atomic.Int64
+	pingFailing  atomic.Bool // The latest Ping failed
+
+	leaseRefreshed atomic.Int64
+	leaseExpires   atomic.Int64 // When the lease goes stale without a refresh
+	leaseFailures  atomic.Int64
+	leaseLost      atomic.Bool
+
+	hintFlushed  atomic.Int64
+	hintDue      atomic.Int64
+	hintFailures atomic.Int64
+}
+
+// leaseRenewed records a successful lease refresh.
+func (h *health) leaseRenewed(timeout time.Duration) {
+	now := time.Now()
+	h.leaseRefreshed.Store(now.UnixNano())
+	h.leaseExpires.Store(now.Add(timeout).UnixNano())
+}
+
+// Ping checks that the database can be written and read within ctx: it
+// writes a random token to an internal collection, with a short TTL, and
+// reads it back under the write lock. Failures wrap ErrPingWrite or
+// ErrPingRead with the cause. If ctx ends first, typically because a stuck
+// write holds the lock, Ping returns ErrPingTimeout and the round trip
+// finishes in the background once the lock is free.
+func (db *DB) Ping(ctx context.Context) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- db.ping(token) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("%w: %w", ErrPingTimeout, ctx.Err())
+	}
+	db.health.pingFailing.Store(err != nil)
+	if err != nil {
+		db.health.pingFailures.Add(1)
+		return err
+	}
+	db.health.lastPing.Store(time.Now().UnixNano())
+	return nil
+}
+
+func (db *DB) ping(token []byte) error {
+	if err := db.lockWrite(); err != nil {
+		return fmt.Errorf("%w: %w", ErrPingWrite, err)
+	}
+	defer db.mu.Unlock()
+
+	if err := db.put(healthCollection, healthKey, token, healthTTL); err != nil {
+		return fmt.Errorf("%w: %w", ErrPingWrite, err)
+	}
+	compKey := compositeKey(healthCollection, healthKey)
+	rec, _, err := db.readRaw(compKey, db.now().UnixNano())
+	if err == nil {
+		rec.Value, err = db.openValue(rec, compKey)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPingRead, err)
+	}
+	if !bytes.Equal(rec.Value, token) {
+		return fmt.Errorf("%w: read back %x, wrote %x", ErrPingRead, rec.Value, token)
+	}
+	return nil
+}
+
+// Healthy reports the state of the database's background work without
+// taking any lock. A lease refresh that is overdue, a deferred hint flush
+// that did not run in time, a lost lease or a failed Ping since the last
+// successful one make it not OK.
+func (db *DB) Healthy() HealthStatus {
+	h := &db.health
+	unix := func(ns int64) time.Time {
+		if ns == 0 {
+			return time.Time{}
+		}
+		return time.Unix(0, ns)
+	}
+	s := HealthStatus{
+		LastWrite:      time.Unix(0, db.lastWrite.Load()),
+		LastPing:       unix(h.lastPing.Load()),
+		PingFailures:   h.pingFailures.Load(),
+		Leasing:        h.leaseExpires.Load() != 0,
+		LeaseRefreshed: unix(h.leaseRefreshed.Load()),
+		LeaseFailures:  h.leaseFailures.Load(),
+		LeaseLost:      h.leaseLost.Load(),
+		HintFlushed:    unix(h.hintFlushed.Load()),
+		HintDue:        unix(h.hintDue.Load()),
+		HintFailures:   h.hintFailures.Load(),
+	}
+
+	now := time.Now()
+	if s.LeaseLost {
+		s.Problems = append(s.Problems, "ownership lease lost to another writer")
+	} else if s.Leasing && now.After(unix(h.leaseExpires.Load())) {
+		s.Problems = append(s.Problems, fmt.Sprintf("lease not refreshed since %s", s.LeaseRefreshed.Format(time.RFC3339)))
+	}
+	if !s.HintDue.IsZero() && now.Sub(s.HintDue) > healthStallGrace {
+		s.Problems = append(s.Problems, fmt.Sprintf("deferred hint flush overdue since %s", s.HintDue.Format(time.RFC3339)))
+	}
+	if h.pingFailing.Load() {
+		s.Problems = append(s.Problems, "last ping failed")
+	}
+	s.OK = len(s.Problems) == 0
+	return s
+}
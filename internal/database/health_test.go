@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status := db.Healthy()
+	if !status.OK || status.LastPing.IsZero() || status.PingFailures != 0 {
+		t.Errorf("Healthy after a successful ping: %+v", status)
+	}
+	if stats, _ := db.Stats(); stats.Keys != 0 {
+		t.Errorf("The health record counts as a user key: %+v", stats)
+	}
+
+	// A writer stuck holding the lock makes Ping time out, and Healthy
+	// still answers
+	db.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = db.Ping(ctx)
+	cancel()
+	if !errors.Is(err, ErrPingTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected ErrPingTimeout, got %v", err)
+	}
+	status = db.Healthy()
+	db.mu.Unlock()
+	if status.OK || status.PingFailures != 1 {
+		t.Errorf("Healthy after a timed out ping: %+v", status)
+	}
+
+	if err := db.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := db.Healthy(); !status.OK {
+		t.Errorf("A successful ping did not clear the failure: %+v", status.Problems)
+	}
+
+	db.file.Close() // The disk goes away
+	if err := db.Ping(context.Background()); !errors.Is(err, ErrPingWrite) {
+		t.Errorf("Expected ErrPingWrite, got %v", err)
+	}
+}
+
+func TestHealthyBackgroundWork(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{
+		LeaseTimeout:      time.Second,
+		HintFlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	status := db.Healthy()
+	if !status.OK || !status.Leasing || status.LeaseRefreshed.IsZero() {
+		t.Errorf("Healthy after Open: %+v", status)
+	}
+
+	db.FlushHint() // Immediate
+	db.FlushHint() // Deferred by an hour
+	status = db.Healthy()
+	if status.HintFlushed.IsZero() || status.HintDue.Before(time.Now().Add(50*time.Minute)) {
+		t.Errorf("Hint flush not tracked: %+v", status)
+	}
+
+	// Overdue background work is reported
+	db.health.hintDue.Store(time.Now().Add(-time.Minute).UnixNano())
+	db.health.leaseExpires.Store(time.Now().Add(-time.Second).UnixNano())
+	if status := db.Healthy(); status.OK || len(status.Problems) != 2 {
+		t.Errorf("Expected a stalled lease refresh and hint flush, got %q", status.Problems)
+	}
+}
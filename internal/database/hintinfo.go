@@ -0,0 +1,52 @@
+package database
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// HintInfo describes a hint file as read by ReadHint.
+type HintInfo struct {
+	MagicValid  bool   // The file starts with a current hint magic; nothing else is set otherwise
+	Mapped      bool   // The hint is in the format of Options.MmapHint
+	Offset      int64  // End of the log the hint covers
+	Salt        []byte // Salt of the data file it was written for
+	Anchor      uint32 // CRC of the log bytes just before Offset
+	SealedBytes int64  // Size of the rest: the sealed index, filters and space accounting, and a mapped hint's array
+}
+
+// ReadHint parses the unencrypted header of the hint file at path, usually
+// the database path with ".hint" appended, for inspection. It opens neither
+// the data file nor the keys, so it needs no password, and it cannot look
+// inside the rest of the hint, which is sealed under the DEK. Whether the
+// hint matches a data file is only checked by Open, against the Salt and
+// Anchor reported here. A file with the wrong magic is reported with
+// MagicValid false and no error; one truncated before the sealed part fails.
+func ReadHint(path string) (HintInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return HintInfo{}, err
+	}
+	defer f.Close()
+
+	var info HintInfo
+	info.Offset, info.Salt, info.Anchor, info.Mapped, err = readHintHeader(bufio.NewReader(f))
+	if err == errInvalidHint {
+		return HintInfo{}, nil
+	}
+	if err != nil {
+		return HintInfo{}, err
+	}
+	info.MagicValid = true
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return info, err
+	}
+	info.SealedBytes = size - int64(len(encodeHintHeader(info.Offset, info.Salt, info.Anchor)))
+	if info.SealedBytes < nonceSize+authTagSize {
+		return info, io.ErrUnexpectedEOF
+	}
+	return info, nil
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadHint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "a", []byte("1"))
+	db.Put("col", "a", []byte("2"))
+	db.Put("col", "b", []byte("1"))
+	db.Put("col", "c", []byte("1"))
+	db.Delete("col", "c")
+	offset, salt := db.Offset(), db.header.Salt
+	db.Close()
+
+	info, err := ReadHint(path + ".hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.MagicValid || info.Offset != offset || !bytes.Equal(info.Salt, salt) {
+		t.Errorf("header: %+v, want offset %d and salt %x", info, offset, salt)
+	}
+	data, err := os.ReadFile(path + ".hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(encodeHintHeader(info.Offset, info.Salt, info.Anchor))
+	if info.SealedBytes != int64(len(data)-header) {
+		t.Errorf("%d sealed bytes in a hint of %d with a %d-byte header", info.SealedBytes, len(data), header)
+	}
+
+	// A hint written by Close is the one Open loads
+	db, report, err := OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.HintUsed {
+		t.Errorf("Open did not use the hint: %+v", report)
+	}
+	db.Close()
+
+	other := filepath.Join(t.TempDir(), "other.hint")
+	os.WriteFile(other, []byte("NOT_A_HINT_FILE_AT_ALL"), 0644)
+	if info, err := ReadHint(other); err != nil || info.MagicValid {
+		t.Errorf("foreign file: %+v, %v", info, err)
+	}
+	os.WriteFile(other, data[:header+nonceSize], 0644)
+	if _, err := ReadHint(other); err == nil {
+		t.Error("truncated hint read without error")
+	}
+}
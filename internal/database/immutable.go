@@ -0,0 +1,127 @@
+package database
+
+import (
+	"crypto/cipher"
+	"errors"
+)
+
+var ErrImmutableKey = errors.New("key of an immutable collection cannot change")
+
+// fastGet locates the current record of a key of an immutable collection
+// for Get without db.mu. Records are never rewritten in place while their
+// file is the log, so the entry stays valid until the key changes, which
+// immutability forbids except for rotation re-seals, or the log is replaced
+// by Compact; both drop it. A Get racing with those reads the old record,
+// which holds the same value, or fails on the closed file and takes the
+// locked path.
+type fastGet struct {
+	file   storageFile
+	offset int64
+	aead   cipher.AEAD
+}
+
+// SetCollectionImmutable marks collection as append-only: new keys may be
+// added, but once a key is live it can be neither overwritten nor deleted,
+// and writes that try fail with ErrImmutableKey. In exchange Get reads its
+// keys without taking the database lock once it has read them once.
+// Expired keys count as absent. Turning it off allows changes again.
+func (db *DB) SetCollectionImmutable(collection string, immutable bool) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	if isInternalCollection(collection) {
+		return ErrCollectionInUse
+	}
+	if db.immutable[collection] == immutable {
+		return nil
+	}
+	value := []byte("0")
+	if immutable {
+		value = []byte("1")
+	}
+	return db.putMeta(metaImmutablePrefix+collection, value)
+}
+
+// checkImmutable fails a write to key of collection if the collection is
+// immutable and the key is live. Callers must hold db.mu.
+func (db *DB) checkImmutable(collection, key string) error {
+	if !db.immutable[collection] {
+		return nil
+	}
+	entry, ok, err := db.index.get(compositeKey(collection, key))
+	if err != nil {
+		return err
+	}
+	if ok && !entry.expired(db.now().UnixNano()) {
+		return ErrImmutableKey
+	}
+	return nil
+}
+
+// checkImmutableWrites applies checkImmutable to the writes of a batch,
+// which may also add a key of an immutable collection only once. Callers
+// must hold db.mu.
+func (db *DB) checkImmutableWrites(writes []batchRecord) error {
+	var added map[string]bool
+	for _, w := range writes {
+		if !db.immutable[w.collection] {
+			continue
+		}
+		if err := db.checkImmutable(w.collection, w.key); err != nil {
+			return err
+		}
+		compKey := compositeKey(w.collection, w.key)
+		if added[compKey] {
+			return ErrImmutableKey
+		}
+		if added == nil {
+			added = make(map[string]bool)
+		}
+		added[compKey] = true
+	}
+	return nil
+}
+
+// noteFastGet records where Get can find rec, the current version of
+// compKey at offset, without the lock. Only records that cannot expire, are
+// sealed and need no re-seal qualify. Callers must hold db.mu.
+func (db *DB) noteFastGet(compKey string, offset int64, rec *record) {
+	if !db.immutable[string(rec.Collection)] || rec.ExpiresAt != 0 || rec.Op != OpPut ||
+		rec.Flags&FlagBoundAAD == 0 || db.needsReseal(rec.Flags) {
+		return
+	}
+	aead := db.cipherFor(rec.Flags)
+	if aead == nil {
+		return
+	}
+	db.fastGets.Store(compKey, &fastGet{file: db.file, offset: offset, aead: aead})
+}
+
+// getFast reads compKey without db.mu if Get has seen it before, reporting
+// false if the locked path must be taken.
+func (db *DB) getFast(compKey string) ([]byte, bool) {
+	v, ok := db.fastGets.Load(compKey)
+	if !ok {
+		return nil, false
+	}
+	fg := v.(*fastGet)
+	rec, _, err := readRecordAt(fg.file, fg.offset)
+	if err != nil || rec.Op != OpPut || rec.ExpiresAt != 0 ||
+		compositeKey(string(rec.Collection), string(rec.Key)) != compKey {
+		return nil, false
+	}
+	payload, err := fg.aead.Open(nil, rec.Nonce, rec.Value, recordAAD(compKey, rec.Timestamp, rec.Op, rec.Flags))
+	if err != nil {
+		return nil, false
+	}
+	value, err := db.decodeValue(rec.Flags, payload)
+	if err == nil {
+		value, err = db.untransform(string(rec.Collection), string(rec.Key), rec.Flags, value)
+	}
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImmutableCollection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetCollectionImmutable("ids", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("ids", "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A live key can neither change nor go away
+	if err := db.Put("ids", "a", []byte("2")); err != ErrImmutableKey {
+		t.Errorf("overwrite: %v", err)
+	}
+	if err := db.Delete("ids", "a"); err != ErrImmutableKey {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := db.DeletePrefix("ids:"); err != ErrImmutableKey {
+		t.Errorf("DeletePrefix: %v", err)
+	}
+	b := db.NewBatch()
+	b.Put("ids", "b", []byte("1"), 0)
+	b.Put("ids", "b", []byte("2"), 0)
+	if err := b.Commit(); err != ErrImmutableKey {
+		t.Errorf("batch adding a key twice: %v", err)
+	}
+	if err := db.SetCollectionImmutable("__nokhal_meta", true); err != ErrCollectionInUse {
+		t.Errorf("internal collection: %v", err)
+	}
+
+	// An expired key is absent, so it may be written again
+	db.PutWithTTL("ids", "session", []byte("1"), time.Minute)
+	clock.Advance(2 * time.Minute)
+	if err := db.Put("ids", "session", []byte("2")); err != nil {
+		t.Errorf("rewriting an expired key: %v", err)
+	}
+
+	// The first Get takes the lock, later ones do not
+	if _, ok := db.getFast("ids:a"); ok {
+		t.Error("fast path used before the first Get")
+	}
+	if v, err := db.Get("ids", "a"); err != nil || string(v) != "1" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	if v, ok := db.getFast("ids:a"); !ok || string(v) != "1" {
+		t.Errorf("fast path = %q, %v", v, ok)
+	}
+
+	// Compaction moves the record, so the fast path starts over
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.getFast("ids:a"); ok {
+		t.Error("fast path survived Compact")
+	}
+	if v, err := db.Get("ids", "a"); err != nil || string(v) != "1" {
+		t.Fatalf("Get after Compact = %q, %v", v, err)
+	}
+	db.Close()
+
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("ids", "a", []byte("2")); err != ErrImmutableKey {
+		t.Errorf("overwrite after reopen: %v", err)
+	}
+	db.Get("ids", "a")
+	if err := db.SetCollectionImmutable("ids", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.getFast("ids:a"); ok {
+		t.Error("fast path kept after immutability was turned off")
+	}
+	if err := db.Put("ids", "a", []byte("2")); err != nil {
+		t.Errorf("overwrite of a mutable collection: %v", err)
+	}
+}
+
+// Run with -race: readers of immutable keys take no lock while other
+// collections are written and the log is compacted under them.
+func TestImmutableGetRace(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SetCollectionImmutable("ids", true); err != nil {
+		t.Fatal(err)
+	}
+	const keys = 64
+	for i := 0; i < keys; i++ {
+		db.Put("ids", fmt.Sprint(i), []byte(fmt.Sprintf("value-%d", i)))
+	}
+
+	done := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			db.Put("busy", fmt.Sprint(i%16), []byte("churn"))
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		for i := 0; i < 3; i++ {
+			if err := db.Compact(); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for n := 0; n < 2000; n++ {
+				i := (n*7 + r) % keys
+				v, err := db.Get("ids", fmt.Sprint(i))
+				if err != nil || string(v) != fmt.Sprintf("value-%d", i) {
+					t.Errorf("Get(%d) = %q, %v", i, v, err)
+					return
+				}
+			}
+		}(r)
+	}
+	readers.Wait()
+	close(done)
+	writers.Wait()
+}
@@ -1,16 +1,48 @@
 package database
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"hash/crc32"
 	"hash/fnv"
 	"io"
 	"os"
 	"strings"
+	"time"
 )
 
-const hintMagic = "NOKHAL_HINT"
+const hintMagic = "NOKHAL_HINT5"
+
+// The hint records the file salt and a checksum of the log bytes just before
+// its offset, so a hint left over from a replaced data file is detected.
+const hintAnchorSize = 64
+
+var (
+	errInvalidHint = errors.New("invalid hint file")
+	errStaleHint   = errors.New("hint does not match data file")
+)
+
+const defaultHintFlushInterval = time.Second
+
+const (
+	defaultBloomSize = 100000
+	bloomBitsPerKey  = 10
+)
+
+// indexEntry locates the latest version of a key in the log and caches the
+// header fields needed to answer metadata queries without reading it.
+type indexEntry struct {
+	Offset    int64
+	Size      int64
+	Timestamp int64
+	ExpiresAt int64
+}
+
+func (e indexEntry) expired(now int64) bool {
+	return e.ExpiresAt > 0 && e.ExpiresAt < now
+}
 
 // BloomFilter is a simple probabilistic data structure
 type BloomFilter struct {
@@ -46,89 +78,442 @@ func compositeKey(collection, key string) string {
 }
 
 func SplitKey(fullKey string) (string, string) {
-	parts := strings.SplitN(fullKey, ":", 2)
-	if len(parts) == 1 {
-		return "", parts[0]
+	collection, key, ok := strings.Cut(fullKey, ":")
+	if !ok {
+		return "", fullKey
+	}
+	return collection, key
+}
+
+// applyRecord updates the index, bloom filter and space accounting for a
+// record appended to the log at offset, and reports whether it superseded a
+// current version. Callers must hold db.mu.
+func (db *DB) applyRecord(compKey string, op byte, offset, size, timestamp, expiresAt int64) (replaced bool) {
+	collection, _ := SplitKey(compKey)
+	db.fastGets.Delete(compKey)
+	// A failed lookup of a low-memory index only skews the space accounting
+	old, ok, _ := db.index.get(compKey)
+	if ok {
+		db.dead[collection] += old.Size
+		db.live[collection] -= old.Size
+		replaced = true
+	}
+	db.noteExpiry(compKey, old, replaced, op, expiresAt)
+
+	switch op {
+	case OpPut, OpMeta:
+		db.checkIndexEntry(compKey, offset, size)
+		db.index.set(compKey, indexEntry{
+			Offset:    offset,
+			Size:      size,
+			Timestamp: timestamp,
+			ExpiresAt: expiresAt,
+		})
+		db.live[collection] += size
+		db.bloom.Add(compKey)
+		addPrefixes(db.prefixes, compKey)
+	case OpDelete:
+		db.index.remove(compKey)
+		db.dead[collection] += size
+		// Cannot remove from Bloom Filter (without counting BF), strictly speaking.
+		// But for simplicity we ignore removal from BF.
+		// It just means potential false positives, which is BF nature.
 	}
-	return parts[0], parts[1]
+	return replaced
+}
+
+// recountLive rebuilds the per-collection live byte totals from the index.
+// Callers must hold db.mu.
+func (db *DB) recountLive() error {
+	db.live = make(map[string]int64)
+	return db.index.each(func(k string, e indexEntry) error {
+		collection, _ := SplitKey(k)
+		db.live[collection] += e.Size
+		return nil
+	})
 }
 
-func (db *DB) loadIndexes() error {
+func (db *DB) loadIndexes() (indexScan, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	scan, err := db.rebuildIndex(true)
+	if err == nil {
+		db.checkLogEnd(scan)
+	}
+	return scan, err
+}
 
-	// Try to load from hint file first
-	loadedOffset, err := db.loadHint()
+// Reindex discards the hint file and rebuilds the in-memory index and bloom
+// filter from a full scan of the log, then writes a fresh hint.
+func (db *DB) Reindex() error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	if err := os.Remove(db.path + ".hint"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db.fastGets.Clear()
+	// Replaying the log must not look like keys being rewritten
+	expiry := db.expiry
+	db.expiry = nil
+	scan, err := db.rebuildIndex(false)
 	if err == nil {
-		db.offset = loadedOffset
-	} else {
+		err = db.checkUnsealed(scan.unsealed)
+	}
+	if db.expiry = expiry; expiry != nil && err == nil {
+		err = db.refillExpiry()
+	}
+	if err != nil {
+		return err
+	}
+	return db.saveHint()
+}
+
+// indexScan describes how rebuildIndex built the index.
+type indexScan struct {
+	hinted  bool  // The hint was loaded
+	hintErr error // Why an existing hint could not be loaded
+	records int   // Records read from the log
+	tail    int64 // Bytes after the last intact record
+	flags   byte  // Union of the flags of the records read
+	ranges  int   // Log ranges indexed in parallel
+
+	// Collections with tombstones not sealed, for checkUnsealed
+	unsealed map[string]bool
+}
+
+// noteUnsealed records that a tombstone of collection is not sealed.
+func (s *indexScan) noteUnsealed(collection string) {
+	if s.unsealed == nil {
+		s.unsealed = make(map[string]bool)
+	}
+	s.unsealed[collection] = true
+}
+
+// rebuildIndex loads the index from the hint (if allowed and valid) and scans
+// the log after it. Callers must hold db.mu.
+func (db *DB) rebuildIndex(useHint bool) (indexScan, error) {
+	var scan indexScan
+	db.indexGen++
+
+	// Try to load from hint file first. A low-memory open never loads the
+	// whole index into memory, so it has no use for the hint.
+	hinted := false
+	if useHint && !db.opts.LowMemory {
+		loadedOffset, err := db.loadHint()
+		if err != nil && !os.IsNotExist(err) {
+			scan.hintErr = err
+		}
+		if err == nil {
+			hinted = true
+			db.offset = loadedOffset
+			if db.dead == nil {
+				db.dead = make(map[string]int64)
+			}
+			if db.index == nil {
+				db.index = make(mapIndex)
+			}
+		}
+	}
+
+	// A low-memory full scan streams the index to disk and derives the
+	// space accounting from the per-collection totals once it is built
+	var build indexBuilder
+	var total map[string]int64
+	if !hinted {
 		// If hint fails, start from beginning
-		db.offset = int64(v4HeaderSize)
-		db.index = make(map[string]int64)
-		db.bloom = NewBloomFilter(100000)
+		db.offset = int64(headerSize)
+		db.bloom = NewBloomFilter(defaultBloomSize)
+		db.prefixes = NewBloomFilter(defaultBloomSize)
+		db.dead = make(map[string]int64)
+		if db.opts.LowMemory {
+			build = db.newIndexBuilder()
+			defer build.discard()
+			total = make(map[string]int64)
+		} else {
+			if db.index != nil {
+				db.index.close()
+			}
+			db.index = make(mapIndex)
+		}
+	}
+	if build == nil {
+		if err := db.recountLive(); err != nil {
+			return scan, err
+		}
 	}
 
 	offset := db.offset
 	fi, err := db.file.Stat()
 	if err != nil {
-		return err
+		return scan, err
 	}
 	fileSize := fi.Size()
+	db.allocated = fileSize
 
-	// Scan remaining records (or all if no hint)
+	// Scan remaining records (or all if no hint). The log ends at the file
+	// end, at a torn record, or where zero-filled preallocation begins.
+	logEnd := fileSize
+	if n := db.indexLoadWorkers(fileSize - offset); n > 0 && build == nil {
+		offset = db.scanParallel(&scan, offset, fileSize, n)
+	}
 	for offset < fileSize {
 		rec, size, err := db.readRecord(offset)
 		if err != nil {
+			if end, torn := preallocatedEnd(db.file, offset, fileSize); end {
+				logEnd = offset + torn
+				break
+			}
 			if err == io.EOF {
 				break
 			}
-			return err
+			return scan, err
 		}
 
+		scan.records++
+		if skip, _ := checkOp(rec.Op, offset); skip {
+			if err := db.verifySkipped(rec); err != nil {
+				return scan, err
+			}
+			offset += size
+			continue
+		}
+		scan.flags |= rec.Flags
 		key := compositeKey(string(rec.Collection), string(rec.Key))
-		if rec.Op == OpPut {
-			db.index[key] = offset
-			db.bloom.Add(key)
+		if rec.Op == OpDelete && rec.Flags&FlagBoundAAD != 0 {
+			// Sealed tombstones are verified so a Put flipped to a Delete
+			// cannot silently drop a key
+			if _, err := db.openValue(rec, key); err != nil {
+				return scan, err
+			}
 		} else if rec.Op == OpDelete {
-			delete(db.index, key)
-			// Cannot remove from Bloom Filter (without counting BF), strictly speaking.
-			// But for simplicity we ignore removal from BF. 
-			// It just means potential false positives, which is BF nature.
+			scan.noteUnsealed(string(rec.Collection))
+		}
+		if build != nil {
+			entry := indexEntry{Offset: offset, Size: size, Timestamp: rec.Timestamp, ExpiresAt: rec.ExpiresAt}
+			if err := build.add(key, entry, rec.Op == OpDelete); err != nil {
+				return scan, err
+			}
+			total[string(rec.Collection)] += size
+		} else {
+			db.applyRecord(key, rec.Op, offset, size, rec.Timestamp, rec.ExpiresAt)
 		}
 		offset += size
 	}
 	db.offset = offset
+
+	if build != nil {
+		index, err := build.finish()
+		if err != nil {
+			return scan, err
+		}
+		if db.index != nil {
+			db.index.close()
+		}
+		db.index = index
+		if err := db.recountLive(); err != nil {
+			return scan, err
+		}
+		for collection, size := range total {
+			db.dead[collection] = size - db.live[collection]
+		}
+	}
+
+	// After a full scan the key count is known, so size the filter for it
+	scan.hinted = hinted
+	if logEnd > offset {
+		scan.tail = logEnd - offset
+	}
+	if !hinted {
+		return scan, db.resizeBloom()
+	}
+	return scan, nil
+}
+
+// resizeBloom replaces the bloom filter and the prefix filter with ones sized
+// for the current key count, dropping stale bits of deleted keys. Callers
+// must hold db.mu.
+func (db *DB) resizeBloom() error {
+	var keys uint
+	if err := db.index.each(func(string, indexEntry) error {
+		keys++
+		return nil
+	}); err != nil {
+		return err
+	}
+	size := keys * bloomBitsPerKey
+	if size < defaultBloomSize {
+		size = defaultBloomSize
+	}
+	db.bloom = NewBloomFilter(size)
+	db.prefixes = NewBloomFilter(size)
+	return db.index.each(func(k string, _ indexEntry) error {
+		db.bloom.Add(k)
+		addPrefixes(db.prefixes, k)
+		return nil
+	})
+}
+
+// FlushHint persists the index to the hint file so the next Open can skip
+// most of the log scan. Calls are coalesced: at most one hint is written per
+// Options.HintFlushInterval, and a call inside the interval schedules a flush
+// of the state current at its end. Close always writes the latest hint.
+func (db *DB) FlushHint() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// The hint written by Freeze stays current until it ends
+	if db.thaw != nil {
+		return nil
+	}
+	wait := db.hintFlushInterval() - time.Since(db.lastHintFlush)
+	if wait <= 0 {
+		return db.flushHint()
+	}
+	if db.hintTimer == nil {
+		db.hintTimer = time.AfterFunc(wait, db.deferredHintFlush)
+		db.health.hintDue.Store(time.Now().Add(wait).UnixNano())
+	}
 	return nil
 }
 
+func (db *DB) deferredHintFlush() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.hintTimer = nil
+	db.health.hintDue.Store(0)
+	if db.closed || db.thaw != nil {
+		return
+	}
+	if err := db.flushHint(); err != nil {
+		db.health.hintFailures.Add(1)
+		db.logger().Warn("nokhal: deferred hint flush failed", "path", db.path, "err", err)
+	}
+}
+
+// flushHint writes the hint now. Callers must hold db.mu.
+func (db *DB) flushHint() error {
+	// A writer that lost its lease must not publish a hint for a log it no longer owns
+	if err := db.checkLease(); err != nil {
+		return err
+	}
+	if err := db.saveHint(); err != nil {
+		return err
+	}
+	db.lastHintFlush = time.Now()
+	db.health.hintFlushed.Store(db.lastHintFlush.UnixNano())
+	return nil
+}
+
+func (db *DB) hintFlushInterval() time.Duration {
+	if db.opts.HintFlushInterval > 0 {
+		return db.opts.HintFlushInterval
+	}
+	return defaultHintFlushInterval
+}
+
+// saveHint writes the hint through a temporary file so a crash mid-write
+// never leaves a truncated hint behind.
 func (db *DB) saveHint() error {
 	hintPath := db.path + ".hint"
-	f, err := os.Create(hintPath)
+	if db.opts.LowMemory {
+		// A low-memory open never reads the hint, so it would only go stale
+		if err := os.Remove(hintPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmpPath := hintPath + ".tmp"
+	f, err := os.Create(tmpPath)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmpPath)
 	defer f.Close()
 
-	// Write Header
-	if _, err := f.WriteString(hintMagic); err != nil {
+	encode := db.encodeHint
+	if db.opts.MmapHint {
+		encode = db.encodeMappedHint
+	}
+	if err := encode(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := replaceFile(tmpPath, hintPath); err != nil {
+		return err
+	}
+	db.hintWrites++
+	return nil
+}
+
+func (db *DB) encodeHint(f *os.File) error {
+	anchor, err := hintAnchor(db.file, db.offset)
+	if err != nil {
 		return err
 	}
 
-	// Write Last Offset
-	if err := binary.Write(f, binary.BigEndian, db.offset); err != nil {
+	// Write Header: magic, last offset, file identity and anchor
+	header := encodeHintHeader(db.offset, db.header.Salt, anchor)
+	if _, err := f.Write(header); err != nil {
 		return err
 	}
 
-	// Encode Index and Bloom Filter
-	enc := gob.NewEncoder(f)
-	if err := enc.Encode(db.index); err != nil {
+	// Encode Index and Bloom Filters. The index names every key, so they are
+	// sealed under the DEK, bound to the header.
+	// An index loaded from a mapped hint is written out as a map
+	index, ok := db.index.(mapIndex)
+	if !ok {
+		index = make(mapIndex)
+		err := db.index.each(func(k string, e indexEntry) error {
+			index[k] = e
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var payload bytes.Buffer
+	enc := gob.NewEncoder(&payload)
+	if err := enc.Encode(index); err != nil {
 		return err
 	}
 	if err := enc.Encode(db.bloom); err != nil {
 		return err
 	}
+	if err := enc.Encode(db.dead); err != nil {
+		return err
+	}
+	if err := enc.Encode(db.prefixes); err != nil {
+		return err
+	}
 
-	return nil
+	nonce, err := db.newNonce()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(nonce); err != nil {
+		return err
+	}
+	_, err = f.Write(db.aead.Seal(nil, nonce, payload.Bytes(), header))
+	return err
+}
+
+// encodeHintHeader returns the unencrypted start of a gob hint.
+func encodeHintHeader(offset int64, salt []byte, anchor uint32) []byte {
+	return appendHintHeader(make([]byte, 0, len(hintMagic)+8+len(salt)+4), hintMagic, offset, salt, anchor)
+}
+
+// appendHintHeader appends the start of a hint with magic to buf.
+func appendHintHeader(buf []byte, magic string, offset int64, salt []byte, anchor uint32) []byte {
+	buf = append(buf, magic...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(offset))
+	buf = append(buf, salt...)
+	return binary.BigEndian.AppendUint32(buf, anchor)
 }
 
 func (db *DB) loadHint() (int64, error) {
@@ -139,29 +524,107 @@ func (db *DB) loadHint() (int64, error) {
 	}
 	defer f.Close()
 
-	// Verify Header
-	magic := make([]byte, len(hintMagic))
-	if _, err := io.ReadFull(f, magic); err != nil {
+	fi, err := db.file.Stat()
+	if err != nil {
 		return 0, err
 	}
-	if string(magic) != hintMagic {
-		return 0, errors.New("invalid hint file")
+	offset, mapped, err := checkHintHeader(f, db.file, db.header, fi.Size())
+	if err != nil {
+		return 0, err
+	}
+	anchor, err := hintAnchor(db.file, offset)
+	if err != nil {
+		return 0, err
+	}
+	if mapped {
+		header := appendHintHeader(nil, mappedHintMagic, offset, db.header.Salt, anchor)
+		return offset, db.loadMappedHint(f, len(header))
 	}
 
-	// Read Offset
-	var offset int64
-	if err := binary.Read(f, binary.BigEndian, &offset); err != nil {
+	// A hint that does not open under the DEK is discarded like a stale one
+	sealed, err := io.ReadAll(f)
+	if err != nil {
 		return 0, err
 	}
+	if len(sealed) < nonceSize {
+		return 0, errInvalidHint
+	}
+	payload, err := db.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], encodeHintHeader(offset, db.header.Salt, anchor))
+	if err != nil {
+		return 0, ErrDecryption
+	}
 
-	// Decode Index and Bloom Filter
-	dec := gob.NewDecoder(f)
-	if err := dec.Decode(&db.index); err != nil {
+	// Decode Index and Bloom Filters
+	dec := gob.NewDecoder(bytes.NewReader(payload))
+	var index mapIndex
+	if err := dec.Decode(&index); err != nil {
 		return 0, err
 	}
+	db.index = index
 	if err := dec.Decode(&db.bloom); err != nil {
 		return 0, err
 	}
+	if err := dec.Decode(&db.dead); err != nil {
+		return 0, err
+	}
+	if err := dec.Decode(&db.prefixes); err != nil {
+		return 0, err
+	}
 
 	return offset, nil
 }
+
+// checkHintHeader reads the hint header from r and verifies that it was
+// written for the data file described by data, header and size. It returns
+// the log offset covered by the hint and whether it is a mapped hint.
+func checkHintHeader(r io.Reader, data io.ReaderAt, header *fileHeader, size int64) (int64, bool, error) {
+	offset, salt, anchor, mapped, err := readHintHeader(r)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if offset < int64(headerSize) || offset > size || !bytes.Equal(salt, header.Salt) {
+		return 0, false, errStaleHint
+	}
+	want, err := hintAnchor(data, offset)
+	if err != nil || want != anchor {
+		return 0, false, errStaleHint
+	}
+	return offset, mapped, nil
+}
+
+// readHintHeader reads the magic, log offset, file salt and anchor that
+// start a hint, and reports whether the magic is that of a mapped hint. A
+// wrong magic fails with errInvalidHint.
+func readHintHeader(r io.Reader) (offset int64, salt []byte, anchor uint32, mapped bool, err error) {
+	magic := make([]byte, len(hintMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, nil, 0, false, err
+	}
+	mapped = string(magic) == mappedHintMagic
+	if string(magic) != hintMagic && !mapped {
+		return 0, nil, 0, false, errInvalidHint
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
+		return 0, nil, 0, false, err
+	}
+	salt = make([]byte, saltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return 0, nil, 0, false, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &anchor); err != nil {
+		return 0, nil, 0, false, err
+	}
+	return offset, salt, anchor, mapped, nil
+}
+
+// hintAnchor checksums up to hintAnchorSize log bytes ending at offset.
+func hintAnchor(r io.ReaderAt, offset int64) (uint32, error) {
+	start := max(offset-hintAnchorSize, int64(headerSize))
+	buf := make([]byte, offset-start)
+	if _, err := r.ReadAt(buf, start); err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// A parallel index load cuts the log into ranges of about equal size, one
+// per worker. Each worker finds the first record at or after its cut and
+// indexes the records that start before the next cut into a partial index
+// of its own. The partial indexes are then applied in log order, so the
+// later of two records wins, as in a sequential scan, even where the clock
+// went back between them. A cut can land inside a value that holds a copy of
+// a record, which then reads back intact, so a range is only used if the
+// previous one ended exactly where it starts; otherwise it is scanned again
+// from there on the calling goroutine. A range that hits an error is handed
+// to the sequential scan, which fails or finds the end of the log as usual.
+
+// indexLoadMinRange is the least log, in bytes, worth a worker of its own.
+// A var so tests can lower it.
+var indexLoadMinRange int64 = 4 << 20
+
+// syncMaxName caps the collection and key sizes of a record a worker takes
+// as its first. A candidate past it is passed over, which at worst costs its
+// range the parallel scan.
+const syncMaxName = 1 << 16
+
+// indexPart is the partial index of one range of the log.
+type indexPart struct {
+	start   int64                // First record, or -1 if none was found
+	end     int64                // End of the last record read
+	last    map[string]partEntry // Latest record of each key
+	dead    map[string]int64     // Bytes per collection superseded in the range
+	records int
+	flags   byte
+	err     error // Why the scan stopped before the end of the range
+
+	unsealed map[string]bool // Collections with tombstones not sealed
+}
+
+type partEntry struct {
+	indexEntry
+	op byte
+}
+
+// indexLoadWorkers returns how many workers scan size bytes of log, or zero
+// to scan it sequentially.
+func (db *DB) indexLoadWorkers(size int64) int {
+	n := min(int64(db.opts.IndexLoadWorkers), size/indexLoadMinRange)
+	if n < 2 {
+		return 0
+	}
+	return int(n)
+}
+
+// scanParallel indexes the log from offset to fileSize with n workers and
+// returns the offset the sequential scan goes on from. Callers must hold
+// db.mu.
+func (db *DB) scanParallel(scan *indexScan, offset, fileSize int64, n int) int64 {
+	cuts := make([]int64, n+1)
+	for i := range cuts {
+		cuts[i] = offset + (fileSize-offset)*int64(i)/int64(n)
+	}
+	parts := make([]*indexPart, n)
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Go(func() {
+			parts[i] = db.scanRange(cuts[i], cuts[i+1], fileSize, i > 0)
+		})
+	}
+	wg.Wait()
+
+	for i, part := range parts {
+		if part.start != offset {
+			part = db.scanRange(offset, cuts[i+1], fileSize, false)
+		} else {
+			scan.ranges++
+		}
+		for key, e := range part.last {
+			db.applyRecord(key, e.op, e.Offset, e.Size, e.Timestamp, e.ExpiresAt)
+		}
+		for collection, size := range part.dead {
+			db.dead[collection] += size
+		}
+		scan.records += part.records
+		scan.flags |= part.flags
+		for collection := range part.unsealed {
+			scan.noteUnsealed(collection)
+		}
+		offset = part.end
+		if part.err != nil {
+			break
+		}
+	}
+	return offset
+}
+
+// scanRange indexes the records that start from from to until. If sync is
+// set, from is a cut that need not be a record boundary, and the scan starts
+// at the first record after it.
+func (db *DB) scanRange(from, until, fileSize int64, sync bool) *indexPart {
+	part := &indexPart{start: -1, last: make(map[string]partEntry), dead: make(map[string]int64), unsealed: make(map[string]bool)}
+	if sync {
+		if from = db.syncRecord(from, until, fileSize); from < 0 {
+			return part
+		}
+	}
+	part.start = from
+
+	offset := from
+	for offset < until {
+		rec, size, err := db.readRecord(offset)
+		if err != nil {
+			part.err = err
+			break
+		}
+		if skip, _ := checkOp(rec.Op, offset); skip {
+			if err := db.verifySkipped(rec); err != nil {
+				part.err = err
+				break
+			}
+			part.records++
+			offset += size
+			continue
+		}
+		key := compositeKey(string(rec.Collection), string(rec.Key))
+		if rec.Op == OpDelete && rec.Flags&FlagBoundAAD != 0 {
+			if _, err := db.openValue(rec, key); err != nil {
+				part.err = err
+				break
+			}
+		} else if rec.Op == OpDelete {
+			part.unsealed[string(rec.Collection)] = true
+		}
+		part.records++
+		part.flags |= rec.Flags
+		if prev, ok := part.last[key]; ok {
+			part.dead[string(rec.Collection)] += prev.Size
+		}
+		part.last[key] = partEntry{
+			indexEntry: indexEntry{Offset: offset, Size: size, Timestamp: rec.Timestamp, ExpiresAt: rec.ExpiresAt},
+			op:         rec.Op,
+		}
+		offset += size
+	}
+	part.end = offset
+	return part
+}
+
+// syncRecord returns the offset of the first intact record that starts from
+// from to until, or -1 if there is none.
+func (db *DB) syncRecord(from, until, fileSize int64) int64 {
+	const window = 64 << 10
+	buf := make([]byte, window+recordHeaderSize+opSize)
+	for base := from; base < until; base += window {
+		n, _ := db.file.ReadAt(buf, base)
+		for i := 0; i < window && base+int64(i) < until && i+recordHeaderSize+opSize <= n; i++ {
+			_, expiresAt, _, collSize, keySize, valSize := decodeRecordHeader(buf[i:])
+			if op := buf[i+recordHeaderSize]; op != OpPut && op != OpDelete && op != OpMeta {
+				continue
+			}
+			size := int64(recordHeaderSize + opSize + collSize + keySize + nonceSize + valSize)
+			if expiresAt < 0 || collSize > syncMaxName || keySize > syncMaxName || size > fileSize-base-int64(i) {
+				continue
+			}
+			if db.intactAt(base+int64(i), size, binary.BigEndian.Uint32(buf[i:])) {
+				return base + int64(i)
+			}
+		}
+	}
+	return -1
+}
+
+// intactAt reports whether the size bytes at offset after the CRC match crc,
+// without holding them in memory at once.
+func (db *DB) intactAt(offset, size int64, crc uint32) bool {
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(db.file, offset+crcSize, size-crcSize)); err != nil {
+		return false
+	}
+	return h.Sum32() == crc
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParallelIndexLoad(t *testing.T) {
+	defer func(n int64) { indexLoadMinRange = n }(indexLoadMinRange)
+	indexLoadMinRange = 4 << 10
+
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{CompressionThreshold: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	write := func(n int) {
+		for range n {
+			key := fmt.Sprint("k", rng.Intn(400))
+			value := make([]byte, rng.Intn(400))
+			rng.Read(value)
+			var err error
+			switch rng.Intn(10) {
+			case 0:
+				err = db.Delete("col", key)
+			case 1:
+				err = db.PutWithTTL("col", key, value, time.Hour)
+			default:
+				err = db.Put("col", key, value)
+			}
+			if err != nil && err != ErrNotFound {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(2000)
+	// A plaintext copy of the log holds records a worker may take for real
+	if err := db.SetCollectionPlaintext("copies", true); err != nil {
+		t.Fatal(err)
+	}
+	copied := make([]byte, db.offset-headerSize)
+	db.file.ReadAt(copied, headerSize)
+	if err := db.Put("copies", "log", copied); err != nil {
+		t.Fatal(err)
+	}
+	write(2000)
+	// And the log ends with a torn record
+	db.file.WriteAt(copied[:100], db.offset)
+
+	load := func(workers int) (indexScan, mapIndex, map[string]int64, map[string]int64) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.opts.IndexLoadWorkers = workers
+		scan, err := db.rebuildIndex(false)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		zero := func(_ string, n int64) bool { return n == 0 }
+		live, dead := maps.Clone(db.live), maps.Clone(db.dead)
+		maps.DeleteFunc(live, zero)
+		maps.DeleteFunc(dead, zero)
+		return scan, maps.Clone(db.index.(mapIndex)), live, dead
+	}
+	wantScan, want, wantLive, wantDead := load(0)
+	if wantScan.ranges != 0 || wantScan.tail != 100 {
+		t.Fatalf("sequential scan: %+v", wantScan)
+	}
+
+	for _, workers := range []int{2, 3, 8, 64} {
+		scan, index, live, dead := load(workers)
+		// Ranges starting inside the copy are scanned again
+		if workers == 64 && (scan.ranges < 2 || scan.ranges == workers) {
+			t.Errorf("%d workers indexed %d ranges", workers, scan.ranges)
+		}
+		scan.ranges = 0
+		if !reflect.DeepEqual(scan, wantScan) {
+			t.Errorf("%d workers: scan %+v, sequential %+v", workers, scan, wantScan)
+		}
+		if !reflect.DeepEqual(index, want) {
+			t.Errorf("%d workers: index of %d keys differs from the sequential one of %d", workers, len(index), len(want))
+		}
+		if !reflect.DeepEqual(live, wantLive) || !reflect.DeepEqual(dead, wantDead) {
+			t.Errorf("%d workers: live %v, dead %v; sequential %v, %v", workers, live, dead, wantLive, wantDead)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package database
+
+import "runtime"
+
+// defaultIndexWalkChunk is Options.IndexWalkChunk when unset: a few hundred
+// microseconds of walking per hold of the read lock.
+const defaultIndexWalkChunk = 10000
+
+func (db *DB) indexWalkChunk() int {
+	if db.opts.IndexWalkChunk != 0 {
+		return db.opts.IndexWalkChunk
+	}
+	return defaultIndexWalkChunk
+}
+
+// walkIndex calls fn for every index entry, like each, for the metadata-only
+// operations. On a large in-memory index it releases and retakes the read
+// lock every Options.IndexWalkChunk entries, so that a waiting writer, and
+// the readers queued behind it, are not held up for the whole walk.
+//
+// A key present for the whole walk is visited exactly once. One written or
+// deleted while the lock was released may be visited or not, as in a range
+// over a map modified in its loop body, which is what the walk is. If
+// Compact or Reindex replaced the index meanwhile, reset is called and the
+// walk starts over on the new one. The low-memory and mapped indexes are
+// walked in one hold. Callers must hold db.mu's read lock, and must read
+// any other state only after walkIndex returns.
+func (db *DB) walkIndex(reset func(), fn func(key string, e indexEntry) error) error {
+	chunk := db.indexWalkChunk()
+	for {
+		m, ok := db.index.(mapIndex)
+		if !ok || chunk < 0 {
+			return db.index.each(fn)
+		}
+
+		gen, n, replaced := db.indexGen, 0, false
+		for k, e := range m {
+			if err := fn(k, e); err != nil {
+				return err
+			}
+			if n++; n%chunk == 0 {
+				db.mu.RUnlock()
+				runtime.Gosched() // Let a writer that is about to lock run
+				db.mu.RLock()
+				if replaced = db.indexGen != gen; replaced {
+					break
+				}
+			}
+		}
+		if !replaced {
+			return nil
+		}
+		reset()
+	}
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// putLatencyP99 measures Put latency while another goroutine calls List
+// over a large index without pause.
+func putLatencyP99(t *testing.T, chunk int) time.Duration {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{IndexWalkChunk: chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// List reads only the index, so entries need no records behind them
+	db.mu.Lock()
+	index := db.index.(mapIndex)
+	for i := range 200000 {
+		index[compositeKey("big", fmt.Sprintf("k%07d", i))] = indexEntry{Offset: headerSize}
+	}
+	db.mu.Unlock()
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !stop.Load() {
+			if _, err := db.List("big"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		stop.Store(true)
+		wg.Wait()
+	}()
+
+	var latencies []time.Duration
+	for i := range 100 {
+		start := time.Now()
+		if err := db.Put("small", fmt.Sprint(i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		latencies = append(latencies, time.Since(start))
+		time.Sleep(time.Millisecond)
+	}
+	slices.Sort(latencies)
+	return latencies[len(latencies)*99/100]
+}
+
+func TestIndexWalkBoundsLockHold(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a large index")
+	}
+	whole := putLatencyP99(t, -1)
+	chunked := putLatencyP99(t, 0)
+	t.Logf("p99 Put latency under List: %v walking in one hold, %v in chunks", whole, chunked)
+	if chunked > whole/4 {
+		t.Errorf("chunked walks left p99 Put latency at %v, against %v in one hold", chunked, whole)
+	}
+}
+
+func TestIndexWalkAcrossChanges(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{IndexWalkChunk: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := range 100 {
+		db.Put("col", fmt.Sprintf("k%03d", i), []byte("v"))
+	}
+
+	// Writes between every entry: the keys present throughout are each
+	// listed once, and so is any other key that shows up
+	var stop atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; !stop.Load(); i++ {
+			db.Put("col", fmt.Sprintf("new%d", i), []byte("v"))
+			db.Delete("col", fmt.Sprintf("new%d", i-1))
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	for range 10 {
+		keys, err := db.List("col")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for _, k := range keys {
+			if seen[k] {
+				t.Fatalf("%s listed twice", k)
+			}
+			seen[k] = true
+		}
+		for i := range 100 {
+			if k := fmt.Sprintf("k%03d", i); !seen[k] {
+				t.Fatalf("%s missing from List", k)
+			}
+		}
+	}
+	stop.Store(true)
+	<-done
+
+	// A Compact between chunks restarts the walk on the new index
+	compacted := make(chan error, 1)
+	started, resets := false, 0
+	var visited []string
+	db.mu.RLock()
+	err = db.walkIndex(func() {
+		resets++
+		visited = visited[:0]
+	}, func(k string, e indexEntry) error {
+		if !started {
+			started = true
+			go func() { compacted <- db.Compact() }()
+			time.Sleep(10 * time.Millisecond) // Let Compact queue for the lock
+		}
+		visited = append(visited, k)
+		return nil
+	})
+	entries := len(db.index.(mapIndex))
+	db.mu.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-compacted; err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(visited)
+	if resets != 1 || len(slices.Compact(visited)) != entries {
+		t.Errorf("walk across Compact: %d resets, %d distinct keys of %d", resets, len(visited), entries)
+	}
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultInfoSampleSize = 10
+
+// CollectionInfo summarizes a collection for administrative tooling.
+type CollectionInfo struct {
+	Name       string
+	Keys       int           // Live (unexpired) keys
+	LiveBytes  int64         // On-disk bytes of live records
+	DeadBytes  int64         // Superseded, deleted and expired bytes awaiting compaction
+	DefaultTTL time.Duration // From SetCollectionTTL, 0 if unset
+	Plaintext  bool          // Collection opted out of encryption
+	Oldest     int64         // Timestamp of the oldest live record (UnixNano)
+	Newest     int64         // Timestamp of the newest live record (UnixNano)
+	SampleKeys []string      // Up to Options.InfoSampleSize keys, sorted
+	Access     AccessStats   // Reads and writes since Open or ResetStats
+}
+
+func (db *DB) CollectionInfo(collection string) (CollectionInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	info := db.newCollectionInfo(collection)
+	prefix := collection + ":"
+	now := db.now().UnixNano()
+	reset := func() { info = db.newCollectionInfo(collection) }
+	err := db.walkIndex(reset, func(k string, e indexEntry) error {
+		if strings.HasPrefix(k, prefix) {
+			db.addToInfo(&info, strings.TrimPrefix(k, prefix), e, now)
+		}
+		return nil
+	})
+	if err != nil {
+		return CollectionInfo{}, err
+	}
+	sort.Strings(info.SampleKeys)
+	return info, nil
+}
+
+// CollectionInfos returns information on every user collection, sorted by name.
+func (db *DB) CollectionInfos() ([]CollectionInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	infos := make(map[string]*CollectionInfo)
+	now := db.now().UnixNano()
+	err := db.walkIndex(func() { clear(infos) }, func(k string, e indexEntry) error {
+		collection, key := SplitKey(k)
+		if isInternalCollection(collection) {
+			return nil
+		}
+		info, ok := infos[collection]
+		if !ok {
+			ci := db.newCollectionInfo(collection)
+			info = &ci
+			infos[collection] = info
+		}
+		db.addToInfo(info, key, e, now)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]CollectionInfo, 0, len(infos))
+	for _, info := range infos {
+		sort.Strings(info.SampleKeys)
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// ExpiringBefore returns the live keys of user collections with an expiry
+// before ts (UnixNano), soonest first, for eviction and capacity planning.
+// It reads only the index, so the records carry the key, timestamp and
+// expiry but no Value. Keys already expired are left out.
+func (db *DB) ExpiringBefore(ts int64) ([]Record, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := db.now().UnixNano()
+	records := make([]Record, 0)
+	err := db.walkIndex(func() { records = records[:0] }, func(k string, e indexEntry) error {
+		collection, key := SplitKey(k)
+		if e.ExpiresAt == 0 || e.ExpiresAt >= ts || e.expired(now) || isInternalCollection(collection) {
+			return nil
+		}
+		records = append(records, Record{
+			Timestamp:  e.Timestamp,
+			ExpiresAt:  e.ExpiresAt,
+			Collection: collection,
+			Key:        key,
+			Op:         OpPut,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].ExpiresAt != records[j].ExpiresAt {
+			return records[i].ExpiresAt < records[j].ExpiresAt
+		}
+		return compositeKey(records[i].Collection, records[i].Key) < compositeKey(records[j].Collection, records[j].Key)
+	})
+	return records, nil
+}
+
+// newCollectionInfo fills the settings part of a CollectionInfo. Callers must hold db.mu.
+func (db *DB) newCollectionInfo(collection string) CollectionInfo {
+	return CollectionInfo{
+		Name:       collection,
+		DeadBytes:  db.dead[collection],
+		DefaultTTL: db.defaultTTL[collection],
+		Plaintext:  db.plaintext[collection],
+		Access:     db.collectionAccess(collection),
+	}
+}
+
+func (db *DB) addToInfo(info *CollectionInfo, key string, e indexEntry, now int64) {
+	if e.expired(now) {
+		info.DeadBytes += e.Size
+		return
+	}
+
+	info.Keys++
+	info.LiveBytes += e.Size
+	if info.Oldest == 0 || e.Timestamp < info.Oldest {
+		info.Oldest = e.Timestamp
+	}
+	if e.Timestamp > info.Newest {
+		info.Newest = e.Timestamp
+	}
+
+	sampleSize := db.opts.InfoSampleSize
+	if sampleSize == 0 {
+		sampleSize = defaultInfoSampleSize
+	}
+	if len(info.SampleKeys) < sampleSize {
+		info.SampleKeys = append(info.SampleKeys, key)
+	}
+}
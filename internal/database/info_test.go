@@ -0,0 +1,173 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCollectionInfo(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	clock := newTestClock()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("users", "alice", []byte("v1"))
+	db.Put("users", "alice", []byte("v2")) // supersedes v1
+	db.Put("users", "bob", []byte("v1"))
+	db.Put("users", "carol", []byte("v1"))
+	db.Delete("users", "carol")
+	db.PutWithTTL("users", "temp", []byte("v1"), time.Nanosecond)
+	db.Put("orders", "o1", []byte("v1"))
+
+	if err := db.SetCollectionTTL("users", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond)
+
+	info, err := db.CollectionInfo("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Keys != 2 {
+		t.Errorf("Expected 2 live keys, got %d", info.Keys)
+	}
+	if info.LiveBytes <= 0 || info.DeadBytes <= 0 {
+		t.Errorf("Expected live and dead bytes, got %d/%d", info.LiveBytes, info.DeadBytes)
+	}
+	if info.DefaultTTL != time.Hour {
+		t.Errorf("Default TTL not reported: %v", info.DefaultTTL)
+	}
+	if info.Oldest == 0 || info.Newest < info.Oldest {
+		t.Errorf("Bad timestamps: oldest=%d newest=%d", info.Oldest, info.Newest)
+	}
+	if len(info.SampleKeys) != 2 || info.SampleKeys[0] != "alice" || info.SampleKeys[1] != "bob" {
+		t.Errorf("Unexpected sample keys: %v", info.SampleKeys)
+	}
+
+	infos, err := db.CollectionInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "orders" || infos[1].Name != "users" {
+		t.Fatalf("Unexpected collections: %+v", infos)
+	}
+	if infos[1].DeadBytes != info.DeadBytes {
+		t.Errorf("CollectionInfos disagrees with CollectionInfo: %d vs %d", infos[1].DeadBytes, info.DeadBytes)
+	}
+	db.Close()
+
+	// Accounting and settings survive a reopen through the hint
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reopened, _ := db.CollectionInfo("users")
+	if reopened.DeadBytes != info.DeadBytes || reopened.DefaultTTL != time.Hour {
+		t.Errorf("Info changed across reopen: %+v vs %+v", reopened, info)
+	}
+}
+
+func TestCollectionDefaultTTL(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.SetCollectionTTL("sessions", time.Hour)
+	db.Put("sessions", "s1", []byte("v"))
+	if e := indexed(t, db, "sessions:s1"); e.ExpiresAt == 0 {
+		t.Error("Default TTL was not applied")
+	}
+}
+
+func TestSizeLastWriteAndStats(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	opened := db.LastWriteTime()
+	time.Sleep(10 * time.Millisecond)
+	db.Put("a", "1", []byte("x"))
+	db.Put("a", "1", []byte("y"))
+	db.Put("b", "2", []byte("z"))
+	db.SetCollectionTTL("b", time.Hour)
+
+	if !db.LastWriteTime().After(opened) {
+		t.Error("LastWriteTime did not advance after a Put")
+	}
+	if db.Size() != db.Offset() {
+		t.Errorf("Size %d != Offset %d", db.Size(), db.Offset())
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 2 || stats.Collections != 2 {
+		t.Errorf("Expected 2 keys in 2 collections, got %+v", stats)
+	}
+	if stats.Size != db.Size() || stats.FileSize != db.Size() || stats.DeadBytes == 0 || stats.LiveBytes == 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestExpiringBefore(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	clock := newTestClock()
+	start := clock.Now()
+	db, err := OpenWithOptions(path, "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// k9 expires first, k0 last, ten minutes apart
+	for i := range 10 {
+		db.PutWithTTL("cache", fmt.Sprintf("k%d", i), []byte("v"), time.Duration(10-i)*10*time.Minute)
+	}
+	db.Put("cache", "forever", []byte("v"))
+	db.PutWithTTL("other", "k5", []byte("v"), 50*time.Minute)
+
+	// k9 has expired; the hour from now ends at 75 minutes
+	clock.Advance(15 * time.Minute)
+	records, err := db.ExpiringBefore(clock.Now().Add(time.Hour).UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rec := range records {
+		got = append(got, rec.Collection+":"+rec.Key)
+		if rec.Value != nil || rec.Timestamp != start.UnixNano() {
+			t.Errorf("%s:%s: value %q, timestamp %d", rec.Collection, rec.Key, rec.Value, rec.Timestamp)
+		}
+	}
+	want := "[cache:k8 cache:k7 cache:k6 cache:k5 other:k5 cache:k4 cache:k3]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("ExpiringBefore = %v, want %s", got, want)
+	}
+	if records, _ := db.ExpiringBefore(start.UnixNano()); len(records) != 0 {
+		t.Errorf("ExpiringBefore a past time = %v", records)
+	}
+}
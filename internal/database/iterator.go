@@ -1,6 +1,7 @@
 package database
 
 import (
+	"encoding/base64"
 	"sort"
 	"strings"
 )
@@ -11,22 +12,39 @@ type Iterator struct {
 	idx    int
 	valid  bool
 	prefix string
+	err    error // Failure to list the keys, returned by NextN
+	handle bool  // Counted against Options.MaxSnapshots until Close
 }
 
+// NewIterator returns an iterator over the keys starting with prefix. Past
+// Options.MaxSnapshots the iterator is empty and Err and NextN return
+// ErrTooManySnapshots.
 func (db *DB) NewIterator(prefix string) *Iterator {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
+	if err := db.acquireHandle(); err != nil {
+		return &Iterator{db: db, idx: -1, prefix: prefix, err: err}
+	}
+	it := db.newIterator(prefix)
+	it.handle = true
+	return it
+}
+
+// newIterator is NewIterator for iterators used and closed within a call,
+// which do not count against the limit. Callers must hold db.mu.
+func (db *DB) newIterator(prefix string) *Iterator {
 	var keys []string
 	// The prefix logic in DB is collection:key or just prefix?
 	// The user passes "prefix" to ScanPrefix, which usually implies "collection:" or "collection:p".
 	// Since our keys in index are "collection:key", we just filter by that.
 	
-	for k := range db.index {
+	err := db.index.each(func(k string, _ indexEntry) error {
 		if strings.HasPrefix(k, prefix) {
 			keys = append(keys, k)
 		}
-	}
+		return nil
+	})
 
 	sort.Strings(keys)
 
@@ -36,6 +54,7 @@ func (db *DB) NewIterator(prefix string) *Iterator {
 		idx:    -1, // Start before first element
 		valid:  false,
 		prefix: prefix,
+		err:    err,
 	}
 }
 
@@ -49,6 +68,15 @@ func (it *Iterator) Next() bool {
 	return true
 }
 
+// seekAfter positions the iterator so that the next call to Next
+// lands on the first key strictly greater than key.
+func (it *Iterator) seekAfter(key string) {
+	it.idx = sort.Search(len(it.keys), func(i int) bool {
+		return it.keys[i] > key
+	}) - 1
+	it.valid = false
+}
+
 func (it *Iterator) Key() string {
 	if !it.valid {
 		return ""
@@ -83,6 +111,82 @@ func (it *Iterator) Value() ([]byte, error) {
 	return val, err
 }
 
+// NextN advances over up to n live records and returns them in key order,
+// decrypting them concurrently. Keys deleted or expired since the iterator was
+// created are skipped. An empty result means the iterator is exhausted.
+func (it *Iterator) NextN(n int) ([]Record, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	records := make([]Record, 0, n)
+	for len(records) < n {
+		var keys []string
+		for len(keys) < n-len(records) && it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		batch, found, err := it.db.getRecords(keys, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i, rec := range batch {
+			if found[i] {
+				records = append(records, rec)
+			}
+		}
+	}
+	return records, nil
+}
+
+// Err returns the error that kept the iterator from listing its keys, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
 func (it *Iterator) Close() {
 	it.keys = nil
+	if it.handle {
+		it.handle = false
+		it.db.releaseHandle()
+	}
+}
+
+// Page returns up to limit live records whose combined key starts with prefix,
+// resuming after the position encoded in token. An empty token starts from the
+// beginning. The returned nextToken is empty when no live key follows the
+// page.
+func (db *DB) Page(prefix string, token string, limit int) ([]Record, string, error) {
+	if limit <= 0 {
+		return nil, "", nil
+	}
+
+	db.mu.RLock()
+	it := db.newIterator(prefix)
+	db.mu.RUnlock()
+	defer it.Close()
+
+	if token != "" {
+		last, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return nil, "", ErrInvalidToken
+		}
+		it.seekAfter(string(last))
+	}
+
+	// One record past the page tells whether any live key follows it
+	records, err := it.NextN(limit + 1)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(records) <= limit {
+		return records, "", nil
+	}
+	records = records[:limit]
+
+	last := records[len(records)-1]
+	nextToken := base64.RawURLEncoding.EncodeToString([]byte(compositeKey(last.Collection, last.Key)))
+	return records, nextToken, nil
 }
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrNotJSON = errors.New("stored value is not JSON")
+
+// PatchJSON applies the RFC 7386 JSON Merge Patch patch to the JSON document
+// stored under collection and key. The read, merge and write happen under
+// the write lock, so concurrent patches of one document do not lose each
+// other's changes. An absent or expired key is patched as an empty object.
+// The patched document keeps the expiry of the stored one.
+func (db *DB) PatchJSON(collection, key string, patch []byte) error {
+	var p any
+	if err := unmarshalJSON(patch, &p); err != nil {
+		return err
+	}
+
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	w := batchRecord{collection: collection, key: key, op: OpPut}
+	var doc any
+	compKey := compositeKey(collection, key)
+	rec, _, err := db.readRaw(compKey, db.now().UnixNano())
+	switch {
+	case err == ErrNotFound:
+	case err != nil:
+		return err
+	default:
+		value, err := db.openUserValue(rec, compKey)
+		if err != nil {
+			return err
+		}
+		if err := unmarshalJSON(value, &doc); err != nil {
+			return fmt.Errorf("%w: %v", ErrNotJSON, err)
+		}
+		w.keepExpiry, w.expiresAt = true, rec.ExpiresAt
+	}
+
+	if w.value, err = json.Marshal(mergePatch(doc, p)); err != nil {
+		return err
+	}
+	return db.commitWrites([]batchRecord{w})
+}
+
+// unmarshalJSON decodes numbers as json.Number so that merging does not
+// round integers beyond the precision of a float64.
+func unmarshalJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("invalid JSON: data after the top-level value")
+	}
+	return nil
+}
+
+// mergePatch is the MergePatch function of RFC 7386: a patch object
+// replaces the members it names, a null member removes one, and any other
+// patch replaces the target entirely.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], value)
+		}
+	}
+	return t
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidJSONPath = errors.New("invalid JSON path")
+
+// QueryJSON returns the records of collection whose value is a JSON document
+// in which the value at jsonPath equals value, in key order. value is
+// compared as JSON after marshaling, so numbers compare by value (30 equals
+// 30.0) and objects regardless of member order. Values that are not JSON or
+// lack the path are skipped.
+//
+// The path is a subset of JSONPath: $ followed by .name, ['name'] or
+// ["name"] members and [n] array indexes, such as $.address.city or
+// $.tags[0]. Wildcards, recursive descent (..), slices, unions and filter
+// expressions ([?(...)]) fail with ErrInvalidJSONPath, and equality is the
+// only comparison.
+func (db *DB) QueryJSON(collection, jsonPath string, value any) ([]Record, error) {
+	path, err := parseJSONPath(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var want any
+	if err := unmarshalJSON(data, &want); err != nil {
+		return nil, err
+	}
+
+	collBytes := []byte(collection)
+	db.mu.RLock()
+	if !db.mayMatchPrefix(collection + ":") {
+		db.mu.RUnlock()
+		return []Record{}, nil
+	}
+	records, err := db.scanLive(func(recColl, recKey []byte) bool {
+		return bytes.Equal(recColl, collBytes)
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make([]Record, 0)
+	for _, rec := range records {
+		var doc any
+		if unmarshalJSON(rec.Value, &doc) != nil {
+			continue
+		}
+		if got, ok := path.lookup(doc); ok && jsonEqual(got, want) {
+			matched = append(matched, rec)
+		}
+	}
+	return matched, nil
+}
+
+// jsonPathStep is a member name, or an array index if name is empty.
+type jsonPathStep struct {
+	name  string
+	index int
+}
+
+type jsonPath []jsonPathStep
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	invalid := func(reason string) (jsonPath, error) {
+		return nil, fmt.Errorf("%w %q: %s", ErrInvalidJSONPath, expr, reason)
+	}
+	if !strings.HasPrefix(expr, "$") {
+		return invalid("must start with $")
+	}
+
+	var path jsonPath
+	rest := expr[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return invalid("recursive descent is not supported")
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return invalid("empty member name")
+			}
+			if name == "*" {
+				return invalid("wildcards are not supported")
+			}
+			path = append(path, jsonPathStep{name: name})
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return invalid("unterminated [")
+			}
+			inner := rest[1:end]
+			if n := len(inner); n >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[n-1] == inner[0] {
+				path = append(path, jsonPathStep{name: inner[1 : n-1]})
+			} else if i, err := strconv.Atoi(inner); err == nil && i >= 0 {
+				path = append(path, jsonPathStep{index: i})
+			} else if strings.HasPrefix(inner, "?") {
+				return invalid("filter expressions are not supported")
+			} else {
+				return invalid(fmt.Sprintf("unsupported selector [%s]", inner))
+			}
+			rest = rest[end+1:]
+		default:
+			return invalid(fmt.Sprintf("unexpected %q", rest[0]))
+		}
+	}
+	return path, nil
+}
+
+// lookup returns the value at p in a document decoded by unmarshalJSON.
+func (p jsonPath) lookup(doc any) (any, bool) {
+	for _, step := range p {
+		if step.name != "" {
+			obj, ok := doc.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = obj[step.name]; !ok {
+				return nil, false
+			}
+		} else {
+			arr, ok := doc.([]any)
+			if !ok || step.index >= len(arr) {
+				return nil, false
+			}
+			doc = arr[step.index]
+		}
+	}
+	return doc, true
+}
+
+// jsonEqual compares two values decoded by unmarshalJSON, numbers by value.
+func jsonEqual(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okA := new(big.Rat).SetString(a.String())
+		y, okB := new(big.Rat).SetString(b.String())
+		return okA && okB && x.Cmp(y) == 0
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		// Strings, booleans and null
+		return a == b
+	}
+}
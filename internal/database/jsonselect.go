@@ -0,0 +1,166 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// SelectJSON projects the JSON documents of collection onto fields, in key
+// order. A field is a top-level member name or a dotted path into nested
+// objects, such as "address.city"; each projection maps the fields found in
+// the document to their raw JSON, and fields the document lacks are absent.
+// Members are located by scanning the document, so unselected parts are
+// skipped without being decoded. fn, which may be nil to keep every
+// projection, runs after the scan without the database lock held, as with
+// Filter. Values that are not JSON objects are skipped and counted in
+// skipped.
+func (db *DB) SelectJSON(collection string, fields []string, fn func(key string, projected map[string]json.RawMessage) bool) (results []map[string]json.RawMessage, skipped int, err error) {
+	tree := newFieldTree(fields)
+
+	collBytes := []byte(collection)
+	db.mu.RLock()
+	if !db.mayMatchPrefix(collection + ":") {
+		db.mu.RUnlock()
+		return []map[string]json.RawMessage{}, 0, nil
+	}
+	records, err := db.scanLive(func(recColl, recKey []byte) bool {
+		return bytes.Equal(recColl, collBytes)
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results = make([]map[string]json.RawMessage, 0)
+	for _, rec := range records {
+		value := bytes.TrimSpace(rec.Value)
+		if len(value) == 0 || value[0] != '{' || !json.Valid(value) {
+			skipped++
+			continue
+		}
+		projected := make(map[string]json.RawMessage)
+		tree.project(value, "", projected)
+		if fn == nil || fn(rec.Key, projected) {
+			results = append(results, projected)
+		}
+	}
+	return results, skipped, nil
+}
+
+// fieldTree holds the selected fields by path segment. selected marks a
+// field whose whole value is wanted; children are fields nested in it.
+type fieldTree struct {
+	selected bool
+	children map[string]*fieldTree
+}
+
+func newFieldTree(fields []string) *fieldTree {
+	root := &fieldTree{}
+	for _, f := range fields {
+		node := root
+		for _, name := range strings.Split(f, ".") {
+			if node.children == nil {
+				node.children = make(map[string]*fieldTree)
+			}
+			child, ok := node.children[name]
+			if !ok {
+				child = &fieldTree{}
+				node.children[name] = child
+			}
+			node = child
+		}
+		node.selected = true
+	}
+	return root
+}
+
+// project adds the selected members of the JSON object obj, which must be
+// valid, to out under their dotted paths, prefixed by path.
+func (t *fieldTree) project(obj []byte, path string, out map[string]json.RawMessage) {
+	i := skipSpace(obj, 1) // Past the opening brace
+	for i < len(obj) && obj[i] != '}' {
+		nameEnd := skipString(obj, i)
+		name := memberName(obj[i:nameEnd])
+		i = skipSpace(obj, skipSpace(obj, nameEnd)+1) // Past the colon
+		valueEnd := skipValue(obj, i)
+		value := obj[i:valueEnd]
+
+		if child, ok := t.children[name]; ok {
+			full := name
+			if path != "" {
+				full = path + "." + name
+			}
+			if child.selected {
+				out[full] = append(json.RawMessage(nil), value...)
+			}
+			if child.children != nil && value[0] == '{' {
+				child.project(value, full, out)
+			}
+		}
+
+		i = skipSpace(obj, valueEnd)
+		if i < len(obj) && obj[i] == ',' {
+			i = skipSpace(obj, i+1)
+		}
+	}
+}
+
+// memberName decodes a quoted member name, unescaping it only if needed.
+func memberName(quoted []byte) string {
+	if bytes.IndexByte(quoted, '\\') < 0 {
+		return string(quoted[1 : len(quoted)-1])
+	}
+	var name string
+	json.Unmarshal(quoted, &name)
+	return name
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// skipString returns the index after the string starting at data[i].
+func skipString(data []byte, i int) int {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return i
+}
+
+// skipValue returns the index after the valid JSON value at data[i].
+func skipValue(data []byte, i int) int {
+	switch data[i] {
+	case '"':
+		return skipString(data, i)
+	case '{', '[':
+		depth := 0
+		for ; i < len(data); i++ {
+			switch data[i] {
+			case '"':
+				i = skipString(data, i) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return i
+	default:
+		// Numbers, true, false and null end at a delimiter
+		for i < len(data) && !strings.ContainsRune(",}] \t\n\r", rune(data[i])) {
+			i++
+		}
+		return i
+	}
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProjectFields(t *testing.T) {
+	doc := []byte(`{ "name" : "Alice", "bio": "says \"hi\" {not} [json]",
+		"address": {"city": "Oslo", "geo": {"lat": 59.9, "lon": 10.7}, "zip": null},
+		"tags": ["a", {"city": "x"}], "name2": true, "age": -1.5e3 }`)
+	for _, tc := range []struct {
+		fields []string
+		want   map[string]string
+	}{
+		{[]string{"name"}, map[string]string{"name": `"Alice"`}},
+		{[]string{"age", "missing"}, map[string]string{"age": `-1.5e3`}},
+		{[]string{"address.city", "address.geo.lon"}, map[string]string{"address.city": `"Oslo"`, "address.geo.lon": `10.7`}},
+		{[]string{"address.zip", "address.nope", "tags.city"}, map[string]string{"address.zip": `null`}},
+		{[]string{"address.geo", "address.geo.lat"}, map[string]string{"address.geo": `{"lat": 59.9, "lon": 10.7}`, "address.geo.lat": `59.9`}},
+		{[]string{"name2", "bio"}, map[string]string{"name2": `true`, "bio": `"says \"hi\" {not} [json]"`}},
+		{[]string{"name.first"}, map[string]string{}},
+	} {
+		got := make(map[string]json.RawMessage)
+		newFieldTree(tc.fields).project(doc, "", got)
+		gotStr := make(map[string]string, len(got))
+		for k, v := range got {
+			gotStr[k] = string(v)
+		}
+		if !reflect.DeepEqual(gotStr, tc.want) {
+			t.Errorf("fields %q: got %v, want %v", tc.fields, gotStr, tc.want)
+		}
+	}
+}
+
+func TestSelectJSON(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("users", "alice", []byte(`{"name":"Alice","age":30,"address":{"city":"Oslo"}}`))
+	db.Put("users", "bob", []byte(`{"name":"Bob","age":25}`))
+	db.Put("users", "raw", []byte(`not json`))
+	db.Put("users", "list", []byte(`[1,2]`))
+	db.Put("other", "carol", []byte(`{"name":"Carol"}`))
+
+	var seen []string
+	results, skipped, err := db.SelectJSON("users", []string{"name", "address.city"}, func(key string, p map[string]json.RawMessage) bool {
+		seen = append(seen, key)
+		return key != "bob"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen, []string{"alice", "bob"}) {
+		t.Fatalf("callback saw %q", seen)
+	}
+	if skipped != 2 {
+		t.Fatalf("skipped %d values, want 2", skipped)
+	}
+	if len(results) != 1 || string(results[0]["name"]) != `"Alice"` || string(results[0]["address.city"]) != `"Oslo"` {
+		t.Fatalf("results %v", results)
+	}
+
+	results, _, err = db.SelectJSON("users", []string{"address.city"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || len(results[1]) != 0 {
+		t.Fatalf("nil callback: results %v", results)
+	}
+}
@@ -0,0 +1,294 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// The writer lease protects against two processes appending to the same file
+// where advisory locks are unreliable (e.g. NFS). A writer stamps a random
+// token into the header and refreshes its timestamp periodically. Another
+// writer only takes over once the stamp is older than Options.LeaseTimeout;
+// the previous owner notices the foreign token on its next refresh and
+// refuses any further writes. It also fences itself off once its last
+// successful refresh is leaseMargin short of the timeout, so a writer that
+// cannot refresh stops before anyone may take over.
+//
+// Staleness is judged with the local clock, so writers sharing a file should
+// keep their clocks roughly in sync. A timestamp in the future is always
+// treated as fresh, which errs on the side of refusing a takeover.
+const (
+	leaseTokenSize = 16
+	leaseHostSize  = 63
+)
+
+// leaseMargin is how long before its lease may be taken over that a writer
+// stops writing, allowing for clock skew between hosts and slow writes.
+func leaseMargin(timeout time.Duration) time.Duration {
+	return timeout / 4
+}
+
+var (
+	ErrDatabaseLocked = errors.New("database is locked by another writer")
+	ErrLeaseLost      = errors.New("writer lease was taken over by another process")
+)
+
+type leaseInfo struct {
+	Token     []byte
+	Timestamp int64
+	PID       uint32
+	Host      string
+}
+
+func (l leaseInfo) held() bool {
+	return len(l.Token) == leaseTokenSize && !bytes.Equal(l.Token, make([]byte, leaseTokenSize))
+}
+
+func (l leaseInfo) encode() []byte {
+	buf := make([]byte, extLeaseSize)
+	offset := 0
+	copy(buf[offset:], l.Token)
+	offset += leaseTokenSize
+	binary.BigEndian.PutUint64(buf[offset:], uint64(l.Timestamp))
+	offset += 8
+	binary.BigEndian.PutUint32(buf[offset:], l.PID)
+	offset += 4
+	host := l.Host
+	if len(host) > leaseHostSize {
+		host = host[:leaseHostSize]
+	}
+	buf[offset] = byte(len(host))
+	offset++
+	copy(buf[offset:], host)
+	return buf
+}
+
+func decodeLease(buf []byte) leaseInfo {
+	var l leaseInfo
+	offset := 0
+	l.Token = append([]byte(nil), buf[offset:offset+leaseTokenSize]...)
+	offset += leaseTokenSize
+	l.Timestamp = int64(binary.BigEndian.Uint64(buf[offset:]))
+	offset += 8
+	l.PID = binary.BigEndian.Uint32(buf[offset:])
+	offset += 4
+	hostLen := int(buf[offset])
+	offset++
+	if hostLen > leaseHostSize {
+		hostLen = leaseHostSize
+	}
+	l.Host = string(buf[offset : offset+hostLen])
+	return l
+}
+
+// liveLease reports whether l is held by a writer that may still be running:
+// one that refreshed it within timeout. With no timeout, freshness cannot be
+// judged and any held lease counts.
+func liveLease(l leaseInfo, timeout time.Duration) bool {
+	if !l.held() {
+		return false
+	}
+	return timeout <= 0 || time.Since(time.Unix(0, l.Timestamp)) < timeout
+}
+
+type lease struct {
+	token   []byte
+	lost    bool
+	renewed time.Time // When the stamp of the last successful refresh was taken
+	stop    chan struct{}
+	done    chan struct{}
+	reset   chan time.Duration // New refresh interval, read by leaseLoop
+}
+
+// resetInterval hands leaseLoop a new refresh interval, replacing one it has
+// not picked up yet. Callers must hold db.mu, which serializes senders.
+func (l *lease) resetInterval(interval time.Duration) {
+	select {
+	case <-l.reset:
+	default:
+	}
+	l.reset <- interval
+}
+
+func (db *DB) readLease() (leaseInfo, error) {
+	buf := make([]byte, extLeaseSize)
+	if _, err := db.file.ReadAt(buf, int64(extLeaseOffset)); err != nil {
+		return leaseInfo{}, err
+	}
+	return decodeLease(buf), nil
+}
+
+// acquireLease claims the file for this writer and starts refreshing the
+// lease in the background. It must be called before the DB is shared.
+func (db *DB) acquireLease() error {
+	if db.opts.LeaseTimeout <= 0 {
+		return nil
+	}
+
+	// Where files can be locked, writers on one machine take the lease one
+	// at a time; the read back below covers the rest
+	if err := lockFile(db.file); err != nil {
+		return err
+	}
+	defer unlockFile(db.file)
+
+	// Compact erases the file in place before renaming its output over it,
+	// so a lease is only trusted from a header that is still intact: the
+	// writer erasing one is live
+	buf := make([]byte, headerSize)
+	n, err := db.file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if checkHeader(buf, n, ErrInvalidFile) != nil {
+		return ErrDatabaseLocked
+	}
+	current := decodeLease(buf[extLeaseOffset : extLeaseOffset+extLeaseSize])
+	if liveLease(current, db.opts.LeaseTimeout) {
+		return ErrDatabaseLocked
+	}
+
+	token := make([]byte, leaseTokenSize)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	stamp := leaseInfo{
+		Token:     token,
+		Timestamp: time.Now().UnixNano(),
+		PID:       uint32(os.Getpid()),
+		Host:      host,
+	}.encode()
+
+	// Write and sync the stamp, then read it back a refresh interval later:
+	// if another writer raced us between the check and the write, only one
+	// token survives, and by then the other's write shows even where reads
+	// are served from a cache, as on NFS.
+	if err := db.writeHeaderRaw(stamp, extLeaseOffset); err != nil {
+		return err
+	}
+	interval := db.opts.LeaseTimeout / 3
+	time.Sleep(interval)
+
+	db.lease = &lease{
+		token: token,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		reset: make(chan time.Duration, 1),
+	}
+	if err := db.renewLease(); err != nil {
+		db.lease = nil
+		if err == ErrLeaseLost {
+			return ErrDatabaseLocked
+		}
+		return err
+	}
+	go db.leaseLoop(db.lease, interval)
+	return nil
+}
+
+func (db *DB) leaseLoop(l *lease, interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case interval := <-l.reset:
+			ticker.Reset(interval)
+		case <-ticker.C:
+			err := db.refreshLease()
+			if err == ErrLeaseLost {
+				db.health.leaseLost.Store(true)
+				return
+			}
+			if err != nil {
+				db.health.leaseFailures.Add(1)
+			}
+		}
+	}
+}
+
+// refreshLease renews this writer's lease, or fences the writer off if the
+// lease has been taken over.
+func (db *DB) refreshLease() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.lease == nil || db.lease.lost {
+		return db.checkLease()
+	}
+	return db.renewLease()
+}
+
+// renewLease stamps the lease with the current time if it is still ours.
+// Callers must hold db.mu or have exclusive access to db.
+func (db *DB) renewLease() error {
+	current, err := db.readLease()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current.Token, db.lease.token) {
+		db.lease.lost = true
+		return ErrLeaseLost
+	}
+
+	now := time.Now()
+	current.Timestamp = now.UnixNano()
+	stamp := current.encode()
+	if err := db.writeHeaderRaw(stamp, extLeaseOffset); err != nil {
+		return err
+	}
+	db.header.Lease = stamp
+	db.lease.renewed = now
+	db.health.leaseRenewed(db.opts.LeaseTimeout)
+	return nil
+}
+
+// checkLease fails closed once the lease has been lost, or once the last
+// successful refresh is so old that another writer may soon take it over.
+// Callers must hold db.mu.
+func (db *DB) checkLease() error {
+	if db.lease == nil {
+		return nil
+	}
+	timeout := db.opts.LeaseTimeout
+	if db.lease.lost || time.Since(db.lease.renewed) >= timeout-leaseMargin(timeout) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// stopLease stops the background refresh. It must be called without db.mu held.
+func (db *DB) stopLease() {
+	if db.lease == nil {
+		return
+	}
+	select {
+	case <-db.lease.stop:
+	default:
+		close(db.lease.stop)
+	}
+	<-db.lease.done
+}
+
+// releaseLease clears the on-disk lease if it is still ours. Callers must
+// hold db.mu or have exclusive access to db, with the refresh stopped.
+func (db *DB) releaseLease() {
+	if db.lease == nil || db.lease.lost {
+		return
+	}
+	current, err := db.readLease()
+	if err != nil || !bytes.Equal(current.Token, db.lease.token) {
+		return
+	}
+	_ = db.writeHeaderRaw(make([]byte, extLeaseSize), extLeaseOffset)
+	db.header.Lease = nil
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeaseBlocksSecondWriter(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	opts := Options{LeaseTimeout: time.Second}
+	db1, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenWithOptions(path, "pass", opts); err != ErrDatabaseLocked {
+		t.Fatalf("Expected ErrDatabaseLocked while lease is fresh, got %v", err)
+	}
+
+	// A clean close releases the lease immediately
+	db1.Close()
+	db2, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatalf("Open after release failed: %v", err)
+	}
+	db2.Close()
+}
+
+func TestLeaseTakeoverFencesOldWriter(t *testing.T) {
+	path, cleanup := tempFile()
+	defer cleanup()
+	defer os.Remove(path + ".hint")
+
+	opts := Options{LeaseTimeout: 200 * time.Millisecond}
+	db1, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db1.Put("col", "k", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a hung writer: it stops refreshing and its lease goes stale
+	db1.stopLease()
+	time.Sleep(300 * time.Millisecond)
+
+	db2, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatalf("Takeover of a stale lease failed: %v", err)
+	}
+	defer db2.Close()
+
+	// The old writer has not refreshed within the timeout and fails closed,
+	// before it sees the foreign token
+	if err := db1.Put("col", "k", []byte("stale")); err != ErrLeaseLost {
+		t.Errorf("Expected fenced writer Put to fail with ErrLeaseLost, got %v", err)
+	}
+	if err := db1.Compact(); err != ErrLeaseLost {
+		t.Errorf("Expected fenced writer Compact to fail with ErrLeaseLost, got %v", err)
+	}
+	if err := db1.refreshLease(); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost on refresh, got %v", err)
+	}
+	db1.Close()
+
+	// The new owner is unaffected by the old writer closing
+	if err := db2.Put("col", "k", []byte("v2")); err != nil {
+		t.Fatalf("New owner Put failed: %v", err)
+	}
+	if _, err := OpenWithOptions(path, "pass", opts); err != ErrDatabaseLocked {
+		t.Errorf("Lease of the new owner should still be held, got %v", err)
+	}
+	val, err := db2.Get("col", "k")
+	if err != nil || string(val) != "v2" {
+		t.Errorf("Expected v2, got %q, %v", val, err)
+	}
+}
+
+func TestLeaseFencesWriterThatCannotRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{LeaseTimeout: 400 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Nobody has taken the lease over, but this writer stops writing before
+	// anyone may
+	db.stopLease()
+	time.Sleep(320 * time.Millisecond)
+	if err := db.Put("col", "k", []byte("v")); err != ErrLeaseLost {
+		t.Fatalf("Put after missed refreshes: %v", err)
+	}
+	if _, err := OpenWithOptions(path, "pass", Options{LeaseTimeout: 400 * time.Millisecond}); err != ErrDatabaseLocked {
+		t.Errorf("lease taken over before its timeout: %v", err)
+	}
+
+	// A refresh that finds the lease still ours lets it write again
+	if err := db.refreshLease(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("col", "k", []byte("v")); err != nil {
+		t.Errorf("Put after a refresh: %v", err)
+	}
+}
+
+func TestLeaseAcquireWaitsForRacingWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	opts := Options{LeaseTimeout: 600 * time.Millisecond}
+	db, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Another host stamps its token just after this writer's stamp, which a
+	// read back right after the write would not see yet
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	raced := make(chan error, 1)
+	go func() {
+		buf := make([]byte, extLeaseSize)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if _, err := f.ReadAt(buf, int64(extLeaseOffset)); err != nil {
+				raced <- err
+				return
+			}
+			if decodeLease(buf).held() {
+				other := leaseInfo{Token: bytes.Repeat([]byte{1}, leaseTokenSize), Timestamp: time.Now().UnixNano(), Host: "other"}
+				_, err := f.WriteAt(other.encode(), int64(extLeaseOffset))
+				raced <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		raced <- errors.New("lease never stamped")
+	}()
+
+	db, err = OpenWithOptions(path, "pass", opts)
+	if err := <-raced; err != nil {
+		t.Fatal(err)
+	}
+	if err != ErrDatabaseLocked {
+		if err == nil {
+			db.Close()
+		}
+		t.Errorf("Open against a racing writer: %v", err)
+	}
+}
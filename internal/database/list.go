@@ -0,0 +1,312 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The entries of lists are records of a reserved collection, one per entry,
+// keyed by the list and an ordinal so that key order is list order. Appends
+// take ordinals from zero up and pushes to the front from -1 down; negative
+// ordinals are written with a leading '!', which sorts before the hex
+// digits, in two's complement, which sorts them in order among themselves.
+// Pushing and popping never rewrite other entries.
+const listCollection = internalPrefix + "_list"
+
+// listPrefix is the composite key prefix of the entries of a list. The
+// lengths keep one list's prefix from being the prefix of another's.
+func listPrefix(collection, key string) string {
+	return compositeKey(listCollection, fmt.Sprintf("%d:%s%d:%s#", len(collection), collection, len(key), key))
+}
+
+// listEntryKey is the composite key of the entry of the list under prefix
+// with ordinal n.
+func listEntryKey(prefix string, n int64) string {
+	if n < 0 {
+		return prefix + fmt.Sprintf("!%016x", uint64(n))
+	}
+	return prefix + fmt.Sprintf("%016x", n)
+}
+
+func parseListOrdinal(prefix, compKey string) (int64, error) {
+	s, negative := strings.CutPrefix(strings.TrimPrefix(compKey, prefix), "!")
+	n, err := strconv.ParseUint(s, 16, 64)
+	if err == nil && negative != (int64(n) < 0) {
+		err = strconv.ErrRange
+	}
+	if err != nil {
+		return 0, fmt.Errorf("corrupt list entry key %q: %w", compKey, err)
+	}
+	return int64(n), nil
+}
+
+// listSpan holds the ordinals of a list's entries, from head up to but not
+// including next. Entries written by the list calls leave no gaps.
+type listSpan struct {
+	head, next int64
+}
+
+func (s listSpan) len() int { return int(s.next - s.head) }
+
+// listSpanOf returns the span of the list under prefix. The first call for
+// a list after Open finds it by walking the index; writers cache it in
+// db.lists for later calls. Callers must hold db.mu.
+func (db *DB) listSpanOf(prefix string) (listSpan, error) {
+	if span, ok := db.lists[prefix]; ok {
+		return span, nil
+	}
+	keys, err := db.listKeys(prefix)
+	if err != nil || len(keys) == 0 {
+		return listSpan{}, err
+	}
+	head, err := parseListOrdinal(prefix, keys[0])
+	if err != nil {
+		return listSpan{}, err
+	}
+	last, err := parseListOrdinal(prefix, keys[len(keys)-1])
+	if err != nil {
+		return listSpan{}, err
+	}
+	return listSpan{head: head, next: last + 1}, nil
+}
+
+// Append adds entry to the end of the list stored under collection and key.
+// It is RPush of a single entry.
+func (db *DB) Append(collection, key string, entry []byte) error {
+	return db.RPush(collection, key, entry)
+}
+
+// RPush adds values to the end of the list stored under collection and key,
+// in order. Each entry is its own record, so a push costs one write per
+// value however long the list is; several values are written as one batch.
+// Lists are separate from the key's regular value: Get, Delete and List do
+// not see them, and collection TTLs do not apply.
+func (db *DB) RPush(collection, key string, values ...[]byte) error {
+	return db.pushList(collection, key, values, false)
+}
+
+// LPush adds values to the front of the list stored under collection and
+// key, one after the other, so the last of them ends up first.
+func (db *DB) LPush(collection, key string, values ...[]byte) error {
+	return db.pushList(collection, key, values, true)
+}
+
+func (db *DB) pushList(collection, key string, values [][]byte, front bool) error {
+	if len(values) == 0 {
+		return nil
+	}
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	prefix := listPrefix(collection, key)
+	span, err := db.listSpanOf(prefix)
+	if err != nil {
+		return err
+	}
+	writes := make([]batchRecord, len(values))
+	for i, v := range values {
+		n := span.next
+		if front {
+			span.head--
+			n = span.head
+		} else {
+			span.next++
+		}
+		_, entryKey := SplitKey(listEntryKey(prefix, n))
+		writes[i] = batchRecord{collection: listCollection, key: entryKey, value: v, op: OpPut}
+	}
+
+	if len(writes) == 1 {
+		err = db.put(listCollection, writes[0].key, writes[0].value, 0)
+	} else {
+		err = db.commitWrites(writes)
+	}
+	if err != nil {
+		return err
+	}
+	db.lists[prefix] = span
+	return nil
+}
+
+// LPop removes the first entry of the list stored under collection and key
+// and returns it, or fails with ErrNotFound if the list is empty. The read
+// and delete happen under the write lock, so of concurrent pops each entry
+// goes to exactly one.
+func (db *DB) LPop(collection, key string) ([]byte, error) {
+	return db.popList(collection, key, true)
+}
+
+// RPop removes the last entry of the list stored under collection and key
+// and returns it, like LPop.
+func (db *DB) RPop(collection, key string) ([]byte, error) {
+	return db.popList(collection, key, false)
+}
+
+func (db *DB) popList(collection, key string, front bool) ([]byte, error) {
+	if err := db.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer db.mu.Unlock()
+
+	prefix := listPrefix(collection, key)
+	for retried := false; ; retried = true {
+		span, err := db.listSpanOf(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if span.len() <= 0 {
+			return nil, ErrNotFound
+		}
+		n := span.next - 1
+		if front {
+			n = span.head
+		}
+		compKey := listEntryKey(prefix, n)
+		rec, _, err := db.readRaw(compKey, db.now().UnixNano())
+		if err == ErrNotFound && !retried {
+			// Entries removed by DeletePrefix leave the cached span stale
+			delete(db.lists, prefix)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, err := db.openUserValue(rec, compKey)
+		if err != nil {
+			return nil, err
+		}
+		_, entryKey := SplitKey(compKey)
+		if err := db.delete(listCollection, entryKey); err != nil {
+			return nil, err
+		}
+		if front {
+			span.head++
+		} else {
+			span.next--
+		}
+		db.lists[prefix] = span
+		return value, nil
+	}
+}
+
+// LLen returns the number of entries of the list stored under collection
+// and key.
+func (db *DB) LLen(collection, key string) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	span, err := db.listSpanOf(listPrefix(collection, key))
+	return span.len(), err
+}
+
+// LRange returns the entries of the list stored under collection and key
+// from index start to stop, both included. Negative indexes count from the
+// end, -1 being the last entry; indexes out of range are clamped to it, and
+// an empty range gives an empty slice. Only the entries in the range are
+// read.
+func (db *DB) LRange(collection, key string, start, stop int) ([][]byte, error) {
+	prefix := listPrefix(collection, key)
+	db.mu.RLock()
+	span, err := db.listSpanOf(prefix)
+	now := db.now().UnixNano()
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	length := span.len()
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	stop = min(stop, length-1)
+	if start > stop {
+		return [][]byte{}, nil
+	}
+	keys := make([]string, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		keys = append(keys, listEntryKey(prefix, span.head+int64(i)))
+	}
+
+	// An entry popped since the span was read is left out
+	records, found, err := db.getRecords(keys, now)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0, len(records))
+	for i, rec := range records {
+		if found[i] {
+			entries = append(entries, rec.Value)
+		}
+	}
+	return entries, nil
+}
+
+// GetList returns the entries of the list stored under collection and key
+// in order, or an empty slice if there are none.
+func (db *DB) GetList(collection, key string) ([][]byte, error) {
+	prefix := listPrefix(collection, key)
+	db.mu.RLock()
+	keys, err := db.listKeys(prefix)
+	now := db.now().UnixNano()
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	records, found, err := db.getRecords(keys, now)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0, len(records))
+	for i, rec := range records {
+		if found[i] {
+			entries = append(entries, rec.Value)
+		}
+	}
+	return entries, nil
+}
+
+// DeleteList removes every entry of the list stored under collection and
+// key in one batch.
+func (db *DB) DeleteList(collection, key string) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	prefix := listPrefix(collection, key)
+	keys, err := db.listKeys(prefix)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	writes := make([]batchRecord, len(keys))
+	for i, k := range keys {
+		_, entryKey := SplitKey(k)
+		writes[i] = batchRecord{collection: listCollection, key: entryKey, op: OpDelete}
+	}
+	if err := db.commitWrites(writes); err != nil {
+		return err
+	}
+	delete(db.lists, prefix)
+	return nil
+}
+
+// listKeys returns the composite keys of the entries under prefix in list
+// order. Callers must hold db.mu.
+func (db *DB) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	err := db.index.each(func(k string, _ indexEntry) error {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	slices.Sort(keys)
+	return keys, err
+}
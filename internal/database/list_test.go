@@ -0,0 +1,208 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAppendList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string, want int) {
+		t.Helper()
+		entries, err := db.GetList("logs", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != want {
+			t.Fatalf("%s: %d entries, want %d", stage, len(entries), want)
+		}
+		for i, e := range entries {
+			if string(e) != fmt.Sprintf("entry %d", i) {
+				t.Fatalf("%s: entry %d = %q", stage, i, e)
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := db.Append("logs", "app", []byte(fmt.Sprintf("entry %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("append", 100)
+
+	// Lists whose names share a prefix stay apart, and the key's regular
+	// value is independent of its list
+	db.Append("logs", "ap", []byte("other"))
+	db.Append("log", "sapp", []byte("other"))
+	db.Put("logs", "app", []byte("value"))
+	check("neighbours", 100)
+	if v, err := db.Get("logs", "app"); err != nil || string(v) != "value" {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+	if keys, _ := db.List("logs"); len(keys) != 1 {
+		t.Errorf("List shows list entries: %v", keys)
+	}
+
+	db.Close()
+	if db, err = Open(path, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("reopen", 100)
+
+	// Appends after a reopen continue the sequence
+	for i := 100; i < 110; i++ {
+		db.Append("logs", "app", []byte(fmt.Sprintf("entry %d", i)))
+	}
+	check("append after reopen", 110)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("compact", 110)
+
+	if err := db.DeleteList("logs", "app"); err != nil {
+		t.Fatal(err)
+	}
+	check("delete", 0)
+	if entries, _ := db.GetList("logs", "ap"); len(entries) != 1 {
+		t.Errorf("DeleteList removed a neighbouring list: %q", entries)
+	}
+	db.Append("logs", "app", []byte("entry 0"))
+	check("append after delete", 1)
+}
+
+func TestListPushPop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	lrange := func(start, stop int) string {
+		t.Helper()
+		entries, err := db.LRange("feeds", "u1", start, stop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%s", entries)
+	}
+
+	// Appended before the first LPush, so the list spans both signs
+	db.Append("feeds", "u1", []byte("c"))
+	db.RPush("feeds", "u1", []byte("d"), []byte("e"))
+	db.LPush("feeds", "u1", []byte("b"), []byte("a"))
+	if got := lrange(0, -1); got != "[a b c d e]" {
+		t.Errorf("LRange(0, -1) = %s", got)
+	}
+	for _, r := range []struct {
+		start, stop int
+		want        string
+	}{
+		{1, 2, "[b c]"}, {-2, -1, "[d e]"}, {-100, 0, "[a]"}, {3, 100, "[d e]"}, {3, 2, "[]"}, {5, 9, "[]"},
+	} {
+		if got := lrange(r.start, r.stop); got != r.want {
+			t.Errorf("LRange(%d, %d) = %s, want %s", r.start, r.stop, got, r.want)
+		}
+	}
+
+	// The order survives Compact and a reopen, where the span is found again
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if db, err = Open(path, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.LLen("feeds", "u1"); err != nil || n != 5 {
+		t.Errorf("LLen after reopening = %d, %v", n, err)
+	}
+	if entries, _ := db.GetList("feeds", "u1"); fmt.Sprintf("%s", entries) != "[a b c d e]" {
+		t.Errorf("GetList = %s", entries)
+	}
+
+	for _, want := range []string{"a", "e", "b", "d", "c"} {
+		pop := db.LPop
+		if want == "e" || want == "d" {
+			pop = db.RPop
+		}
+		if v, err := pop("feeds", "u1"); err != nil || string(v) != want {
+			t.Errorf("pop = %q, %v; want %q", v, err, want)
+		}
+	}
+	if _, err := db.LPop("feeds", "u1"); err != ErrNotFound {
+		t.Errorf("LPop of an empty list: %v", err)
+	}
+	if n, _ := db.LLen("feeds", "u1"); n != 0 {
+		t.Errorf("LLen of an empty list = %d", n)
+	}
+
+	// A cached span outlived by a DeletePrefix of the entries
+	db.RPush("feeds", "u1", []byte("x"), []byte("y"))
+	if err := db.DeletePrefix(listPrefix("feeds", "u1")); err != nil {
+		t.Fatal(err)
+	}
+	db.RPush("feeds", "u1", []byte("z"))
+	if v, err := db.LPop("feeds", "u1"); err != nil || string(v) != "z" {
+		t.Errorf("LPop after DeletePrefix = %q, %v", v, err)
+	}
+}
+
+func TestListQueueConsumers(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const jobs, consumers = 10000, 8
+	for i := 0; i < jobs; i += 100 {
+		batch := make([][]byte, 100)
+		for j := range batch {
+			batch[j] = []byte(fmt.Sprint(i + j))
+		}
+		if err := db.RPush("queue", "jobs", batch...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	taken := make(map[string]int)
+	var wg sync.WaitGroup
+	for range consumers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				v, err := db.LPop("queue", "jobs")
+				if err == ErrNotFound {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				taken[string(v)]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(taken) != jobs {
+		t.Errorf("%d distinct jobs taken, want %d", len(taken), jobs)
+	}
+	for job, n := range taken {
+		if n != 1 {
+			t.Errorf("job %s taken %d times", job, n)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"sort"
+	"strings"
+)
+
+// LiveIteratorOptions configures a LiveIterator.
+type LiveIteratorOptions struct {
+	// ExcludeNew visits only keys that existed when the iterator was
+	// created. By default keys added later are visited too, if they sort
+	// after the iterator's position.
+	ExcludeNew bool
+}
+
+// LiveIterator visits the keys under a prefix in order like Iterator, but
+// reflects the database as it is at each step rather than when it was
+// created: Next looks every key up again under the read lock and reads its
+// value there, skipping keys deleted or expired in the meantime, so Value
+// never fails for a key that went away. Unless ExcludeNew is set, the first
+// Next after a write lists the keys past the iterator's position again,
+// which costs a walk of the index.
+type LiveIterator struct {
+	db     *DB
+	prefix string
+	opts   LiveIteratorOptions
+
+	keys   []string
+	idx    int
+	offset int64 // Log end when keys were listed
+	rec    Record
+	valid  bool
+	err    error
+	handle bool // Counted against Options.MaxSnapshots until Close
+}
+
+// NewLiveIterator returns a LiveIterator over the keys starting with prefix.
+// Past Options.MaxSnapshots it visits nothing and Err returns
+// ErrTooManySnapshots.
+func (db *DB) NewLiveIterator(prefix string, opts LiveIteratorOptions) *LiveIterator {
+	it := &LiveIterator{db: db, prefix: prefix, opts: opts}
+	db.mu.RLock()
+	it.err = db.acquireHandle()
+	db.mu.RUnlock()
+	if it.err == nil {
+		it.handle = true
+		it.list("")
+	}
+	return it
+}
+
+// list replaces the keys left to visit with the current keys under the
+// prefix that sort after key.
+func (it *LiveIterator) list(after string) {
+	db := it.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var keys []string
+	it.err = db.index.each(func(k string, _ indexEntry) error {
+		if strings.HasPrefix(k, it.prefix) && k > after {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	it.keys, it.idx, it.offset = keys, -1, db.offset
+}
+
+// Next advances to the next key that is live now and reads its value. It
+// returns false at the end or on an error, reported by Err.
+func (it *LiveIterator) Next() bool {
+	it.valid = false
+	if it.err != nil {
+		return false
+	}
+	if !it.opts.ExcludeNew && it.db.Offset() != it.offset {
+		after := ""
+		if it.idx >= 0 && it.idx < len(it.keys) {
+			after = it.keys[it.idx]
+		}
+		if it.list(after); it.err != nil {
+			return false
+		}
+	}
+	for it.idx+1 < len(it.keys) {
+		it.idx++
+		rec, err := it.db.getRecord(it.keys[it.idx])
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.rec, it.valid = rec, true
+		return true
+	}
+	return false
+}
+
+// Key returns the combined key (collection:key) Next stopped at.
+func (it *LiveIterator) Key() string {
+	if !it.valid {
+		return ""
+	}
+	return it.keys[it.idx]
+}
+
+// Value returns the value Next read for the current key.
+func (it *LiveIterator) Value() ([]byte, error) {
+	if !it.valid {
+		return nil, ErrNotFound
+	}
+	return it.rec.Value, nil
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *LiveIterator) Err() error {
+	return it.err
+}
+
+func (it *LiveIterator) Close() {
+	it.keys = nil
+	it.valid = false
+	if it.handle {
+		it.handle = false
+		it.db.releaseHandle()
+	}
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLiveIterator(t *testing.T) {
+	for _, excludeNew := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ExcludeNew=%v", excludeNew), func(t *testing.T) {
+			clock := newTestClock()
+			db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 1; i <= 5; i++ {
+				db.Put("col", fmt.Sprintf("k%d", i), []byte("old"))
+			}
+			db.Put("other", "k9", []byte("old"))
+
+			it := db.NewLiveIterator("col:", LiveIteratorOptions{ExcludeNew: excludeNew})
+			defer it.Close()
+			snapshot := db.NewIterator("col:")
+			defer snapshot.Close()
+			if !it.Next() || it.Key() != "col:k1" {
+				t.Fatalf("first key %q, err %v", it.Key(), it.Err())
+			}
+
+			// Change the data behind the iterator's back
+			db.Delete("col", "k2")
+			db.PutWithTTL("col", "k3", []byte("expiring"), time.Millisecond)
+			db.Put("col", "k4", []byte("new"))
+			db.Put("col", "k0", []byte("new")) // Behind the position
+			db.Put("col", "k6", []byte("new")) // Ahead of it
+			clock.Advance(time.Second)
+
+			got := map[string]string{}
+			var keys []string
+			for it.Next() {
+				v, err := it.Value()
+				if err != nil {
+					t.Fatalf("Value of %s: %v", it.Key(), err)
+				}
+				keys = append(keys, it.Key())
+				got[it.Key()] = string(v)
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"col:k4", "col:k5", "col:k6"}
+			if excludeNew {
+				want = want[:2]
+			}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("visited %v, want %v", keys, want)
+			}
+			if got["col:k4"] != "new" {
+				t.Errorf("k4 = %q, want the value written during iteration", got["col:k4"])
+			}
+
+			// The snapshot iterator still steps onto the deleted key
+			snapshot.Next()
+			snapshot.Next()
+			if _, err := snapshot.Value(); snapshot.Key() != "col:k2" || err != ErrNotFound {
+				t.Errorf("snapshot iterator at %q: %v", snapshot.Key(), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package database
+
+import "syscall"
+
+const fileLocking = true
+
+// lockFile takes an exclusive advisory lock on f, waiting for other handles
+// to release theirs. Locks belong to the open file, so two handles on one
+// file exclude each other even within a process.
+func lockFile(f storageFile) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f storageFile) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
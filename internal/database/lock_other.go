@@ -0,0 +1,15 @@
+//go:build !(windows || linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package database
+
+// fileLocking is false where there is no file locking to use. Code that
+// locks files must still be correct without it.
+const fileLocking = false
+
+func lockFile(f storageFile) error {
+	return nil
+}
+
+func unlockFile(f storageFile) error {
+	return nil
+}
@@ -0,0 +1,15 @@
+package database
+
+import (
+	"os"
+	"testing"
+)
+
+// NOKHAL_PARANOID=1 runs the whole suite with Options.Paranoid in effect,
+// as the nokhaldebug build tag does.
+func TestMain(m *testing.M) {
+	if os.Getenv("NOKHAL_PARANOID") != "" {
+		paranoidAll = true
+	}
+	os.Exit(m.Run())
+}
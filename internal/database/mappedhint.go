@@ -0,0 +1,315 @@
+package database
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// A mapped hint, written with Options.MmapHint, holds the index as an array
+// of fixed-size entries sorted by a keyed hash of their key, which Open maps
+// into memory and searches in place instead of decoding it into a map. It
+// starts with the header of a gob hint under its own magic, followed by the
+// entry count and the size of a sealed section. That section holds the hash
+// key, a SHA-256 digest of the array, the key names in array order and the
+// filters and space accounting of a gob hint. The array, which names no
+// key, follows in the clear.
+const mappedHintMagic = "NOKHAL_MMAP1"
+
+// mappedEntrySize is the size of an array entry: the key hash, then the
+// Offset, Size, Timestamp and ExpiresAt of its indexEntry.
+const mappedEntrySize = 5 * 8
+
+// mappedHintMeta is the sealed section of a mapped hint.
+type mappedHintMeta struct {
+	HashKey  []byte
+	Digest   []byte
+	Names    []byte // Uvarint length and bytes of each key, in array order
+	Bloom    *BloomFilter
+	Dead     map[string]int64
+	Prefixes *BloomFilter
+}
+
+// mappedIndex is the index loaded from a mapped hint. Like a diskIndex, it
+// holds changes made since in memory until the next Compact or Reindex
+// builds a new index.
+type mappedIndex struct {
+	entries []byte   // The array, in the mapped file
+	keys    []string // Key of each entry
+	hashKey []byte
+	unmap   func() error
+
+	overlay map[string]indexEntry
+	removed map[string]struct{}
+
+	sortOnce sync.Once
+	sorted   []int32 // Entries in key order
+}
+
+func (m *mappedIndex) hash(key string) uint64 {
+	return mappedHash(m.hashKey, key)
+}
+
+func mappedHash(hashKey []byte, key string) uint64 {
+	h := hmac.New(sha256.New, hashKey)
+	io.WriteString(h, key)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (m *mappedIndex) hashAt(i int) uint64 {
+	return binary.BigEndian.Uint64(m.entries[i*mappedEntrySize:])
+}
+
+func (m *mappedIndex) entryAt(i int) indexEntry {
+	b := m.entries[i*mappedEntrySize+8:]
+	return indexEntry{
+		Offset:    int64(binary.BigEndian.Uint64(b)),
+		Size:      int64(binary.BigEndian.Uint64(b[8:])),
+		Timestamp: int64(binary.BigEndian.Uint64(b[16:])),
+		ExpiresAt: int64(binary.BigEndian.Uint64(b[24:])),
+	}
+}
+
+func (m *mappedIndex) get(key string) (indexEntry, bool, error) {
+	if e, ok := m.overlay[key]; ok {
+		return e, true, nil
+	}
+	if _, ok := m.removed[key]; ok {
+		return indexEntry{}, false, nil
+	}
+	h := m.hash(key)
+	i := sort.Search(len(m.keys), func(i int) bool { return m.hashAt(i) >= h })
+	for ; i < len(m.keys) && m.hashAt(i) == h; i++ {
+		if m.keys[i] == key {
+			return m.entryAt(i), true, nil
+		}
+	}
+	return indexEntry{}, false, nil
+}
+
+func (m *mappedIndex) set(key string, e indexEntry) {
+	m.overlay[key] = e
+	delete(m.removed, key)
+}
+
+func (m *mappedIndex) remove(key string) {
+	delete(m.overlay, key)
+	m.removed[key] = struct{}{}
+}
+
+// shadowed reports whether the array entry of key is out of date.
+func (m *mappedIndex) shadowed(key string) bool {
+	if _, ok := m.overlay[key]; ok {
+		return true
+	}
+	_, ok := m.removed[key]
+	return ok
+}
+
+func (m *mappedIndex) each(fn func(key string, e indexEntry) error) error {
+	for i, k := range m.keys {
+		if m.shadowed(k) {
+			continue
+		}
+		if err := fn(k, m.entryAt(i)); err != nil {
+			return err
+		}
+	}
+	for k, e := range m.overlay {
+		if err := fn(k, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachSorted merges the array, in key order, with the overlay.
+func (m *mappedIndex) eachSorted(fn func(key string, e indexEntry) error) error {
+	m.sortOnce.Do(func() {
+		m.sorted = make([]int32, len(m.keys))
+		for i := range m.sorted {
+			m.sorted[i] = int32(i)
+		}
+		slices.SortFunc(m.sorted, func(a, b int32) int { return cmp.Compare(m.keys[a], m.keys[b]) })
+	})
+
+	overlay := slices.Sorted(maps.Keys(m.overlay))
+	for _, i := range m.sorted {
+		k := m.keys[i]
+		for len(overlay) > 0 && overlay[0] < k {
+			if err := fn(overlay[0], m.overlay[overlay[0]]); err != nil {
+				return err
+			}
+			overlay = overlay[1:]
+		}
+		if m.shadowed(k) {
+			continue
+		}
+		if err := fn(k, m.entryAt(int(i))); err != nil {
+			return err
+		}
+	}
+	for _, k := range overlay {
+		if err := fn(k, m.overlay[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mappedIndex) close() error {
+	return m.unmap()
+}
+
+// encodeMappedHint writes the index as a mapped hint.
+func (db *DB) encodeMappedHint(f *os.File) error {
+	anchor, err := hintAnchor(db.file, db.offset)
+	if err != nil {
+		return err
+	}
+
+	type keyed struct {
+		hash uint64
+		key  string
+		e    indexEntry
+	}
+	hashKey := make([]byte, 32)
+	if _, err := rand.Read(hashKey); err != nil {
+		return err
+	}
+	var entries []keyed
+	err = db.index.each(func(k string, e indexEntry) error {
+		entries = append(entries, keyed{mappedHash(hashKey, k), k, e})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(entries, func(a, b keyed) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.key, b.key))
+	})
+
+	array := make([]byte, 0, len(entries)*mappedEntrySize)
+	var names []byte
+	for _, e := range entries {
+		array = binary.BigEndian.AppendUint64(array, e.hash)
+		array = binary.BigEndian.AppendUint64(array, uint64(e.e.Offset))
+		array = binary.BigEndian.AppendUint64(array, uint64(e.e.Size))
+		array = binary.BigEndian.AppendUint64(array, uint64(e.e.Timestamp))
+		array = binary.BigEndian.AppendUint64(array, uint64(e.e.ExpiresAt))
+		names = binary.AppendUvarint(names, uint64(len(e.key)))
+		names = append(names, e.key...)
+	}
+	digest := sha256.Sum256(array)
+
+	var payload bytes.Buffer
+	meta := mappedHintMeta{
+		HashKey:  hashKey,
+		Digest:   digest[:],
+		Names:    names,
+		Bloom:    db.bloom,
+		Dead:     db.dead,
+		Prefixes: db.prefixes,
+	}
+	if err := gob.NewEncoder(&payload).Encode(&meta); err != nil {
+		return err
+	}
+	nonce, err := db.newNonce()
+	if err != nil {
+		return err
+	}
+
+	header := appendHintHeader(nil, mappedHintMagic, db.offset, db.header.Salt, anchor)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(entries)))
+	header = binary.BigEndian.AppendUint64(header, uint64(nonceSize+payload.Len()+db.aead.Overhead()))
+	sealed := db.aead.Seal(nonce, nonce, payload.Bytes(), header)
+	for _, b := range [][]byte{header, sealed, array} {
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMappedHint maps the mapped hint f, whose header of headerLen bytes was
+// checked, and loads the index, filters and space accounting from it.
+func (db *DB) loadMappedHint(f *os.File, headerLen int) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, unmap, err := mapFile(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	if err := db.openMappedHint(data, headerLen, unmap); err != nil {
+		unmap()
+		return err
+	}
+	return nil
+}
+
+// openMappedHint loads the mapped hint in data, which unmap releases.
+func (db *DB) openMappedHint(data []byte, headerLen int, unmap func() error) error {
+	pos := headerLen + 16
+	if len(data) < pos {
+		return errInvalidHint
+	}
+	count := binary.BigEndian.Uint64(data[headerLen:])
+	sealedLen := binary.BigEndian.Uint64(data[headerLen+8:])
+	if sealedLen < nonceSize || sealedLen > uint64(len(data)-pos) {
+		return errInvalidHint
+	}
+	sealed := data[pos : pos+int(sealedLen)]
+	entries := data[pos+int(sealedLen):]
+	if len(entries)%mappedEntrySize != 0 || uint64(len(entries)/mappedEntrySize) != count {
+		return errInvalidHint
+	}
+
+	payload, err := db.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], data[:pos])
+	if err != nil {
+		return ErrDecryption
+	}
+	var meta mappedHintMeta
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&meta); err != nil {
+		return err
+	}
+	if digest := sha256.Sum256(entries); !bytes.Equal(digest[:], meta.Digest) {
+		return errInvalidHint
+	}
+
+	// The keys share one string, so they cost no allocation each
+	names := string(meta.Names)
+	keys := make([]string, count)
+	next := 0
+	for i := range keys {
+		n, size := binary.Uvarint(meta.Names[next:])
+		if size <= 0 || n > uint64(len(names)-next-size) {
+			return errInvalidHint
+		}
+		next += size
+		keys[i] = names[next : next+int(n)]
+		next += int(n)
+	}
+
+	db.index = &mappedIndex{
+		entries: entries,
+		keys:    keys,
+		hashKey: meta.HashKey,
+		unmap:   unmap,
+		overlay: make(map[string]indexEntry),
+		removed: make(map[string]struct{}),
+	}
+	db.bloom, db.dead, db.prefixes = meta.Bloom, meta.Dead, meta.Prefixes
+	return nil
+}
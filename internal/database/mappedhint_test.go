@@ -0,0 +1,134 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMappedHint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{MmapHint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 1000 {
+		key := fmt.Sprintf("k%04d", i)
+		if i%10 == 0 {
+			err = db.PutWithTTL("col", key, []byte(key), time.Hour)
+		} else {
+			err = db.Put("col", key, []byte(key))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 100 {
+		db.Delete("col", fmt.Sprintf("k%04d", i*7))
+	}
+	db.SetCollectionTTL("ttl", time.Hour)
+	db.Put("other", "x", []byte("x"))
+	want, err := db.ScanPrefix("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if info, err := ReadHint(path + ".hint"); err != nil || !info.MagicValid || !info.Mapped {
+		t.Fatalf("hint written with MmapHint: %+v, %v", info, err)
+	}
+
+	// Open searches the mapped array without the option
+	check := func(db *DB) {
+		t.Helper()
+		got, err := db.ScanPrefix("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ScanPrefix returned %d records, want %d", len(got), len(want))
+		}
+		for _, rec := range want {
+			if v, err := db.Get(rec.Collection, rec.Key); err != nil || string(v) != string(rec.Value) {
+				t.Errorf("Get(%s:%s) = %q, %v", rec.Collection, rec.Key, v, err)
+			}
+		}
+		if _, err := db.Get("col", "k0007"); err != ErrNotFound {
+			t.Errorf("Get of a deleted key: %v", err)
+		}
+		if db.defaultTTL["ttl"] != time.Hour {
+			t.Error("collection TTL setting not loaded")
+		}
+	}
+	db, report, err := OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.HintUsed || report.RecordsScanned != 0 {
+		t.Errorf("open report: %+v", report)
+	}
+	if _, ok := db.index.(*mappedIndex); !ok {
+		t.Fatalf("index is a %T", db.index)
+	}
+	check(db)
+
+	// Later writes are merged in, in key order
+	db.Put("col", "k0001", []byte("new"))
+	db.Put("col", "k0001a", []byte("added"))
+	db.Delete("col", "k0002")
+	var keys []string
+	err = db.ScanPrefixFunc("col:", func(rec *Record) error {
+		keys = append(keys, rec.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.IsSorted(keys) || keys[0] != "k0001" || keys[1] != "k0001a" || keys[2] != "k0003" {
+		t.Errorf("ScanPrefixFunc after writes starts %v", keys[:3])
+	}
+	if v, _ := db.Get("col", "k0001"); string(v) != "new" {
+		t.Errorf("Get(k0001) after a rewrite = %q", v)
+	}
+	db.Delete("col", "k0001a")
+	db.Put("col", "k0001", []byte("k0001"))
+	db.Put("col", "k0002", []byte("k0002"))
+	want, _ = db.ScanPrefix("")
+
+	// Without the option Close writes a gob hint from the mapped index
+	db.Close()
+	if info, _ := ReadHint(path + ".hint"); info.Mapped {
+		t.Error("hint still mapped after a close without MmapHint")
+	}
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.index.(mapIndex); !ok {
+		t.Errorf("index loaded from a gob hint is a %T", db.index)
+	}
+	check(db)
+	db.UpdateOptions(func(o *Options) { o.MmapHint = true })
+	db.Close()
+
+	// A changed array is caught, and the log scanned instead
+	data, err := os.ReadFile(path + ".hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	os.WriteFile(path+".hint", data, 0600)
+	db, report, err = OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if report.HintUsed || !report.HintDiscarded {
+		t.Errorf("open report with a changed array: %+v", report)
+	}
+	check(db)
+}
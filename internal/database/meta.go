@@ -0,0 +1,153 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Database-level settings are stored as regular encrypted records inside a
+// reserved collection, so they survive compaction and travel with backups.
+const (
+	internalPrefix = "__nokhal"
+	metaCollection = internalPrefix + "_meta"
+
+	metaPlaintextPrefix = "plaintext:"
+	metaTTLPrefix       = "ttl:"
+	metaImmutablePrefix = "immutable:"
+)
+
+func isInternalCollection(collection string) bool {
+	return strings.HasPrefix(collection, internalPrefix)
+}
+
+// hiddenFromPrefix reports whether records of collection should be left out of
+// a prefix scan. Internal collections are only visible when asked for explicitly.
+func hiddenFromPrefix(collection, prefix string) bool {
+	return isInternalCollection(collection) && !strings.HasPrefix(prefix, internalPrefix)
+}
+
+func (db *DB) loadMeta() error {
+	db.mu.RLock()
+	var keys []string
+	prefix := metaCollection + ":"
+	err := db.index.each(func(k string, _ indexEntry) error {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		rec, err := db.getRecord(k)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		db.applyMeta(rec.Key, rec.Value)
+	}
+	return nil
+}
+
+// applyMeta updates in-memory settings from a meta record. Callers must hold
+// db.mu or have exclusive access to db.
+func (db *DB) applyMeta(key string, value []byte) {
+	switch {
+	case strings.HasPrefix(key, metaPlaintextPrefix):
+		collection := strings.TrimPrefix(key, metaPlaintextPrefix)
+		if string(value) == "1" {
+			db.plaintext[collection] = true
+		} else {
+			delete(db.plaintext, collection)
+		}
+	case strings.HasPrefix(key, metaTTLPrefix):
+		collection := strings.TrimPrefix(key, metaTTLPrefix)
+		n, _ := strconv.ParseInt(string(value), 10, 64)
+		if n > 0 {
+			db.defaultTTL[collection] = time.Duration(n)
+		} else {
+			delete(db.defaultTTL, collection)
+		}
+	case strings.HasPrefix(key, metaImmutablePrefix):
+		collection := strings.TrimPrefix(key, metaImmutablePrefix)
+		if string(value) == "1" {
+			db.immutable[collection] = true
+		} else {
+			delete(db.immutable, collection)
+			db.fastGets.Clear()
+		}
+	case strings.HasPrefix(key, metaIncompressiblePrefix):
+		db.applyIncompressible(strings.TrimPrefix(key, metaIncompressiblePrefix), value)
+	case key == metaWALMark:
+		db.walMark, _ = strconv.ParseUint(string(value), 10, 64)
+	case strings.HasPrefix(key, metaDictPrefix):
+		db.addDict(key, value)
+	}
+}
+
+// putMeta persists a meta setting and applies it. Callers must hold db.mu.
+func (db *DB) putMeta(key string, value []byte) error {
+	if err := db.put(metaCollection, key, value, 0); err != nil {
+		return err
+	}
+	db.applyMeta(key, value)
+	return nil
+}
+
+// hasRecords reports whether collection has any live key. Callers must hold db.mu.
+func (db *DB) hasRecords(collection string) (bool, error) {
+	prefix := collection + ":"
+	err := db.index.each(func(k string, _ indexEntry) error {
+		if strings.HasPrefix(k, prefix) {
+			return errStopEach
+		}
+		return nil
+	})
+	if err == errStopEach {
+		return true, nil
+	}
+	return false, err
+}
+
+func (db *DB) SetCollectionPlaintext(collection string, plaintext bool) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	if isInternalCollection(collection) {
+		return ErrCollectionInUse
+	}
+	if db.plaintext[collection] == plaintext {
+		return nil
+	}
+	used, err := db.hasRecords(collection)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrCollectionInUse
+	}
+
+	value := []byte("0")
+	if plaintext {
+		value = []byte("1")
+	}
+	return db.putMeta(metaPlaintextPrefix+collection, value)
+}
+
+// SetCollectionTTL sets the TTL applied to writes in collection that don't
+// specify one. Zero removes the default.
+func (db *DB) SetCollectionTTL(collection string, ttl time.Duration) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	return db.putMeta(metaTTLPrefix+collection, []byte(strconv.FormatInt(int64(ttl), 10)))
+}
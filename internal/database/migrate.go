@@ -0,0 +1,122 @@
+package database
+
+// Number of values MapValues rewrites per batch
+const mapValuesBatchSize = 256
+
+// MapValues rewrites every live value of collection with fn, in key order,
+// and returns the number of values written. Rewritten records keep their
+// expiry.
+//
+// Values are committed in batches of mapValuesBatchSize. If fn returns an
+// error, MapValues stops and returns it along with the count of values
+// already committed: those stay migrated, nothing else of the batch in
+// progress is written. Calling MapValues again with an fn that recognizes
+// migrated values resumes the migration.
+//
+// fn runs without the database lock held. A key written while fn runs on
+// its value is not overwritten: fn runs again on the value just written,
+// and a key deleted meanwhile stays deleted.
+func (db *DB) MapValues(collection string, fn func(key string, old []byte) ([]byte, error)) (int, error) {
+	db.mu.RLock()
+	it := db.newIterator(collection + ":")
+	db.mu.RUnlock()
+	defer it.Close()
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for {
+		var keys []string
+		for len(keys) < mapValuesBatchSize && it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if len(keys) == 0 {
+			return migrated, nil
+		}
+		n, err := db.mapBatch(keys, fn)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+	}
+}
+
+// mapBatch rewrites the values of compKeys with fn and returns the number
+// written. Each value is written back only if its key still points at the
+// record fn was given; the others are read again and passed to fn again,
+// until none is left.
+func (db *DB) mapBatch(compKeys []string, fn func(key string, old []byte) ([]byte, error)) (int, error) {
+	written := 0
+	for len(compKeys) > 0 {
+		records, found, offsets, err := db.getRecordsAt(compKeys, 0)
+		if err != nil {
+			return written, err
+		}
+		var writes []batchRecord
+		var read []int64
+		for i, rec := range records {
+			if !found[i] {
+				continue
+			}
+			value, err := fn(rec.Key, rec.Value)
+			if err != nil {
+				return written, err
+			}
+			writes = append(writes, batchRecord{
+				collection: rec.Collection,
+				key:        rec.Key,
+				value:      value,
+				op:         OpPut,
+				keepExpiry: true,
+				expiresAt:  rec.ExpiresAt,
+			})
+			read = append(read, offsets[i])
+		}
+
+		n, changed, err := db.commitUnchanged(writes, read)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		compKeys = changed
+	}
+	return written, nil
+}
+
+// commitUnchanged commits the writes whose key the index still points at
+// the offset given for it, and returns how many it committed and the keys
+// written since, leaving out those deleted or expired.
+func (db *DB) commitUnchanged(writes []batchRecord, offsets []int64) (int, []string, error) {
+	if len(writes) == 0 {
+		return 0, nil, nil
+	}
+	if err := db.lockWrite(); err != nil {
+		return 0, nil, err
+	}
+	defer db.mu.Unlock()
+
+	now := db.now().UnixNano()
+	var unchanged []batchRecord
+	var changed []string
+	for i, w := range writes {
+		compKey := compositeKey(w.collection, w.key)
+		entry, ok, err := db.index.get(compKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case !ok || entry.expired(now):
+		case entry.Offset != offsets[i]:
+			changed = append(changed, compKey)
+		default:
+			unchanged = append(unchanged, w)
+		}
+	}
+	if len(unchanged) > 0 {
+		if err := db.commitWrites(unchanged); err != nil {
+			return 0, nil, err
+		}
+	}
+	return len(unchanged), changed, nil
+}
@@ -0,0 +1,352 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// Number of records whose CRCs RecoverFromMirror compares between the
+// primary and the mirror before trusting their shared prefix.
+const mirrorSamples = 64
+
+var ErrMirrorDiverged = errors.New("mirror diverged from primary")
+
+// MirrorStatus reports the state of the write-through mirror.
+type MirrorStatus struct {
+	Enabled       bool
+	Path          string
+	PrimaryOffset int64  // End of the primary log
+	MirrorOffset  int64  // End of the log copied to the mirror
+	Lag           int64  // PrimaryOffset - MirrorOffset
+	Failures      int64  // Failed mirror writes since Open
+	LastError     string // Most recent mirror error, empty if none
+	Diverged      bool   // Mirror holds other data; writes to it are suspended
+}
+
+type mirror struct {
+	file     *os.File
+	path     string
+	offset   int64
+	failures int64
+	lastErr  error
+	diverged bool
+}
+
+// openMirror attaches Options.MirrorPath, creating the mirror or catching it
+// up from the primary. A mirror that belongs to another database, or holds
+// more log than the primary, is never overwritten: it is marked diverged so
+// that RecoverFromMirror can still use it. Callers must hold db.mu.
+func (db *DB) openMirror() error {
+	if db.opts.MirrorPath == "" {
+		return nil
+	}
+	m := &mirror{path: db.opts.MirrorPath}
+	db.mirror = m
+
+	f, err := os.OpenFile(m.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return db.mirrorFailed(err)
+	}
+	m.file = f
+
+	fi, err := f.Stat()
+	if err != nil {
+		return db.mirrorFailed(err)
+	}
+	if size := fi.Size(); size >= int64(headerSize) {
+		mh, err := readFileHeader(f)
+		if err != nil || !sameDatabase(db.header, mh) {
+			m.diverged = true
+			return db.mirrorFailed(ErrMirrorDiverged)
+		}
+		switch {
+		case size > db.offset:
+			// Intact records past the primary's end mean the primary lost
+			// its tail; a partial record is just a torn write
+			if _, end := walkLog(f, db.offset); end > db.offset {
+				m.diverged = true
+				return db.mirrorFailed(ErrMirrorDiverged)
+			}
+			m.offset = db.offset
+		case size < db.offset:
+			_, m.offset = walkLog(f, int64(headerSize))
+		default:
+			m.offset = size
+		}
+	}
+
+	if err := db.catchUpMirror(db.offset); err != nil {
+		return db.mirrorFailed(err)
+	}
+	if err := m.file.Truncate(m.offset); err != nil {
+		return db.mirrorFailed(err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return db.mirrorFailed(err)
+	}
+	return nil
+}
+
+// catchUpMirror copies the primary between the mirror's offset and end.
+// The header is copied with the writer lease cleared.
+func (db *DB) catchUpMirror(end int64) error {
+	m := db.mirror
+	if m.offset < int64(headerSize) {
+		header, err := db.headerCopy()
+		if err != nil {
+			return err
+		}
+		if _, err := m.file.WriteAt(header, 0); err != nil {
+			return err
+		}
+		m.offset = int64(headerSize)
+	}
+	if m.offset >= end {
+		return nil
+	}
+
+	section := io.NewSectionReader(db.file, m.offset, end-m.offset)
+	if _, err := io.Copy(io.NewOffsetWriter(m.file, m.offset), section); err != nil {
+		return err
+	}
+	m.offset = end
+	return nil
+}
+
+// mirrorWrite copies bytes just written to the primary log at offset. A
+// mirror that fell behind is caught up first. Failures are logged and only
+// returned when Options.MirrorRequired is set. Callers must hold db.mu.
+func (db *DB) mirrorWrite(data []byte, offset int64, sync bool) error {
+	m := db.mirror
+	if m == nil {
+		return nil
+	}
+	if m.diverged || m.file == nil {
+		return db.mirrorRequired()
+	}
+
+	if err := db.catchUpMirror(offset); err != nil {
+		return db.mirrorFailed(err)
+	}
+	if _, err := m.file.WriteAt(data, offset); err != nil {
+		return db.mirrorFailed(err)
+	}
+	m.offset = offset + int64(len(data))
+	if sync {
+		if err := m.file.Sync(); err != nil {
+			return db.mirrorFailed(err)
+		}
+	}
+	return nil
+}
+
+// mirrorHeader copies an in-place header update. Callers must hold db.mu.
+func (db *DB) mirrorHeader(data []byte, offset int) error {
+	m := db.mirror
+	if m == nil || m.diverged || m.file == nil || m.offset < int64(headerSize) {
+		// The next catch-up copies the whole header
+		return nil
+	}
+	if _, err := m.file.WriteAt(data, int64(offset)); err != nil {
+		return db.mirrorFailed(err)
+	}
+	return nil
+}
+
+// mirrorPatch copies an in-place rewrite of log bytes. Bytes the mirror does
+// not hold yet reach it with the next catch-up. Callers must hold db.mu.
+func (db *DB) mirrorPatch(data []byte, offset int64) error {
+	m := db.mirror
+	if m == nil || m.diverged || m.file == nil || offset >= m.offset {
+		return nil
+	}
+	data = data[:min(int64(len(data)), m.offset-offset)]
+	if _, err := m.file.WriteAt(data, offset); err != nil {
+		return db.mirrorFailed(err)
+	}
+	return nil
+}
+
+// resetMirror rebuilds the mirror from scratch after Compact replaced the
+// primary. Callers must hold db.mu.
+func (db *DB) resetMirror() error {
+	m := db.mirror
+	if m == nil || m.diverged || m.file == nil {
+		return nil
+	}
+	if err := m.file.Truncate(0); err != nil {
+		return db.mirrorFailed(err)
+	}
+	m.offset = 0
+	if err := db.catchUpMirror(db.offset); err != nil {
+		return db.mirrorFailed(err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return db.mirrorFailed(err)
+	}
+	return nil
+}
+
+func (db *DB) mirrorFailed(err error) error {
+	m := db.mirror
+	m.failures++
+	m.lastErr = err
+	db.logger().Warn("nokhal: mirror write failed", "mirror", m.path, "err", err)
+	return db.mirrorRequired()
+}
+
+func (db *DB) mirrorRequired() error {
+	if !db.opts.MirrorRequired {
+		return nil
+	}
+	if db.mirror.lastErr != nil {
+		return db.mirror.lastErr
+	}
+	return ErrMirrorDiverged
+}
+
+func (db *DB) closeMirror() {
+	if db.mirror != nil && db.mirror.file != nil {
+		db.mirror.file.Close()
+	}
+}
+
+func (db *DB) MirrorStatus() MirrorStatus {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	m := db.mirror
+	if m == nil {
+		return MirrorStatus{PrimaryOffset: db.offset}
+	}
+	status := MirrorStatus{
+		Enabled:       true,
+		Path:          m.path,
+		PrimaryOffset: db.offset,
+		MirrorOffset:  m.offset,
+		Lag:           db.offset - m.offset,
+		Failures:      m.failures,
+		Diverged:      m.diverged,
+	}
+	if m.lastErr != nil {
+		status.LastError = m.lastErr.Error()
+	}
+	return status
+}
+
+// RecoverFromMirror restores records lost from the tail of primary by copying
+// the missing suffix from mirror. Both files must belong to the same database
+// and their shared prefix must match at sampled record CRCs. Returns the
+// number of bytes recovered. The primary must not be open.
+func RecoverFromMirror(primary, mirror, password string) (int64, error) {
+	pf, err := os.OpenFile(primary, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer pf.Close()
+	mf, err := os.Open(mirror)
+	if err != nil {
+		return 0, err
+	}
+	defer mf.Close()
+
+	ph, err := readFileHeader(pf)
+	if err != nil {
+		return 0, err
+	}
+	mh, err := readFileHeader(mf)
+	if err != nil {
+		return 0, err
+	}
+	if !sameDatabase(ph, mh) {
+		return 0, ErrMirrorDiverged
+	}
+
+	kekAead, err := newCipher(deriveKey(password, ph.Salt, ph.KDF))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := kekAead.Open(nil, ph.KEKNonce, ph.EncryptedDEK, dekAAD); err != nil {
+		return 0, ErrInvalidPassword
+	}
+
+	// Find the intact prefix of the primary and check it against the mirror
+	offsets, primaryEnd := walkLog(pf, int64(headerSize))
+	stride := len(offsets)/mirrorSamples + 1
+	for i := 0; i < len(offsets); i += stride {
+		if !sameCRC(pf, mf, offsets[i]) {
+			return 0, ErrMirrorDiverged
+		}
+	}
+	if len(offsets) > 0 && !sameCRC(pf, mf, offsets[len(offsets)-1]) {
+		return 0, ErrMirrorDiverged
+	}
+
+	_, mirrorEnd := walkLog(mf, primaryEnd)
+	if mirrorEnd <= primaryEnd {
+		return 0, nil
+	}
+
+	// Copy the missing suffix over whatever torn tail the primary has
+	section := io.NewSectionReader(mf, primaryEnd, mirrorEnd-primaryEnd)
+	if _, err := io.Copy(io.NewOffsetWriter(pf, primaryEnd), section); err != nil {
+		return 0, err
+	}
+	if err := pf.Truncate(mirrorEnd); err != nil {
+		return 0, err
+	}
+	if err := pf.Sync(); err != nil {
+		return 0, err
+	}
+
+	// Offsets in the hint no longer describe the log
+	_ = os.Remove(primary + ".hint")
+	return mirrorEnd - primaryEnd, nil
+}
+
+func readFileHeader(r io.ReaderAt) (*fileHeader, error) {
+	buf := make([]byte, headerSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := checkHeader(buf, n, ErrInvalidFile); err != nil {
+		return nil, err
+	}
+	return decodeHeader(buf), nil
+}
+
+// sameDatabase reports whether two headers were written for the same
+// database, i.e. share salt and wrapped DEK.
+func sameDatabase(a, b *fileHeader) bool {
+	return bytes.Equal(a.Salt, b.Salt) && bytes.Equal(a.EncryptedDEK, b.EncryptedDEK)
+}
+
+// walkLog returns the offsets of the intact records starting at from and the
+// offset where the first torn or corrupt record begins.
+func walkLog(r io.ReaderAt, from int64) ([]int64, int64) {
+	var offsets []int64
+	offset := from
+	for {
+		_, size, err := readRecordAt(r, offset)
+		if err != nil {
+			return offsets, offset
+		}
+		offsets = append(offsets, offset)
+		offset += size
+	}
+}
+
+func sameCRC(a, b io.ReaderAt, offset int64) bool {
+	crcA := make([]byte, crcSize)
+	crcB := make([]byte, crcSize)
+	if _, err := a.ReadAt(crcA, offset); err != nil {
+		return false
+	}
+	if _, err := b.ReadAt(crcB, offset); err != nil {
+		return false
+	}
+	return bytes.Equal(crcA, crcB)
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorStaysTwin(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "primary.nok")
+	mirrorPath := filepath.Join(dir, "mirror.nok")
+
+	db, err := OpenWithOptions(path, "pass", Options{MirrorPath: mirrorPath, MirrorRequired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("col", fmt.Sprintf("k%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := db.NewBatch()
+	batch.Put("col", "batched", []byte("b"), 0)
+	batch.Delete("col", "k0")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTwin := func() {
+		t.Helper()
+		primary, _ := os.ReadFile(path)
+		mirrored, _ := os.ReadFile(mirrorPath)
+		if !bytes.Equal(primary, mirrored) {
+			t.Fatalf("Mirror differs from primary (%d vs %d bytes)", len(mirrored), len(primary))
+		}
+	}
+	if st := db.MirrorStatus(); !st.Enabled || st.Lag != 0 || st.Failures != 0 {
+		t.Errorf("Unexpected status: %+v", st)
+	}
+	assertTwin()
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	assertTwin()
+	db.Close()
+
+	// A reopened database keeps appending to the existing mirror
+	db, err = OpenWithOptions(path, "pass", Options{MirrorPath: mirrorPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("col", "later", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	assertTwin()
+}
+
+func TestRecoverFromMirror(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "primary.nok")
+	mirrorPath := filepath.Join(dir, "mirror.nok")
+
+	db, err := OpenWithOptions(path, "pass", Options{MirrorPath: mirrorPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cut int64
+	for i := 0; i < 20; i++ {
+		if i == 15 {
+			cut = db.Offset() + 7 // Leave a torn record behind
+		}
+		if err := db.Put("col", fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// The primary loses its tail
+	if err := os.Truncate(path, cut); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path + ".hint")
+
+	// A mirror ahead of the primary is not overwritten on open
+	db, err = OpenWithOptions(path, "pass", Options{MirrorPath: mirrorPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := db.MirrorStatus(); !st.Diverged {
+		t.Errorf("Expected diverged mirror, got %+v", st)
+	}
+	db.Close()
+
+	if _, err := RecoverFromMirror(path, mirrorPath, "wrong"); err != ErrInvalidPassword {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	n, err := RecoverFromMirror(path, mirrorPath, "pass")
+	if err != nil || n == 0 {
+		t.Fatalf("RecoverFromMirror: %d, %v", n, err)
+	}
+
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		val, err := db.Get("col", fmt.Sprintf("k%02d", i))
+		if err != nil || string(val) != fmt.Sprintf("v%d", i) {
+			t.Errorf("k%02d after recovery: %q, %v", i, val, err)
+		}
+	}
+
+	// A mirror of another database is refused
+	other := filepath.Join(dir, "other.nok")
+	odb, err := Open(other, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	odb.Close()
+	if _, err := RecoverFromMirror(path, other, "pass"); err != ErrMirrorDiverged {
+		t.Errorf("Expected ErrMirrorDiverged, got %v", err)
+	}
+}
+
+func TestMirrorFailureDegrades(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "primary.nok")
+	unreachable := filepath.Join(dir, "missing", "mirror.nok")
+
+	if _, err := OpenWithOptions(path, "pass", Options{MirrorPath: unreachable, MirrorRequired: true}); err == nil {
+		t.Fatal("Expected open to fail with a required, unreachable mirror")
+	}
+	os.Remove(path)
+
+	db, err := OpenWithOptions(path, "pass", Options{MirrorPath: unreachable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("col", "key", []byte("value")); err != nil {
+		t.Fatalf("Optional mirror failure broke the write: %v", err)
+	}
+	st := db.MirrorStatus()
+	if st.Failures == 0 || st.LastError == "" || st.Lag == 0 {
+		t.Errorf("Expected failures and lag to be reported, got %+v", st)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package database
+
+import "os"
+
+// mapFile reads the size bytes of f into memory where mmap is not used.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,243 @@
+package database
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// DefaultAtomicMaxKeys caps the keys of one GetAtomic call unless
+// AtomicGetOptions.MaxKeys says otherwise.
+const DefaultAtomicMaxKeys = 10000
+
+// ErrMissingKeys lists the keys a GetAtomic call did not find.
+type ErrMissingKeys struct {
+	Keys []string
+}
+
+func (e *ErrMissingKeys) Error() string {
+	return "keys not found: " + strings.Join(e.Keys, ", ")
+}
+
+// ErrTooManyKeys reports a GetAtomic call over more keys than allowed.
+type ErrTooManyKeys struct {
+	Count int
+	Max   int
+}
+
+func (e *ErrTooManyKeys) Error() string {
+	return fmt.Sprintf("too many keys for an atomic read: %d (max %d)", e.Count, e.Max)
+}
+
+// AtomicGetOptions configures GetAtomicWithOptions.
+type AtomicGetOptions struct {
+	// AllowMissing leaves missing or expired keys out of the result instead
+	// of failing with ErrMissingKeys.
+	AllowMissing bool
+
+	// MaxKeys caps the keys of one call, as the read lock is held while all
+	// of them are read and decrypted. Zero means DefaultAtomicMaxKeys.
+	MaxKeys int
+}
+
+// GetMulti returns the values of keys in collection, in the order given. Keys
+// that are missing or expired yield a nil value. Values are decrypted
+// concurrently, bounded by Options.DecryptWorkers.
+func (db *DB) GetMulti(collection string, keys []string) ([][]byte, error) {
+	compKeys := make([]string, len(keys))
+	for i, k := range keys {
+		compKeys[i] = compositeKey(collection, k)
+	}
+
+	records, found, err := db.getRecords(compKeys, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(keys))
+	for i := range records {
+		if found[i] {
+			values[i] = records[i].Value
+		}
+	}
+	return values, nil
+}
+
+// GetAtomic returns the values of keys in collection as one consistent cut:
+// all of them are read and decrypted under a single hold of the read lock, so
+// no write or batch commits between the reads. If any key is missing or
+// expired it returns an *ErrMissingKeys naming them and no values. More than
+// DefaultAtomicMaxKeys keys fail with *ErrTooManyKeys.
+func (db *DB) GetAtomic(collection string, keys []string) (map[string][]byte, error) {
+	return db.GetAtomicWithOptions(collection, keys, AtomicGetOptions{})
+}
+
+// GetAtomicWithOptions is GetAtomic with options. Writers wait while the
+// read lock is held, and so do readers that arrive behind a waiting writer,
+// so a large key set stalls the database for as long as it takes to decrypt.
+func (db *DB) GetAtomicWithOptions(collection string, keys []string, opts AtomicGetOptions) (map[string][]byte, error) {
+	limit := opts.MaxKeys
+	if limit <= 0 {
+		limit = DefaultAtomicMaxKeys
+	}
+	if len(keys) > limit {
+		return nil, &ErrTooManyKeys{Count: len(keys), Max: limit}
+	}
+
+	compKeys := make([]string, len(keys))
+	for i, k := range keys {
+		compKeys[i] = compositeKey(collection, k)
+	}
+	// getRecords holds the read lock from the first read to the last decryption
+	records, found, err := db.getRecords(compKeys, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(keys))
+	var missing []string
+	for i, k := range keys {
+		if found[i] {
+			values[k] = records[i].Value
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 && !opts.AllowMissing {
+		return nil, &ErrMissingKeys{Keys: missing}
+	}
+	return values, nil
+}
+
+// HasMulti reports which of keys exist in collection, in one pass under the
+// read lock. Expiry is checked against the index, so no value is read or
+// decrypted. Duplicate keys share one map entry.
+func (db *DB) HasMulti(collection string, keys []string) (map[string]bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := db.now().UnixNano()
+	present := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		compKey := compositeKey(collection, k)
+		if !db.bloom.Contains(compKey) {
+			present[k] = false
+			continue
+		}
+		entry, ok, err := db.index.get(compKey)
+		if err != nil {
+			return nil, err
+		}
+		present[k] = ok && !entry.expired(now)
+	}
+	return present, nil
+}
+
+// getRecords is the batch form of getRecord. found[i] is false for keys that
+// are missing or expired. Records are read sequentially, then opened by a
+// bounded worker pool while the read lock is still held, so a concurrent
+// Compact cannot swap the DEKs underneath the workers. Every key is judged
+// expired or not by the read timestamp now, as in readRaw; zero takes it from
+// the clock once the lock is held, for callers doing no other reads.
+func (db *DB) getRecords(compKeys []string, now int64) ([]Record, []bool, error) {
+	records, found, _, err := db.getRecordsAt(compKeys, now)
+	return records, found, err
+}
+
+// getRecordsAt is getRecords that also returns the offset each record was
+// read from.
+func (db *DB) getRecordsAt(compKeys []string, now int64) ([]Record, []bool, []int64, error) {
+	records := make([]Record, len(compKeys))
+	found := make([]bool, len(compKeys))
+	reseal := make([]bool, len(compKeys))
+	offsets := make([]int64, len(compKeys))
+
+	db.mu.RLock()
+	if now == 0 {
+		now = db.now().UnixNano()
+	}
+
+	raw := make([]*record, len(compKeys))
+	for i, k := range compKeys {
+		rec, offset, err := db.readRaw(k, now)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			db.mu.RUnlock()
+			return nil, nil, nil, err
+		}
+		raw[i], offsets[i] = rec, offset
+	}
+
+	errs := make([]error, len(compKeys))
+	db.parallel(len(compKeys), func(i int) {
+		rec := raw[i]
+		if rec == nil {
+			return
+		}
+		value, err := db.openUserValue(rec, compKeys[i])
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		records[i] = Record{
+			Timestamp:  rec.Timestamp,
+			ExpiresAt:  rec.ExpiresAt,
+			Collection: string(rec.Collection),
+			Key:        string(rec.Key),
+			Value:      value,
+			Op:         rec.Op,
+		}
+		found[i] = true
+		reseal[i] = db.needsReseal(rec.Flags)
+	})
+
+	db.mu.RUnlock()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// Same lazy migration as getRecord
+	for i := range compKeys {
+		if reseal[i] {
+			_ = db.resealRecord(compKeys[i], offsets[i])
+		}
+	}
+	return records, found, offsets, nil
+}
+
+// parallel calls fn for every index in [0, n) on up to decryptWorkers
+// goroutines and waits for them to finish.
+func (db *DB) parallel(n int, fn func(i int)) {
+	workers := min(db.decryptWorkers(), n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				fn(i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func (db *DB) decryptWorkers() int {
+	if db.opts.DecryptWorkers > 0 {
+		return db.opts.DecryptWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// Counter nonces are a random per-database prefix followed by a big-endian
+// counter. Counters are handed out from blocks of nonceBlock values whose end
+// is persisted in the header before the first of them is used, so a crash
+// can only skip counters, never reuse them.
+const (
+	noncePrefixSize = nonceSize - 8
+	nonceBlock      = 1 << 16
+)
+
+// AAD prefix of the seal over the counter nonce field
+var nonceSealAAD = []byte("NOKHAL_NONCES")
+
+// encodeNonces returns the counter nonce extension field of the header.
+func (h *fileHeader) encodeNonces() []byte {
+	buf := make([]byte, extNonceSize)
+	copy(buf, h.NoncePrefix)
+	binary.BigEndian.PutUint64(buf[noncePrefixSize:], h.NonceLimit)
+	return buf
+}
+
+// encodeNonceSpan returns the header from the counter nonce field through
+// its seal. The fields in between are rewritten unchanged, so the field and
+// its seal, all within the first sector, are replaced together or not at all.
+func (h *fileHeader) encodeNonceSpan() []byte {
+	return h.encode()[extNonceOffset : extNonceSealOffset+extNonceSealSize]
+}
+
+// sealNonces authenticates the counter nonce field under the DEK aead.
+func (h *fileHeader) sealNonces(aead cipher.AEAD) error {
+	if h.NonceLimit == 0 {
+		h.NonceSeal = nil
+		return nil
+	}
+	nonce, err := generateNonce()
+	if err != nil {
+		return err
+	}
+	aad := append(append([]byte(nil), nonceSealAAD...), h.encodeNonces()...)
+	h.NonceSeal = aead.Seal(nonce, nonce, nil, aad)
+	return nil
+}
+
+// checkNonces fails with ErrDecryption unless the counter nonce field is
+// sealed under the DEK aead. A field and seal both zero, as in a file that
+// never used a counter nonce, pass: Open then draws a new random prefix, so
+// zeroing them cannot bring back used nonces either.
+func (h *fileHeader) checkNonces(aead cipher.AEAD) error {
+	if h.NonceLimit == 0 && h.NonceSeal == nil {
+		return nil
+	}
+	if len(h.NonceSeal) != extNonceSealSize {
+		return ErrDecryption
+	}
+	aad := append(append([]byte(nil), nonceSealAAD...), h.encodeNonces()...)
+	if _, err := aead.Open(nil, h.NonceSeal[:authNonceSize], h.NonceSeal[authNonceSize:], aad); err != nil {
+		return ErrDecryption
+	}
+	return nil
+}
+
+// newNonce returns the nonce for the next sealed record: random, or the next
+// counter nonce with Options.CounterNonces. Callers must hold db.mu.
+func (db *DB) newNonce() ([]byte, error) {
+	if !db.opts.CounterNonces {
+		return generateNonce()
+	}
+	if db.nonceNext >= db.header.NonceLimit {
+		if err := db.reserveNonces(); err != nil {
+			return nil, err
+		}
+	}
+	nonce := make([]byte, nonceSize)
+	copy(nonce, db.header.NoncePrefix)
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], db.nonceNext)
+	db.nonceNext++
+	return nonce, nil
+}
+
+// reserveNonces persists the end of the next block of counters, choosing the
+// database's prefix first if it has none yet. Callers must hold db.mu.
+func (db *DB) reserveNonces() error {
+	header := *db.header
+	if header.NoncePrefix == nil {
+		header.NoncePrefix = make([]byte, noncePrefixSize)
+		if _, err := io.ReadFull(rand.Reader, header.NoncePrefix); err != nil {
+			return err
+		}
+	}
+	header.NonceLimit = db.nonceNext + nonceBlock
+	if err := header.sealNonces(db.aead); err != nil {
+		return err
+	}
+	if err := db.writeHeaderAt(header.encodeNonceSpan(), extNonceOffset); err != nil {
+		return err
+	}
+	db.header.NoncePrefix, db.header.NonceLimit, db.header.NonceSeal = header.NoncePrefix, header.NonceLimit, header.NonceSeal
+	return nil
+}
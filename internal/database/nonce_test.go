@@ -0,0 +1,170 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCounterNonces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	opts := Options{CounterNonces: true}
+
+	// Every sealed record in the log must carry the same prefix and a
+	// counter above all the ones before it
+	var prefix []byte
+	var last uint64
+	var seen int
+	check := func(db *DB) {
+		t.Helper()
+		offsets, _ := walkLog(db.file, int64(headerSize))
+		prefix, last, seen = nil, 0, 0
+		for _, offset := range offsets {
+			rec, _, err := db.readRecord(offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Flags&FlagPlaintext != 0 || bytes.Equal(rec.Nonce, make([]byte, nonceSize)) {
+				continue
+			}
+			if prefix == nil {
+				prefix = rec.Nonce[:noncePrefixSize]
+			} else if !bytes.Equal(rec.Nonce[:noncePrefixSize], prefix) {
+				t.Fatalf("record at %d has prefix %x, want %x", offset, rec.Nonce[:noncePrefixSize], prefix)
+			}
+			counter := binary.BigEndian.Uint64(rec.Nonce[noncePrefixSize:])
+			if seen > 0 && counter <= last {
+				t.Fatalf("record at %d has counter %d after %d", offset, counter, last)
+			}
+			last = counter
+			seen++
+		}
+		if db.header.NonceLimit <= last {
+			t.Fatalf("reserved limit %d does not cover counter %d", db.header.NonceLimit, last)
+		}
+	}
+	write := func(db *DB, round int) {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			if err := db.Put("col", fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Delete("col", "k0"); err != nil {
+			t.Fatal(err)
+		}
+		batch := db.NewBatch()
+		batch.Put("col", "b", []byte("batched"), 0)
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(db, 1)
+	check(db)
+	if seen != 52 {
+		t.Fatalf("%d sealed records, want 52", seen)
+	}
+	firstPrefix, before := prefix, last
+	db.Close()
+
+	// Counters resume past everything reserved before the reopen
+	db, err = OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(db, 2)
+	check(db)
+	if !bytes.Equal(prefix, firstPrefix) || last <= before+nonceBlock-52 {
+		t.Fatalf("after reopen: prefix %x (was %x), last counter %d (was %d)", prefix, firstPrefix, last, before)
+	}
+
+	// Rekeyed records take counters too, and the compacted header keeps
+	// the limit reserved for them
+	if err := db.BeginKeyRotation(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	before = last
+	db.Close()
+
+	db, err = OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	write(db, 3)
+	check(db)
+	if last <= before {
+		t.Fatalf("counter %d after compaction and reopen, was %d", last, before)
+	}
+	if v, err := db.Get("col", "k1"); err != nil || string(v) != "v3" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+}
+
+func TestCounterNonceLimitSealed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	opts := Options{CounterNonces: true}
+	db, err := OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "key", []byte("value"))
+	prefix := db.header.NoncePrefix
+	db.Close()
+
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limitAt := extNonceOffset + noncePrefixSize
+	tamper := func(name string, mutate func(header []byte)) {
+		data := bytes.Clone(original)
+		mutate(data[:headerSize])
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := OpenWithOptions(path, "pass", opts)
+		if err == nil {
+			db.Close()
+		}
+		if err != ErrDecryption {
+			t.Errorf("%s: Open = %v, want ErrDecryption", name, err)
+		}
+	}
+	tamper("lowered limit", func(h []byte) { binary.BigEndian.PutUint64(h[limitAt:], 1) })
+	tamper("zeroed limit", func(h []byte) { binary.BigEndian.PutUint64(h[limitAt:], 0) })
+	tamper("changed prefix", func(h []byte) { h[extNonceOffset] ^= 1 })
+	tamper("zeroed seal", func(h []byte) { clear(h[extNonceSealOffset : extNonceSealOffset+extNonceSealSize]) })
+
+	// With the field and its seal both cleared, counters start over under a
+	// new prefix
+	data := bytes.Clone(original)
+	clear(data[extNonceOffset : extNonceOffset+extNonceSize])
+	clear(data[extNonceSealOffset : extNonceSealOffset+extNonceSealSize])
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(path, "pass", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("col", "key", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(db.header.NoncePrefix, prefix) {
+		t.Errorf("prefix %x reused after the field was cleared", prefix)
+	}
+}
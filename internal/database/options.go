@@ -0,0 +1,303 @@
+package database
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Values at or below this size are stored uncompressed by default
+const defaultCompressionThreshold = 128
+
+// ErrImmutableOptions is returned by UpdateOptions when fn changed options
+// that only take effect at Open. Fields names them.
+type ErrImmutableOptions struct {
+	Fields []string
+}
+
+func (e *ErrImmutableOptions) Error() string {
+	return "options cannot be changed while open: " + strings.Join(e.Fields, ", ")
+}
+
+// Options configures how a database is opened. The zero value gives the
+// same behavior as Open. Fields not marked otherwise can be changed on an
+// open database with UpdateOptions.
+type Options struct {
+	// LeaseTimeout enables single-writer enforcement through an ownership
+	// lease stored in the file header. A writer refreshes its lease every
+	// LeaseTimeout/3; a lease older than LeaseTimeout may be taken over.
+	// A writer whose last refresh is older than three quarters of
+	// LeaseTimeout fails writes with ErrLeaseLost until a refresh succeeds.
+	// Open waits LeaseTimeout/3 after stamping the lease before it checks
+	// that no other writer stamped it too. Where the platform has file locks
+	// (flock on Unix, LockFileEx on Windows), writers on one machine also
+	// take the lease one at a time. Zero disables leasing. UpdateOptions can
+	// change the timeout but cannot turn leasing on or off.
+	LeaseTimeout time.Duration
+
+	// ForceReinit turns a file whose header is truncated (non-empty but
+	// shorter than a full header) into a fresh empty database instead of
+	// failing with ErrInvalidFile. Whatever the file contained is discarded.
+	// Only used by Open.
+	ForceReinit bool
+
+	// InfoSampleSize is the number of keys sampled by CollectionInfo.
+	// Zero uses 10; a negative value disables sampling.
+	InfoSampleSize int
+
+	// DecryptWorkers bounds the goroutines used to decrypt the records
+	// fetched by GetMulti, Page and Iterator.NextN. Zero uses GOMAXPROCS;
+	// one decrypts on the calling goroutine.
+	DecryptWorkers int
+
+	// IndexLoadWorkers scans the log with up to this many goroutines when
+	// Open or Reindex builds the index from it, each taking a range of at
+	// least 4 MiB, which loads a large file on an SSD faster given idle cores.
+	// The index is the same as a sequential scan builds. Zero or one scans
+	// sequentially, as LowMemory always does.
+	IndexLoadWorkers int
+
+	// MmapHint writes the hint as a sorted array that Open maps into memory
+	// and searches in place, instead of decoding the whole index into a map,
+	// which makes opening a database of millions of keys near-instant. Point
+	// lookups cost a keyed hash and a binary search instead of a map lookup,
+	// and keys written after Open are indexed in memory until the next
+	// Compact or Reindex. The file is mapped on Linux, macOS and FreeBSD and
+	// read elsewhere. Key names and a digest of the array are sealed as in
+	// the default hint, but the array is not: it names no key, yet shows the
+	// number of records and the layout of the log. Open reads either format
+	// whatever the setting; the next hint save writes the one it asks for.
+	MmapHint bool
+
+	// MirrorPath enables write-through mirroring: every committed record is
+	// also written to this file, which stays a byte-for-byte twin of the
+	// database (same DEK). Put it on a different disk. Only used by Open.
+	MirrorPath string
+
+	// MirrorRequired fails writes whose mirror copy fails. By default mirror
+	// failures are logged and counted in MirrorStatus, and the mirror is
+	// caught up on the next successful write.
+	MirrorRequired bool
+
+	// HintFlushInterval is the minimum time between hint files written by
+	// FlushHint. Zero uses one second.
+	HintFlushInterval time.Duration
+
+	// ContentChecksums stores a CRC32 of each new value inside its encrypted
+	// payload and checks it after decryption and decompression, so a value
+	// mangled by the codec pipeline fails with ErrContentChecksum instead of
+	// being returned. Costs four bytes and one CRC per value. Records written
+	// with a checksum are always verified, whatever this option says.
+	ContentChecksums bool
+
+	// CompressionThreshold is the value size above which values are
+	// compressed. Zero uses 128 bytes; a negative value disables compression.
+	CompressionThreshold int
+
+	// SyncWrites fsyncs the file after every Put and Delete. Batches are
+	// always synced.
+	SyncWrites bool
+
+	// PreallocateBytes grows the file in chunks of this size, with fallocate
+	// on Linux, instead of by every append, which keeps it from fragmenting.
+	// The zero-filled space past the end of the log is ignored on open, a
+	// record torn inside it is dropped like any torn tail, and Close and
+	// Compact give it back. Zero grows the file with each write.
+	PreallocateBytes int64
+
+	// TempDir is where Compact writes its output, for when the database's
+	// volume is nearly full or slow. The finished file is then moved next to
+	// the database, by a copy when TempDir is on another filesystem, so that
+	// volume still needs room for it. Empty writes next to the database.
+	TempDir string
+
+	// MinFreeBytes makes writes that would grow the file past the point
+	// where fewer than this many bytes stay free on its volume fail with
+	// ErrDiskFull, before anything is written, so an application on a
+	// small device can back off before the disk fills. With PreallocateBytes
+	// only the writes that extend the file are checked, against the size of
+	// the new chunk. Compact checks that the compacted log fits on the volume
+	// it writes to, and on the database's own when TempDir is elsewhere.
+	// Free space is measured with statfs on Linux, macOS and FreeBSD;
+	// elsewhere setting it fails Open and UpdateOptions. Zero disables the
+	// check.
+	MinFreeBytes int64
+
+	// Paranoid verifies the engine's invariants as it goes, for tests and
+	// staging: every write is read back and CRC-checked, every index update
+	// must point at a record of its key, and Open cross-checks the log end
+	// against a walk of the file. A violation panics with the offsets and
+	// keys involved. Builds with the nokhaldebug tag enable it everywhere.
+	Paranoid bool
+
+	// CounterNonces seals new records with a nonce made of a random
+	// per-database prefix and a counter persisted in the header, instead of
+	// a random one, so nonces never repeat under a DEK however many records
+	// are written, including those re-sealed by a key rotation. Counters are
+	// reserved in blocks whose end is synced to a header field, sealed under
+	// the DEK, before use, so a crash skips counters but never reuses them;
+	// Open fails with ErrDecryption if the field was altered. Copies of the
+	// file written to independently, such as a restored backup next to the
+	// original, share the counter, so write to only one of them. Records
+	// keep their nonce either way, so the option can be changed at any time.
+	CounterNonces bool
+
+	// FailWhenFrozen makes writes to a database held by Freeze fail with
+	// ErrFrozen instead of waiting for it to be unfrozen.
+	FailWhenFrozen bool
+
+	// CompressionDict presets the compressor with bytes typical of the
+	// values, such as a sample JSON document, which helps most with many
+	// small, similar values; tune CompressionThreshold to their size. The
+	// file must declare FeatureCompressionDict. The dictionary is stored
+	// encrypted in the database the first time a value may use it and is
+	// never removed. Values compressed with it are flagged FlagDict and carry
+	// its CRC32, so changing it leaves earlier values readable; a value whose
+	// dictionary is missing fails with ErrUnknownDict. Settings are never
+	// compressed with one.
+	CompressionDict []byte
+
+	// LowMemory keeps the key index in a temporary sorted file next to the
+	// database instead of in memory, for devices where the index of a large
+	// file does not fit. Lookups cost a file read, the hint file is neither
+	// read nor written, and Open always scans the whole log. Keys written
+	// after Open are indexed in memory until the next Compact or Reindex.
+	// Only used by Open.
+	LowMemory bool
+
+	// LazyExpireDelete makes Get tombstone an expired key it finds, which
+	// drops it from the index and, at the next Compact, from the file,
+	// spreading the cleanup over reads instead of leaving it all to Compact.
+	// Such a Get takes the write lock after its read.
+	LazyExpireDelete bool
+
+	// TombstoneTTL keeps the tombstone of a deleted key through Compact
+	// until it is that old by its timestamp, for replication, where a
+	// delete must reach every replica before it is forgotten and an older
+	// put arriving late must find it. Kept tombstones count as dead bytes in
+	// Stats and CompactionAdvice, and a subscription replaying the compacted
+	// log sees them as deletes. Zero drops every tombstone at the next
+	// Compact.
+	TombstoneTTL time.Duration
+
+	// IndexWalkChunk is how many index entries List, AllKeys, Stats,
+	// CollectionInfo, CollectionInfos and ExpiringBefore visit per hold of
+	// the read lock on a large index, so a writer waiting for the lock is
+	// not held up by the whole walk. Keys written or deleted while the lock
+	// is released may be missed or not. Zero means 10000; a negative value
+	// walks the index in one hold.
+	IndexWalkChunk int
+
+	// MaxSnapshots bounds the snapshots and iterators open at once, which
+	// hold memory and, for snapshots, keep Compact from running. Snapshot
+	// fails with ErrTooManySnapshots past it, and so do NewIterator and
+	// NewLiveIterator through the iterator's error. Zero means no limit.
+	MaxSnapshots int
+
+	// MaxBatchMemory bounds the bytes of collections, keys and values held
+	// by all the batches of the database not yet committed, so that many
+	// goroutines building large batches at once cannot exhaust memory. An
+	// operation that would pass it is dropped and fails its batch with
+	// ErrBatchMemory; see Batch.Err. Stats().BatchMemory reports the bytes
+	// held. Zero means no limit.
+	MaxBatchMemory int64
+
+	// KDF sets the Argon2id parameters a new file derives its key with, for
+	// devices where the default 64 MiB is too much; zero fields keep the
+	// defaults of DefaultKDF. The parameters are stored in the header, so an
+	// existing file is opened with its own and KDF is ignored; OpenReport.KDF
+	// reports them. A file created with other than DefaultKDF declares
+	// FeatureKDFParams. Invalid parameters, such as less than 8 KiB of
+	// memory per thread, fail with ErrInvalidKDF. Only used by Open.
+	KDF KDFParams
+
+	// Logger receives warnings about degraded operation. Nil discards them.
+	Logger *slog.Logger
+
+	// Now is the clock that expiry is judged and records are stamped by,
+	// so tests can move time instead of sleeping; see package nokhaltest.
+	// Nil uses time.Now. Durations, the lease and health checks always use
+	// the real clock.
+	Now func() time.Time
+}
+
+func (o Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return slog.New(slog.DiscardHandler)
+}
+
+func (db *DB) logger() *slog.Logger {
+	return db.opts.logger()
+}
+
+// now returns the current time by the Now option. db.mu must be held.
+func (db *DB) now() time.Time {
+	if db.opts.Now != nil {
+		return db.opts.Now()
+	}
+	return time.Now()
+}
+
+func (db *DB) compressionThreshold() int {
+	if db.opts.CompressionThreshold != 0 {
+		return db.opts.CompressionThreshold
+	}
+	return defaultCompressionThreshold
+}
+
+// UpdateOptions changes options of an open database. fn receives a copy of
+// the effective options; its changes are applied atomically with respect to
+// reads and writes, or not at all if it touched an option that only takes
+// effect at Open, in which case *ErrImmutableOptions lists them. A pending
+// deferred hint flush and the lease refresh are rescheduled for the new
+// intervals.
+func (db *DB) UpdateOptions(fn func(*Options)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	next := db.opts
+	fn(&next)
+
+	var immutable []string
+	if next.ForceReinit != db.opts.ForceReinit {
+		immutable = append(immutable, "ForceReinit")
+	}
+	if (next.LeaseTimeout > 0) != (db.opts.LeaseTimeout > 0) {
+		immutable = append(immutable, "LeaseTimeout")
+	}
+	if next.LowMemory != db.opts.LowMemory {
+		immutable = append(immutable, "LowMemory")
+	}
+	if next.KDF != db.opts.KDF {
+		immutable = append(immutable, "KDF")
+	}
+	if next.MirrorPath != db.opts.MirrorPath {
+		immutable = append(immutable, "MirrorPath")
+	}
+	if len(immutable) > 0 {
+		return &ErrImmutableOptions{Fields: immutable}
+	}
+	if err := checkFeatures(db.header.Features, next); err != nil {
+		return err
+	}
+	if err := checkDiskFreeOption(db.path, next); err != nil {
+		return err
+	}
+
+	prev := db.opts
+	db.opts = next
+	db.batchLimit.Store(next.MaxBatchMemory)
+
+	if next.HintFlushInterval != prev.HintFlushInterval && db.hintTimer != nil {
+		db.hintTimer.Stop()
+		wait := max(db.hintFlushInterval()-time.Since(db.lastHintFlush), 0)
+		db.hintTimer = time.AfterFunc(wait, db.deferredHintFlush)
+		db.health.hintDue.Store(time.Now().Add(wait).UnixNano())
+	}
+	if next.LeaseTimeout != prev.LeaseTimeout && db.lease != nil {
+		db.lease.resetInterval(next.LeaseTimeout / 3)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateOptions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{
+		MirrorPath:        filepath.Join(dir, "mirror.nok"),
+		HintFlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	flagsOf := func(key string) byte {
+		t.Helper()
+		rec, _, err := db.readRecord(indexed(t, db, "col:"+key).Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Flags
+	}
+	update := func(fn func(*Options)) {
+		t.Helper()
+		if err := db.UpdateOptions(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := bytes.Repeat([]byte("x"), 200)
+
+	t.Run("CompressionThreshold", func(t *testing.T) {
+		db.Put("col", "default", value)
+		update(func(o *Options) { o.CompressionThreshold = 1000 })
+		db.Put("col", "raised", value)
+		update(func(o *Options) { o.CompressionThreshold = -1 })
+		db.Put("col", "disabled", bytes.Repeat([]byte("x"), 5000))
+		update(func(o *Options) { o.CompressionThreshold = 0 })
+
+		if flagsOf("default")&FlagCompressed == 0 {
+			t.Error("Expected compression at the default threshold")
+		}
+		if flagsOf("raised")&FlagCompressed != 0 || flagsOf("disabled")&FlagCompressed != 0 {
+			t.Error("Expected no compression after raising or disabling the threshold")
+		}
+	})
+
+	t.Run("ContentChecksums", func(t *testing.T) {
+		update(func(o *Options) { o.ContentChecksums = true })
+		db.Put("col", "summed", []byte("v"))
+		update(func(o *Options) { o.ContentChecksums = false })
+		db.Put("col", "unsummed", []byte("v"))
+		if flagsOf("summed")&FlagChecksum == 0 || flagsOf("unsummed")&FlagChecksum != 0 {
+			t.Error("ContentChecksums did not follow the update")
+		}
+	})
+
+	t.Run("SyncWrites", func(t *testing.T) {
+		update(func(o *Options) { o.SyncWrites = true })
+		if err := db.Put("col", "synced", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		stats, _ := db.Stats()
+		if !stats.Options.SyncWrites {
+			t.Error("Stats does not report the effective SyncWrites")
+		}
+	})
+
+	t.Run("DecryptWorkersAndSampleSize", func(t *testing.T) {
+		update(func(o *Options) {
+			o.DecryptWorkers = 3
+			o.InfoSampleSize = 2
+		})
+		if db.decryptWorkers() != 3 {
+			t.Errorf("decryptWorkers = %d, want 3", db.decryptWorkers())
+		}
+		info, _ := db.CollectionInfo("col")
+		if len(info.SampleKeys) != 2 {
+			t.Errorf("Sampled %d keys, want 2", len(info.SampleKeys))
+		}
+	})
+
+	t.Run("MirrorRequiredAndLogger", func(t *testing.T) {
+		db.mirror.file.Close() // The mirror disk fails
+		var logs bytes.Buffer
+		update(func(o *Options) { o.Logger = slog.New(slog.NewTextHandler(&logs, nil)) })
+		if err := db.Put("col", "optional", []byte("v")); err != nil {
+			t.Fatalf("Optional mirror failed the write: %v", err)
+		}
+		if !strings.Contains(logs.String(), "mirror") {
+			t.Errorf("New logger did not receive the mirror warning: %q", logs.String())
+		}
+		update(func(o *Options) { o.MirrorRequired = true })
+		if err := db.Put("col", "required", []byte("v")); err == nil {
+			t.Error("Expected the write to fail once the mirror is required")
+		}
+		update(func(o *Options) { o.MirrorRequired = false })
+	})
+
+	t.Run("HintFlushInterval", func(t *testing.T) {
+		hintPath := path + ".hint"
+		db.FlushHint() // First flush is immediate
+		os.Remove(hintPath)
+		db.FlushHint() // Deferred by an hour
+		if exists(hintPath) {
+			t.Fatal("Expected the flush to be deferred")
+		}
+		update(func(o *Options) { o.HintFlushInterval = time.Millisecond })
+		deadline := time.Now().Add(2 * time.Second)
+		for !exists(hintPath) && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !exists(hintPath) {
+			t.Error("Pending flush was not rescheduled for the shorter interval")
+		}
+	})
+
+	t.Run("Immutable", func(t *testing.T) {
+		before, _ := db.Stats()
+		err := db.UpdateOptions(func(o *Options) {
+			o.MirrorPath = ""
+			o.ForceReinit = true
+			o.LeaseTimeout = time.Minute
+			o.InfoSampleSize = 7
+		})
+		var immutable *ErrImmutableOptions
+		if !errors.As(err, &immutable) {
+			t.Fatalf("Expected *ErrImmutableOptions, got %v", err)
+		}
+		if want := []string{"ForceReinit", "LeaseTimeout", "MirrorPath"}; !reflect.DeepEqual(immutable.Fields, want) {
+			t.Errorf("Fields = %v, want %v", immutable.Fields, want)
+		}
+		after, _ := db.Stats()
+		if after.Options.InfoSampleSize != before.Options.InfoSampleSize {
+			t.Error("A rejected update must not apply its mutable changes")
+		}
+	})
+}
+
+func TestUpdateLeaseTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{LeaseTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stamp := func() int64 {
+		l, err := db.readLease()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Timestamp
+	}
+	first := stamp()
+
+	if err := db.UpdateOptions(func(o *Options) { o.LeaseTimeout = 30 * time.Millisecond }); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for stamp() == first && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stamp() == first {
+		t.Error("Lease refresh was not rescheduled for the shorter timeout")
+	}
+}
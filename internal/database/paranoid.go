@@ -0,0 +1,87 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// paranoidAll turns on the invariant checks of Options.Paranoid for every
+// database. It is set by the nokhaldebug build tag, and by the tests when
+// NOKHAL_PARANOID is set.
+var paranoidAll = debugBuild
+
+// paranoid reports whether the invariant checks are enabled.
+func (db *DB) paranoid() bool {
+	return paranoidAll || db.opts.Paranoid
+}
+
+// violation panics with a description of a broken invariant of the
+// database at path.
+func violation(path, format string, args ...any) {
+	panic(fmt.Sprintf("nokhal: invariant violated in %s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+// checkWritten re-reads data, just written at offset, and verifies that it
+// holds exactly the bytes written as a chain of records with valid CRCs.
+// Callers must hold db.mu.
+func (db *DB) checkWritten(offset int64, data []byte) {
+	if !db.paranoid() {
+		return
+	}
+	buf := make([]byte, len(data))
+	if _, err := db.file.ReadAt(buf, offset); err != nil {
+		violation(db.path, "re-reading %d bytes written at offset %d: %v", len(data), offset, err)
+	}
+	if !bytes.Equal(buf, data) {
+		violation(db.path, "%d bytes written at offset %d read back differently", len(data), offset)
+	}
+	end := offset + int64(len(data))
+	for at := offset; at < end; {
+		_, size, err := db.readRecord(at)
+		if err != nil {
+			violation(db.path, "record at offset %d of the write at %d-%d: %v", at, offset, end, err)
+		}
+		at += size
+		if at > end {
+			violation(db.path, "record ending at %d overruns the write at %d-%d", at, offset, end)
+		}
+	}
+}
+
+// checkIndexEntry verifies that the record an index update points to has
+// the indexed key and size. Callers must hold db.mu.
+func (db *DB) checkIndexEntry(compKey string, offset, size int64) {
+	if !db.paranoid() {
+		return
+	}
+	rec, actual, err := db.readRecord(offset)
+	if err != nil {
+		violation(db.path, "index entry %q points at offset %d: %v", compKey, offset, err)
+	}
+	if key := compositeKey(string(rec.Collection), string(rec.Key)); key != compKey {
+		violation(db.path, "index entry %q points at offset %d, which holds %q", compKey, offset, key)
+	}
+	if actual != size {
+		violation(db.path, "index entry %q at offset %d has size %d, the record %d", compKey, offset, size, actual)
+	}
+}
+
+// checkLogEnd cross-checks the log end found by loading the index against
+// an independent walk of the file: the records must chain from the header
+// to db.offset, and the rest of the file must be the reported torn tail
+// followed by nothing but zero-filled preallocation. Callers must hold db.mu.
+func (db *DB) checkLogEnd(scan indexScan) {
+	if !db.paranoid() {
+		return
+	}
+	if _, end := walkLog(db.file, int64(headerSize)); end != db.offset {
+		violation(db.path, "index loaded up to offset %d, but the records chain up to %d (hint used: %v)", db.offset, end, scan.hinted)
+	}
+	fi, err := db.file.Stat()
+	if err != nil {
+		violation(db.path, "stat: %v", err)
+	}
+	if rest := db.offset + scan.tail; rest != fi.Size() && !zeroFrom(db.file, rest, fi.Size()) {
+		violation(db.path, "log ends at %d with a %d byte torn tail, but the file has %d bytes", db.offset, scan.tail, fi.Size())
+	}
+}
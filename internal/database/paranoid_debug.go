@@ -0,0 +1,7 @@
+//go:build nokhaldebug
+
+package database
+
+// Builds with the nokhaldebug tag check invariants in every database, as if
+// Options.Paranoid were set.
+const debugBuild = true
@@ -0,0 +1,5 @@
+//go:build !nokhaldebug
+
+package database
+
+const debugBuild = false
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParanoidViolations(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Paranoid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("col", "a", []byte("1"))
+	db.Put("col", "b", []byte("2"))
+	a := indexed(t, db, "col:a")
+
+	expectPanic := func(name string, want []string, fn func()) {
+		t.Helper()
+		defer func() {
+			t.Helper()
+			msg, _ := recover().(string)
+			for _, w := range want {
+				if !strings.Contains(msg, w) {
+					t.Errorf("%s: panic %q lacks %q", name, msg, w)
+				}
+			}
+		}()
+		fn()
+	}
+
+	expectPanic("index entry", []string{`"col:b"`, `"col:a"`, "offset"}, func() {
+		db.applyRecord("col:b", OpPut, a.Offset, a.Size, a.Timestamp, 0)
+	})
+	expectPanic("log end", []string{"index loaded up to offset", "records chain up to"}, func() {
+		db.offset -= a.Size
+		defer func() { db.offset += a.Size }()
+		db.checkLogEnd(indexScan{})
+	})
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"bytes"
+	"io"
+)
+
+// ensureAllocated makes room for a write ending at end. With
+// Options.PreallocateBytes set, the file is extended in chunks of that size
+// instead of by every append; the zero-filled space past db.offset is not
+// part of the log. Growth that would leave less than Options.MinFreeBytes
+// free fails with ErrDiskFull. Callers must hold db.mu.
+func (db *DB) ensureAllocated(end int64) error {
+	if end <= db.allocated {
+		return nil
+	}
+	chunk := db.opts.PreallocateBytes
+	size := end
+	if chunk > 0 {
+		size = (end/chunk + 1) * chunk
+	}
+	if err := db.checkDiskFree(db.path, size-db.allocated); err != nil {
+		return err
+	}
+	db.extensions++
+	if chunk <= 0 {
+		// The write itself extends the file
+		db.allocated = end
+		return nil
+	}
+	if err := preallocate(db.file, db.allocated, size-db.allocated); err != nil {
+		return err
+	}
+	db.allocated = size
+	return nil
+}
+
+// trimAllocation gives back preallocated space past the end of the log.
+// Callers must hold db.mu.
+func (db *DB) trimAllocation() error {
+	if db.allocated <= db.offset {
+		return nil
+	}
+	if err := db.file.Truncate(db.offset); err != nil {
+		return err
+	}
+	db.allocated = db.offset
+	return nil
+}
+
+// preallocatedEnd reports whether the log ends at offset because the bytes
+// there are zero-filled preallocation rather than a record. A record torn by
+// a crash inside preallocated space is followed by zeros too: in that case
+// torn is its size. Records never start with a zero header, as their CRC and
+// timestamp are never both zero.
+func preallocatedEnd(r io.ReaderAt, offset, fileSize int64) (end bool, torn int64) {
+	if zeroFrom(r, offset, min(offset+recordHeaderSize, fileSize)) {
+		return true, 0
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return false, 0
+	}
+
+	_, _, _, collSize, keySize, valSize := decodeRecordHeader(header)
+	size := int64(recordHeaderSize + opSize + collSize + keySize + nonceSize + valSize)
+	if offset+size >= fileSize || !zeroFrom(r, offset+size, fileSize) {
+		return false, 0
+	}
+	return true, size
+}
+
+// zeroFrom reports whether every byte of r between from and to is zero.
+func zeroFrom(r io.ReaderAt, from, to int64) bool {
+	buf := make([]byte, 64*1024)
+	for from < to {
+		n, err := r.ReadAt(buf[:min(int64(len(buf)), to-from)], from)
+		if !allZero(buf[:n]) {
+			return false
+		}
+		if err != nil {
+			return err == io.EOF
+		}
+		from += int64(n)
+	}
+	return true
+}
+
+func allZero(b []byte) bool {
+	return len(bytes.Trim(b, "\x00")) == 0
+}
+
+// preallocateTruncate extends f to off+n bytes by truncation, which reserves
+// no blocks but still spares the metadata update of every append.
+func preallocateTruncate(f storageFile, off, n int64) error {
+	return f.Truncate(off + n)
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package database
+
+import (
+	"errors"
+	"syscall"
+)
+
+// preallocate reserves n bytes at off with fallocate, so the filesystem can
+// hand out one contiguous extent. Filesystems without fallocate support fall
+// back to truncation.
+func preallocate(f storageFile, off, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, off, n)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return preallocateTruncate(f, off, n)
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package database
+
+// preallocate extends f to off+n bytes. Without fallocate the blocks are not
+// reserved, but the file no longer grows with every append.
+func preallocate(f storageFile, off, n int64) error {
+	return preallocateTruncate(f, off, n)
+}
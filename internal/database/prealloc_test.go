@@ -0,0 +1,84 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	const chunk = 64 * 1024
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+	db, err := OpenWithOptions(path, "pass", Options{PreallocateBytes: chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := db.Put("col", fmt.Sprintf("key-%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.extensions > 2 {
+		t.Errorf("200 puts grew the file %d times", db.extensions)
+	}
+	size, _ := db.FileSize()
+	if size%chunk != 0 || size <= db.Offset() {
+		t.Errorf("FileSize = %d with log end %d, want whole chunks past it", size, db.Offset())
+	}
+
+	// A crash leaves the preallocated zeros behind, here after a record
+	// whose write was torn halfway
+	tornAt := db.Offset()
+	db.Put("col", "torn", []byte("value"))
+	tornSize := db.Offset() - tornAt
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clear(image[tornAt+tornSize/2 : tornAt+tornSize])
+	crashed := filepath.Join(dir, "crashed.nok")
+	if err := os.WriteFile(crashed, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != tornAt+tornSize {
+		t.Errorf("Close left %d bytes, want the log end %d", fi.Size(), tornAt+tornSize)
+	}
+
+	db, report, err := OpenWithReport(crashed, "pass", Options{PreallocateBytes: chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if report.TruncatedTail != tornSize {
+		t.Errorf("TruncatedTail = %d, want the torn record's %d bytes", report.TruncatedTail, tornSize)
+	}
+	if db.Offset() != tornAt {
+		t.Errorf("Log end = %d, want %d", db.Offset(), tornAt)
+	}
+	if v, err := db.Get("col", "key-199"); err != nil || string(v) != "value" {
+		t.Errorf("Get key-199 = %q, %v", v, err)
+	}
+	if _, err := db.Get("col", "torn"); err != ErrNotFound {
+		t.Errorf("Torn record readable: %v", err)
+	}
+
+	// Writes continue over the torn record and Compact right-sizes the file
+	if err := db.Put("col", "after", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := db.FileSize(); size != db.Offset() {
+		t.Errorf("Compacted file is %d bytes, log end %d", size, db.Offset())
+	}
+	if v, err := db.Get("col", "after"); err != nil || string(v) != "value" {
+		t.Errorf("Get after = %q, %v", v, err)
+	}
+}
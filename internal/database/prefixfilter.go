@@ -0,0 +1,43 @@
+package database
+
+import "strings"
+
+// prefixBloomLen is how many leading key bytes the prefix filter holds.
+const prefixBloomLen = 4
+
+// addPrefixes adds the collection of compKey, and compKey cut after each of
+// the first prefixBloomLen bytes of its key, to the prefix filter bf.
+//
+// Every prefix of a stored combined key that reaches past the colon is then
+// in the filter once cut to at most prefixBloomLen key bytes, which is what
+// mayMatchPrefix probes. Like the key filter, it keeps the bits of deleted
+// keys until it is rebuilt.
+func addPrefixes(bf *BloomFilter, compKey string) {
+	collection, key := SplitKey(compKey)
+	bf.Add(collection)
+	for n := 1; n <= min(len(key), prefixBloomLen); n++ {
+		bf.Add(compKey[:len(collection)+1+n])
+	}
+}
+
+// mayMatchPrefix reports whether a combined key starting with prefix may
+// have been written, counting the checks for Stats. A false positive costs
+// the scan it would have cost anyway; false is only returned for prefixes
+// no key ever had. Prefixes that end inside a collection name cannot be
+// checked. Callers must hold db.mu.
+func (db *DB) mayMatchPrefix(prefix string) bool {
+	collection, key, ok := strings.Cut(prefix, ":")
+	if !ok {
+		return true
+	}
+	probe := collection
+	if key != "" {
+		probe = prefix[:len(collection)+1+min(len(key), prefixBloomLen)]
+	}
+	db.prefixChecks.Add(1)
+	if db.prefixes.Contains(probe) {
+		return true
+	}
+	db.prefixSkips.Add(1)
+	return false
+}
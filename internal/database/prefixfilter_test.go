@@ -0,0 +1,240 @@
+package database
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefixFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	rng := rand.New(rand.NewSource(1))
+	word := func(alphabet string, max int) string {
+		b := make([]byte, rng.Intn(max+1))
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	// The naive reference: every live combined key
+	live := make(map[string]bool)
+	for range 2000 {
+		collection := "c" + word("ab", 2)
+		key := word("abcd:", 7)
+		if rng.Intn(4) == 0 {
+			db.Delete(collection, key)
+			delete(live, compositeKey(collection, key))
+			continue
+		}
+		if err := db.Put(collection, key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		live[compositeKey(collection, key)] = true
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for range 2000 {
+			prefix := word("abcdx:", 10)
+			if rng.Intn(2) == 0 {
+				prefix = "c" + prefix
+			}
+			var want []string
+			for k := range live {
+				if strings.HasPrefix(k, prefix) {
+					want = append(want, k)
+				}
+			}
+			slices.Sort(want)
+			records, err := db.ScanPrefix(prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, rec := range records {
+				got = append(got, compositeKey(rec.Collection, rec.Key))
+			}
+			if !slices.Equal(got, want) {
+				t.Fatalf("%s: ScanPrefix(%q) = %v, want %v", stage, prefix, got, want)
+			}
+		}
+	}
+
+	check("after writes")
+	stats, _ := db.Stats()
+	if stats.PrefixSkips == 0 || stats.PrefixSkips >= stats.PrefixChecks {
+		t.Errorf("prefix filter checks %d, skips %d", stats.PrefixChecks, stats.PrefixSkips)
+	}
+	if vals, err := db.Filter("absent", func(string, []byte) bool { return true }); err != nil || len(vals) != 0 {
+		t.Errorf("Filter of an absent collection = %v, %v", vals, err)
+	}
+	if after, _ := db.Stats(); after.PrefixSkips != stats.PrefixSkips+1 {
+		t.Errorf("Filter of an absent collection scanned the log")
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after Compact")
+
+	// The filter is persisted in the hint
+	db.Close()
+	db, report, err := OpenWithReport(path, "pass", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.HintUsed {
+		t.Fatalf("hint not used: %+v", report)
+	}
+	check("after reopening")
+}
+
+func TestScanPrefixMeta(t *testing.T) {
+	clock := newTestClock()
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("col", "a", []byte("first"))
+	db.Put("col", "a", []byte("second"))
+	db.PutWithTTL("col", "b", []byte(strings.Repeat("x", 4096)), time.Hour)
+	db.PutWithTTL("col", "gone", []byte("x"), time.Minute)
+	db.Put("col", "deleted", []byte("x"))
+	db.Delete("col", "deleted")
+	db.Put("other", "c", []byte("x"))
+	db.SetCollectionPlaintext("plain", true)
+	db.Put("plain", "d", []byte("x"))
+	clock.Advance(2 * time.Minute)
+
+	for _, prefix := range []string{"", "col:", "plain:", "col:a", "none"} {
+		full, err := db.ScanPrefix(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := db.ScanPrefixMeta(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(meta) != len(full) {
+			t.Fatalf("ScanPrefixMeta(%q) = %d records, ScanPrefix %d", prefix, len(meta), len(full))
+		}
+		for i, rec := range meta {
+			if rec.Value != nil {
+				t.Errorf("ScanPrefixMeta(%q) returned a value for %s", prefix, rec.Key)
+			}
+			rec.Value = full[i].Value
+			if !reflect.DeepEqual(rec, full[i]) {
+				t.Errorf("ScanPrefixMeta(%q) = %+v, ScanPrefix %+v", prefix, rec, full[i])
+			}
+		}
+	}
+	if meta, _ := db.ScanPrefixMeta("col:"); len(meta) != 2 || meta[1].Key != "b" || meta[1].ExpiresAt == 0 {
+		t.Errorf("ScanPrefixMeta(col:) = %+v", meta)
+	}
+
+	// The CRC is still checked
+	db.file.WriteAt([]byte{0xff}, db.offset-1)
+	if _, err := db.ScanPrefixMeta(""); err != ErrChecksumMismatch {
+		t.Errorf("ScanPrefixMeta of a corrupt record: %v", err)
+	}
+}
+
+func TestScanPrefixFunc(t *testing.T) {
+	clock := newTestClock()
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("col", "a", []byte(`{"n": 1}`))
+	db.PutWithTTL("col", "b", []byte(strings.Repeat("x", 4096)), time.Hour)
+	db.PutWithTTL("col", "gone", []byte("x"), time.Minute)
+	db.Put("col", "c", []byte("not json"))
+	db.Put("col", "deleted", []byte("x"))
+	db.Delete("col", "deleted")
+	db.SetCollectionPlaintext("plain", true)
+	db.Put("plain", "d", []byte("clear"))
+	db.Put("plain", "e", []byte("text"))
+	clock.Advance(2 * time.Minute)
+
+	for _, prefix := range []string{"", "col:", "plain:", "col:a", "none"} {
+		full, err := db.ScanPrefix(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []Record
+		err = db.ScanPrefixFunc(prefix, func(rec *Record) error {
+			kept := *rec
+			kept.Value = rec.ValueCopy()
+			got = append(got, kept)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(full) || len(got) > 0 && !reflect.DeepEqual(got, full) {
+			t.Errorf("ScanPrefixFunc(%q) = %+v, ScanPrefix %+v", prefix, got, full)
+		}
+	}
+
+	// An error from fn stops the scan
+	stop := errors.New("stop")
+	calls := 0
+	err = db.ScanPrefixFunc("", func(rec *Record) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("ScanPrefixFunc stopped after %d calls with %v", calls, err)
+	}
+
+	// The helpers
+	err = db.ScanPrefixFunc("col:", func(rec *Record) error {
+		var v struct{ N int }
+		switch rec.Key {
+		case "a":
+			if err := rec.DecodeJSON(&v); err != nil || v.N != 1 {
+				t.Errorf("DecodeJSON(a) = %+v, %v", v, err)
+			}
+			if rec.TTL() != 0 || rec.Expired(clock.Now().Add(1000*time.Hour)) {
+				t.Errorf("a without an expiry has TTL %v", rec.TTL())
+			}
+		case "b":
+			if now := clock.Now(); rec.Expired(now) || !rec.Expired(now.Add(time.Hour)) {
+				t.Errorf("b expiring at %d judged wrongly around %v", rec.ExpiresAt, now)
+			}
+		case "c":
+			if err := rec.DecodeJSON(&v); !errors.Is(err, ErrNotJSON) {
+				t.Errorf("DecodeJSON(c) = %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TTL goes by the system clock, not Options.Now
+	rec := Record{ExpiresAt: time.Now().Add(time.Hour).UnixNano()}
+	if ttl := rec.TTL(); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL of a record expiring in an hour = %v", ttl)
+	}
+	if rec.ExpiresAt = time.Now().Add(-time.Hour).UnixNano(); rec.TTL() >= 0 {
+		t.Errorf("TTL of an expired record = %v", rec.TTL())
+	}
+}
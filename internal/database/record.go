@@ -1,13 +1,18 @@
 package database
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"hash/crc32"
+	"time"
 )
 
 const (
 	magicHeader = "NOKHAL"
-	version     = 4 // Updated to version 4 for Envelope Encryption
+	version     = 5 // Version 5 adds the header extension area
 
 	crcSize            = 4
 	timestampSize      = 8
@@ -31,7 +36,7 @@ const (
 	dekSize          = 32
 	encryptedDekSize = dekSize + authTagSize // 32 + 16 = 48
 	v4HeaderSize     = len(magicHeader) + 1 + saltSize + authNonceSize + encryptedDekSize
-	
+
 	// Legacy Header Sizes
 	v3HeaderSize = len(magicHeader) + 1 + saltSize + authTokenSize
 )
@@ -41,11 +46,67 @@ const (
 	OpDelete
 )
 
+// Forward compatibility: a record whose op has opSkippable set may be skipped
+// whole, using the sizes in its header, by a version that does not know the
+// op. Such records are not indexed and do not survive Compact, but are
+// authenticated before they are skipped; see DB.verifySkipped. An unknown op
+// without the bit fails with ErrUnsupportedFeature.
+const (
+	opSkippable byte = 1 << 7
+
+	// OpMeta stores a database setting in the meta collection. It reads
+	// like OpPut.
+	OpMeta = opSkippable | 0
+)
+
+// ErrUnsupportedFeature is returned when the log holds a record written by a
+// later version with an op this build does not know and may not skip. Match
+// it with errors.As.
+type ErrUnsupportedFeature struct {
+	Op     byte
+	Offset int64
+}
+
+func (e *ErrUnsupportedFeature) Error() string {
+	return fmt.Sprintf("unsupported record op %#02x at offset %d", e.Op, e.Offset)
+}
+
+// checkOp reports whether the record at offset with op is to be skipped, or
+// fails if it can be neither read nor skipped.
+func checkOp(op byte, offset int64) (skip bool, err error) {
+	switch {
+	case op == OpPut, op == OpDelete, op == OpMeta:
+		return false, nil
+	case op&opSkippable != 0:
+		return true, nil
+	default:
+		return false, &ErrUnsupportedFeature{Op: op, Offset: offset}
+	}
+}
+
+// valueOp is the op of a value written to collection.
+func valueOp(collection string) byte {
+	if collection == metaCollection {
+		return OpMeta
+	}
+	return OpPut
+}
+
 const (
-	FlagNone       byte = 0
-	FlagCompressed byte = 1 << 0 // Bit 0: 1 = Compressed
+	FlagNone        byte = 0
+	FlagCompressed  byte = 1 << 0 // Bit 0: 1 = Compressed
+	FlagPlaintext   byte = 1 << 1 // Bit 1: 1 = Value stored unencrypted
+	FlagKeyID       byte = 1 << 2 // Bit 2: 1 = Sealed with the rotation DEK
+	FlagChecksum    byte = 1 << 3 // Bit 3: 1 = Payload starts with a CRC32 of the value
+	FlagBoundAAD    byte = 1 << 4 // Bit 4: 1 = AAD also covers the op and flags bytes
+	FlagDict        byte = 1 << 5 // Bit 5: 1 = Compressed with a stored dictionary, whose ID starts the payload
+	FlagTransformed byte = 1 << 6 // Bit 6: 1 = Value was encoded by the collection's Transform
+	FlagSet         byte = 1 << 7 // Bit 7: 1 = Value is the encoded member set of SAdd
 )
 
+// Size of the content checksum prepended to the payload under FlagChecksum
+const contentSumSize = 4
+
 // Public Record struct (Decrypted)
 type Record struct {
 	Timestamp  int64
@@ -56,6 +117,39 @@ type Record struct {
 	Op         byte
 }
 
+// ValueCopy returns a copy of Value, which stays valid after a
+// ScanPrefixFunc callback returns.
+func (r *Record) ValueCopy() []byte {
+	return bytes.Clone(r.Value)
+}
+
+// DecodeJSON unmarshals Value into dest. A value that is not JSON fails
+// with ErrNotJSON.
+func (r *Record) DecodeJSON(dest any) error {
+	err := json.Unmarshal(r.Value, dest)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("%w: %v", ErrNotJSON, err)
+	}
+	return err
+}
+
+// TTL returns the time left until the record expires by the system clock,
+// negative once it has, or zero if it never expires. Databases with
+// Options.Now judge expiry by their own clock; use Expired with it.
+func (r *Record) TTL() time.Duration {
+	if r.ExpiresAt == 0 {
+		return 0
+	}
+	return time.Until(time.Unix(0, r.ExpiresAt))
+}
+
+// Expired reports whether the record has expired at now, as the database
+// judges it: after its expiry, not at it.
+func (r *Record) Expired(now time.Time) bool {
+	return r.ExpiresAt > 0 && r.ExpiresAt < now.UnixNano()
+}
+
 // Internal record struct (Encrypted/On-Disk)
 type record struct {
 	Timestamp  int64
@@ -68,8 +162,20 @@ type record struct {
 	Op         byte
 }
 
+// maxRecordSize bounds the encoded size of a record. Writes of a larger one
+// fail with ErrRecordTooLarge, so readers of an untrusted stream can treat
+// a record header declaring more as corrupt instead of allocating for it.
+const maxRecordSize = 1 << 30
+
+var ErrRecordTooLarge = errors.New("record too large")
+
+// size is the encoded size of r.
+func (r *record) size() int {
+	return recordHeaderSize + opSize + len(r.Collection) + len(r.Key) + len(r.Nonce) + len(r.Value)
+}
+
 func (r *record) Encode() ([]byte, int) {
-	totalSize := recordHeaderSize + opSize + len(r.Collection) + len(r.Key) + len(r.Nonce) + len(r.Value)
+	totalSize := r.size()
 	buf := make([]byte, totalSize)
 
 	// CRC placeholder at 0-3
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// appendRaw writes a fabricated record with op, sealed under the DEK, at the
+// end of the closed database at path and drops the hint, as a later version
+// might have.
+func appendRaw(t *testing.T, path string, op byte) int64 {
+	t.Helper()
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &record{
+		Timestamp:  time.Now().UnixNano(),
+		Collection: []byte("col"),
+		Key:        []byte("a"),
+		Op:         op,
+		Flags:      FlagBoundAAD,
+	}
+	if rec.Nonce, err = generateNonce(); err != nil {
+		t.Fatal(err)
+	}
+	rec.Value = db.aead.Seal(nil, rec.Nonce, []byte("layout of a later version"), recordAAD("col:a", rec.Timestamp, op, rec.Flags))
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := rec.Encode()
+	if _, err := f.WriteAt(encoded, fi.Size()); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path + ".hint")
+	return fi.Size()
+}
+
+// logOps returns the op of every record in the log of db.
+func logOps(t *testing.T, db *DB) []byte {
+	t.Helper()
+	var ops []byte
+	offsets, _ := walkLog(db.file, int64(headerSize))
+	for _, offset := range offsets {
+		rec, _, err := db.readRecord(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, rec.Op)
+	}
+	return ops
+}
+
+func TestUnknownOps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "a", []byte("v1"))
+	if err := db.SetCollectionTTL("col", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ops := logOps(t, db); !bytes.Contains(ops, []byte{OpMeta}) {
+		t.Errorf("settings written with ops %v, want OpMeta", ops)
+	}
+	db.Close()
+
+	// A skippable record is stepped over by every reader
+	appendRaw(t, path, opSkippable|0x05)
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("col", "a"); err != nil || string(v) != "v1" {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+	if records, err := db.List("col"); err != nil || len(records) != 1 {
+		t.Errorf("List = %v, %v", records, err)
+	}
+	if db.defaultTTL["col"] != time.Hour {
+		t.Errorf("collection TTL = %v after reopen", db.defaultTTL["col"])
+	}
+	if err := db.Put("col", "b", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if _, err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	report, err := VerifyBackupWithOptions(&backup, "pass", VerifyOptions{Decrypt: true})
+	if err != nil || report.Records != report.Puts+report.Deletes+1 {
+		t.Errorf("VerifyBackup: %+v, %v", report, err)
+	}
+
+	// Compaction drops it, and settings survive a key rotation
+	if err := db.BeginKeyRotation(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if ops := logOps(t, db); bytes.Contains(ops, []byte{opSkippable | 0x05}) {
+		t.Errorf("compacted log still holds the skippable record: ops %v", ops)
+	}
+	db.Close()
+	db, err = Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.defaultTTL["col"] != time.Hour {
+		t.Errorf("collection TTL = %v after rotation", db.defaultTTL["col"])
+	}
+	db.Close()
+
+	// An unknown op that may not be skipped refuses to open
+	offset := appendRaw(t, path, 0x05)
+	_, err = Open(path, "pass")
+	var unsupported *ErrUnsupportedFeature
+	if !errors.As(err, &unsupported) || unsupported.Op != 0x05 || unsupported.Offset != offset {
+		t.Fatalf("Open = %v, want ErrUnsupportedFeature for op 0x05 at %d", err, offset)
+	}
+}
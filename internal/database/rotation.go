@@ -0,0 +1,205 @@
+package database
+
+import (
+	"crypto/cipher"
+	"errors"
+)
+
+var ErrRotationInProgress = errors.New("key rotation already in progress")
+
+// BeginKeyRotation generates a new DEK and starts an incremental rotation.
+// New writes are sealed with the new key, Get lazily re-seals records still
+// under the old key, and the next Compact re-seals the remaining tail and
+// promotes the new key, ending the rotation.
+func (db *DB) BeginKeyRotation() error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	if db.nextAead != nil {
+		return ErrRotationInProgress
+	}
+
+	dek, nonce, wrapped, err := newDEK(db.kek)
+	if err != nil {
+		return err
+	}
+	nextAead, err := newCipher(dek)
+	if err != nil {
+		return err
+	}
+
+	header := *db.header
+	header.Rotating = true
+	header.NextKEKNonce = nonce
+	header.NextEncryptedDEK = wrapped
+	if err := db.writeHeaderAt(header.encodeRotation(), extRotationOffset); err != nil {
+		return err
+	}
+
+	db.header = &header
+	db.nextAead = nextAead
+	return nil
+}
+
+// RotateSalt replaces the salt the KEK is derived from, keeping the
+// password, for policies that require a periodic salt change. password must
+// be the current one. The DEK, and the next DEK of a key rotation in
+// progress, are re-wrapped with a KEK derived from password and a fresh salt,
+// and the header fields holding them are rewritten in one synced write; the
+// log is not touched. Writes wait for both key derivations.
+func (db *DB) RotateSalt(password string) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	header := *db.header
+	oldKEK, err := newCipher(deriveKey(password, header.Salt, header.KDF))
+	if err != nil {
+		return err
+	}
+	dek, err := oldKEK.Open(nil, header.KEKNonce, header.EncryptedDEK, dekAAD)
+	if err != nil {
+		return ErrInvalidPassword
+	}
+
+	salt, err := generateSalt()
+	if err != nil {
+		return err
+	}
+	kek, err := newCipher(deriveKey(password, salt, header.KDF))
+	if err != nil {
+		return err
+	}
+	header.Salt = salt
+	if header.KEKNonce, header.EncryptedDEK, err = wrapDEK(kek, dek); err != nil {
+		return err
+	}
+	if header.Rotating {
+		next, err := oldKEK.Open(nil, header.NextKEKNonce, header.NextEncryptedDEK, dekAAD)
+		if err != nil {
+			return ErrDecryption
+		}
+		if header.NextKEKNonce, header.NextEncryptedDEK, err = wrapDEK(kek, next); err != nil {
+			return err
+		}
+	}
+
+	// The salt, the wrapped DEK and the rotation area are contiguous and all
+	// within the first sector, so they are replaced together or not at all
+	encoded := header.encode()
+	if err := db.writeHeaderAt(encoded[headerSaltOffset:extRotationOffset+extRotationSize], headerSaltOffset); err != nil {
+		return err
+	}
+	db.header, db.kek, db.salt = &header, kek, salt
+
+	// The hint names the old salt, so Open would discard it
+	if err := db.flushHint(); err != nil {
+		db.health.hintFailures.Add(1)
+		db.logger().Warn("nokhal: hint flush after salt rotation failed", "path", db.path, "err", err)
+	}
+	return nil
+}
+
+func (db *DB) RotationActive() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.nextAead != nil
+}
+
+// writeCipher returns the AEAD new records are sealed with and the flag
+// identifying it. Callers must hold db.mu.
+func (db *DB) writeCipher() (cipher.AEAD, byte) {
+	if db.nextAead != nil {
+		return db.nextAead, FlagKeyID
+	}
+	return db.aead, FlagNone
+}
+
+// cipherFor returns the AEAD a record with the given flags was sealed with,
+// or nil if that key is not available. Callers must hold db.mu.
+func (db *DB) cipherFor(flags byte) cipher.AEAD {
+	if flags&FlagKeyID != 0 {
+		return db.nextAead
+	}
+	return db.aead
+}
+
+// needsReseal reports whether a record is still sealed under the DEK being
+// rotated out. Callers must hold db.mu.
+func (db *DB) needsReseal(flags byte) bool {
+	return db.nextAead != nil && flags&(FlagKeyID|FlagPlaintext) == 0
+}
+
+// resealRecord appends a copy of the live record at offset sealed under the
+// new DEK, keeping its original timestamp and expiry and its value as stored,
+// transform included. It is a no-op if the key has been written again since
+// offset was read.
+func (db *DB) resealRecord(compKey string, offset int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// A frozen database is not written; a later read re-seals the record
+	if db.nextAead == nil || db.thaw != nil {
+		return nil
+	}
+	if entry, _, err := db.index.get(compKey); err != nil || entry.Offset != offset {
+		return err
+	}
+
+	rec, _, err := db.readRecord(offset)
+	if err != nil {
+		return err
+	}
+	stored, err := db.openValue(rec, compKey)
+	if err != nil {
+		return err
+	}
+	collection, key := string(rec.Collection), string(rec.Key)
+	// A re-seal keeps the value compressed only if it was
+	flags, nonce, value, err := db.sealValue(collection, key, stored, rec.Timestamp, rec.Flags&(FlagTransformed|FlagSet), rec.Flags&FlagCompressed != 0)
+	if err != nil {
+		return err
+	}
+
+	return db.writeRecord(&record{
+		Timestamp:  rec.Timestamp,
+		ExpiresAt:  rec.ExpiresAt,
+		Flags:      flags,
+		Collection: rec.Collection,
+		Key:        rec.Key,
+		Value:      value,
+		Nonce:      nonce,
+		Op:         valueOp(collection),
+	})
+}
+
+// rekeyForCompaction re-seals a record under the new DEK while a rotation is
+// being finished by Compact. The returned record no longer carries FlagKeyID
+// since the new DEK becomes the primary key. Callers must hold db.mu.
+func (db *DB) rekeyForCompaction(rec *record) (*record, error) {
+	if rec.Op == OpDelete && rec.Flags&FlagBoundAAD == 0 || rec.Flags&FlagPlaintext != 0 {
+		rec.Flags &^= FlagKeyID
+		return rec, nil
+	}
+
+	aead := db.cipherFor(rec.Flags)
+	compKey := compositeKey(string(rec.Collection), string(rec.Key))
+	plaintext, err := aead.Open(nil, rec.Nonce, rec.Value, recordAAD(compKey, rec.Timestamp, rec.Op, rec.Flags))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+
+	nonce, err := db.newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	out := *rec
+	out.Flags &^= FlagKeyID
+	out.Nonce = nonce
+	out.Value = db.nextAead.Seal(nil, nonce, plaintext, recordAAD(compKey, out.Timestamp, out.Op, out.Flags))
+	return &out, nil
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"io"
+)
+
+// scanChunkBytes is how much of the log scanLiveFunc reads per hold of the
+// read lock, and so about the most raw record bytes it holds at once. Tests
+// shrink it.
+var scanChunkBytes int64 = 1 << 20
+
+// pendingRecord is a current record read by scanLiveFunc under the read
+// lock, with the DEK it is sealed under resolved there, to be opened once
+// the lock is released.
+type pendingRecord struct {
+	rec     *record
+	compKey string
+	aead    cipher.AEAD // Nil for a record of a plaintext collection
+}
+
+// scanLiveFunc calls fn with the latest live version of every record
+// accepted by match, in log order, without the database lock held, so fn
+// may call back into the DB. The log is read scanChunkBytes at a time:
+// under the read lock the records of a chunk that the index still points
+// at are collected, then the lock is released while they are decrypted and
+// passed to fn, and the scan resumes at the offset it reached. A key
+// rewritten, by fn or any other writer, before the scan reaches it is
+// visited in its latest version, read from where the index points past the
+// end of the scan, while keys created after the scan began are not visited.
+// If Compact or Reindex replaces the log or its index in between, the scan
+// starts over on the new one, skipping the keys it has visited, which are
+// the only thing it keeps across chunks; keys written before the restart
+// are then visited in their latest version. Expiry is judged once, when
+// the scan starts. An error from fn stops the scan and is returned.
+func (db *DB) scanLiveFunc(match func(collection, key []byte) bool, fn func(rec Record) error) error {
+	visited := make(map[string]bool)
+
+	db.mu.RLock()
+	now := db.now().UnixNano()
+	gen, next, limit := db.indexGen, int64(headerSize), db.offset
+	for next < limit {
+		chunk, end, err := db.readScanChunk(match, visited, next, limit, now)
+		db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		for _, p := range chunk {
+			value, err := db.openPending(p)
+			if err != nil {
+				return err
+			}
+			err = fn(Record{
+				Timestamp:  p.rec.Timestamp,
+				ExpiresAt:  p.rec.ExpiresAt,
+				Collection: string(p.rec.Collection),
+				Key:        string(p.rec.Key),
+				Value:      value,
+				Op:         p.rec.Op,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		db.mu.RLock()
+		next = end
+		if db.indexGen != gen {
+			gen, next, limit = db.indexGen, int64(headerSize), db.offset
+		}
+	}
+	db.mu.RUnlock()
+	return nil
+}
+
+// readScanChunk reads records from offset next until it has read
+// scanChunkBytes or reached limit, and returns the live versions of the keys
+// accepted by match and not yet visited, with the offset it stopped at. A
+// key is returned at the record the index points at, or, if the index
+// points at limit or later, at the first of its records read; the keys
+// returned are marked visited. Callers must hold db.mu.
+func (db *DB) readScanChunk(match func(collection, key []byte) bool, visited map[string]bool, next, limit, now int64) ([]pendingRecord, int64, error) {
+	bufReader := bufio.NewReaderSize(io.NewSectionReader(db.file, next, limit-next), 128*1024)
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+
+	var chunk []pendingRecord
+	start := next
+	for next < limit && next-start < scanChunkBytes {
+		header := buf[:recordHeaderSize]
+		if _, err := io.ReadFull(bufReader, header); err != nil {
+			return nil, 0, err
+		}
+		_, _, _, collSize, keySize, valSize := decodeRecordHeader(header)
+		totalSize := recordHeaderSize + opSize + collSize + keySize + nonceSize + valSize
+		offset := next
+		next += int64(totalSize)
+
+		data := buf
+		if totalSize > len(buf) {
+			data = make([]byte, totalSize)
+			copy(data, header)
+		}
+		data = data[:totalSize]
+		if _, err := io.ReadFull(bufReader, data[recordHeaderSize:]); err != nil {
+			return nil, 0, err
+		}
+		names := data[recordHeaderSize+opSize:]
+		collection, key := names[:collSize], names[collSize:collSize+keySize]
+		if !match(collection, key) {
+			continue
+		}
+		compKey := string(collection) + ":" + string(key)
+		if visited[compKey] {
+			continue
+		}
+		entry, ok, err := db.index.get(compKey)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok || entry.expired(now) {
+			continue
+		}
+
+		var rec *record
+		switch {
+		case entry.Offset == offset:
+			// Kept past the next read into buf, and CRC-checked as a whole
+			rec, err = parseRecord(append([]byte(nil), data...), offset)
+		case entry.Offset >= limit:
+			// Rewritten since the scan began, past where it stops
+			rec, _, err = db.readRecord(entry.Offset)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		visited[compKey] = true
+		p := pendingRecord{rec: rec, compKey: compKey}
+		if rec.Flags&FlagPlaintext != 0 {
+			if !db.trustPlaintext(rec.Flags, string(rec.Collection)) {
+				return nil, 0, ErrDecryption
+			}
+		} else if p.aead = db.cipherFor(rec.Flags); p.aead == nil {
+			return nil, 0, ErrDecryption
+		}
+		chunk = append(chunk, p)
+	}
+	return chunk, next, nil
+}
+
+// openPending decrypts and decodes a record collected by readScanChunk. It
+// needs no lock: the DEK was resolved when the record was read.
+func (db *DB) openPending(p pendingRecord) ([]byte, error) {
+	rec := p.rec
+	payload := rec.Value
+	if p.aead != nil {
+		var err error
+		payload, err = p.aead.Open(nil, rec.Nonce, rec.Value, recordAAD(p.compKey, rec.Timestamp, rec.Op, rec.Flags))
+		if err != nil {
+			return nil, ErrDecryption
+		}
+	}
+	value, err := db.decodeValue(rec.Flags, payload)
+	if err != nil {
+		return nil, err
+	}
+	return db.untransform(string(rec.Collection), string(rec.Key), rec.Flags, value)
+}
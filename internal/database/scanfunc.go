@@ -0,0 +1,68 @@
+package database
+
+import "strings"
+
+// ScanPrefixFunc calls fn with the latest live version of every record whose
+// combined key (collection:key) starts with prefix, in key order, like
+// ScanPrefix but without collecting them: each record is read and opened
+// just before fn gets it, into buffers reused for the next one. The Record
+// and its Value are only valid until fn returns; keep a value with
+// ValueCopy. fn runs with the database read-locked, so the scan sees one
+// snapshot, and must not call back into the DB. An error from fn stops the
+// scan and is returned.
+func (db *DB) ScanPrefixFunc(prefix string, fn func(rec *Record) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if !db.mayMatchPrefix(prefix) {
+		return nil
+	}
+
+	now := db.now().UnixNano()
+	var buf, plain []byte
+	var rec Record
+	return db.index.eachSorted(func(k string, e indexEntry) error {
+		if !strings.HasPrefix(k, prefix) || e.expired(now) {
+			return nil
+		}
+		collection, key := SplitKey(k)
+		if hiddenFromPrefix(collection, prefix) {
+			return nil
+		}
+
+		if int64(cap(buf)) < e.Size {
+			buf = make([]byte, e.Size)
+		}
+		buf = buf[:e.Size]
+		if _, err := db.file.ReadAt(buf, e.Offset); err != nil {
+			return err
+		}
+		raw, err := parseRecord(buf, e.Offset)
+		if err != nil {
+			return err
+		}
+		payload, err := db.decrypt(plain[:0], raw, k)
+		if err != nil {
+			return err
+		}
+		if raw.Flags&FlagPlaintext == 0 {
+			plain = payload
+		}
+		value, err := db.decodeValue(raw.Flags, payload)
+		if err == nil {
+			value, err = db.untransform(collection, key, raw.Flags, value)
+		}
+		if err != nil {
+			return err
+		}
+
+		rec = Record{
+			Timestamp:  raw.Timestamp,
+			ExpiresAt:  raw.ExpiresAt,
+			Collection: collection,
+			Key:        key,
+			Value:      value,
+			Op:         raw.Op,
+		}
+		return fn(&rec)
+	})
+}
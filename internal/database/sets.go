@@ -0,0 +1,175 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrNotSet     = errors.New("stored value is not a set")
+	ErrInvalidSet = errors.New("malformed set encoding")
+)
+
+// A set is stored as the value of its key, flagged with FlagSet: its
+// members in byte order, without duplicates, each a uvarint length followed
+// by its bytes. Absent keys are empty sets, and removing the last member
+// deletes the key.
+
+// encodeSet encodes members, which must be sorted and distinct.
+func encodeSet(members [][]byte) []byte {
+	size := 0
+	for _, m := range members {
+		size += binary.MaxVarintLen64 + len(m)
+	}
+	out := make([]byte, 0, size)
+	for _, m := range members {
+		out = binary.AppendUvarint(out, uint64(len(m)))
+		out = append(out, m...)
+	}
+	return out
+}
+
+func decodeSet(b []byte) ([][]byte, error) {
+	var members [][]byte
+	for len(b) > 0 {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || n > uint64(len(b)-size) {
+			return nil, ErrInvalidSet
+		}
+		b = b[size:]
+		members = append(members, b[:n:n])
+		b = b[n:]
+	}
+	return members, nil
+}
+
+// declareSets declares FeatureSets if writes hold a set and the header does
+// not declare it yet. Callers must hold the write lock.
+func (db *DB) declareSets(writes []batchRecord) error {
+	if db.hasFeature(FeatureSets) {
+		return nil
+	}
+	for _, w := range writes {
+		if w.flags&FlagSet != 0 {
+			return db.enableFeature(FeatureSets)
+		}
+	}
+	return nil
+}
+
+// readSet returns the members of the set stored under compKey, as of the
+// read timestamp now, and whether the key is present. Callers must hold
+// db.mu.
+func (db *DB) readSet(compKey string, now int64) ([][]byte, *record, error) {
+	rec, _, err := db.readRaw(compKey, now)
+	if err == ErrNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec.Flags&FlagSet == 0 {
+		return nil, nil, ErrNotSet
+	}
+	value, err := db.openUserValue(rec, compKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := decodeSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return members, rec, nil
+}
+
+// updateSet replaces the members of a set with those update returns, under
+// the write lock. The set keeps its expiry unless ttl is not nil.
+func (db *DB) updateSet(collection, key string, ttl *time.Duration, update func(members [][]byte) [][]byte) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	members, rec, err := db.readSet(compositeKey(collection, key), db.now().UnixNano())
+	if err != nil {
+		return err
+	}
+	updated := update(members)
+
+	w := batchRecord{collection: collection, key: key, op: OpPut, flags: FlagSet}
+	switch {
+	case len(updated) == 0 && rec == nil:
+		return nil
+	case len(updated) == 0:
+		w.op = OpDelete
+	case ttl != nil:
+		w.ttl = *ttl
+	case slices.EqualFunc(updated, members, bytes.Equal):
+		return nil
+	case rec != nil:
+		w.keepExpiry, w.expiresAt = true, rec.ExpiresAt
+	}
+	if w.op == OpPut {
+		w.value = encodeSet(updated)
+	}
+	return db.commitWrites([]batchRecord{w})
+}
+
+// addMembers merges add into the sorted, distinct members.
+func addMembers(members, add [][]byte) [][]byte {
+	merged := append(slices.Clone(members), add...)
+	slices.SortFunc(merged, bytes.Compare)
+	return slices.CompactFunc(merged, bytes.Equal)
+}
+
+// SAdd adds members to the set stored under collection and key, creating it
+// if the key is absent. The read and write happen under the write lock, so
+// concurrent changes to one set do not lose each other's members. The set
+// keeps its expiry; a new one gets the collection's default TTL. A key
+// holding a value that is not a set fails with ErrNotSet.
+func (db *DB) SAdd(collection, key string, members ...[]byte) error {
+	return db.updateSet(collection, key, nil, func(old [][]byte) [][]byte {
+		return addMembers(old, members)
+	})
+}
+
+// SAddWithTTL is SAdd that also makes the whole set expire after ttl.
+func (db *DB) SAddWithTTL(collection, key string, ttl time.Duration, members ...[]byte) error {
+	return db.updateSet(collection, key, &ttl, func(old [][]byte) [][]byte {
+		return addMembers(old, members)
+	})
+}
+
+// SRemove removes members from the set stored under collection and key.
+// Members not in the set are ignored, and removing the last member deletes
+// the key.
+func (db *DB) SRemove(collection, key string, members ...[]byte) error {
+	return db.updateSet(collection, key, nil, func(old [][]byte) [][]byte {
+		return slices.DeleteFunc(slices.Clone(old), func(m []byte) bool {
+			return slices.ContainsFunc(members, func(r []byte) bool { return bytes.Equal(m, r) })
+		})
+	})
+}
+
+// SMembers returns the members of the set stored under collection and key
+// in byte order. An absent or expired key is an empty set.
+func (db *DB) SMembers(collection, key string) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	members, _, err := db.readSet(compositeKey(collection, key), db.now().UnixNano())
+	return members, err
+}
+
+// SContains reports whether member is in the set stored under collection
+// and key.
+func (db *DB) SContains(collection, key string, member []byte) (bool, error) {
+	members, err := db.SMembers(collection, key)
+	if err != nil {
+		return false, err
+	}
+	_, found := slices.BinarySearchFunc(members, member, bytes.Compare)
+	return found, nil
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setString(t *testing.T, db *DB, collection, key string) string {
+	t.Helper()
+	got, err := db.SMembers(collection, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%q", got)
+}
+
+func TestSets(t *testing.T) {
+	clock := newTestClock()
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got := setString(t, db, "tags", "a"); got != "[]" {
+		t.Errorf("absent set = %s", got)
+	}
+	db.SAdd("tags", "a", []byte("red"), []byte("blue"), []byte("red"))
+	db.SAdd("tags", "a", []byte("green"), []byte(""))
+	if got := setString(t, db, "tags", "a"); got != `["" "blue" "green" "red"]` {
+		t.Errorf("members = %s", got)
+	}
+	if ok, err := db.SContains("tags", "a", []byte("green")); err != nil || !ok {
+		t.Errorf("SContains(green) = %v, %v", ok, err)
+	}
+	if ok, err := db.SContains("tags", "a", []byte("gray")); err != nil || ok {
+		t.Errorf("SContains(gray) = %v, %v", ok, err)
+	}
+	db.SRemove("tags", "a", []byte("blue"), []byte("gray"), []byte(""))
+	if got := setString(t, db, "tags", "a"); got != `["green" "red"]` {
+		t.Errorf("members after SRemove = %s", got)
+	}
+
+	// Get returns the encoding; a plain value is not a set
+	if v, err := db.Get("tags", "a"); err != nil || string(v) != "\x05green\x03red" {
+		t.Errorf("Get of a set = %q, %v", v, err)
+	}
+	db.Put("tags", "plain", []byte("x"))
+	if err := db.SAdd("tags", "plain", []byte("y")); err != ErrNotSet {
+		t.Errorf("SAdd to a plain value: %v", err)
+	}
+	if _, err := db.SMembers("tags", "plain"); err != ErrNotSet {
+		t.Errorf("SMembers of a plain value: %v", err)
+	}
+
+	// The TTL covers the whole set and survives changes to it
+	db.SAddWithTTL("tags", "b", time.Minute, []byte("x"))
+	db.SAdd("tags", "b", []byte("y"))
+	db.SRemove("tags", "b", []byte("x"))
+	clock.Advance(2 * time.Minute)
+	if got := setString(t, db, "tags", "b"); got != "[]" {
+		t.Errorf("expired set = %s", got)
+	}
+
+	// Removing the last member deletes the key
+	db.SRemove("tags", "a", []byte("green"), []byte("red"))
+	if _, err := db.Get("tags", "a"); err != ErrNotFound {
+		t.Errorf("Get of an emptied set: %v", err)
+	}
+
+	// The flag survives Swap, key rotation and Compact
+	db.SAdd("tags", "c", []byte("z"))
+	if err := db.Swap("tags", "c", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BeginKeyRotation(); err != nil {
+		t.Fatal(err)
+	}
+	db.Get("tags", "d") // Re-sealed under the new key
+	if got := setString(t, db, "tags", "d"); got != `["z"]` {
+		t.Errorf("members after Swap and rotation = %s", got)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := setString(t, db, "tags", "d"); got != `["z"]` {
+		t.Errorf("members after Compact = %s", got)
+	}
+}
+
+func TestSetsConcurrent(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each writer adds its own members and removes every other one again
+	const writers, perWriter = 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				member := []byte(fmt.Sprintf("w%d-%d", w, i))
+				if err := db.SAdd("tags", "shared", member); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%2 == 1 {
+					if err := db.SRemove("tags", "shared", member); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := db.SMembers("tags", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != writers*perWriter/2 {
+		t.Errorf("%d members, want %d", len(got), writers*perWriter/2)
+	}
+	for w := range writers {
+		for i := 0; i < perWriter; i += 2 {
+			member := []byte(fmt.Sprintf("w%d-%d", w, i))
+			if ok, _ := db.SContains("tags", "shared", member); !ok {
+				t.Errorf("lost member %s", member)
+			}
+		}
+	}
+}
+
+func TestSetsDeclareFeature(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Features()&FeatureSets != 0 {
+		t.Fatalf("new file declares %s", db.Features())
+	}
+	// Removing a member of an absent set writes nothing and declares nothing
+	if err := db.SRemove("tags", "a", []byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Features()&FeatureSets != 0 {
+		t.Errorf("SRemove of an absent set declared %s", db.Features())
+	}
+	if err := db.SAdd("tags", "a", []byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Features()&FeatureSets == 0 {
+		t.Errorf("SAdd left features %s", db.Features())
+	}
+
+	// The declaration carries over to a file the set is exported into
+	exported := filepath.Join(dir, "tags.nok")
+	if err := db.ExportCollection("tags", exported, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	supported := supportedFeatures
+	supportedFeatures &^= FeatureSets
+	defer func() { supportedFeatures = supported }()
+	for _, p := range []string{path, exported} {
+		if _, err := Open(p, "pass"); !errors.Is(err, ErrUnknownFeature) {
+			t.Errorf("build without sets opened %s: %v", filepath.Base(p), err)
+		}
+	}
+}
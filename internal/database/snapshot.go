@@ -0,0 +1,138 @@
+package database
+
+import "errors"
+
+var (
+	ErrTooManySnapshots = errors.New("too many open snapshots and iterators")
+	ErrSnapshotOpen     = errors.New("log records are pinned by an open snapshot")
+	ErrSnapshotClosed   = errors.New("snapshot is closed")
+)
+
+// Snapshot is a read-only view of the database as it was when it was taken.
+// It holds the offset of the version of each key that was current then, so
+// its reads see neither later writes nor later deletes, and expiry is judged
+// at the time it was taken. Until Close, the records it points at are
+// pinned: Compact, which moves every record, fails with ErrSnapshotOpen, and
+// so does SecureDeletePrefix for a prefix matching a key the snapshot holds.
+type Snapshot struct {
+	db      *DB
+	entries map[string]indexEntry
+	now     int64
+	offset  int64 // Log end when the snapshot was taken
+	closed  bool
+}
+
+// Snapshot takes a Snapshot of the database. It copies the key index, which
+// costs a walk of it and memory for every key. The snapshot counts against
+// Options.MaxSnapshots until Close, and fails with ErrTooManySnapshots past
+// it.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entries := make(map[string]indexEntry)
+	err := db.index.each(func(k string, e indexEntry) error {
+		entries[k] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.acquireHandle(); err != nil {
+		return nil, err
+	}
+	s := &Snapshot{db: db, entries: entries, now: db.now().UnixNano(), offset: db.offset}
+
+	db.pinMu.Lock()
+	if db.snapshots == nil {
+		db.snapshots = make(map[*Snapshot]struct{})
+	}
+	db.snapshots[s] = struct{}{}
+	db.pinMu.Unlock()
+	return s, nil
+}
+
+// Offset returns the end of the log when the snapshot was taken.
+func (s *Snapshot) Offset() int64 {
+	return s.offset
+}
+
+// Get returns the value key had when the snapshot was taken.
+func (s *Snapshot) Get(collection, key string) ([]byte, error) {
+	db := s.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	compKey := compositeKey(collection, key)
+	db.pinMu.Lock()
+	entry, ok := s.entries[compKey]
+	closed := s.closed
+	db.pinMu.Unlock()
+	if closed {
+		return nil, ErrSnapshotClosed
+	}
+	if !ok || entry.expired(s.now) {
+		return nil, ErrNotFound
+	}
+
+	rec, _, err := db.readRecord(entry.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if string(rec.Collection) != collection || string(rec.Key) != key {
+		return nil, ErrInvalidFile
+	}
+	return db.openUserValue(rec, compKey)
+}
+
+// Close releases the snapshot and the records it pins. It may be called
+// more than once.
+func (s *Snapshot) Close() {
+	db := s.db
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed, s.entries = true, nil
+	delete(db.snapshots, s)
+	db.handles--
+}
+
+// acquireHandle counts a new snapshot or iterator against
+// Options.MaxSnapshots. Callers must hold db.mu.
+func (db *DB) acquireHandle() error {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	if limit := db.opts.MaxSnapshots; limit > 0 && db.handles >= limit {
+		return ErrTooManySnapshots
+	}
+	db.handles++
+	return nil
+}
+
+// releaseHandle returns a handle taken by acquireHandle.
+func (db *DB) releaseHandle() {
+	db.pinMu.Lock()
+	db.handles--
+	db.pinMu.Unlock()
+}
+
+// checkPinned fails if an open snapshot holds a key accepted by match, whose
+// records the caller is about to reclaim. A nil match stands for every key.
+func (db *DB) checkPinned(match func(collection, key []byte) bool) error {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	for s := range db.snapshots {
+		if match == nil {
+			return ErrSnapshotOpen
+		}
+		for k := range s.entries {
+			collection, key := SplitKey(k)
+			if match([]byte(collection), []byte(key)) {
+				return ErrSnapshotOpen
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotPinsRecords(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db.nok"), "pass", Options{MaxSnapshots: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("col", "a", []byte("old"))
+	db.Put("col", "b", []byte("b"))
+	db.Put("other", "x", []byte("x"))
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "a", []byte("new"))
+	db.Delete("col", "b")
+	db.Put("col", "c", []byte("c"))
+
+	for key, want := range map[string]string{"a": "old", "b": "b"} {
+		if v, err := snap.Get("col", key); err != nil || string(v) != want {
+			t.Errorf("snapshot Get(%s) = %q, %v", key, v, err)
+		}
+	}
+	if _, err := snap.Get("col", "c"); err != ErrNotFound {
+		t.Errorf("snapshot Get of a later key: %v", err)
+	}
+
+	// The superseded and deleted records stay until the snapshot is closed
+	if err := db.Compact(); err != ErrSnapshotOpen {
+		t.Fatalf("Compact with an open snapshot: %v", err)
+	}
+	if err := db.SecureDeletePrefix("col:"); err != ErrSnapshotOpen {
+		t.Fatalf("SecureDeletePrefix of pinned keys: %v", err)
+	}
+	if v, err := db.Get("col", "a"); err != nil || string(v) != "new" {
+		t.Errorf("Get after a refused SecureDeletePrefix = %q, %v", v, err)
+	}
+	if err := db.SecureDeletePrefix("later:"); err != nil {
+		t.Errorf("SecureDeletePrefix of unpinned keys: %v", err)
+	}
+	if v, err := snap.Get("col", "a"); err != nil || string(v) != "old" {
+		t.Errorf("snapshot Get after refused reclamation = %q, %v", v, err)
+	}
+
+	// One handle is left under MaxSnapshots: 2
+	it := db.NewIterator("col:")
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if _, err := db.Snapshot(); err != ErrTooManySnapshots {
+		t.Errorf("Snapshot past the limit: %v", err)
+	}
+	if err := db.NewIterator("col:").Err(); err != ErrTooManySnapshots {
+		t.Errorf("NewIterator past the limit: %v", err)
+	}
+	if err := db.NewLiveIterator("col:", LiveIteratorOptions{}).Err(); err != ErrTooManySnapshots {
+		t.Errorf("NewLiveIterator past the limit: %v", err)
+	}
+	if _, _, err := db.Page("col:", "", 10); err != nil {
+		t.Errorf("Page at the limit: %v", err)
+	}
+	if stats, _ := db.Stats(); stats.Snapshots != 2 {
+		t.Errorf("Stats.Snapshots = %d, want 2", stats.Snapshots)
+	}
+	it.Close()
+	it.Close()
+
+	snap.Close()
+	snap.Close()
+	if _, err := snap.Get("col", "a"); err != ErrSnapshotClosed {
+		t.Errorf("Get on a closed snapshot: %v", err)
+	}
+	if stats, _ := db.Stats(); stats.Snapshots != 0 {
+		t.Errorf("Stats.Snapshots after Close = %d", stats.Snapshots)
+	}
+	result, err := db.CompactWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BytesAfter >= result.BytesBefore {
+		t.Errorf("Compact reclaimed nothing: %+v", result)
+	}
+	if err := db.SecureDeletePrefix("col:"); err != nil {
+		t.Errorf("SecureDeletePrefix after Close: %v", err)
+	}
+}
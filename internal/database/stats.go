@@ -0,0 +1,109 @@
+package database
+
+import (
+	"time"
+)
+
+// Stats is a point-in-time snapshot of database-wide counters.
+type Stats struct {
+	Keys        int       // Live (unexpired) keys in user collections
+	Collections int       // User collections with at least one live key
+	LiveBytes   int64     // On-disk bytes of current record versions
+	DeadBytes   int64     // Bytes reclaimable by Compact
+	Size        int64     // Logical size: end of the committed log
+	FileSize    int64     // Physical size of the data file
+	LastWrite   time.Time // Time of the last successful append
+	Options     Options   // Effective options, including UpdateOptions changes
+
+	BytesWritten   int64            // Log bytes appended since Open
+	Churn          map[string]Churn // Writes since Open per user collection
+	LastCompaction CompactionResult // The last Compact since Open, zero if none
+
+	Frozen      bool  // Writes are held by Freeze
+	Snapshots   int   // Open snapshots and iterators
+	BatchMemory int64 // Bytes held by uncommitted batches (Options.MaxBatchMemory)
+
+	PrefixChecks uint64 // Prefix and collection scans checked against the prefix filter since Open
+	PrefixSkips  uint64 // Of those, scans answered empty without reading the log
+
+	Compression map[string]CompressionStats // Compression attempts per user collection
+	Access      map[string]AccessStats      // Reads and writes per user collection since Open or ResetStats
+}
+
+// Size returns the logical size of the database, the end of the committed
+// log. Unlike the file size it ignores torn tails and preallocation.
+func (db *DB) Size() int64 {
+	return db.Offset()
+}
+
+// LastWriteTime returns when a record was last appended, or the file's
+// modification time at Open if nothing was written since. It takes no lock.
+func (db *DB) LastWriteTime() time.Time {
+	return time.Unix(0, db.lastWrite.Load())
+}
+
+func (db *DB) Stats() (Stats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	fi, err := db.file.Stat()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{
+		Size:      db.offset,
+		FileSize:  fi.Size(),
+		LastWrite: time.Unix(0, db.lastWrite.Load()),
+		Options:   db.opts,
+
+		Churn:          make(map[string]Churn),
+		LastCompaction: db.lastCompaction,
+		Frozen:         db.thaw != nil,
+		BatchMemory:    db.batchMemory.Load(),
+
+		PrefixChecks: db.prefixChecks.Load(),
+		PrefixSkips:  db.prefixSkips.Load(),
+
+		Access: db.accessByCollection(),
+	}
+	db.pinMu.Lock()
+	stats.Snapshots = db.handles
+	db.pinMu.Unlock()
+	stats.Compression = make(map[string]CompressionStats, len(db.compression))
+	for collection, c := range db.compression {
+		stats.Compression[collection] = c.CompressionStats
+	}
+	for collection, c := range db.churn {
+		stats.BytesWritten += c.BytesWritten
+		if !isInternalCollection(collection) {
+			stats.Churn[collection] = c
+		}
+	}
+
+	now := db.now().UnixNano()
+	collections := make(map[string]bool)
+	reset := func() {
+		stats.Keys = 0
+		clear(collections)
+	}
+	err = db.walkIndex(reset, func(k string, e indexEntry) error {
+		collection, _ := SplitKey(k)
+		if isInternalCollection(collection) || e.expired(now) {
+			return nil
+		}
+		stats.Keys++
+		collections[collection] = true
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.Collections = len(collections)
+	for _, n := range db.live {
+		stats.LiveBytes += n
+	}
+	for _, n := range db.dead {
+		stats.DeadBytes += n
+	}
+	return stats, nil
+}
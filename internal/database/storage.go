@@ -0,0 +1,32 @@
+package database
+
+import (
+	"io"
+	"os"
+)
+
+// storageFile is what the log is read from and written to: the data file
+// and the output of Compact. Outside tests it is always an *os.File; tests
+// wrap one to inject faults and simulate crashes.
+type storageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Writer
+	io.Reader
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+	Name() string
+	Fd() uintptr
+}
+
+// openStorage opens the data file or a Compact output like os.OpenFile. A
+// var so tests can substitute a faulty disk.
+var openStorage = func(name string, flag int, perm os.FileMode) (storageFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,597 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	errInjected = errors.New("injected disk fault")
+	errCrashed  = errors.New("disk crashed")
+)
+
+// faultDisk stands in for the disk under every file openStorage opens. It
+// fails every Kth write or sync, and simulates a crash: each file falls back
+// to what its last successful sync made durable, followed by a prefix of the
+// writes made since, the last of which may be torn at any byte. Writes reach
+// the file in the order they were made. A failed write may still have
+// reached part of the file, as with a disk that fills up mid-write.
+type faultDisk struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	failWrite, failSync int // Fail every Kth write or sync; 0 never
+	crashAt             int // Crash instead of the Nth write or sync; 0 never
+
+	writes, syncs, ops int
+	gen                int // Handles of an earlier generation were open at a crash
+	crashed            bool
+	inodes             []*faultInode
+}
+
+// faultInode is the durable state of one file, which all its handles share:
+// a sync through any of them makes every earlier write durable.
+type faultInode struct {
+	keeper  *os.File // Held open to roll the file back after a crash
+	info    os.FileInfo
+	synced  []byte
+	pending []faultWrite
+}
+
+// faultWrite is a write, or a truncation to off, that no sync covers yet.
+type faultWrite struct {
+	off      int64
+	data     []byte
+	truncate bool
+}
+
+// newFaultDisk puts a faulty disk under openStorage for the rest of the test.
+func newFaultDisk(t *testing.T, seed int64) *faultDisk {
+	d := &faultDisk{rng: rand.New(rand.NewSource(seed))}
+	open := openStorage
+	openStorage = d.open
+	t.Cleanup(func() {
+		openStorage = open
+		d.restart()
+	})
+	return d
+}
+
+func (d *faultDisk) open(name string, flag int, perm os.FileMode) (storageFile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.crashed {
+		return nil, errCrashed
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for _, in := range d.inodes {
+		if os.SameFile(in.info, fi) {
+			if flag&os.O_TRUNC != 0 {
+				in.pending = append(in.pending, faultWrite{truncate: true})
+			}
+			return &faultFile{File: f, disk: d, inode: in, gen: d.gen}, nil
+		}
+	}
+
+	// What a file holds when the disk first sees it is durable
+	in := &faultInode{info: fi}
+	if in.keeper, err = os.OpenFile(name, os.O_RDWR, 0); err == nil {
+		in.synced, err = in.contents()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.inodes = append(d.inodes, in)
+	return &faultFile{File: f, disk: d, inode: in, gen: d.gen}, nil
+}
+
+func (in *faultInode) contents() ([]byte, error) {
+	fi, err := in.keeper.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, fi.Size())
+	if _, err := in.keeper.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// fault counts a write or sync of a handle of generation gen and returns the
+// error it fails with, if any. Callers must hold d.mu.
+func (d *faultDisk) fault(gen int, count *int, every int) error {
+	if d.crashed || gen != d.gen {
+		return errCrashed
+	}
+	if d.ops++; d.ops == d.crashAt {
+		d.crash()
+		return errCrashed
+	}
+	if *count++; every > 0 && *count%every == 0 {
+		return errInjected
+	}
+	return nil
+}
+
+// crash loses what no sync covers. Callers must hold d.mu.
+func (d *faultDisk) crash() {
+	d.crashed = true
+	for _, in := range d.inodes {
+		keep := d.rng.Intn(len(in.pending) + 1)
+		replay := slices.Clip(in.pending[:keep])
+		if keep < len(in.pending) && !in.pending[keep].truncate && d.rng.Intn(2) == 0 {
+			w := in.pending[keep]
+			replay = append(replay, faultWrite{off: w.off, data: w.data[:d.rng.Intn(len(w.data)+1)]})
+		}
+		in.keeper.Truncate(int64(len(in.synced)))
+		in.keeper.WriteAt(in.synced, 0)
+		for _, w := range replay {
+			if w.truncate {
+				in.keeper.Truncate(w.off)
+			} else {
+				in.keeper.WriteAt(w.data, w.off)
+			}
+		}
+	}
+}
+
+// crashNow crashes the disk between two operations.
+func (d *faultDisk) crashNow() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.crashed {
+		d.crash()
+	}
+}
+
+func (d *faultDisk) isCrashed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.crashed
+}
+
+// restart brings the disk back after a crash. Handles opened before it keep
+// failing, and whatever the files now hold is durable.
+func (d *faultDisk) restart() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, in := range d.inodes {
+		in.keeper.Close()
+	}
+	d.inodes = nil
+	d.crashed = false
+	d.gen++
+}
+
+// setFaults makes every failWrite-th write and failSync-th sync fail from
+// now on; zero turns a kind of fault off.
+func (d *faultDisk) setFaults(failWrite, failSync int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failWrite, d.failSync = failWrite, failSync
+	d.writes, d.syncs = 0, 0
+}
+
+// crashAfter crashes the disk instead of the nth write or sync from now.
+func (d *faultDisk) crashAfter(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.crashAt = d.ops + n
+}
+
+// faultFile is a handle on a file of a faultDisk.
+type faultFile struct {
+	*os.File
+	disk  *faultDisk
+	inode *faultInode
+	gen   int
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	d := f.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.fault(f.gen, &d.writes, d.failWrite)
+	if err == errCrashed {
+		return 0, err
+	}
+	if err != nil {
+		p = p[:d.rng.Intn(len(p)+1)]
+	}
+	n, werr := f.File.WriteAt(p, off)
+	f.inode.pending = append(f.inode.pending, faultWrite{off: off, data: slices.Clone(p[:n])})
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.WriteAt(p, off)
+	if _, serr := f.File.Seek(off+int64(n), io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	d := f.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.fault(f.gen, &d.writes, d.failWrite); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.inode.pending = append(f.inode.pending, faultWrite{off: size, truncate: true})
+	return nil
+}
+
+func (f *faultFile) Sync() error {
+	d := f.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.fault(f.gen, &d.syncs, d.failSync); err != nil {
+		return err
+	}
+	data, err := f.inode.contents()
+	if err != nil {
+		return err
+	}
+	f.inode.synced, f.inode.pending = data, nil
+	return nil
+}
+
+// dropTail cuts the last n bytes off the file at path.
+func dropTail(t *testing.T, path string, n int64) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, max(fi.Size()-n, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// flipBits flips n random bits of the file at path between from and to, or
+// its end if to is negative.
+func flipBits(t *testing.T, rng *rand.Rand, path string, from, to int64, n int) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to < 0 || to > int64(len(data)) {
+		to = int64(len(data))
+	}
+	if from >= to {
+		return
+	}
+	for range n {
+		data[from+rng.Int63n(to-from)] ^= 1 << rng.Intn(8)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crashWorkload runs random writes, batches and compactions against a
+// database on a faultDisk, and tracks the states the database may be found
+// in after a crash. Every value is unique, so a value read back names the
+// write it came from.
+type crashWorkload struct {
+	t    *testing.T
+	rng  *rand.Rand
+	disk *faultDisk
+	path string
+	opts Options
+	db   *DB
+	n    int
+
+	state       map[string]string   // After every write that succeeded
+	recoverable []map[string]string // What a crash may leave
+	written     map[string][]string // Every value each key was ever given
+}
+
+// kv is a write of value to key, or its delete if value is empty.
+type kv struct{ key, value string }
+
+func newCrashWorkload(t *testing.T, seed int64) *crashWorkload {
+	w := &crashWorkload{
+		t:       t,
+		rng:     rand.New(rand.NewSource(seed)),
+		disk:    newFaultDisk(t, seed),
+		path:    filepath.Join(t.TempDir(), "db.nok"),
+		opts:    Options{KDF: KDFParams{Memory: 64, Parallelism: 1}},
+		state:   make(map[string]string),
+		written: make(map[string][]string),
+	}
+	w.opts.SyncWrites = w.rng.Intn(2) == 0
+	w.recoverable = []map[string]string{w.state}
+	w.open()
+	t.Cleanup(func() {
+		if w.db != nil {
+			w.db.Close()
+		}
+	})
+	return w
+}
+
+// open opens the database, trying again while injected faults fail it. If
+// the disk crashes meanwhile, w.db is left nil.
+func (w *crashWorkload) open() {
+	w.t.Helper()
+	for {
+		db, err := OpenWithOptions(w.path, "pass", w.opts)
+		switch {
+		case err == nil:
+			w.db = db
+			return
+		case errors.Is(err, errCrashed):
+			return
+		case !errors.Is(err, errInjected):
+			w.t.Fatalf("open: %v", err)
+		}
+	}
+}
+
+// read returns the live records of the database.
+func (w *crashWorkload) read(db *DB) (map[string]string, error) {
+	recs, err := db.ScanPrefix("")
+	if err != nil {
+		return nil, err
+	}
+	got := make(map[string]string, len(recs))
+	for _, rec := range recs {
+		got[rec.Key] = string(rec.Value)
+	}
+	return got, nil
+}
+
+func applied(state map[string]string, effects []kv) map[string]string {
+	state = maps.Clone(state)
+	for _, e := range effects {
+		if e.value == "" {
+			delete(state, e.key)
+		} else {
+			state[e.key] = e.value
+		}
+	}
+	return state
+}
+
+// attempted notes a write of effects that returned err. A crash may keep a
+// prefix of its records even if it failed, and it only needs a sync to be
+// durable if it succeeded.
+func (w *crashWorkload) attempted(err error, effects []kv, synced bool) {
+	w.t.Helper()
+	for m := 1; m <= len(effects); m++ {
+		w.recoverable = append(w.recoverable, applied(w.state, effects[:m]))
+	}
+	for _, e := range effects {
+		w.written[e.key] = append(w.written[e.key], e.value)
+	}
+	switch {
+	case err == nil:
+		w.state = applied(w.state, effects)
+		if synced {
+			w.recoverable = []map[string]string{w.state}
+		}
+	case errors.Is(err, errInjected), errors.Is(err, errCrashed):
+	default:
+		w.t.Fatalf("write %d: %v", w.n, err)
+	}
+}
+
+func (w *crashWorkload) write(key string) kv {
+	w.n++
+	if w.rng.Intn(4) == 0 {
+		return kv{key: key}
+	}
+	return kv{key, fmt.Sprintf("%s@%d", key, w.n)}
+}
+
+// step runs one random operation.
+func (w *crashWorkload) step() {
+	w.t.Helper()
+	key := func() string { return fmt.Sprint("k", w.rng.Intn(40)) }
+	switch op := w.rng.Intn(20); {
+	case op < 12:
+		e := w.write(key())
+		var err error
+		synced := w.opts.SyncWrites
+		if e.value == "" {
+			// Deleting a missing key writes nothing, so syncs nothing
+			_, live := w.state[e.key]
+			synced = synced && live
+			err = w.db.Delete("c", e.key)
+		} else {
+			err = w.db.Put("c", e.key, []byte(e.value))
+		}
+		w.attempted(err, []kv{e}, synced)
+	case op < 17:
+		b := w.db.NewBatch()
+		var effects []kv
+		for _, i := range w.rng.Perm(40)[:2+w.rng.Intn(6)] {
+			e := w.write(fmt.Sprint("k", i))
+			if e.value == "" {
+				b.Delete("c", e.key)
+			} else {
+				b.Put("c", e.key, []byte(e.value), 0)
+			}
+			effects = append(effects, e)
+		}
+		w.attempted(b.Commit(), effects, true)
+	case op < 19:
+		w.attempted(w.db.Compact(), nil, true)
+	default:
+		// A clean close syncs nothing: what the last session wrote is only
+		// durable once something syncs it
+		w.db.Close()
+		w.db = nil
+		w.open()
+	}
+}
+
+// checkLive fails unless the open database holds exactly the writes that
+// succeeded.
+func (w *crashWorkload) checkLive(when string) {
+	w.t.Helper()
+	got, err := w.read(w.db)
+	if err != nil {
+		w.t.Fatalf("%s: %v", when, err)
+	}
+	if !maps.Equal(got, w.state) {
+		w.t.Fatalf("%s: database holds %v, want %v", when, got, w.state)
+	}
+}
+
+// crashAndReopen crashes the disk, reopens the database and checks it holds
+// one of the states the crash may have left.
+func (w *crashWorkload) crashAndReopen() {
+	w.t.Helper()
+	w.disk.crashNow()
+	w.db = nil // Abandoned like a crashed process
+	w.disk.restart()
+	if w.open(); w.db == nil {
+		w.t.Fatal("open after a crash: disk crashed again")
+	}
+	got, err := w.read(w.db)
+	if err != nil {
+		w.t.Fatalf("reading after a crash: %v", err)
+	}
+	if !slices.ContainsFunc(w.recoverable, func(s map[string]string) bool { return maps.Equal(s, got) }) {
+		w.t.Fatalf("after a crash the database holds %v, which no prefix of the log since the last sync gives; last state %v", got, w.state)
+	}
+	w.state = got
+	w.recoverable = []map[string]string{got}
+}
+
+// openDamaged opens a damaged database. With paranoid checks in effect, as
+// under the nokhaldebug tag, a violation they find counts as an error.
+func openDamaged(path string, opts Options) (db *DB, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(string)
+			if !ok || !strings.Contains(msg, "invariant violated") {
+				panic(r)
+			}
+			err = errors.New(msg)
+		}
+	}()
+	return OpenWithOptions(path, "pass", opts)
+}
+
+func TestCrashRecovery(t *testing.T) {
+	for seed := range int64(40) {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			w := newCrashWorkload(t, seed)
+			if seed%2 == 1 {
+				w.disk.setFaults(4+w.rng.Intn(8), 4+w.rng.Intn(8))
+			}
+			for range 4 {
+				w.disk.crashAfter(1 + w.rng.Intn(80))
+				for !w.disk.isCrashed() {
+					w.step()
+				}
+				w.crashAndReopen()
+			}
+		})
+	}
+}
+
+func TestFaultyWrites(t *testing.T) {
+	for seed := range int64(20) {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			w := newCrashWorkload(t, seed)
+			w.disk.setFaults(2+w.rng.Intn(6), 2+w.rng.Intn(6))
+			for i := range 150 {
+				w.step()
+				w.checkLive(fmt.Sprint("after step ", i))
+			}
+
+			// Without a crash, every write that succeeded is found again and
+			// none that failed
+			w.disk.setFaults(0, 0)
+			w.db.Close()
+			w.open()
+			w.checkLive("after reopening")
+		})
+	}
+}
+
+func TestCorruptionDetected(t *testing.T) {
+	for seed := range int64(40) {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			w := newCrashWorkload(t, seed)
+			for range 60 {
+				w.step()
+			}
+			w.db.Close()
+			w.db = nil
+
+			hintDamaged := false
+			switch seed % 4 {
+			case 0:
+				dropTail(t, w.path, 1+w.rng.Int63n(200))
+			case 1:
+				flipBits(t, w.rng, w.path, headerSize, -1, 1+w.rng.Intn(3))
+			case 2:
+				flipBits(t, w.rng, w.path, 0, headerSize, 1)
+			case 3:
+				flipBits(t, w.rng, w.path+".hint", 0, -1, 1+w.rng.Intn(3))
+				hintDamaged = true
+			}
+
+			// Damage is caught or costs records, but never yields a value
+			// that was not written to its key
+			db, err := openDamaged(w.path, w.opts)
+			if err != nil {
+				if hintDamaged {
+					t.Fatalf("open with a damaged hint: %v", err)
+				}
+				return
+			}
+			defer db.Close()
+			got, err := w.read(db)
+			if hintDamaged {
+				if err != nil || !maps.Equal(got, w.state) {
+					t.Fatalf("with a damaged hint the database holds %v, %v; want %v", got, err, w.state)
+				}
+				return
+			}
+			if err != nil {
+				return
+			}
+			for key, value := range got {
+				if !slices.Contains(w.written[key], value) {
+					t.Errorf("%s reads back %q, which was never written to it", key, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+)
+
+// Transform rewrites the values of a collection at the API boundary, for
+// example to encrypt some JSON fields under a second key or to redact them
+// for a low-privilege reader. Encode runs on every value written to the
+// collection before nokhal compresses and encrypts it; Decode runs on every
+// value read, after decryption. key is the key within the collection. Both
+// run with the database locked and must not call back into it.
+type Transform interface {
+	Encode(key string, plaintext []byte) ([]byte, error)
+	Decode(key string, stored []byte) ([]byte, error)
+}
+
+var ErrNoTransform = errors.New("value was written with a transform that is not set")
+
+// SetTransform installs t for collection, or removes the collection's
+// transform if t is nil. Transforms live in memory only: set them again
+// after every Open. Values written under a transform are flagged
+// FlagTransformed, so values written without one, before it was set or
+// after it was removed, are returned as stored; reading a flagged value
+// with no transform set fails with ErrNoTransform. The file must declare
+// FeatureTransforms.
+func (db *DB) SetTransform(collection string, t Transform) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if isInternalCollection(collection) {
+		return ErrCollectionInUse
+	}
+	if !db.hasFeature(FeatureTransforms) {
+		return fmt.Errorf("%w: %s (see EnableFeature)", ErrFeatureNotEnabled, FeatureTransforms)
+	}
+	transforms := maps.Clone(db.transformMap())
+	if transforms == nil {
+		transforms = make(map[string]Transform)
+	}
+	if t == nil {
+		delete(transforms, collection)
+	} else {
+		transforms[collection] = t
+	}
+	db.transforms.Store(&transforms)
+	return nil
+}
+
+// transformMap returns the installed transforms by collection. The map is
+// replaced rather than changed, so it may be read without db.mu.
+func (db *DB) transformMap() map[string]Transform {
+	if transforms := db.transforms.Load(); transforms != nil {
+		return *transforms
+	}
+	return nil
+}
+
+// transformValue applies the transform of collection, if any, to a value
+// being written and returns the flags to seal it with. Callers must hold
+// db.mu.
+func (db *DB) transformValue(collection, key string, value []byte) ([]byte, byte, error) {
+	t := db.transformMap()[collection]
+	if t == nil {
+		return value, FlagNone, nil
+	}
+	encoded, err := t.Encode(key, value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return encoded, FlagTransformed, nil
+}
+
+// untransform undoes the transform of a value read for a caller, given the
+// flags of its record.
+func (db *DB) untransform(collection, key string, flags byte, stored []byte) ([]byte, error) {
+	if flags&FlagTransformed == 0 {
+		return stored, nil
+	}
+	t := db.transformMap()[collection]
+	if t == nil {
+		return nil, ErrNoTransform
+	}
+	return t.Decode(key, stored)
+}
+
+// openUserValue opens the value of rec like openValue and undoes its
+// transform, giving the value as the caller wrote it.
+func (db *DB) openUserValue(rec *record, compKey string) ([]byte, error) {
+	value, err := db.openValue(rec, compKey)
+	if err != nil {
+		return nil, err
+	}
+	return db.untransform(string(rec.Collection), string(rec.Key), rec.Flags, value)
+}
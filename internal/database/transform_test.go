@@ -0,0 +1,133 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// tagTransform prefixes values with their key and counts encodes.
+type tagTransform struct{ encodes int }
+
+func (t *tagTransform) Encode(key string, plaintext []byte) ([]byte, error) {
+	t.encodes++
+	return append([]byte("tag:"+key+":"), plaintext...), nil
+}
+
+func (t *tagTransform) Decode(key string, stored []byte) ([]byte, error) {
+	prefix := []byte("tag:" + key + ":")
+	if !bytes.HasPrefix(stored, prefix) {
+		return nil, fmt.Errorf("value not tagged for %q: %q", key, stored)
+	}
+	return stored[len(prefix):], nil
+}
+
+func TestTransform(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tr := &tagTransform{}
+	if err := db.SetTransform("col", tr); !errors.Is(err, ErrFeatureNotEnabled) {
+		t.Fatalf("SetTransform on an undeclared feature: %v", err)
+	}
+	if err := db.EnableFeature(FeatureTransforms); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored returns the value of key as it is in the log, and its flags
+	stored := func(key string) ([]byte, byte) {
+		t.Helper()
+		rec, _, err := db.readRecord(indexed(t, db, "col:"+key).Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.openValue(rec, "col:"+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value, rec.Flags
+	}
+
+	// Values written before the transform is set stay as they are
+	db.Put("col", "plain", []byte("p"))
+	if err := db.SetTransform("col", tr); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("col", "put", []byte("1"))
+	b := db.NewBatch()
+	b.Put("col", "batch", []byte("2"), 0)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, flags := stored("put"); string(v) != "tag:put:1" || flags&FlagTransformed == 0 {
+		t.Errorf("stored %q with flags %08b", v, flags)
+	}
+	if v, flags := stored("plain"); string(v) != "p" || flags&FlagTransformed != 0 {
+		t.Errorf("untransformed value stored %q with flags %08b", v, flags)
+	}
+
+	want := map[string]string{"plain": "p", "put": "1", "batch": "2"}
+	check := func() {
+		t.Helper()
+		for k, w := range want {
+			if v, err := db.Get("col", k); err != nil || string(v) != w {
+				t.Errorf("Get(%s) = %q, %v", k, v, err)
+			}
+		}
+		records, err := db.ScanPrefix("col:")
+		if err != nil || len(records) != len(want) {
+			t.Fatalf("ScanPrefix = %v, %v", records, err)
+		}
+		for _, r := range records {
+			if string(r.Value) != want[r.Key] {
+				t.Errorf("ScanPrefix %s = %q", r.Key, r.Value)
+			}
+		}
+		values, err := db.GetMulti("col", []string{"put", "batch"})
+		if err != nil || string(values[0]) != want["put"] || string(values[1]) != want["batch"] {
+			t.Errorf("GetMulti = %q, %v", values, err)
+		}
+	}
+	check()
+
+	// Swap moves values between keys, so they are encoded for their new key
+	if err := db.Swap("col", "put", "batch"); err != nil {
+		t.Fatal(err)
+	}
+	want["put"], want["batch"] = "2", "1"
+	check()
+
+	// Compaction and key rotation keep the stored bytes and encode nothing
+	before, _ := stored("put")
+	encodes := tr.encodes
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BeginKeyRotation(); err != nil {
+		t.Fatal(err)
+	}
+	check() // Re-seals under the new key
+	after, flags := stored("put")
+	if !bytes.Equal(before, after) || flags&(FlagTransformed|FlagKeyID) != FlagTransformed|FlagKeyID {
+		t.Errorf("stored %q with flags %08b after compaction and re-seal, want %q transformed", after, flags, before)
+	}
+	if tr.encodes != encodes {
+		t.Errorf("%d encodes during compaction and re-seal", tr.encodes-encodes)
+	}
+
+	// Without the transform, flagged values cannot be read
+	if err := db.SetTransform("col", nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("col", "plain"); err != nil || string(v) != "p" {
+		t.Errorf("Get(plain) = %q, %v", v, err)
+	}
+	if _, err := db.Get("col", "put"); err != ErrNoTransform {
+		t.Errorf("Get of a transformed value without the transform: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Write-ahead log entries are records of a reserved collection keyed by
+// their offset in fixed-width hex, so that key order is append order. The
+// offset is a sequence number, not a file position: it never changes,
+// whatever compaction does to the file. Truncation stores a mark in meta;
+// entries below it are hidden at once and dropped by the next Compact.
+const (
+	walCollection = internalPrefix + "_wal"
+	metaWALMark   = "wal:mark"
+
+	// walReadChunk bounds the entries ReadEntries decrypts at once
+	walReadChunk = 256
+)
+
+// AppendEntry adds data to the end of the write-ahead log and returns its
+// offset. Offsets start at zero and increase by one with each entry; they
+// are never reused, even after TruncateBefore. The entry is written like a
+// Put: it is durable once the file is synced, at once with SyncWrites. An
+// entry torn by a crash is dropped on Open with the rest of the torn tail,
+// and the next append reuses its offset, which was never returned.
+func (db *DB) AppendEntry(data []byte) (offset int64, err error) {
+	if err := db.lockWrite(); err != nil {
+		return 0, err
+	}
+	defer db.mu.Unlock()
+
+	n, err := db.nextWALOffset()
+	if err != nil {
+		return 0, err
+	}
+	if err := db.put(walCollection, fmt.Sprintf("%016x", n), data, 0); err != nil {
+		return 0, err
+	}
+	db.walNext = n + 1
+	return int64(n), nil
+}
+
+// ReadEntries calls fn with the entries of the write-ahead log at or after
+// from, in offset order, until fn returns an error, which ReadEntries then
+// returns. Entries below the truncation mark are skipped. fn runs without
+// the lock held, so it may append or truncate; entries appended while
+// ReadEntries runs are not visited, and entries truncated meanwhile may be.
+func (db *DB) ReadEntries(from int64, fn func(offset int64, data []byte) error) error {
+	db.mu.RLock()
+	var keys []string
+	prefix := walCollection + ":"
+	err := db.index.each(func(k string, _ indexEntry) error {
+		if strings.HasPrefix(k, prefix) && !db.walTruncated(k) {
+			if n, _ := walOffset(k); int64(n) >= from {
+				keys = append(keys, k)
+			}
+		}
+		return nil
+	})
+	now := db.now().UnixNano()
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	slices.Sort(keys)
+
+	for len(keys) > 0 {
+		chunk := keys[:min(len(keys), walReadChunk)]
+		keys = keys[len(chunk):]
+		records, found, err := db.getRecords(chunk, now)
+		if err != nil {
+			return err
+		}
+		for i, rec := range records {
+			// Dropped by a Compact since the keys were collected
+			if !found[i] {
+				continue
+			}
+			n, _ := walOffset(chunk[i])
+			if err := fn(int64(n), rec.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TruncateBefore discards the entries of the write-ahead log below offset.
+// It writes a single record: the entries disappear from ReadEntries at once
+// and their space is reclaimed by the next Compact. An offset past the end
+// of the log truncates everything, and the next append still gets the
+// offset that follows the last one.
+func (db *DB) TruncateBefore(offset int64) error {
+	if err := db.lockWrite(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	next, err := db.nextWALOffset()
+	if err != nil {
+		return err
+	}
+	mark := min(uint64(max(offset, 0)), next)
+	if mark <= db.walMark {
+		return nil
+	}
+	return db.putMeta(metaWALMark, []byte(strconv.FormatUint(mark, 10)))
+}
+
+// nextWALOffset returns the offset of the next entry. The first append after
+// Open finds it from the last entry and the truncation mark; later ones use
+// the cached value. Callers must hold db.mu.
+func (db *DB) nextWALOffset() (uint64, error) {
+	if db.walNext > 0 {
+		return db.walNext, nil
+	}
+	next := db.walMark
+	prefix := walCollection + ":"
+	err := db.index.each(func(k string, _ indexEntry) error {
+		if !strings.HasPrefix(k, prefix) {
+			return nil
+		}
+		n, err := walOffset(k)
+		if err != nil {
+			return err
+		}
+		next = max(next, n+1)
+		return nil
+	})
+	return next, err
+}
+
+// walTruncated reports whether compKey is a write-ahead log entry below the
+// truncation mark. Callers must hold db.mu.
+func (db *DB) walTruncated(compKey string) bool {
+	if db.walMark == 0 || !strings.HasPrefix(compKey, walCollection+":") {
+		return false
+	}
+	n, err := walOffset(compKey)
+	return err == nil && n < db.walMark
+}
+
+// walOffset parses the offset of the write-ahead log entry compKey.
+func walOffset(compKey string) (uint64, error) {
+	_, key := SplitKey(compKey)
+	n, err := strconv.ParseUint(key, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt log entry key %q: %w", compKey, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	reopen := func() {
+		t.Helper()
+		db.Close()
+		if db, err = Open(path, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendN := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			want, err := db.nextWALOffset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset, err := db.AppendEntry([]byte(fmt.Sprintf("e%d", want)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != int64(want) {
+				t.Fatalf("AppendEntry returned %d, want %d", offset, want)
+			}
+		}
+	}
+	read := func(from int64) []int64 {
+		t.Helper()
+		var offsets []int64
+		err := db.ReadEntries(from, func(offset int64, data []byte) error {
+			if string(data) != fmt.Sprintf("e%d", offset) {
+				t.Errorf("entry %d holds %q", offset, data)
+			}
+			offsets = append(offsets, offset)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return offsets
+	}
+	expect := func(stage string, from int64, first, end int64) {
+		t.Helper()
+		var want []int64
+		for i := first; i < end; i++ {
+			want = append(want, i)
+		}
+		if got := read(from); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: ReadEntries(%d) = %v, want %v", stage, from, got, want)
+		}
+	}
+
+	// The log coexists with regular keys without showing up among them
+	db.Put("col", "k", []byte("v"))
+	appendN(10)
+	expect("appended", 0, 0, 10)
+	expect("appended", 5, 5, 10)
+	if keys, _ := db.AllKeys(); !reflect.DeepEqual(keys, []string{"col:k"}) {
+		t.Errorf("AllKeys = %v", keys)
+	}
+
+	stop := errors.New("stop")
+	var visited int
+	err = db.ReadEntries(0, func(int64, []byte) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("ReadEntries returned %v after %d entries, want stop after 1", err, visited)
+	}
+
+	// Truncated entries disappear at once, and offsets survive compaction
+	if err := db.TruncateBefore(4); err != nil {
+		t.Fatal(err)
+	}
+	expect("truncated", 0, 4, 10)
+	result, err := db.CompactWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LiveRecords != 8 { // col:k, six entries and the mark
+		t.Errorf("compaction kept %d records, want 8", result.LiveRecords)
+	}
+	expect("compacted", 0, 4, 10)
+	appendN(1)
+	reopen()
+	expect("reopened", 0, 4, 11)
+
+	// Truncating past the end empties the log without skipping offsets
+	if err := db.TruncateBefore(100); err != nil {
+		t.Fatal(err)
+	}
+	expect("emptied", 0, 0, 0)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	appendN(2)
+	expect("after emptying", 0, 11, 13)
+	if err := db.TruncateBefore(5); err != nil {
+		t.Fatal(err)
+	}
+	expect("mark never moves back", 0, 11, 13)
+
+	// An entry torn by a crash is dropped, and its offset is handed out again
+	cut := db.Offset() + 7
+	appendN(1)
+	db.Close()
+	if err := os.Truncate(path, cut); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path + ".hint")
+	if db, err = Open(path, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	expect("torn tail", 0, 11, 13)
+	appendN(1)
+	expect("after torn tail", 0, 11, 14)
+	if v, err := db.Get("col", "k"); err != nil || string(v) != "v" {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+}
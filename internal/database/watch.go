@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+)
+
+// ErrLogCompacted is returned by WatchFrom and Subscription.Next when a
+// checkpoint lies in a log that Compact has since replaced, or past the end
+// of the log. The changes since the checkpoint are gone; the consumer must
+// resync from the current state, for example with ScanPrefix, and watch
+// again from a checkpoint taken before it.
+var ErrLogCompacted = errors.New("log compacted past checkpoint")
+
+// Checkpoint is a position in the log, after the last change a Subscription
+// returned. It stays valid across restarts, so consumers persist it to
+// resume where they left off. The zero Checkpoint is the start of the log.
+type Checkpoint struct {
+	Epoch  uint64 // Identifies the log, which each Compact replaces
+	Offset int64  // Log offset of the next record
+}
+
+// Event is a change read from the log by a Subscription: a write (Op
+// OpPut) with its value, or a delete (Op OpDelete) without one.
+type Event = Record
+
+// logHorizon describes the log the last Compact replaced, so that a
+// checkpoint at its end, which has seen every change it held, carries over
+// to the compacted log.
+type logHorizon struct {
+	Epoch uint64 // Of the replaced log
+	End   int64  // Its end
+	Start int64  // End of the compacted log, where later writes began
+}
+
+// newLogEpoch draws the epoch of a compacted log.
+func newLogEpoch() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// Subscription reads the changes under a prefix from the log in order,
+// starting at a checkpoint. See WatchFrom.
+type Subscription struct {
+	db     *DB
+	prefix string
+	at     Checkpoint
+}
+
+// WatchFrom returns a Subscription to the changes of the keys whose combined
+// key (collection:key) starts with prefix, from checkpoint on. Next replays
+// the records already in the log, then waits for new ones, so a consumer
+// never misses a change and never sees one twice, however far it falls
+// behind. Internal collections are only visible when prefix names them.
+// A checkpoint in a log replaced by Compact fails with ErrLogCompacted,
+// unless it is the end of the log the last Compact replaced, which carries
+// over to the compacted log.
+func (db *DB) WatchFrom(checkpoint Checkpoint, prefix string) (*Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, os.ErrClosed
+	}
+	at, err := db.resolveCheckpoint(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{db: db, prefix: prefix, at: at}, nil
+}
+
+// Next returns the next change and the checkpoint after it, waiting for one
+// until ctx ends. A Compact that replaces the log under a subscription that
+// has not reached its end fails Next with ErrLogCompacted. Any other error,
+// such as a value that fails to decrypt, leaves the subscription at the
+// change, so Next returns it again. Next must not be called concurrently.
+func (s *Subscription) Next(ctx context.Context) (Event, Checkpoint, error) {
+	db := s.db
+	for {
+		db.mu.RLock()
+		if db.closed {
+			db.mu.RUnlock()
+			return Event{}, s.at, os.ErrClosed
+		}
+		at, err := db.resolveCheckpoint(s.at)
+		if err != nil {
+			db.mu.RUnlock()
+			return Event{}, s.at, err
+		}
+		s.at = at
+
+		if s.at.Offset < db.offset {
+			ev, size, ok, err := db.readEvent(s.at.Offset, s.prefix)
+			db.mu.RUnlock()
+			if err != nil {
+				return Event{}, s.at, err
+			}
+			s.at.Offset += size
+			if ok {
+				return ev, s.at, nil
+			}
+			continue
+		}
+
+		wait := db.watchChan()
+		db.mu.RUnlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return Event{}, s.at, ctx.Err()
+		}
+	}
+}
+
+// resolveCheckpoint returns c as a position in the current log. Callers
+// must hold db.mu.
+func (db *DB) resolveCheckpoint(c Checkpoint) (Checkpoint, error) {
+	h := db.header
+	switch {
+	case c.Offset == 0:
+		return Checkpoint{Epoch: h.LogEpoch, Offset: int64(headerSize)}, nil
+	case c.Epoch == h.LogEpoch:
+		if c.Offset < int64(headerSize) || c.Offset > db.offset {
+			return c, ErrLogCompacted
+		}
+		return c, nil
+	case c.Epoch == h.Horizon.Epoch && c.Offset == h.Horizon.End:
+		return Checkpoint{Epoch: h.LogEpoch, Offset: h.Horizon.Start}, nil
+	}
+	return c, ErrLogCompacted
+}
+
+// readEvent reads the record at offset as an Event, reporting its size and
+// whether it is a change under prefix. Callers must hold db.mu.
+func (db *DB) readEvent(offset int64, prefix string) (Event, int64, bool, error) {
+	rec, size, err := db.readRecord(offset)
+	if err != nil {
+		return Event{}, 0, false, err
+	}
+	if skip, err := checkOp(rec.Op, offset); err != nil {
+		return Event{}, size, false, err
+	} else if skip {
+		return Event{}, size, false, db.verifySkipped(rec)
+	}
+	collection := string(rec.Collection)
+	compKey := compositeKey(collection, string(rec.Key))
+	if !strings.HasPrefix(compKey, prefix) || hiddenFromPrefix(collection, prefix) {
+		return Event{}, size, false, nil
+	}
+
+	ev := Event{
+		Timestamp:  rec.Timestamp,
+		ExpiresAt:  rec.ExpiresAt,
+		Collection: collection,
+		Key:        string(rec.Key),
+		Op:         rec.Op,
+	}
+	if rec.Op != OpDelete {
+		if ev.Value, err = db.openUserValue(rec, compKey); err != nil {
+			return Event{}, 0, false, err
+		}
+	}
+	return ev, size, true, nil
+}
+
+// watchChan returns a channel closed by the next wakeWatchers. Callers must
+// hold db.mu, so that no change slips in before they wait.
+func (db *DB) watchChan() <-chan struct{} {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if db.appended == nil {
+		db.appended = make(chan struct{})
+	}
+	return db.appended
+}
+
+// wakeWatchers wakes the subscriptions waiting for the log to change.
+// Callers must hold db.mu for writing.
+func (db *DB) wakeWatchers() {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if db.appended != nil {
+		close(db.appended)
+		db.appended = nil
+	}
+}
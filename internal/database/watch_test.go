@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.nok")
+	db, err := Open(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	db.Put("users", "alice", []byte("1"))
+	db.Put("other", "x", []byte("x"))
+	db.Put("users", "bob", []byte("2"))
+	db.Delete("users", "alice")
+	db.Append("users", "bob", []byte("list entries live in an internal collection"))
+
+	type change struct {
+		op       byte
+		key, val string
+	}
+	next := func(sub *Subscription) (change, Checkpoint) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ev, at, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		return change{ev.Op, ev.Collection + ":" + ev.Key, string(ev.Value)}, at
+	}
+
+	sub, err := db.WatchFrom(Checkpoint{}, "users:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := []change{{OpPut, "users:alice", "1"}, {OpPut, "users:bob", "2"}, {OpDelete, "users:alice", ""}}
+	var checkpoints []Checkpoint
+	for _, want := range history {
+		got, at := next(sub)
+		if got != want {
+			t.Errorf("replayed %+v, want %+v", got, want)
+		}
+		checkpoints = append(checkpoints, at)
+	}
+
+	// Past the history, Next waits for a write
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if _, _, err := sub.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Next at the end of the log: %v", err)
+	}
+	cancel()
+
+	// Live writes follow the history with no gap or duplicate at the switch,
+	// whether they land before or while the subscription waits
+	const writers, perWriter = 4, 200
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				key := fmt.Sprintf("w%d-%03d", w, i)
+				if i%50 == 0 {
+					b := db.NewBatch()
+					b.Put("users", key, []byte(key), 0)
+					b.Put("other", key, []byte(key), 0)
+					if err := b.Commit(); err != nil {
+						t.Error(err)
+					}
+					continue
+				}
+				if err := db.Put("users", key, []byte(key)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	last := make([]int, writers)
+	for i := range last {
+		last[i] = -1
+	}
+	var live []change
+	for range writers * perWriter {
+		got, at := next(sub)
+		live = append(live, got)
+		checkpoints = append(checkpoints, at)
+		var w, i int
+		if _, err := fmt.Sscanf(got.key, "users:w%d-%d", &w, &i); err != nil || got.val != got.key[len("users:"):] {
+			t.Fatalf("unexpected change %+v", got)
+		}
+		if i != last[w]+1 {
+			t.Fatalf("writer %d: change %d after %d", w, i, last[w])
+		}
+		last[w] = i
+	}
+	wg.Wait()
+
+	// A consumer restarted from any checkpoint resumes right after it
+	all := append(history, live...)
+	for _, i := range []int{0, 2, 3, 100, len(all) - 2} {
+		sub, err := db.WatchFrom(checkpoints[i], "users:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := next(sub); got != all[i+1] {
+			t.Errorf("resumed after change %d with %+v, want %+v", i, got, all[i+1])
+		}
+	}
+
+	// A checkpoint taken at the end of the log survives Compact and a reopen
+	end := checkpoints[len(checkpoints)-1]
+	behind := checkpoints[len(checkpoints)-2]
+	lagging, err := db.WatchFrom(behind, "users:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := lagging.Next(ctx); err != ErrLogCompacted {
+		t.Errorf("Next of a subscription behind Compact: %v", err)
+	}
+	if _, err := db.WatchFrom(behind, "users:"); err != ErrLogCompacted {
+		t.Errorf("WatchFrom a checkpoint before Compact: %v", err)
+	}
+	db.Close()
+	if db, err = Open(path, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err = db.WatchFrom(end, "users:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("users", "carol", []byte("3"))
+	if got, _ := next(sub); got != (change{OpPut, "users:carol", "3"}) {
+		t.Errorf("first change after Compact: %+v", got)
+	}
+	if _, err := db.WatchFrom(Checkpoint{Epoch: end.Epoch, Offset: 1 << 40}, ""); err != ErrLogCompacted {
+		t.Errorf("WatchFrom past the end of the log: %v", err)
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.WatchFrom(Checkpoint{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, _, err := sub.Next(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	db.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Next across Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not wake a waiting subscription")
+	}
+}
@@ -0,0 +1,410 @@
+// Command gengolden writes the on-disk format fixtures read by the
+// compatibility tests in internal/database.
+//
+// Run it whenever a change affects the file format, including a new optional
+// header or record feature, after adding a scenario for it:
+//
+//	go run ./internal/gengolden
+//
+// Fixtures are named after the format version that wrote them. Existing
+// fixtures are never overwritten: files written by earlier releases must keep
+// opening with the current code.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wesleyyan-sb/nokhal/internal/database"
+)
+
+const password = "golden-password"
+
+// manifest describes the expected contents of a fixture.
+type manifest struct {
+	Password   string               `json:"password"`
+	Records    map[string][]byte    `json:"records"`              // "collection:key" -> value
+	Absent     []string             `json:"absent,omitempty"`     // Deleted or expired keys
+	Plaintext  []string             `json:"plaintext,omitempty"`  // Collections stored unencrypted
+	Rotating   bool                 `json:"rotating,omitempty"`   // Key rotation left in progress
+	Features   string               `json:"features,omitempty"`   // Features the header declares
+	Flags      byte                 `json:"flags,omitempty"`      // Flags some scanned record carries each of
+	KDF        *database.KDFParams  `json:"kdf,omitempty"`        // Parameters the key is derived with
+	Hint       bool                 `json:"hint,omitempty"`       // A hint ships with the fixture and must be used
+	Checkpoint *database.Checkpoint `json:"checkpoint,omitempty"` // Taken before the log was compacted
+	Events     []string             `json:"events,omitempty"`     // Keys changed after Checkpoint, in order
+}
+
+type scenario struct {
+	name  string
+	opts  database.Options
+	build func(db *database.DB, m *manifest) error
+
+	hint bool // Keep the hint written on Close
+	open bool // Keep the file as it is before Close, which trims preallocated space
+}
+
+var scenarios = []scenario{
+	{name: "basic", build: buildBasic},
+	{name: "plaintext", build: buildPlaintext},
+	{name: "rotation", build: buildRotation},
+	{name: "settings", build: buildSettings},
+	{name: "compacted", build: buildCompacted},
+	{name: "tombstones", build: buildTombstones},
+	{name: "counter-nonces", opts: database.Options{CounterNonces: true}, build: buildCounterNonces},
+	{name: "compression-dict", opts: database.Options{CompressionDict: docDict, CompressionThreshold: 64}, build: buildCompressionDict},
+	{name: "kdf-params", opts: database.Options{KDF: smallKDF}, build: buildKDFParams},
+	{name: "hint", build: buildHint, hint: true},
+	{name: "mmap-hint", opts: database.Options{MmapHint: true}, build: buildHint, hint: true},
+	{name: "preallocated", opts: database.Options{PreallocateBytes: 4096}, build: buildPreallocated, open: true},
+	{name: "log-epoch", build: buildLogEpoch},
+	{name: "sets", build: buildSets},
+}
+
+func main() {
+	out := flag.String("out", filepath.Join("internal", "database", "testdata", "golden"), "Fixture directory")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fail(err)
+	}
+	for _, sc := range scenarios {
+		name, err := generate(*out, sc)
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", sc.name, err))
+		}
+		if name != "" {
+			fmt.Println("wrote", name)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "gengolden:", err)
+	os.Exit(1)
+}
+
+// generate builds one scenario in a temporary file and moves it into place
+// under its versioned name, unless a fixture of that name already exists.
+func generate(out string, sc scenario) (string, error) {
+	tmp := filepath.Join(out, sc.name+".tmp")
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + ".hint")
+
+	db, err := database.OpenWithOptions(tmp, password, sc.opts)
+	if err != nil {
+		return "", err
+	}
+	m := &manifest{Password: password, Records: make(map[string][]byte), Hint: sc.hint}
+	if err := sc.build(db, m); err != nil {
+		db.Close()
+		return "", err
+	}
+	if f := db.Features(); f != 0 {
+		m.Features = f.String()
+	}
+
+	var data []byte
+	if sc.open {
+		data, err = os.ReadFile(tmp)
+		if err != nil {
+			db.Close()
+			return "", err
+		}
+	}
+	if err := db.Close(); err != nil {
+		return "", err
+	}
+	if !sc.open {
+		if data, err = os.ReadFile(tmp); err != nil {
+			return "", err
+		}
+	}
+	// The version byte follows the 6-byte magic
+	base := filepath.Join(out, fmt.Sprintf("v%d-%s", data[6], sc.name))
+	if _, err := os.Stat(base + ".nok"); err == nil {
+		return "", nil
+	}
+
+	js, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(base+".json", append(js, '\n'), 0644); err != nil {
+		return "", err
+	}
+	if sc.hint {
+		if err := os.Rename(tmp+".hint", base+".nok.hint"); err != nil {
+			return "", err
+		}
+	}
+	return base + ".nok", os.WriteFile(base+".nok", data, 0644)
+}
+
+func put(db *database.DB, m *manifest, collection, key string, value []byte) error {
+	m.Records[collection+":"+key] = value
+	return db.Put(collection, key, value)
+}
+
+func buildBasic(db *database.DB, m *manifest) error {
+	if err := put(db, m, "users", "alice", []byte(`{"name":"Alice"}`)); err != nil {
+		return err
+	}
+	if err := put(db, m, "users", "bob", []byte("first")); err != nil {
+		return err
+	}
+	// Overwrite
+	if err := put(db, m, "users", "bob", []byte("second")); err != nil {
+		return err
+	}
+	// Compressed
+	if err := put(db, m, "posts", "long", bytes.Repeat([]byte("compressible "), 100)); err != nil {
+		return err
+	}
+	if err := put(db, m, "posts", "empty", []byte{}); err != nil {
+		return err
+	}
+
+	// Deleted
+	if err := db.Put("users", "carol", []byte("gone")); err != nil {
+		return err
+	}
+	if err := db.Delete("users", "carol"); err != nil {
+		return err
+	}
+	m.Absent = append(m.Absent, "users:carol")
+
+	// Expired and long-lived TTLs
+	if err := db.PutWithTTL("sessions", "old", []byte("expired"), time.Millisecond); err != nil {
+		return err
+	}
+	m.Absent = append(m.Absent, "sessions:old")
+	m.Records["sessions:new"] = []byte("valid")
+	if err := db.PutWithTTL("sessions", "new", []byte("valid"), 50*365*24*time.Hour); err != nil {
+		return err
+	}
+
+	// Batch
+	batch := db.NewBatch()
+	batch.Put("batch", "one", []byte("1"), 0)
+	batch.Put("batch", "two", []byte("2"), 0)
+	batch.Delete("users", "alice")
+	m.Records["batch:one"] = []byte("1")
+	m.Records["batch:two"] = []byte("2")
+	delete(m.Records, "users:alice")
+	m.Absent = append(m.Absent, "users:alice")
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	return nil
+}
+
+func buildPlaintext(db *database.DB, m *manifest) error {
+	if err := db.SetCollectionPlaintext("public", true); err != nil {
+		return err
+	}
+	m.Plaintext = []string{"public"}
+	if err := put(db, m, "public", "readme", []byte("not secret")); err != nil {
+		return err
+	}
+	if err := put(db, m, "public", "big", bytes.Repeat([]byte("public data "), 50)); err != nil {
+		return err
+	}
+	return put(db, m, "private", "secret", []byte("still encrypted"))
+}
+
+func buildRotation(db *database.DB, m *manifest) error {
+	for _, k := range []string{"cold", "hot"} {
+		if err := put(db, m, "keys", k, []byte(k+"-value")); err != nil {
+			return err
+		}
+	}
+	if err := db.BeginKeyRotation(); err != nil {
+		return err
+	}
+	// Reading re-seals "hot" under the new DEK; "cold" stays on the old one
+	if _, err := db.Get("keys", "hot"); err != nil {
+		return err
+	}
+	m.Rotating = true
+	return put(db, m, "keys", "new", []byte("written-during-rotation"))
+}
+
+func buildSettings(db *database.DB, m *manifest) error {
+	if err := db.SetCollectionTTL("cache", 50*365*24*time.Hour); err != nil {
+		return err
+	}
+	return put(db, m, "cache", "entry", []byte("cached"))
+}
+
+func buildCompacted(db *database.DB, m *manifest) error {
+	for i := 0; i < 10; i++ {
+		if err := put(db, m, "logs", fmt.Sprintf("%02d", i), []byte(fmt.Sprintf("line %d", i))); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 10; i += 2 {
+		key := fmt.Sprintf("%02d", i)
+		if err := db.Delete("logs", key); err != nil {
+			return err
+		}
+		delete(m.Records, "logs:"+key)
+		m.Absent = append(m.Absent, "logs:"+key)
+	}
+	return db.Compact()
+}
+
+// buildTombstones writes the sealed tombstones of deletes and of
+// SecureDeletePrefix, which bind their op and flags.
+func buildTombstones(db *database.DB, m *manifest) error {
+	m.Flags = database.FlagBoundAAD
+	for _, k := range []string{"a", "b", "c"} {
+		if err := put(db, m, "docs", k, []byte("doc "+k)); err != nil {
+			return err
+		}
+	}
+	if err := db.Delete("docs", "b"); err != nil {
+		return err
+	}
+	delete(m.Records, "docs:b")
+	m.Absent = append(m.Absent, "docs:b")
+
+	for _, k := range []string{"x", "y"} {
+		if err := db.Put("wipe", k, []byte("secret "+k)); err != nil {
+			return err
+		}
+		m.Absent = append(m.Absent, "wipe:"+k)
+	}
+	return db.SecureDeletePrefix("wipe:")
+}
+
+// buildCounterNonces seals records, and the reserved counter limit in the
+// header, with counter nonces.
+func buildCounterNonces(db *database.DB, m *manifest) error {
+	for i := 0; i < 5; i++ {
+		if err := put(db, m, "events", fmt.Sprintf("%02d", i), []byte(fmt.Sprintf("event %d", i))); err != nil {
+			return err
+		}
+	}
+	if err := put(db, m, "events", "00", []byte("rewritten")); err != nil {
+		return err
+	}
+	if err := db.Delete("events", "01"); err != nil {
+		return err
+	}
+	delete(m.Records, "events:01")
+	m.Absent = append(m.Absent, "events:01")
+
+	batch := db.NewBatch()
+	batch.Put("events", "batched", []byte("in a batch"), 0)
+	m.Records["events:batched"] = []byte("in a batch")
+	return batch.Commit()
+}
+
+// docDict is the compression dictionary of the compression-dict fixture.
+var docDict = []byte(`{"id":0,"type":"customer","name":"user-","email":"user-@example.com","plan":"standard","country":"NL","active":true,"tags":["newsletter","beta"]}`)
+
+// buildCompressionDict stores a dictionary and values compressed with it.
+func buildCompressionDict(db *database.DB, m *manifest) error {
+	m.Flags = database.FlagCompressed | database.FlagDict
+	for i := 0; i < 10; i++ {
+		doc := fmt.Sprintf(`{"id":%d,"type":"customer","name":"user-%d","email":"user-%d@example.com","plan":"standard","country":"NL","active":true,"tags":["newsletter","beta"]}`, i, i, i)
+		if err := put(db, m, "docs", fmt.Sprint(i), []byte(doc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// smallKDF are the Argon2id parameters of the kdf-params fixture.
+var smallKDF = database.KDFParams{Time: 2, Memory: 64, Parallelism: 1}
+
+// buildKDFParams writes a file whose key is derived with other than the
+// default parameters.
+func buildKDFParams(db *database.DB, m *manifest) error {
+	kdf := smallKDF
+	m.KDF = &kdf
+	return put(db, m, "users", "alice", []byte("derived with small parameters"))
+}
+
+// buildHint leaves records for the hint written on Close to index.
+func buildHint(db *database.DB, m *manifest) error {
+	for i := 0; i < 20; i++ {
+		if err := put(db, m, "items", fmt.Sprintf("%02d", i), []byte(fmt.Sprintf("item %d", i))); err != nil {
+			return err
+		}
+	}
+	if err := db.Delete("items", "03"); err != nil {
+		return err
+	}
+	delete(m.Records, "items:03")
+	m.Absent = append(m.Absent, "items:03")
+	return put(db, m, "other", "key", []byte("not an item"))
+}
+
+// buildPreallocated leaves zero-filled preallocated space past the log.
+func buildPreallocated(db *database.DB, m *manifest) error {
+	for i := 0; i < 5; i++ {
+		if err := put(db, m, "blocks", fmt.Sprint(i), bytes.Repeat([]byte{byte('a' + i)}, 100)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildLogEpoch compacts the log after a consumer has read all of it, and
+// writes more, so that its checkpoint resumes on the compacted log.
+func buildLogEpoch(db *database.DB, m *manifest) error {
+	for i := 0; i < 4; i++ {
+		if err := put(db, m, "feed", fmt.Sprint(i), []byte(fmt.Sprintf("entry %d", i))); err != nil {
+			return err
+		}
+	}
+	sub, err := db.WatchFrom(database.Checkpoint{}, "feed:")
+	if err != nil {
+		return err
+	}
+	var at database.Checkpoint
+	for i := 0; i < 4; i++ {
+		if _, at, err = sub.Next(context.Background()); err != nil {
+			return err
+		}
+	}
+	m.Checkpoint = &at
+
+	if err := db.Compact(); err != nil {
+		return err
+	}
+	for _, k := range []string{"4", "5"} {
+		if err := put(db, m, "feed", k, []byte("entry "+k)); err != nil {
+			return err
+		}
+		m.Events = append(m.Events, "feed:"+k)
+	}
+	return nil
+}
+
+// buildSets writes set records, which declare FeatureSets.
+func buildSets(db *database.DB, m *manifest) error {
+	m.Flags = database.FlagSet
+	if err := db.SAdd("tags", "post1", []byte("go"), []byte("db"), []byte("crypto")); err != nil {
+		return err
+	}
+	if err := db.SRemove("tags", "post1", []byte("db")); err != nil {
+		return err
+	}
+	value, err := db.Get("tags", "post1")
+	if err != nil {
+		return err
+	}
+	m.Records["tags:post1"] = value
+	return nil
+}
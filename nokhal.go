@@ -1,7 +1,10 @@
 package nokhal
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"net/http"
 	"time"
 
 	"github.com/wesleyyan-sb/nokhal/internal/database"
@@ -13,11 +16,152 @@ type Record = database.Record
 // Iterator iterates over keys in sorted order.
 type Iterator = database.Iterator
 
+// LiveIterator iterates over keys in sorted order, looking each one up again as it goes.
+type LiveIterator = database.LiveIterator
+
+// LiveIteratorOptions configures NewLiveIterator.
+type LiveIteratorOptions = database.LiveIteratorOptions
+
+// CollectionInfo summarizes a collection's keys, space usage and settings.
+type CollectionInfo = database.CollectionInfo
+
+// CollStats is the fragmentation of a collection's records in the log.
+type CollStats = database.CollStats
+
+// Options configures how a database is opened.
+type Options = database.Options
+
+// BackupReport summarizes a backup stream checked by VerifyBackup.
+type BackupReport = database.BackupReport
+
+// HintInfo describes a hint file read by ReadHint.
+type HintInfo = database.HintInfo
+
+// VerifyOptions controls how thoroughly a backup stream is verified.
+type VerifyOptions = database.VerifyOptions
+
+// Stats is a point-in-time snapshot of database-wide counters.
+type Stats = database.Stats
+
+// AccessStats counts the operations on one collection since Open or ResetStats.
+type AccessStats = database.AccessStats
+
+// OpenReport describes housekeeping and integrity findings of OpenWithReport.
+type OpenReport = database.OpenReport
+
+// MirrorStatus reports the state of the write-through mirror.
+type MirrorStatus = database.MirrorStatus
+
+// HealthStatus summarizes the progress of the database's background work.
+type HealthStatus = database.HealthStatus
+
+// CompactionResult reports what a CompactWithResult call did.
+type CompactionResult = database.CompactionResult
+
+// Churn counts the puts, overwrites, deletes and bytes written to a collection since Open.
+type Churn = database.Churn
+
+// CompressionStats describes the compression attempts of a collection and whether they are paused.
+type CompressionStats = database.CompressionStats
+
+// PutOptions configures PutWithOptions.
+type PutOptions = database.PutOptions
+
+// Advice is the recommendation of CompactionAdvice and the measurements behind it.
+type Advice = database.Advice
+
+// Recommendation is the verdict of CompactionAdvice.
+type Recommendation = database.Recommendation
+
+// Verdicts of CompactionAdvice.
+const (
+	AdviceNotWorthIt  = database.AdviceNotWorthIt
+	AdviceCompactNow  = database.AdviceCompactNow
+	AdviceAutoCompact = database.AdviceAutoCompact
+)
+
+// ErrUnsupportedVersion reports the format version of a file this build cannot open.
+type ErrUnsupportedVersion = database.ErrUnsupportedVersion
+
+// ErrUnsupportedFeature reports a record written by a later version that this build may not skip.
+type ErrUnsupportedFeature = database.ErrUnsupportedFeature
+
+// Feature is an optional capability a file's header must declare before records may use it.
+type Feature = database.Feature
+
+// Optional features; see EnableFeature.
+const (
+	FeatureCompressionDict = database.FeatureCompressionDict
+	FeatureTransforms      = database.FeatureTransforms
+	FeatureKDFParams       = database.FeatureKDFParams
+	FeatureBoundAAD        = database.FeatureBoundAAD
+	FeatureSets            = database.FeatureSets
+)
+
+// KDFParams are the Argon2id parameters a file derives its key with; see Options.KDF.
+type KDFParams = database.KDFParams
+
+// DefaultKDF are the Argon2id parameters of files created without Options.KDF.
+var DefaultKDF = database.DefaultKDF
+
+// Snapshot is a read-only, point-in-time view of the database that pins the records it sees.
+type Snapshot = database.Snapshot
+
+// Transform rewrites a collection's values at the API boundary, for field-level encryption or redaction.
+type Transform = database.Transform
+
+// ErrImmutableOptions lists options UpdateOptions cannot change on an open database.
+type ErrImmutableOptions = database.ErrImmutableOptions
+
+// ImportOptions configures ImportWithOptions.
+type ImportOptions = database.ImportOptions
+
+// ImportReport accounts for every record of an import.
+type ImportReport = database.ImportReport
+
+// ErrImportLine is an import failure at one line of the stream.
+type ErrImportLine = database.ErrImportLine
+
+// ErrExportInterrupted is an export cut short by a failed write, with the key to resume after.
+type ErrExportInterrupted = database.ErrExportInterrupted
+
+// BatchOptions configures a batch created by NewBatchWithOptions.
+type BatchOptions = database.BatchOptions
+
+// ErrAssertionFailed names the first batch assertion that did not hold at Commit.
+type ErrAssertionFailed = database.ErrAssertionFailed
+
+// AtomicGetOptions configures GetAtomicWithOptions.
+type AtomicGetOptions = database.AtomicGetOptions
+
+// ErrMissingKeys lists the keys a GetAtomic call did not find.
+type ErrMissingKeys = database.ErrMissingKeys
+
+// ErrTooManyKeys reports a GetAtomic call over more keys than allowed.
+type ErrTooManyKeys = database.ErrTooManyKeys
+
+// DefaultAtomicMaxKeys caps the keys of one GetAtomic call by default.
+const DefaultAtomicMaxKeys = database.DefaultAtomicMaxKeys
+
+// Checkpoint is a durable position in the log for WatchFrom.
+type Checkpoint = database.Checkpoint
+
+// Event is a change returned by Subscription.Next.
+type Event = database.Event
+
+// Subscription reads changes from the log in order, from a checkpoint.
+type Subscription = database.Subscription
+
 // Batch groups multiple operations into a single atomic write.
 type Batch struct {
 	inner *database.Batch
 }
 
+// CollectionBatch is a Batch whose writes all target one collection.
+type CollectionBatch struct {
+	inner *database.CollectionBatch
+}
+
 // DB represents a Nokhal database instance.
 type DB struct {
 	inner *database.DB
@@ -32,37 +176,159 @@ func Open(path, password string) (*DB, error) {
 	return &DB{inner: db}, nil
 }
 
+// OpenWithOptions opens or creates a database with non-default options.
+func OpenWithOptions(path, password string, opts Options) (*DB, error) {
+	db, err := database.OpenWithOptions(path, password, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{inner: db}, nil
+}
+
+// OpenWithReport opens a database and reports housekeeping done on open, such as orphaned files removed after a crash.
+func OpenWithReport(path, password string, opts Options) (*DB, OpenReport, error) {
+	db, report, err := database.OpenWithReport(path, password, opts)
+	if err != nil {
+		return nil, report, err
+	}
+	return &DB{inner: db}, report, nil
+}
+
+// OptionsFromEnv reads options from the NOKHAL_* environment variables listed in DOCS.md.
+// A value that does not parse fails with ErrInvalidEnv naming the variable. Combine the
+// result with options set in code using Options.Merge.
+func OptionsFromEnv() (Options, error) {
+	return database.OptionsFromEnv()
+}
+
 // Put adds a key-value pair to a collection.
 func (db *DB) Put(collection, key string, value []byte) error {
 	return db.inner.Put(collection, key, value)
 }
 
+// PutContext is Put giving up with ctx.Err(), having written nothing, if ctx ends while it waits for the write lock.
+func (db *DB) PutContext(ctx context.Context, collection, key string, value []byte) error {
+	return db.inner.PutContext(ctx, collection, key, value)
+}
+
 // PutWithTTL adds a key-value pair with an expiration time.
 func (db *DB) PutWithTTL(collection, key string, value []byte, ttl time.Duration) error {
 	return db.inner.PutWithTTL(collection, key, value, ttl)
 }
 
+// PutExpired writes a key-value pair that is already expired: it is in the log, but Get never returns it.
+func (db *DB) PutExpired(collection, key string, value []byte) error {
+	return db.inner.PutExpired(collection, key, value)
+}
+
+// PutWithOptions adds a key-value pair with a TTL and, optionally, without attempting compression.
+func (db *DB) PutWithOptions(collection, key string, value []byte, opts PutOptions) error {
+	return db.inner.PutWithOptions(collection, key, value, opts)
+}
+
+// OnExpire registers a hook called once for every user key that expires.
+func (db *DB) OnExpire(fn func(collection, key string)) error {
+	return db.inner.OnExpire(fn)
+}
+
+// FireExpired reports keys expired by the database clock to the OnExpire hooks right away.
+func (db *DB) FireExpired() int {
+	return db.inner.FireExpired()
+}
+
 // Get retrieves a value from a collection by key.
 func (db *DB) Get(collection, key string) ([]byte, error) {
 	return db.inner.Get(collection, key)
 }
 
+// GetMulti retrieves several keys of a collection at once, decrypting them concurrently. Missing keys yield nil.
+func (db *DB) GetMulti(collection string, keys []string) ([][]byte, error) {
+	return db.inner.GetMulti(collection, keys)
+}
+
+// HasMulti reports which of keys exist in collection without reading their values.
+func (db *DB) HasMulti(collection string, keys []string) (map[string]bool, error) {
+	return db.inner.HasMulti(collection, keys)
+}
+
+// GetAtomic reads keys of a collection as one consistent cut, with no write in between,
+// and fails with *ErrMissingKeys unless every key is found.
+func (db *DB) GetAtomic(collection string, keys []string) (map[string][]byte, error) {
+	return db.inner.GetAtomic(collection, keys)
+}
+
+// GetAtomicWithOptions is GetAtomic with options to tolerate missing keys or change the
+// cap on the number of keys.
+func (db *DB) GetAtomicWithOptions(collection string, keys []string, opts AtomicGetOptions) (map[string][]byte, error) {
+	return db.inner.GetAtomicWithOptions(collection, keys, opts)
+}
+
+// MapValues rewrites every value of collection with fn, in batches, returning the number migrated.
+// If fn fails, batches already committed stay migrated and the rest is left untouched.
+func (db *DB) MapValues(collection string, fn func(key string, old []byte) ([]byte, error)) (int, error) {
+	return db.inner.MapValues(collection, fn)
+}
+
 // List retrieves all keys in a collection.
 func (db *DB) List(collection string) ([]string, error) {
 	return db.inner.List(collection)
 }
 
+// IsEmpty reports whether a collection has no live keys, stopping at the first one found.
+func (db *DB) IsEmpty(collection string) (bool, error) {
+	return db.inner.IsEmpty(collection)
+}
+
+// AnyKeyWithPrefix returns an arbitrary live key of collection starting with keyPrefix, if there is one.
+func (db *DB) AnyKeyWithPrefix(collection, keyPrefix string) (string, bool, error) {
+	return db.inner.AnyKeyWithPrefix(collection, keyPrefix)
+}
+
+// AllKeys returns every live combined key (collection:key) across all collections, sorted.
+func (db *DB) AllKeys() ([]string, error) {
+	return db.inner.AllKeys()
+}
+
+// AllKeysFunc calls fn with each key AllKeys returns, in order, until fn returns false.
+func (db *DB) AllKeysFunc(fn func(composite string) bool) error {
+	return db.inner.AllKeysFunc(fn)
+}
+
 // Filter scans a collection and returns only records that satisfy the filter function.
+// The filter runs without the database lock held, so it may read or write the DB.
 func (db *DB) Filter(collection string, fn func(key string, value []byte) bool) ([][]byte, error) {
 	return db.inner.Filter(collection, fn)
 }
 
+// DeletePrefix deletes every key whose combined key (collection:key) starts with prefix.
+func (db *DB) DeletePrefix(prefix string) error {
+	return db.inner.DeletePrefix(prefix)
+}
+
+// SecureDeletePrefix deletes like DeletePrefix and immediately overwrites the deleted values on disk.
+func (db *DB) SecureDeletePrefix(prefix string) error {
+	return db.inner.SecureDeletePrefix(prefix)
+}
+
 // ScanPrefix scans the database for records whose combined key (collection:key) starts with prefix.
 func (db *DB) ScanPrefix(prefix string) ([]Record, error) {
 	return db.inner.ScanPrefix(prefix)
 }
 
+// ScanPrefixMeta scans like ScanPrefix but returns records with nil values, checking CRCs without decrypting.
+// Use it only on trusted files: a record altered along with its CRC goes unnoticed.
+func (db *DB) ScanPrefixMeta(prefix string) ([]Record, error) {
+	return db.inner.ScanPrefixMeta(prefix)
+}
+
+// ScanPrefixFunc calls fn with each record ScanPrefix would return, in key order, without collecting them.
+// The Record and its Value are reused for the next record: keep a value with rec.ValueCopy.
+func (db *DB) ScanPrefixFunc(prefix string, fn func(rec *Record) error) error {
+	return db.inner.ScanPrefixFunc(prefix, fn)
+}
+
 // FilterPrefix scans for records by prefix and returns decrypted values that satisfy the filter.
+// The filter runs without the database lock held, so it may read or write the DB.
 func (db *DB) FilterPrefix(prefix string, fn func(key string, value []byte) bool) ([][]byte, error) {
 	return db.inner.FilterPrefix(prefix, fn)
 }
@@ -72,11 +338,47 @@ func (db *DB) NewIterator(prefix string) *Iterator {
 	return db.inner.NewIterator(prefix)
 }
 
+// Snapshot takes a point-in-time view of the database. Close it to let Compact run again.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	return db.inner.Snapshot()
+}
+
+// NewLiveIterator creates an iterator for the given prefix that skips keys deleted or expired while it runs.
+func (db *DB) NewLiveIterator(prefix string, opts LiveIteratorOptions) *LiveIterator {
+	return db.inner.NewLiveIterator(prefix, opts)
+}
+
+// Page returns up to limit records under prefix in key order, starting after token.
+// The returned token resumes the listing and is empty once all records were returned.
+func (db *DB) Page(prefix string, token string, limit int) ([]Record, string, error) {
+	return db.inner.Page(prefix, token, limit)
+}
+
+// Swap atomically exchanges the values of two keys in a collection.
+func (db *DB) Swap(collection, keyA, keyB string) error {
+	return db.inner.Swap(collection, keyA, keyB)
+}
+
+// ReplaceCollection atomically replaces the whole content of a collection with entries.
+func (db *DB) ReplaceCollection(collection string, entries map[string][]byte) error {
+	return db.inner.ReplaceCollection(collection, entries)
+}
+
 // NewBatch creates a new batch operation.
 func (db *DB) NewBatch() *Batch {
 	return &Batch{inner: db.inner.NewBatch()}
 }
 
+// DefaultBatchOptions returns batch options with coalescing on.
+func DefaultBatchOptions() BatchOptions {
+	return database.DefaultBatchOptions()
+}
+
+// NewBatchWithOptions creates a new batch operation with the given options.
+func (db *DB) NewBatchWithOptions(opts BatchOptions) *Batch {
+	return &Batch{inner: db.inner.NewBatchWithOptions(opts)}
+}
+
 // Put adds a put operation to the batch.
 func (b *Batch) Put(collection, key string, value []byte, ttl time.Duration) {
 	b.inner.Put(collection, key, value, ttl)
@@ -87,11 +389,166 @@ func (b *Batch) Delete(collection, key string) {
 	b.inner.Delete(collection, key)
 }
 
+// AssertValue makes Commit fail with *ErrAssertionFailed, writing nothing, unless key holds expected.
+func (b *Batch) AssertValue(collection, key string, expected []byte) {
+	b.inner.AssertValue(collection, key, expected)
+}
+
+// AssertAbsent makes Commit fail with *ErrAssertionFailed, writing nothing, if key exists.
+func (b *Batch) AssertAbsent(collection, key string) {
+	b.inner.AssertAbsent(collection, key)
+}
+
+// Err returns the ErrBatchMemory of an operation that did not fit Options.MaxBatchMemory, which Commit will return.
+func (b *Batch) Err() error {
+	return b.inner.Err()
+}
+
+// Discard drops the batch's operations and gives back the memory they held against Options.MaxBatchMemory.
+func (b *Batch) Discard() {
+	b.inner.Discard()
+}
+
 // Commit executes all operations in the batch atomically.
 func (b *Batch) Commit() error {
 	return b.inner.Commit()
 }
 
+// CommitContext is Commit giving up with ctx.Err(), leaving the batch as it was, if ctx ends while it waits for the write lock.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	return b.inner.CommitContext(ctx)
+}
+
+// NewCollectionBatch creates a batch whose operations all target collection.
+func (db *DB) NewCollectionBatch(collection string) *CollectionBatch {
+	return &CollectionBatch{inner: db.inner.NewCollectionBatch(collection)}
+}
+
+// Put adds a put operation to the batch.
+func (b *CollectionBatch) Put(key string, value []byte, ttl time.Duration) {
+	b.inner.Put(key, value, ttl)
+}
+
+// Delete adds a delete operation to the batch.
+func (b *CollectionBatch) Delete(key string) {
+	b.inner.Delete(key)
+}
+
+// AssertValue makes Commit fail, writing nothing, unless key holds expected.
+func (b *CollectionBatch) AssertValue(key string, expected []byte) {
+	b.inner.AssertValue(key, expected)
+}
+
+// AssertAbsent makes Commit fail, writing nothing, if key exists.
+func (b *CollectionBatch) AssertAbsent(key string) {
+	b.inner.AssertAbsent(key)
+}
+
+// Err returns the ErrBatchMemory of an operation that did not fit Options.MaxBatchMemory, which Commit will return.
+func (b *CollectionBatch) Err() error {
+	return b.inner.Err()
+}
+
+// Discard drops the batch's operations and gives back the memory they held against Options.MaxBatchMemory.
+func (b *CollectionBatch) Discard() {
+	b.inner.Discard()
+}
+
+// Commit executes all operations in the batch atomically.
+func (b *CollectionBatch) Commit() error {
+	return b.inner.Commit()
+}
+
+// CommitContext is Commit giving up with ctx.Err() if ctx ends while it waits for the write lock.
+func (b *CollectionBatch) CommitContext(ctx context.Context) error {
+	return b.inner.CommitContext(ctx)
+}
+
+// SetCollectionPlaintext turns encryption OFF (or back on) for a collection.
+//
+// WARNING: values written to a plaintext collection are stored UNENCRYPTED and
+// can be read by anyone with access to the file; only a CRC protects them.
+// Keys of every collection remain visible in the hint file either way. The
+// setting is persisted and can only be changed while the collection is empty,
+// otherwise ErrCollectionInUse is returned.
+func (db *DB) SetCollectionPlaintext(collection string, plaintext bool) error {
+	return db.inner.SetCollectionPlaintext(collection, plaintext)
+}
+
+// SetTransform installs a value transform for a collection, or removes it if t is nil. Transforms are not persisted.
+func (db *DB) SetTransform(collection string, t Transform) error {
+	return db.inner.SetTransform(collection, t)
+}
+
+// SetCollectionImmutable makes a collection append-only, so that Get reads its keys without taking the database lock.
+func (db *DB) SetCollectionImmutable(collection string, immutable bool) error {
+	return db.inner.SetCollectionImmutable(collection, immutable)
+}
+
+// SetCollectionTTL sets the TTL applied to writes in a collection that don't specify one.
+func (db *DB) SetCollectionTTL(collection string, ttl time.Duration) error {
+	return db.inner.SetCollectionTTL(collection, ttl)
+}
+
+// CollectionInfo returns key counts, space usage and settings of a collection in one call.
+func (db *DB) CollectionInfo(collection string) (CollectionInfo, error) {
+	return db.inner.CollectionInfo(collection)
+}
+
+// CollectionInfos returns CollectionInfo for every collection, sorted by name.
+func (db *DB) CollectionInfos() ([]CollectionInfo, error) {
+	return db.inner.CollectionInfos()
+}
+
+// CollectionStats walks the log once and reports the live and dead bytes of every
+// collection, to tell which ones are fragmented.
+func (db *DB) CollectionStats() (map[string]CollStats, error) {
+	return db.inner.CollectionStats()
+}
+
+// ExpiringBefore returns the live keys expiring before ts (UnixNano), soonest first, from the index alone.
+func (db *DB) ExpiringBefore(ts int64) ([]Record, error) {
+	return db.inner.ExpiringBefore(ts)
+}
+
+// SetUserVersion stores an application-defined schema version in the file header, like SQLite's user_version.
+func (db *DB) SetUserVersion(n uint32) error {
+	return db.inner.SetUserVersion(n)
+}
+
+// UserVersion returns the application schema version, 0 if never set.
+func (db *DB) UserVersion() (uint32, error) {
+	return db.inner.UserVersion()
+}
+
+// EnableFeature irreversibly declares an optional feature in the file header; older versions then refuse to open the file.
+func (db *DB) EnableFeature(f Feature) error {
+	return db.inner.EnableFeature(f)
+}
+
+// Features returns the optional features the file header declares.
+func (db *DB) Features() Feature {
+	return db.inner.Features()
+}
+
+// BeginKeyRotation starts an incremental rotation of the data encryption key.
+// New writes use the new key, Get re-seals records it reads, and the next
+// Compact re-seals the rest and completes the rotation.
+func (db *DB) BeginKeyRotation() error {
+	return db.inner.BeginKeyRotation()
+}
+
+// RotateSalt re-wraps the data encryption key under a fresh salt, keeping password.
+// Only the header is rewritten.
+func (db *DB) RotateSalt(password string) error {
+	return db.inner.RotateSalt(password)
+}
+
+// RotationActive reports whether a key rotation is waiting to be completed by Compact.
+func (db *DB) RotationActive() bool {
+	return db.inner.RotationActive()
+}
+
 // PutJSON encodes v as JSON and stores it with the combined key (collection:key).
 func (db *DB) PutJSON(fullKey string, v any) error {
 	coll, key := database.SplitKey(fullKey)
@@ -112,21 +569,360 @@ func (db *DB) GetJSON(fullKey string, dest any) error {
 	return json.Unmarshal(data, dest)
 }
 
+// PatchJSON applies an RFC 7386 JSON Merge Patch to the JSON document stored under the
+// combined key (collection:key), atomically under the write lock. patch is encoded with
+// json.Marshal unless it is already []byte or json.RawMessage; an absent key is patched
+// as an empty object. Use omitempty for struct fields the patch must not touch, as a
+// null member removes the field.
+func (db *DB) PatchJSON(fullKey string, patch any) error {
+	coll, key := database.SplitKey(fullKey)
+	var data []byte
+	switch p := patch.(type) {
+	case []byte:
+		data = p
+	case json.RawMessage:
+		data = p
+	default:
+		var err error
+		if data, err = json.Marshal(patch); err != nil {
+			return err
+		}
+	}
+	return db.inner.PatchJSON(coll, key, data)
+}
+
+// QueryJSON returns the records of collection whose JSON value holds value at jsonPath,
+// a simple JSONPath such as $.age or $.address.city. Only equality is supported.
+func (db *DB) QueryJSON(collection, jsonPath string, value any) ([]Record, error) {
+	return db.inner.QueryJSON(collection, jsonPath, value)
+}
+
+// SelectJSON returns the chosen top-level or dotted fields (such as "address.city") of
+// each JSON document in collection accepted by fn, which may be nil. Fields a document
+// lacks are absent from its map; skipped counts the values that are not JSON objects.
+func (db *DB) SelectJSON(collection string, fields []string, fn func(key string, projected map[string]json.RawMessage) bool) (results []map[string]json.RawMessage, skipped int, err error) {
+	return db.inner.SelectJSON(collection, fields, fn)
+}
+
+// Append adds entry to the end of the list under collection and key with a single write,
+// without reading or rewriting earlier entries.
+func (db *DB) Append(collection, key string, entry []byte) error {
+	return db.inner.Append(collection, key, entry)
+}
+
+// GetList returns the entries of the list under collection and key in append order.
+func (db *DB) GetList(collection, key string) ([][]byte, error) {
+	return db.inner.GetList(collection, key)
+}
+
+// DeleteList removes every entry of the list under collection and key.
+func (db *DB) DeleteList(collection, key string) error {
+	return db.inner.DeleteList(collection, key)
+}
+
+// RPush adds values to the end of the list under collection and key, one record each.
+func (db *DB) RPush(collection, key string, values ...[]byte) error {
+	return db.inner.RPush(collection, key, values...)
+}
+
+// LPush adds values to the front of the list under collection and key, so the last
+// of them ends up first.
+func (db *DB) LPush(collection, key string, values ...[]byte) error {
+	return db.inner.LPush(collection, key, values...)
+}
+
+// LPop removes and returns the first entry of the list under collection and key,
+// atomically, or fails with ErrNotFound if the list is empty.
+func (db *DB) LPop(collection, key string) ([]byte, error) {
+	return db.inner.LPop(collection, key)
+}
+
+// RPop removes and returns the last entry of the list under collection and key.
+func (db *DB) RPop(collection, key string) ([]byte, error) {
+	return db.inner.RPop(collection, key)
+}
+
+// LRange returns the entries of the list under collection and key from start to stop,
+// both included; negative indexes count from the end.
+func (db *DB) LRange(collection, key string, start, stop int) ([][]byte, error) {
+	return db.inner.LRange(collection, key, start, stop)
+}
+
+// LLen returns the number of entries of the list under collection and key.
+func (db *DB) LLen(collection, key string) (int, error) {
+	return db.inner.LLen(collection, key)
+}
+
+// SAdd adds members to the set stored under collection and key, atomically under the
+// write lock. The set keeps its expiry.
+func (db *DB) SAdd(collection, key string, members ...[]byte) error {
+	return db.inner.SAdd(collection, key, members...)
+}
+
+// SAddWithTTL adds members to the set under collection and key and makes the whole set
+// expire after ttl.
+func (db *DB) SAddWithTTL(collection, key string, ttl time.Duration, members ...[]byte) error {
+	return db.inner.SAddWithTTL(collection, key, ttl, members...)
+}
+
+// SRemove removes members from the set under collection and key, deleting the key once
+// the set is empty.
+func (db *DB) SRemove(collection, key string, members ...[]byte) error {
+	return db.inner.SRemove(collection, key, members...)
+}
+
+// SMembers returns the members of the set under collection and key in byte order.
+func (db *DB) SMembers(collection, key string) ([][]byte, error) {
+	return db.inner.SMembers(collection, key)
+}
+
+// SContains reports whether member is in the set under collection and key.
+func (db *DB) SContains(collection, key string, member []byte) (bool, error) {
+	return db.inner.SContains(collection, key, member)
+}
+
+// AppendEntry adds data to the end of the write-ahead log and returns its offset.
+func (db *DB) AppendEntry(data []byte) (int64, error) {
+	return db.inner.AppendEntry(data)
+}
+
+// ReadEntries calls fn with the write-ahead log entries at or after from, in offset order.
+func (db *DB) ReadEntries(from int64, fn func(offset int64, data []byte) error) error {
+	return db.inner.ReadEntries(from, fn)
+}
+
+// WatchFrom subscribes to the changes of keys under prefix from checkpoint on,
+// replaying the log before waiting for new writes.
+func (db *DB) WatchFrom(checkpoint Checkpoint, prefix string) (*Subscription, error) {
+	return db.inner.WatchFrom(checkpoint, prefix)
+}
+
+// TruncateBefore discards the write-ahead log entries below offset.
+func (db *DB) TruncateBefore(offset int64) error {
+	return db.inner.TruncateBefore(offset)
+}
+
+// GetAndDelete returns the value of a key and deletes it atomically; concurrent callers for one key get ErrNotFound.
+func (db *DB) GetAndDelete(collection, key string) ([]byte, error) {
+	return db.inner.GetAndDelete(collection, key)
+}
+
+// PutIfAbsent stores value unless the key holds an unexpired value, and reports whether it did.
+func (db *DB) PutIfAbsent(collection, key string, value []byte, ttl time.Duration) (bool, error) {
+	return db.inner.PutIfAbsent(collection, key, value, ttl)
+}
+
 // Delete removes a key from a collection.
 func (db *DB) Delete(collection, key string) error {
 	return db.inner.Delete(collection, key)
 }
 
+// DeleteContext is Delete giving up with ctx.Err(), having written nothing, if ctx ends while it waits for the write lock.
+func (db *DB) DeleteContext(ctx context.Context, collection, key string) error {
+	return db.inner.DeleteContext(ctx, collection, key)
+}
+
+// Offset returns the current append position, usable as a consistent cut point for backups.
+func (db *DB) Offset() int64 {
+	return db.inner.Offset()
+}
+
+// FileSize returns the size of the database file on disk, read through the open handle.
+func (db *DB) FileSize() (int64, error) {
+	return db.inner.FileSize()
+}
+
+// Size returns the logical size of the database: the end of the committed log.
+func (db *DB) Size() int64 {
+	return db.inner.Size()
+}
+
+// LastWriteTime returns when a record was last appended. It is safe to poll without taking locks.
+func (db *DB) LastWriteTime() time.Time {
+	return db.inner.LastWriteTime()
+}
+
+// Stats returns a snapshot of key counts, space usage, sizes and the last write time.
+func (db *DB) Stats() (Stats, error) {
+	return db.inner.Stats()
+}
+
+// ResetStats zeroes the per-collection access counters of Stats and CollectionInfo.
+func (db *DB) ResetStats() {
+	db.inner.ResetStats()
+}
+
+// MirrorStatus reports lag, failures and divergence of the mirror configured by Options.MirrorPath.
+func (db *DB) MirrorStatus() MirrorStatus {
+	return db.inner.MirrorStatus()
+}
+
+// Freeze syncs the database and holds all writes until unfreeze is called or ctx ends,
+// for example during a filesystem snapshot. Reads continue normally.
+func (db *DB) Freeze(ctx context.Context) (unfreeze func(), err error) {
+	return db.inner.Freeze(ctx)
+}
+
+// Ping checks within ctx that the database can be written and read, by round-tripping a
+// short-lived record in an internal collection.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.inner.Ping(ctx)
+}
+
+// Healthy reports stalled background work and failure counters without taking any lock.
+func (db *DB) Healthy() HealthStatus {
+	return db.inner.Healthy()
+}
+
+// HealthHandler serves liveness and readiness probes, typically mounted at /healthz. Each
+// request runs Ping bounded by timeout and answers 200 if it succeeds and Healthy reports no
+// problem, 503 otherwise, with the HealthStatus and any ping error as JSON.
+func (db *DB) HealthHandler(timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		pingErr := db.Ping(ctx)
+		status := db.Healthy()
+
+		body := struct {
+			HealthStatus
+			PingError string `json:",omitempty"`
+		}{HealthStatus: status}
+		code := http.StatusOK
+		if pingErr != nil {
+			body.PingError = pingErr.Error()
+		}
+		if pingErr != nil || !status.OK {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// RecoverFromMirror restores records lost from the tail of a closed primary file by copying them from its mirror.
+func RecoverFromMirror(primary, mirror, password string) (int64, error) {
+	return database.RecoverFromMirror(primary, mirror, password)
+}
+
 // Close closes the database.
 func (db *DB) Close() error {
 	return db.inner.Close()
 }
 
+// CloseWithContext is Close returning ctx.Err() if ctx ends first, leaving the close to finish in the background.
+func (db *DB) CloseWithContext(ctx context.Context) error {
+	return db.inner.CloseWithContext(ctx)
+}
+
 // Compact reclaims space by removing old versions of keys and deleted records.
 func (db *DB) Compact() error {
 	return db.inner.Compact()
 }
 
+// CompactWithResult compacts like Compact and reports its duration, the records kept
+// and dropped, and the size of the log before and after.
+func (db *DB) CompactWithResult() (CompactionResult, error) {
+	return db.inner.CompactWithResult()
+}
+
+// CompactFunc compacts like Compact and also drops the live records keep rejects.
+func (db *DB) CompactFunc(keep func(rec Record) bool) error {
+	return db.inner.CompactFunc(keep)
+}
+
+// CompactionAdvice estimates what a Compact would reclaim and how long it would take,
+// from the churn measured since Open, and recommends whether to run one.
+func (db *DB) CompactionAdvice() (Advice, error) {
+	return db.inner.CompactionAdvice()
+}
+
+// UpdateOptions changes the tunable options of an open database without reopening it.
+func (db *DB) UpdateOptions(fn func(*Options)) error {
+	return db.inner.UpdateOptions(fn)
+}
+
+// FlushHint persists the index to the hint file. Calls are coalesced to at most one write per Options.HintFlushInterval.
+func (db *DB) FlushHint() error {
+	return db.inner.FlushHint()
+}
+
+// Reindex discards the hint file, rebuilds the index from a full log scan and writes a fresh hint.
+func (db *DB) Reindex() error {
+	return db.inner.Reindex()
+}
+
+// Backup writes a consistent copy of the database to w.
+func (db *DB) Backup(w io.Writer) (int64, error) {
+	return db.inner.Backup(w)
+}
+
+// ReadHint parses a hint file for inspection, without the data file or the password.
+func ReadHint(path string) (HintInfo, error) {
+	return database.ReadHint(path)
+}
+
+// IsNokhalFile reports whether the file at path has the nokhal magic and, if so, its format version, without the password.
+func IsNokhalFile(path string) (version byte, ok bool, err error) {
+	return database.IsNokhalFile(path)
+}
+
+// VerifyBackup checks that a backup stream is complete and that password unwraps its key, without restoring it.
+func VerifyBackup(r io.Reader, password string) (BackupReport, error) {
+	return database.VerifyBackup(r, password)
+}
+
+// VerifyBackupWithOptions is VerifyBackup with optional AEAD verification of every value.
+func VerifyBackupWithOptions(r io.Reader, password string, opts VerifyOptions) (BackupReport, error) {
+	return database.VerifyBackupWithOptions(r, password, opts)
+}
+
+// Export writes live records under prefix to w as JSON lines with decrypted, base64-encoded values, after a header line with the export time.
+func (db *DB) Export(w io.Writer, prefix string) (int, error) {
+	return db.inner.Export(w, prefix)
+}
+
+// ExportResume continues an interrupted Export with the records under prefix after the combined key afterKey.
+func (db *DB) ExportResume(w io.Writer, prefix string, afterKey string) (int, error) {
+	return db.inner.ExportResume(w, prefix, afterKey)
+}
+
+// VerifyExport checks the checkpoints and footer of an export without importing it.
+func VerifyExport(r io.Reader) (int, error) {
+	return database.VerifyExport(r)
+}
+
+// Import applies a JSON-lines export, keeping existing keys unless overwrite is set.
+func (db *DB) Import(r io.Reader, overwrite bool) (int, error) {
+	return db.inner.Import(r, overwrite)
+}
+
+// ImportWithOptions applies a JSON-lines export and reports what it did with each record.
+func (db *DB) ImportWithOptions(r io.Reader, opts ImportOptions) (ImportReport, error) {
+	return db.inner.ImportWithOptions(r, opts)
+}
+
+// ExportEncrypted writes the JSON-lines export sealed under a passphrase chosen for the recipient.
+func (db *DB) ExportEncrypted(w io.Writer, prefix string, passphrase string) (int, error) {
+	return db.inner.ExportEncrypted(w, prefix, passphrase)
+}
+
+// ExportCollection copies the live records of collection into a new database at destPath encrypted with destPassword.
+func (db *DB) ExportCollection(collection, destPath, destPassword string) error {
+	return db.inner.ExportCollection(collection, destPath, destPassword)
+}
+
+// ImportEncrypted applies a stream written by ExportEncrypted. A wrong passphrase fails before any record is written.
+func (db *DB) ImportEncrypted(r io.Reader, passphrase string, overwrite bool) (int, error) {
+	return db.inner.ImportEncrypted(r, passphrase, overwrite)
+}
+
+// ImportEncryptedWithOptions is ImportWithOptions for a stream written by ExportEncrypted.
+func (db *DB) ImportEncryptedWithOptions(r io.Reader, passphrase string, opts ImportOptions) (ImportReport, error) {
+	return db.inner.ImportEncryptedWithOptions(r, passphrase, opts)
+}
+
 // Errors
 var (
 	ErrNotFound         = database.ErrNotFound
@@ -134,4 +930,43 @@ var (
 	ErrInvalidFile      = database.ErrInvalidFile
 	ErrDecryption       = database.ErrDecryption
 	ErrInvalidPassword  = database.ErrInvalidPassword
+	ErrInvalidToken     = database.ErrInvalidToken
+	ErrCollectionInUse  = database.ErrCollectionInUse
+	ErrContentChecksum  = database.ErrContentChecksum
+	ErrUnknownDict      = database.ErrUnknownDict
+	ErrImmutableKey     = database.ErrImmutableKey
+	ErrNoTransform      = database.ErrNoTransform
+
+	ErrTooManySnapshots = database.ErrTooManySnapshots
+	ErrSnapshotOpen     = database.ErrSnapshotOpen
+	ErrSnapshotClosed   = database.ErrSnapshotClosed
+
+	ErrFeatureNotEnabled = database.ErrFeatureNotEnabled
+	ErrUnknownFeature    = database.ErrUnknownFeature
+	ErrInvalidKDF        = database.ErrInvalidKDF
+
+	ErrRotationInProgress = database.ErrRotationInProgress
+	ErrDatabaseLocked     = database.ErrDatabaseLocked
+	ErrLeaseLost          = database.ErrLeaseLost
+	ErrBackupTruncated    = database.ErrBackupTruncated
+	ErrBackupCorrupt      = database.ErrBackupCorrupt
+	ErrRecordTooLarge     = database.ErrRecordTooLarge
+	ErrInvalidEnvelope    = database.ErrInvalidEnvelope
+	ErrExportUndated      = database.ErrExportUndated
+	ErrExportTruncated    = database.ErrExportTruncated
+	ErrExportChecksum     = database.ErrExportChecksum
+	ErrMirrorDiverged     = database.ErrMirrorDiverged
+	ErrPendingCompaction  = database.ErrPendingCompaction
+	ErrNotJSON            = database.ErrNotJSON
+	ErrNotSet             = database.ErrNotSet
+	ErrInvalidSet         = database.ErrInvalidSet
+	ErrInvalidJSONPath    = database.ErrInvalidJSONPath
+	ErrPingWrite          = database.ErrPingWrite
+	ErrPingRead           = database.ErrPingRead
+	ErrPingTimeout        = database.ErrPingTimeout
+	ErrFrozen             = database.ErrFrozen
+	ErrDiskFull           = database.ErrDiskFull
+	ErrBatchMemory        = database.ErrBatchMemory
+	ErrInvalidEnv         = database.ErrInvalidEnv
+	ErrLogCompacted       = database.ErrLogCompacted
 )
@@ -3,8 +3,17 @@ package nokhal
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPublicAPI(t *testing.T) {
@@ -147,3 +156,197 @@ func TestDocSupport(t *testing.T) {
 		t.Errorf("Expected 2 results for FilterPrefix, got %d", len(results))
 	}
 }
+
+func TestCollectionBatch(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "nokhal_public_test_*.nok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tempFile.Name()
+	tempFile.Close()
+	defer os.Remove(path)
+	defer os.Remove(path + ".hint")
+
+	db, err := Open(path, "public_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("users", "gone", []byte("x"))
+
+	batch := db.NewCollectionBatch("users")
+	batch.Put("alice", []byte("1"), 0)
+	batch.Put("bob", []byte("2"), 0)
+	batch.Delete("gone")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := db.Get("users", "alice"); err != nil || string(val) != "1" {
+		t.Errorf("users:alice = %q, %v", val, err)
+	}
+	if _, err := db.Get("users", "gone"); err != ErrNotFound {
+		t.Errorf("Expected users:gone to be deleted, got %v", err)
+	}
+	keys, _ := db.List("users")
+	if len(keys) != 2 {
+		t.Errorf("Expected 2 keys in users, got %v", keys)
+	}
+	if recs, _ := db.ScanPrefix("alice"); len(recs) != 0 {
+		t.Error("Collection batch wrote outside its collection")
+	}
+}
+
+func TestPatchJSON(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	type Address struct {
+		City string `json:"city"`
+		Zip  string `json:"zip"`
+	}
+	type User struct {
+		Name    string   `json:"name"`
+		Age     int      `json:"age"`
+		Tags    []string `json:"tags"`
+		Address Address  `json:"address"`
+	}
+	db.PutJSON("users:alice", User{Name: "Alice", Age: 30, Tags: []string{"admin"}, Address: Address{City: "Lisbon", Zip: "1000"}})
+
+	patch := map[string]any{"age": 31, "address": map[string]any{"city": "Porto"}}
+	if err := db.PatchJSON("users:alice", patch); err != nil {
+		t.Fatal(err)
+	}
+	var u User
+	if err := db.GetJSON("users:alice", &u); err != nil {
+		t.Fatal(err)
+	}
+	want := User{Name: "Alice", Age: 31, Tags: []string{"admin"}, Address: Address{City: "Porto", Zip: "1000"}}
+	if !reflect.DeepEqual(u, want) {
+		t.Errorf("Patched user = %+v, want %+v", u, want)
+	}
+
+	// null removes a member, and an absent key starts from an empty object
+	db.PatchJSON("users:alice", []byte(`{"tags":null}`))
+	db.PatchJSON("users:bob", json.RawMessage(`{"name":"Bob"}`))
+	for key, want := range map[string]string{
+		"alice": `{"address":{"city":"Porto","zip":"1000"},"age":31,"name":"Alice"}`,
+		"bob":   `{"name":"Bob"}`,
+	} {
+		if v, _ := db.Get("users", key); string(v) != want {
+			t.Errorf("%s = %s, want %s", key, v, want)
+		}
+	}
+
+	// Concurrent patches of one document do not lose updates
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.PatchJSON("users:bob", map[string]int{fmt.Sprintf("f%d", i): i}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var fields map[string]any
+	db.GetJSON("users:bob", &fields)
+	if len(fields) != 21 {
+		t.Errorf("Concurrent patches left %d fields, want 21", len(fields))
+	}
+
+	db.Put("users", "raw", []byte("not json"))
+	if err := db.PatchJSON("users:raw", map[string]int{"a": 1}); !errors.Is(err, ErrNotJSON) {
+		t.Errorf("Expected ErrNotJSON, got %v", err)
+	}
+}
+
+func TestQueryJSON(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	type User struct {
+		Name string   `json:"name"`
+		Age  int      `json:"age"`
+		Tags []string `json:"tags"`
+	}
+	db.PutJSON("users:alice", User{Name: "Alice", Age: 30, Tags: []string{"admin"}})
+	db.PutJSON("users:bob", User{Name: "Bob", Age: 25})
+	db.PutJSON("users:carol", User{Name: "Carol", Age: 30, Tags: []string{"ops", "admin"}})
+	db.PutJSON("staff:dave", User{Name: "Dave", Age: 30})
+	db.Put("users", "raw", []byte("not json"))
+
+	keys := func(records []Record) []string {
+		var keys []string
+		for _, r := range records {
+			keys = append(keys, r.Key)
+		}
+		return keys
+	}
+	for _, tc := range []struct {
+		path  string
+		value any
+		want  []string
+	}{
+		{"$.age", 30, []string{"alice", "carol"}},
+		{"$.age", 30.0, []string{"alice", "carol"}},
+		{"$.name", "Bob", []string{"bob"}},
+		{"$.tags[1]", "admin", []string{"carol"}},
+		{"$['tags'][0]", "admin", []string{"alice"}},
+		{"$.tags", []string{"admin"}, []string{"alice"}},
+		{"$", map[string]any{"tags": nil, "age": 25, "name": "Bob"}, []string{"bob"}},
+		{"$.age", "30", nil},
+		{"$.missing", nil, nil},
+	} {
+		records, err := db.QueryJSON("users", tc.path, tc.value)
+		if err != nil {
+			t.Fatalf("QueryJSON(%s): %v", tc.path, err)
+		}
+		if got := keys(records); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("QueryJSON(%s == %v) = %v, want %v", tc.path, tc.value, got, tc.want)
+		}
+	}
+
+	for _, path := range []string{"age", "$..age", "$.*", "$.tags[*]", "$.tags[0:2]", "$[?(@.age > 20)]"} {
+		if _, err := db.QueryJSON("users", path, 1); !errors.Is(err, ErrInvalidJSONPath) {
+			t.Errorf("QueryJSON(%s): expected ErrInvalidJSONPath, got %v", path, err)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	handler := db.HealthHandler(time.Second)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var body struct {
+		OK        bool
+		PingError string
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || !body.OK || body.PingError != "" {
+		t.Errorf("Healthy database answered %d: %+v", rec.Code, body)
+	}
+
+	db.Close()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "health check write failed") {
+		t.Errorf("Closed database answered %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,72 @@
+// Package nokhaltest helps test code that uses nokhal, chiefly code that
+// relies on TTLs: a Clock stands in for the database's notion of now, so
+// expiry can be reached by advancing it instead of sleeping.
+package nokhaltest
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wesleyyan-sb/nokhal"
+)
+
+// Clock is a manually driven clock for Options.Now. It is safe for
+// concurrent use.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock stopped at t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the clock's current time. Pass it as Options.Now.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, or back if d is negative.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// Password is the password Open creates test databases with.
+const Password = "nokhaltest"
+
+// Open creates an empty database driven by a new Clock and closes it when
+// the test ends. nokhal has no in-memory backend, so the database is a file
+// in tb.TempDir(). The clock starts at a fixed instant rather than the real
+// time, so runs are reproducible; opts.Now is replaced by it.
+func Open(tb testing.TB, opts nokhal.Options) (*nokhal.DB, *Clock) {
+	tb.Helper()
+	clock := NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	return OpenWithClock(tb, clock, opts), clock
+}
+
+// OpenWithClock is like Open but uses clock, for tests that reopen a
+// database or share one clock between several.
+func OpenWithClock(tb testing.TB, clock *Clock, opts nokhal.Options) *nokhal.DB {
+	tb.Helper()
+	opts.Now = clock.Now
+	db, err := nokhal.OpenWithOptions(filepath.Join(tb.TempDir(), "db.nok"), Password, opts)
+	if err != nil {
+		tb.Fatalf("nokhaltest: open: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
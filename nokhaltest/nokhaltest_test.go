@@ -0,0 +1,31 @@
+package nokhaltest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wesleyyan-sb/nokhal"
+)
+
+func TestClockDrivesExpiry(t *testing.T) {
+	db, clock := Open(t, nokhal.Options{})
+	if err := db.PutWithTTL("col", "k", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key lives up to and including the nanosecond it expires at
+	clock.Advance(time.Hour)
+	if _, err := db.Get("col", "k"); err != nil {
+		t.Fatalf("Get at the expiry instant: %v", err)
+	}
+	clock.Advance(time.Nanosecond)
+	if _, err := db.Get("col", "k"); err != nokhal.ErrNotFound {
+		t.Fatalf("Get a nanosecond later = %v, want ErrNotFound", err)
+	}
+
+	// Moving the clock back revives it, as the record is still in the log
+	clock.Set(clock.Now().Add(-time.Minute))
+	if v, err := db.Get("col", "k"); err != nil || string(v) != "v" {
+		t.Fatalf("Get after Set = %q, %v", v, err)
+	}
+}
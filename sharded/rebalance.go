@@ -0,0 +1,175 @@
+package sharded
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/wesleyyan-sb/nokhal"
+)
+
+// moveChunk is the number of keys RebalanceKeys moves at a time, holding up
+// other operations while it does.
+const moveChunk = 256
+
+// exportLine is a line of a nokhal export, which is how RebalanceKeys reads
+// records off a shard and writes them to another with their expiry intact.
+// Checkpoint and footer lines set Checkpoint or End instead, and are skipped.
+type exportLine struct {
+	Collection string          `json:"collection"`
+	Key        string          `json:"key"`
+	Value      []byte          `json:"value"`
+	ExpiresAt  int64           `json:"expires_at,omitempty"`
+	Checkpoint json.RawMessage `json:"checkpoint,omitempty"`
+	End        json.RawMessage `json:"end,omitempty"`
+}
+
+// AddShard opens or creates a shard at path and adds it after the others.
+// About 1/n of the keys, with n the new number of shards, now belong to it;
+// they stay where they are until RebalanceKeys moves them, and reads find
+// them there in the meantime. Adding another shard first fails with
+// ErrRebalancePending. Open the ShardedDB with path added to the end of the
+// paths from now on.
+func (sd *ShardedDB) AddShard(path string) error {
+	sd.rebalancing.Lock()
+	defer sd.rebalancing.Unlock()
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.prev != nil {
+		return ErrRebalancePending
+	}
+	db, err := nokhal.OpenWithOptions(path, sd.password, sd.opts)
+	if err != nil {
+		return fmt.Errorf("sharded: open %s: %w", path, err)
+	}
+	sd.shards = append(sd.shards, db)
+	sd.prev = sd.ring
+	sd.ring = newRing(len(sd.shards))
+	return nil
+}
+
+// RebalanceKeys moves every key that is not on the shard that owns it there,
+// calling progress, if not nil, with the number moved so far after each step.
+// Keys already in place are not touched. Each shard is read as a snapshot,
+// then its keys are moved moveChunk at a time, with expiry kept; other
+// operations wait while a chunk moves, and a key written since the snapshot
+// is left as written. Run it after AddShard, and again after reopening with
+// a shard whose rebalance did not finish: only the ShardedDB that added the
+// shard finds keys on their old shard, and deletes them there. It is safe to
+// run again after a failure.
+func (sd *ShardedDB) RebalanceKeys(progress func(moved int)) error {
+	sd.rebalancing.Lock()
+	defer sd.rebalancing.Unlock()
+
+	moved := 0
+	for i := range sd.Shards() {
+		if err := sd.rebalanceShard(i, &moved, progress); err != nil {
+			return err
+		}
+	}
+	sd.mu.Lock()
+	sd.prev = nil
+	sd.mu.Unlock()
+	return nil
+}
+
+// rebalanceShard moves the keys on shard src that belong elsewhere.
+func (sd *ShardedDB) rebalanceShard(src int, moved *int, progress func(moved int)) error {
+	sd.mu.RLock()
+	db := sd.shards[src]
+	sd.mu.RUnlock()
+
+	var buf bytes.Buffer
+	if _, err := db.Export(&buf, ""); err != nil {
+		return fmt.Errorf("sharded: read shard %d: %w", src, err)
+	}
+	dec := json.NewDecoder(&buf)
+	var header json.RawMessage
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("sharded: read shard %d: %w", src, err)
+	}
+	var misplaced []exportLine
+	for {
+		var line exportLine
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("sharded: read shard %d: %w", src, err)
+		}
+		if line.Checkpoint != nil || line.End != nil {
+			continue
+		}
+		// The ring does not change while rebalancing holds AddShard off
+		if sd.ShardFor(line.Collection, line.Key) != src {
+			misplaced = append(misplaced, line)
+		}
+	}
+
+	for chunk := range slices.Chunk(misplaced, moveChunk) {
+		sd.mu.Lock()
+		n, err := sd.move(src, chunk)
+		sd.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		*moved += n
+		if progress != nil {
+			progress(*moved)
+		}
+	}
+	return nil
+}
+
+// move writes the records of lines that are still on shard src to their
+// owners and deletes them from src, returning how many it moved. A key no
+// longer on src was written or deleted since it was read, through its
+// owner. Callers must hold sd.mu for writing.
+func (sd *ShardedDB) move(src int, lines []exportLine) (int, error) {
+	keys := make(map[string][]string)
+	for _, line := range lines {
+		keys[line.Collection] = append(keys[line.Collection], line.Key)
+	}
+	present := make(map[string]map[string]bool)
+	for collection, k := range keys {
+		found, err := sd.shards[src].HasMulti(collection, k)
+		if err != nil {
+			return 0, fmt.Errorf("sharded: shard %d: %w", src, err)
+		}
+		present[collection] = found
+	}
+
+	streams := make([]bytes.Buffer, len(sd.shards))
+	remove := sd.shards[src].NewBatch()
+	n := 0
+	for _, line := range lines {
+		if !present[line.Collection][line.Key] {
+			continue
+		}
+		dest := sd.ring.owner(line.Collection, line.Key)
+		if err := json.NewEncoder(&streams[dest]).Encode(&line); err != nil {
+			return 0, err
+		}
+		remove.Delete(line.Collection, line.Key)
+		n++
+	}
+
+	// A key already on its owner is a copy a failed run left behind, or
+	// newer than this one: either way it is kept
+	for dest := range streams {
+		if streams[dest].Len() == 0 {
+			continue
+		}
+		if _, err := sd.shards[dest].ImportWithOptions(&streams[dest], nokhal.ImportOptions{}); err != nil {
+			return 0, fmt.Errorf("sharded: write to shard %d: %w", dest, err)
+		}
+	}
+	if err := remove.Commit(); err != nil {
+		return 0, fmt.Errorf("sharded: remove from shard %d: %w", src, err)
+	}
+	return n, nil
+}
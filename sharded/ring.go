@@ -0,0 +1,76 @@
+package sharded
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// vnodes is the number of points each shard takes on the ring. More points
+// spread keys more evenly at the cost of a larger ring.
+const vnodes = 128
+
+// point is a position on the ring and the shard that owns the keys hashing
+// to it or to any position before it, back to the previous point.
+type point struct {
+	hash  uint64
+	shard int
+}
+
+// ring maps keys to shards by consistent hashing. A shard's points depend
+// only on its position in the list of paths, so adding a shard only moves
+// keys to it, and only about a share of them proportional to its points.
+type ring []point
+
+func newRing(shards int) ring {
+	r := make(ring, 0, shards*vnodes)
+	for s := range shards {
+		for v := range vnodes {
+			r = append(r, point{hash: hashString("shard-" + strconv.Itoa(s) + "-" + strconv.Itoa(v)), shard: s})
+		}
+	}
+	slices.SortFunc(r, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.shard, b.shard))
+	})
+	return r
+}
+
+// owner returns the shard of collection and key.
+func (r ring) owner(collection, key string) int {
+	h := hashKey(collection, key)
+	i, _ := slices.BinarySearchFunc(r, h, func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].shard
+}
+
+// hashKey is the stable hash keys are routed by. It must not change: data
+// written under one hash is not found under another.
+func hashKey(collection, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(collection))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return mix(h.Sum64())
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix(h.Sum64())
+}
+
+// mix is the splitmix64 finalizer. FNV alone leaves similar short strings,
+// such as the names of a shard's points, close together on the ring.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
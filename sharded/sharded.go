@@ -0,0 +1,304 @@
+// Package sharded spreads one logical dataset over several nokhal files, for
+// data that outgrows a single file or disk. Keys are routed to a shard by a
+// stable hash of their collection and key on a consistent hashing ring, so
+// adding a shard moves only the keys that now belong to it.
+//
+// The shards are ordinary nokhal databases sharing a password and options.
+// They are only consistent with each other through a ShardedDB: write to
+// them directly and keys may end up on a shard that does not own them.
+package sharded
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wesleyyan-sb/nokhal"
+)
+
+var (
+	ErrNoShards = errors.New("sharded: no shard paths")
+
+	// ErrRebalancePending is returned by AddShard while keys moved by an
+	// earlier AddShard have not been rebalanced yet.
+	ErrRebalancePending = errors.New("sharded: rebalance pending, call RebalanceKeys first")
+)
+
+// ShardedDB routes the operations of one logical database to its shards.
+// It is safe for concurrent use.
+type ShardedDB struct {
+	password string
+	opts     nokhal.Options
+
+	rebalancing sync.Mutex // Keeps AddShard and RebalanceKeys apart
+
+	mu     sync.RWMutex // Held for writing to add a shard and to move keys
+	shards []*nokhal.DB
+	ring   ring
+
+	// prev is the ring before the last AddShard, until RebalanceKeys has
+	// moved the keys it routes elsewhere. While it is set, a key may still
+	// be on its previous owner.
+	prev ring
+}
+
+// OpenSharded opens or creates the shards at paths with password and opts.
+// The order of paths decides which keys each shard owns: pass the same paths
+// in the same order every time, and add shards only at the end, through
+// AddShard. Options.MirrorPath cannot be shared by the shards and is
+// rejected.
+func OpenSharded(paths []string, password string, opts nokhal.Options) (*ShardedDB, error) {
+	if len(paths) == 0 {
+		return nil, ErrNoShards
+	}
+	if opts.MirrorPath != "" {
+		return nil, errors.New("sharded: Options.MirrorPath would be shared by every shard")
+	}
+	sd := &ShardedDB{password: password, opts: opts}
+	for _, path := range paths {
+		db, err := nokhal.OpenWithOptions(path, password, opts)
+		if err != nil {
+			sd.Close()
+			return nil, fmt.Errorf("sharded: open %s: %w", path, err)
+		}
+		sd.shards = append(sd.shards, db)
+	}
+	sd.ring = newRing(len(sd.shards))
+	return sd, nil
+}
+
+// Close closes every shard.
+func (sd *ShardedDB) Close() error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	var errs []error
+	for _, db := range sd.shards {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Shards returns the number of shards.
+func (sd *ShardedDB) Shards() int {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	return len(sd.shards)
+}
+
+// ShardFor returns the index, in the order of the paths, of the shard that
+// owns collection and key.
+func (sd *ShardedDB) ShardFor(collection, key string) int {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	return sd.ring.owner(collection, key)
+}
+
+// previous returns the shard that owned collection and key before the last
+// AddShard, if its keys are not rebalanced yet and it is not the current
+// owner, or nil. Callers must hold sd.mu.
+func (sd *ShardedDB) previous(collection, key string, owner int) *nokhal.DB {
+	if sd.prev == nil {
+		return nil
+	}
+	if p := sd.prev.owner(collection, key); p != owner {
+		return sd.shards[p]
+	}
+	return nil
+}
+
+// Put adds a key-value pair to a collection on the shard that owns it.
+func (sd *ShardedDB) Put(collection, key string, value []byte) error {
+	return sd.PutWithTTL(collection, key, value, 0)
+}
+
+// PutWithTTL adds a key-value pair that expires after ttl. Zero means no
+// expiration.
+func (sd *ShardedDB) PutWithTTL(collection, key string, value []byte, ttl time.Duration) error {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	owner := sd.ring.owner(collection, key)
+	if err := sd.shards[owner].PutWithTTL(collection, key, value, ttl); err != nil {
+		return err
+	}
+	// Drop the copy awaiting rebalance, so it cannot be moved over this one
+	if prev := sd.previous(collection, key, owner); prev != nil {
+		return prev.Delete(collection, key)
+	}
+	return nil
+}
+
+// Get retrieves a value from the shard that owns it.
+func (sd *ShardedDB) Get(collection, key string) ([]byte, error) {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	owner := sd.ring.owner(collection, key)
+	value, err := sd.shards[owner].Get(collection, key)
+	if err == nokhal.ErrNotFound {
+		if prev := sd.previous(collection, key, owner); prev != nil {
+			return prev.Get(collection, key)
+		}
+	}
+	return value, err
+}
+
+// Delete removes a key from the shard that owns it.
+func (sd *ShardedDB) Delete(collection, key string) error {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	owner := sd.ring.owner(collection, key)
+	if err := sd.shards[owner].Delete(collection, key); err != nil {
+		return err
+	}
+	if prev := sd.previous(collection, key, owner); prev != nil {
+		return prev.Delete(collection, key)
+	}
+	return nil
+}
+
+// each calls fn for every shard concurrently and joins their errors. Callers
+// must hold sd.mu.
+func (sd *ShardedDB) each(fn func(i int, db *nokhal.DB) error) error {
+	errs := make([]error, len(sd.shards))
+	var wg sync.WaitGroup
+	for i, db := range sd.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(i, db); err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// List retrieves all keys in a collection from every shard, sorted.
+func (sd *ShardedDB) List(collection string) ([]string, error) {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	results := make([][]string, len(sd.shards))
+	err := sd.each(func(i int, db *nokhal.DB) error {
+		var err error
+		results[i], err = db.List(collection)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := slices.Concat(results...)
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+// Filter returns the values of collection that satisfy fn, from every shard.
+// The shards are scanned concurrently, so fn must be safe for concurrent
+// use, and values come grouped by shard rather than in key order.
+func (sd *ShardedDB) Filter(collection string, fn func(key string, value []byte) bool) ([][]byte, error) {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	results := make([][][]byte, len(sd.shards))
+	err := sd.each(func(i int, db *nokhal.DB) error {
+		var err error
+		results[i], err = db.Filter(collection, fn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat(results...), nil
+}
+
+// ScanPrefix returns the records of every shard whose combined key
+// (collection:key) starts with prefix, in key order.
+func (sd *ShardedDB) ScanPrefix(prefix string) ([]nokhal.Record, error) {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	results := make([][]nokhal.Record, len(sd.shards))
+	err := sd.each(func(i int, db *nokhal.DB) error {
+		var err error
+		results[i], err = db.ScanPrefix(prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := slices.Concat(results...)
+	slices.SortFunc(records, func(a, b nokhal.Record) int {
+		return cmp.Or(cmp.Compare(a.Collection, b.Collection), cmp.Compare(a.Key, b.Key))
+	})
+	return records, nil
+}
+
+// Batch groups operations across shards. Unlike a nokhal.Batch it is not
+// atomic as a whole: Commit splits it into one batch per shard and commits
+// those one after the other, each atomically. If a shard's commit fails, the
+// shards committed before it keep their writes and the rest get none.
+type Batch struct {
+	sd  *ShardedDB
+	ops []batchOp
+}
+
+type batchOp struct {
+	collection, key string
+	value           []byte
+	ttl             time.Duration
+	delete          bool
+}
+
+// NewBatch creates a new batch operation.
+func (sd *ShardedDB) NewBatch() *Batch {
+	return &Batch{sd: sd}
+}
+
+// Put adds a put operation to the batch.
+func (b *Batch) Put(collection, key string, value []byte, ttl time.Duration) {
+	b.ops = append(b.ops, batchOp{collection: collection, key: key, value: value, ttl: ttl})
+}
+
+// Delete adds a delete operation to the batch.
+func (b *Batch) Delete(collection, key string) {
+	b.ops = append(b.ops, batchOp{collection: collection, key: key, delete: true})
+}
+
+// Commit writes the batch, one shard at a time. An error names the shard
+// that failed; see Batch for what it leaves written.
+func (b *Batch) Commit() error {
+	sd := b.sd
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+
+	// Copies awaiting rebalance are dropped once the writes that replace
+	// them are committed
+	writes := make([]*nokhal.Batch, len(sd.shards))
+	drops := make([]*nokhal.Batch, len(sd.shards))
+	batchFor := func(batches []*nokhal.Batch, i int) *nokhal.Batch {
+		if batches[i] == nil {
+			batches[i] = sd.shards[i].NewBatch()
+		}
+		return batches[i]
+	}
+	for _, op := range b.ops {
+		owner := sd.ring.owner(op.collection, op.key)
+		if op.delete {
+			batchFor(writes, owner).Delete(op.collection, op.key)
+		} else {
+			batchFor(writes, owner).Put(op.collection, op.key, op.value, op.ttl)
+		}
+		if sd.previous(op.collection, op.key, owner) != nil {
+			batchFor(drops, sd.prev.owner(op.collection, op.key)).Delete(op.collection, op.key)
+		}
+	}
+	for i, batch := range slices.Concat(writes, drops) {
+		if batch == nil {
+			continue
+		}
+		if err := batch.Commit(); err != nil {
+			return fmt.Errorf("sharded: commit on shard %d: %w", i%len(sd.shards), err)
+		}
+	}
+	return nil
+}
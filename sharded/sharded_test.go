@@ -0,0 +1,230 @@
+package sharded
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wesleyyan-sb/nokhal"
+	"github.com/wesleyyan-sb/nokhal/nokhaltest"
+)
+
+const testKeys = 3000
+
+func shardPaths(dir string, n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("shard%d.nok", i))
+	}
+	return paths
+}
+
+func TestRoutingStable(t *testing.T) {
+	dir := t.TempDir()
+	sd, err := OpenSharded(shardPaths(dir, 3), "pass", nokhal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := make([]int, testKeys)
+	counts := make([]int, 3)
+	for i := range owners {
+		owners[i] = sd.ShardFor("col", fmt.Sprint("k", i))
+		counts[owners[i]]++
+		if err := sd.Put("col", fmt.Sprint("k", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sd.Close()
+	for s, n := range counts {
+		if n < testKeys/5 {
+			t.Errorf("shard %d owns %d of %d keys", s, n, testKeys)
+		}
+	}
+
+	// Reopening routes every key the same way, so each is found
+	sd, err = OpenSharded(shardPaths(dir, 3), "pass", nokhal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	for i, owner := range owners {
+		key := fmt.Sprint("k", i)
+		if got := sd.ShardFor("col", key); got != owner {
+			t.Fatalf("%s moved from shard %d to %d on reopen", key, owner, got)
+		}
+		if v, err := sd.shards[owner].Get("col", key); err != nil || string(v) != fmt.Sprint(i) {
+			t.Fatalf("%s on its shard = %q, %v", key, v, err)
+		}
+	}
+
+	// A shard added at the end only takes keys, about a quarter of them
+	if err := sd.AddShard(filepath.Join(dir, "shard3.nok")); err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for i, owner := range owners {
+		got := sd.ShardFor("col", fmt.Sprint("k", i))
+		if got != owner {
+			if got != 3 {
+				t.Fatalf("k%d moved from shard %d to %d, not to the new shard", i, owner, got)
+			}
+			moved++
+		}
+	}
+	if moved < testKeys/6 || moved > testKeys/3 {
+		t.Errorf("adding a fourth shard moved %d of %d keys", moved, testKeys)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	dir := t.TempDir()
+	clock := nokhaltest.NewClock(time.Unix(1700000000, 0))
+	sd, err := OpenSharded(shardPaths(dir, 3), "pass", nokhal.Options{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	for i := range testKeys {
+		key := fmt.Sprint("k", i)
+		if i%10 == 0 {
+			err = sd.PutWithTTL("col", key, []byte(fmt.Sprint(i)), time.Hour)
+		} else {
+			err = sd.Put("col", key, []byte(fmt.Sprint(i)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sd.AddShard(filepath.Join(dir, "shard3.nok")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddShard(filepath.Join(dir, "shard4.nok")); err != ErrRebalancePending {
+		t.Errorf("second AddShard before rebalance: %v", err)
+	}
+
+	// Before the rebalance, keys are found on their old shard, and writes
+	// and deletes of them win over the copies still there
+	var onNew []string
+	for i := range testKeys {
+		key := fmt.Sprint("k", i)
+		if sd.ShardFor("col", key) == 3 {
+			onNew = append(onNew, key)
+		}
+		if v, err := sd.Get("col", key); err != nil || string(v) != fmt.Sprint(i) {
+			t.Fatalf("Get(%s) before rebalance = %q, %v", key, v, err)
+		}
+	}
+	sd.Put("col", onNew[0], []byte("rewritten"))
+	sd.Delete("col", onNew[1])
+	b := sd.NewBatch()
+	b.Put("col", onNew[2], []byte("batched"), 0)
+	b.Delete("col", onNew[3])
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls, last int
+	err = sd.RebalanceKeys(func(moved int) {
+		calls++
+		last = moved
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(onNew) - 4; last != want || calls < 3 {
+		t.Errorf("progress reported %d moved in %d calls, want %d", last, calls, want)
+	}
+
+	// Every key is now on its owner only, with its value and expiry
+	want := map[string]string{onNew[0]: "rewritten", onNew[2]: "batched"}
+	for i := range testKeys {
+		key := fmt.Sprint("k", i)
+		value, ok := fmt.Sprint(i), true
+		if v, set := want[key]; set {
+			value = v
+		}
+		if key == onNew[1] || key == onNew[3] {
+			ok = false
+		}
+		owner := sd.ShardFor("col", key)
+		for s, db := range sd.shards {
+			v, err := db.Get("col", key)
+			switch {
+			case s == owner && ok && (err != nil || string(v) != value):
+				t.Fatalf("%s on its shard %d = %q, %v; want %q", key, s, v, err, value)
+			case (s != owner || !ok) && err != nokhal.ErrNotFound:
+				t.Fatalf("%s left on shard %d: %q, %v", key, s, v, err)
+			}
+		}
+	}
+	clock.Advance(2 * time.Hour)
+	for _, key := range onNew[4:] {
+		var i int
+		fmt.Sscanf(key, "k%d", &i)
+		_, err := sd.Get("col", key)
+		if i%10 == 0 && err != nokhal.ErrNotFound {
+			t.Errorf("%s kept after its expiry: %v", key, err)
+		} else if i%10 != 0 && err != nil {
+			t.Errorf("Get(%s): %v", key, err)
+		}
+	}
+
+	// A second run finds nothing to move
+	again := 0
+	if err := sd.RebalanceKeys(func(moved int) { again = moved }); err != nil || again != 0 {
+		t.Errorf("second rebalance moved %d, %v", again, err)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	sd, err := OpenSharded(shardPaths(t.TempDir(), 4), "pass", nokhal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	b := sd.NewBatch()
+	for i := range 100 {
+		b.Put("col", fmt.Sprintf("k%03d", i), []byte(fmt.Sprint(i)), 0)
+	}
+	b.Put("other", "x", []byte("x"), 0)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	used := make(map[int]bool)
+	for i := range 100 {
+		used[sd.ShardFor("col", fmt.Sprintf("k%03d", i))] = true
+	}
+	if len(used) != 4 {
+		t.Fatalf("100 keys landed on %d of 4 shards", len(used))
+	}
+
+	keys, err := sd.List("col")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 100 || keys[0] != "k000" || keys[99] != "k099" {
+		t.Errorf("List = %d keys, %v", len(keys), keys)
+	}
+	records, err := sd.ScanPrefix("col:k05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 10 || records[0].Key != "k050" || records[9].Key != "k059" {
+		t.Errorf("ScanPrefix returned %d records", len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i-1].Key >= records[i].Key {
+			t.Errorf("ScanPrefix out of order at %s", records[i].Key)
+		}
+	}
+	values, err := sd.Filter("col", func(key string, value []byte) bool { return len(value) == 1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 10 {
+		t.Errorf("Filter returned %d values, want 10", len(values))
+	}
+}
@@ -0,0 +1,184 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrUnterminatedQuote = errors.New("unterminated quote")
+	ErrUndefined         = errors.New("not defined")
+)
+
+// Command is one parsed input line.
+type Command struct {
+	Name string   // Lowercased first word, empty for a blank line
+	Args []string // Remaining words, flags included
+}
+
+// Parse tokenizes line without variables; see Tokenize.
+func Parse(line string) (Command, error) {
+	return ParseWith(line, nil)
+}
+
+// ParseWith tokenizes line, replacing variables with lookup's values, and
+// makes the words a Command.
+func ParseWith(line string, lookup func(name string) (string, bool)) (Command, error) {
+	words, err := Tokenize(line, lookup)
+	if err != nil {
+		return Command{}, err
+	}
+	if len(words) == 0 {
+		return Command{}, nil
+	}
+	return Command{Name: strings.ToLower(words[0]), Args: words[1:]}, nil
+}
+
+// SplitFlags separates "--" flags from positional arguments.
+func SplitFlags(parts []string) ([]string, map[string]bool) {
+	var args []string
+	flags := make(map[string]bool)
+	for _, p := range parts {
+		if strings.HasPrefix(p, "--") {
+			flags[p] = true
+		} else {
+			args = append(args, p)
+		}
+	}
+	return args, flags
+}
+
+// Tokenize splits line into words. Words are separated by unquoted spaces.
+// Single quotes keep everything up to the closing quote literally; double
+// quotes keep spaces but expand variables and honor \" \\ and \$. Outside
+// quotes a backslash escapes the next character and an unquoted # starting
+// a word comments out the rest of the line. $name and ${name} are replaced
+// by lookup's value without splitting it into words; with a nil lookup a $
+// is an ordinary character.
+func Tokenize(line string, lookup func(name string) (string, bool)) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	rs := []rune(line)
+
+	// expand consumes the variable reference at rs[i], a '$', and returns the
+	// index after it
+	expand := func(i int) (int, error) {
+		if lookup == nil {
+			word.WriteRune('$')
+			return i + 1, nil
+		}
+		name, end := "", i+1
+		if end < len(rs) && rs[end] == '{' {
+			n := slices.Index(rs[end:], '}')
+			if n < 0 {
+				return 0, fmt.Errorf("%w: ${", ErrUnterminatedQuote)
+			}
+			name, end = string(rs[end+1:end+n]), end+n+1
+		} else {
+			for end < len(rs) && isNameRune(rs[end], end == i+1) {
+				end++
+			}
+			name = string(rs[i+1 : end])
+		}
+		if name == "" {
+			word.WriteRune('$')
+			return i + 1, nil
+		}
+		value, ok := lookup(name)
+		if !ok {
+			return 0, fmt.Errorf("%w: $%s", ErrUndefined, name)
+		}
+		word.WriteString(value)
+		return end, nil
+	}
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			i++
+		case r == '#' && !inWord:
+			i = len(rs)
+		case r == '\\':
+			if i+1 < len(rs) {
+				word.WriteRune(rs[i+1])
+			}
+			inWord = true
+			i += 2
+		case r == '\'':
+			n := slices.Index(rs[i+1:], '\'')
+			if n < 0 {
+				return nil, fmt.Errorf("%w: '", ErrUnterminatedQuote)
+			}
+			word.WriteString(string(rs[i+1 : i+1+n]))
+			inWord = true
+			i += n + 2
+		case r == '"':
+			inWord = true
+			for i++; ; {
+				if i >= len(rs) {
+					return nil, fmt.Errorf("%w: \"", ErrUnterminatedQuote)
+				}
+				c := rs[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(rs) && strings.ContainsRune(`"\$`, rs[i+1]) {
+					word.WriteRune(rs[i+1])
+					i += 2
+					continue
+				}
+				if c == '$' {
+					var err error
+					if i, err = expand(i); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				word.WriteRune(c)
+				i++
+			}
+		case r == '$':
+			var err error
+			if i, err = expand(i); err != nil {
+				return nil, err
+			}
+			inWord = true
+		default:
+			word.WriteRune(r)
+			inWord = true
+			i++
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func isNameRune(r rune, first bool) bool {
+	return r == '_' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+}
+
+// ValidName reports whether name can be referenced as a variable, $name.
+func ValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !isNameRune(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package shell
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	vars := map[string]string{"col": "users", "greeting": "hello world", "n1": "1"}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	cases := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"  get  users   alice ", []string{"get", "users", "alice"}},
+		{`put c k "a  b" 'c  d'`, []string{"put", "c", "k", "a  b", "c  d"}},
+		{`put c k ""`, []string{"put", "c", "k", ""}},
+		{`a"b c"'d e'f`, []string{"ab cd ef"}},
+		{`say \"quoted\" back\\slash a\ b`, []string{"say", `"quoted"`, `back\slash`, "a b"}},
+		{`"say \"hi\" \$col \n"`, []string{`say "hi" $col \n`}},
+		{"get $col alice", []string{"get", "users", "alice"}},
+		{"put $col k $greeting", []string{"put", "users", "k", "hello world"}},
+		{`"$col:${n1}x" '$col'`, []string{"users:1x", "$col"}},
+		{"cost 5$ $ $1", []string{"cost", "5$", "$", "$1"}},
+		{"get users # the rest is ignored", []string{"get", "users"}},
+		{"get users#1", []string{"get", "users#1"}},
+		{"日本 '語'", []string{"日本", "語"}},
+	}
+	for _, tc := range cases {
+		got, err := Tokenize(tc.line, lookup)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Tokenize(%q) = %q, %v, want %q", tc.line, got, err, tc.want)
+		}
+	}
+
+	for _, line := range []string{`put "open`, "put 'open", "get ${col"} {
+		if _, err := Tokenize(line, lookup); !errors.Is(err, ErrUnterminatedQuote) {
+			t.Errorf("Tokenize(%q): expected ErrUnterminatedQuote, got %v", line, err)
+		}
+	}
+	if _, err := Tokenize("get $missing", lookup); !errors.Is(err, ErrUndefined) {
+		t.Errorf("Expected ErrUndefined, got %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		line string
+		want Command
+	}{
+		{"", Command{}},
+		{"   ", Command{}},
+		{"databases", Command{Name: "databases", Args: []string{}}},
+		{"  USE prod ", Command{Name: "use", Args: []string{"prod"}}},
+		{"put col key two words", Command{Name: "put", Args: []string{"col", "key", "two", "words"}}},
+		{`put col key "two  words"`, Command{Name: "put", Args: []string{"col", "key", "two  words"}}},
+		{"get col $key", Command{Name: "get", Args: []string{"col", "$key"}}},
+	}
+	for _, tc := range cases {
+		if got, err := Parse(tc.line); err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", tc.line, got, err, tc.want)
+		}
+	}
+
+	args, flags := SplitFlags([]string{"--encrypt", "prefix", "out.json", "--overwrite"})
+	if !reflect.DeepEqual(args, []string{"prefix", "out.json"}) || !flags["--encrypt"] || !flags["--overwrite"] {
+		t.Errorf("SplitFlags = %v, %v", args, flags)
+	}
+}
@@ -0,0 +1,536 @@
+// Package shell runs the commands of the nokhal command line shell against
+// one database, so that programs embedding nokhal can offer the same REPL
+// over their own input, such as a debug console or an admin socket:
+//
+//	sh := shell.New(db)
+//	if err := sh.Execute("put users alice 42", os.Stdout); err != nil {
+//		fmt.Println("Error:", err)
+//	}
+//
+// Each command writes its output to the writer it is given and returns its
+// failure as an error instead of printing it. Commands that manage several
+// databases, aliases or variables belong to the nokhal binary, not to a
+// Shell.
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wesleyyan-sb/nokhal"
+)
+
+var (
+	// ErrUsage is wrapped by the error of a command given the wrong
+	// arguments, whose message shows the right ones
+	ErrUsage          = errors.New("usage")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrNoDatabase     = errors.New("no database open")
+	ErrNoPrompt       = errors.New("no prompt to read a passphrase from")
+)
+
+// Shell runs commands against a database. It is not safe for concurrent
+// use.
+type Shell struct {
+	// Password is the database's, which verify-backup checks a backup
+	// with. Without it, verify-backup fails.
+	Password string
+
+	// Prompt reads a secret from the operator, such as the passphrase of
+	// export --encrypt, after showing label. Without it, the commands that
+	// need one fail with ErrNoPrompt.
+	Prompt func(label string) (string, error)
+
+	db       *nokhal.DB
+	unfreeze func() // Ends the freeze started by the freeze command, if any
+}
+
+// New returns a Shell running commands against db. A Shell with a nil db
+// only runs hint, which reads a file alone.
+func New(db *nokhal.DB) *Shell {
+	return &Shell{db: db}
+}
+
+// Execute parses line, see Parse, and runs it. A blank line does nothing.
+func (s *Shell) Execute(line string, out io.Writer) error {
+	cmd, err := Parse(line)
+	if err != nil {
+		return err
+	}
+	return s.Run(cmd, out)
+}
+
+// Run runs a parsed command, writing its output to out.
+func (s *Shell) Run(cmd Command, out io.Writer) error {
+	switch cmd.Name {
+	case "":
+		return nil
+	case "hint":
+		if len(cmd.Args) != 1 {
+			return usage("hint <file>")
+		}
+		return printHint(out, cmd.Args[0])
+	}
+	if s.db == nil {
+		return ErrNoDatabase
+	}
+
+	db := s.db
+	args := cmd.Args
+	switch cmd.Name {
+	case "put":
+		if len(args) < 3 {
+			return usage("put <collection> <key> <value>")
+		}
+		if err := db.Put(args[0], args[1], []byte(strings.Join(args[2:], " "))); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "OK")
+	case "get":
+		if len(args) != 2 {
+			return usage("get <collection> <key>")
+		}
+		val, err := db.Get(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", val)
+	case "del":
+		if len(args) != 2 {
+			return usage("del <collection> <key>")
+		}
+		if err := db.Delete(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "OK")
+	case "list":
+		if len(args) != 1 {
+			return usage("list <collection>")
+		}
+		keys, err := db.List(args[0])
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			fmt.Fprintln(out, k)
+		}
+	case "scan":
+		if len(args) > 1 {
+			return usage("scan [prefix]")
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		return db.ScanPrefixFunc(prefix, func(rec *nokhal.Record) error {
+			_, err := fmt.Fprintf(out, "%s:%s\t%s\n", rec.Collection, rec.Key, rec.Value)
+			return err
+		})
+	case "collections":
+		verbose := len(args) == 1 && args[0] == "-v"
+		if len(args) > 1 || (len(args) == 1 && !verbose) {
+			return usage("collections [-v]")
+		}
+		return printCollections(out, db, verbose)
+	case "compact":
+		if err := db.Compact(); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Compaction complete")
+	case "stats":
+		verbose := len(args) == 1 && args[0] == "-v"
+		byCollection := len(args) == 1 && args[0] == "--by-collection"
+		if len(args) > 1 || (len(args) == 1 && !verbose && !byCollection) {
+			return usage("stats [-v | --by-collection]")
+		}
+		if byCollection {
+			return printAccess(out, db)
+		}
+		return printStats(out, db, verbose)
+	case "freeze":
+		if len(args) > 1 {
+			return usage("freeze [timeout]")
+		}
+		timeout := 5 * time.Minute
+		if len(args) == 1 {
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return usage("freeze [timeout], such as freeze 30s")
+			}
+			timeout = d
+		}
+		// The timeout unfreezes the database if the operator forgets to
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		unfreeze, err := db.Freeze(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		s.unfreeze = func() {
+			unfreeze()
+			cancel()
+		}
+		fmt.Fprintf(out, "Writes frozen for up to %s; run unfreeze when done\n", timeout)
+	case "unfreeze":
+		if s.unfreeze == nil {
+			fmt.Fprintln(out, "Not frozen")
+			return nil
+		}
+		s.unfreeze()
+		s.unfreeze = nil
+		fmt.Fprintln(out, "Unfrozen")
+	case "reindex":
+		if err := db.Reindex(); err != nil {
+			return err
+		}
+		infos, err := db.CollectionInfos()
+		if err != nil {
+			return err
+		}
+		keys := 0
+		for _, info := range infos {
+			keys += info.Keys
+		}
+		fmt.Fprintf(out, "Reindex complete: %d keys\n", keys)
+	case "backup":
+		if len(args) != 1 {
+			return usage("backup <file>")
+		}
+		if err := backupTo(db, args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Backup complete")
+	case "verify-backup":
+		decrypt := len(args) == 2 && args[0] == "-decrypt"
+		if len(args) != 1 && !decrypt {
+			return usage("verify-backup [-decrypt] <file>")
+		}
+		report, err := verifyBackup(args[len(args)-1], s.Password, decrypt)
+		fmt.Fprintf(out, "Records: %d (%d puts, %d deletes), %d bytes\n", report.Records, report.Puts, report.Deletes, report.Bytes)
+		fmt.Fprintf(out, "Newest record: %s\n", formatTimestamp(report.Newest))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "OK")
+	case "export":
+		args, flags := SplitFlags(args)
+		if flags["--resume"] {
+			if len(args) != 3 || flags["--encrypt"] {
+				return usage("export --resume <prefix> <after-key> <file>")
+			}
+			n, err := exportTo(db, args[0], args[1], args[2], "")
+			return printExportResult(out, n, err)
+		}
+		if len(args) != 2 {
+			return usage("export [--encrypt] <prefix> <file>")
+		}
+		passphrase := ""
+		if flags["--encrypt"] {
+			var err error
+			if passphrase, err = s.confirmPassphrase(); err != nil {
+				return err
+			}
+		}
+		n, err := exportTo(db, args[0], "", args[1], passphrase)
+		return printExportResult(out, n, err)
+	case "import":
+		args, flags := SplitFlags(args)
+		if len(args) != 1 {
+			return usage("import [--encrypt] [--overwrite] [--keep-expired] [--shift-expiry] [--allow-partial] <file>")
+		}
+		passphrase := ""
+		if flags["--encrypt"] {
+			var err error
+			if passphrase, err = s.prompt("Import passphrase: "); err != nil {
+				return err
+			}
+		}
+		opts := nokhal.ImportOptions{
+			Overwrite:    flags["--overwrite"],
+			KeepExpired:  flags["--keep-expired"],
+			ShiftExpiry:  flags["--shift-expiry"],
+			AllowPartial: flags["--allow-partial"],
+		}
+		report, err := importFrom(db, args[0], passphrase, opts)
+		if err == nil || len(report.Errors) > 0 {
+			printImportReport(out, report)
+		}
+		return err
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, cmd.Name)
+	}
+	return nil
+}
+
+func usage(text string) error {
+	return fmt.Errorf("%w: %s", ErrUsage, text)
+}
+
+func (s *Shell) prompt(label string) (string, error) {
+	if s.Prompt == nil {
+		return "", ErrNoPrompt
+	}
+	return s.Prompt(label)
+}
+
+// confirmPassphrase prompts for a new passphrase twice.
+func (s *Shell) confirmPassphrase() (string, error) {
+	passphrase, err := s.prompt("Export passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	repeat, err := s.prompt("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" || repeat != passphrase {
+		return "", errors.New("passphrases are empty or do not match")
+	}
+	return passphrase, nil
+}
+
+func printHint(out io.Writer, path string) error {
+	info, err := nokhal.ReadHint(path)
+	if !info.MagicValid {
+		if err == nil {
+			fmt.Fprintln(out, "Not a hint file (bad magic)")
+		}
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Offset:\t%d\n", info.Offset)
+	fmt.Fprintf(w, "Salt:\t%x\n", info.Salt)
+	fmt.Fprintf(w, "Anchor:\t%08x\n", info.Anchor)
+	fmt.Fprintf(w, "Mapped:\t%t\n", info.Mapped)
+	fmt.Fprintf(w, "Sealed bytes:\t%d\n", info.SealedBytes)
+	w.Flush()
+	return err
+}
+
+func printCollections(out io.Writer, db *nokhal.DB, verbose bool) error {
+	infos, err := db.CollectionInfos()
+	if err != nil {
+		return err
+	}
+	if !verbose {
+		for _, info := range infos {
+			fmt.Fprintln(out, info.Name)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTION\tKEYS\tLIVE\tDEAD\tTTL\tOLDEST\tNEWEST\tSAMPLE")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			info.Name, info.Keys, info.LiveBytes, info.DeadBytes, info.DefaultTTL,
+			formatTimestamp(info.Oldest), formatTimestamp(info.Newest), strings.Join(info.SampleKeys, ","))
+	}
+	return w.Flush()
+}
+
+// printStats prints the database statistics and, if verbose, the churn per
+// collection, the last compaction and the compaction advice.
+func printStats(out io.Writer, db *nokhal.DB, verbose bool) error {
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Keys:\t%d\n", stats.Keys)
+	fmt.Fprintf(w, "Collections:\t%d\n", stats.Collections)
+	fmt.Fprintf(w, "Live bytes:\t%d\n", stats.LiveBytes)
+	fmt.Fprintf(w, "Dead bytes:\t%d\n", stats.DeadBytes)
+	fmt.Fprintf(w, "Size:\t%d (file %d)\n", stats.Size, stats.FileSize)
+	fmt.Fprintf(w, "Last write:\t%s\n", stats.LastWrite.Format(time.RFC3339))
+	fmt.Fprintf(w, "Written since open:\t%d\n", stats.BytesWritten)
+	if stats.Frozen {
+		fmt.Fprintf(w, "Frozen:\tyes\n")
+	}
+	if !verbose {
+		return w.Flush()
+	}
+
+	if last := stats.LastCompaction; last.Duration > 0 {
+		fmt.Fprintf(w, "Last compaction:\t%s, %d kept, %d dropped, %d -> %d bytes\n",
+			last.Duration.Round(time.Microsecond), last.LiveRecords, last.DroppedRecords, last.BytesBefore, last.BytesAfter)
+	}
+	advice, err := db.CompactionAdvice()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Reclaimable:\t%d bytes (%.0f%%)\n", advice.ReclaimableBytes, 100*advice.ReclaimableRatio)
+	fmt.Fprintf(w, "Write amplification:\t%.2f\n", advice.WriteAmplification)
+	fmt.Fprintf(w, "Churn ratio:\t%.2f\n", advice.ChurnRatio)
+	if advice.EstimatedDuration > 0 {
+		fmt.Fprintf(w, "Estimated compaction:\t%s\n", advice.EstimatedDuration.Round(time.Microsecond))
+	}
+	fmt.Fprintf(w, "Advice:\t%s (threshold %.0f%%): %s\n", advice.Recommendation, 100*advice.Threshold, advice.Reason)
+
+	names := make([]string, 0, len(stats.Churn))
+	for name := range stats.Churn {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "COLLECTION\tPUTS\tOVERWRITES\tDELETES\tWRITTEN\tCOMPRESSED")
+	for _, name := range names {
+		c := stats.Churn[name]
+		z := stats.Compression[name]
+		compressed := fmt.Sprintf("%d/%d", z.Compressed, z.Attempts)
+		if z.Incompressible {
+			compressed += " (paused)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", name, c.Puts, c.Overwrites, c.Deletes, c.BytesWritten, compressed)
+	}
+	return w.Flush()
+}
+
+// printAccess prints the reads and writes of each collection since Open or
+// ResetStats, the busiest first by bytes read and written.
+func printAccess(out io.Writer, db *nokhal.DB) error {
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(stats.Access))
+	for name := range stats.Access {
+		names = append(names, name)
+	}
+	busy := func(a nokhal.AccessStats) uint64 { return a.BytesRead + a.BytesWritten }
+	sort.Slice(names, func(i, j int) bool {
+		a, b := stats.Access[names[i]], stats.Access[names[j]]
+		if busy(a) != busy(b) {
+			return busy(a) > busy(b)
+		}
+		return names[i] < names[j]
+	})
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTION\tGETS\tPUTS\tDELETES\tREAD\tWRITTEN\tAVG VALUE")
+	for _, name := range names {
+		a := stats.Access[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%.0f\n", name, a.Gets, a.Puts, a.Deletes, a.BytesRead, a.BytesWritten, a.AvgValueSize)
+	}
+	return w.Flush()
+}
+
+func formatTimestamp(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(0, ts).Format(time.RFC3339)
+}
+
+func backupTo(db *nokhal.DB, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Backup(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func verifyBackup(path, password string, decrypt bool) (nokhal.BackupReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nokhal.BackupReport{}, err
+	}
+	defer f.Close()
+	return nokhal.VerifyBackupWithOptions(f, password, nokhal.VerifyOptions{Decrypt: decrypt})
+}
+
+// exportTo exports the records under prefix to a new file at path, only
+// those after the combined key afterKey if it is set.
+func exportTo(db *nokhal.DB, prefix, afterKey, path, passphrase string) (int, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	switch {
+	case passphrase != "":
+		n, err = db.ExportEncrypted(f, prefix, passphrase)
+	case afterKey != "":
+		n, err = db.ExportResume(f, prefix, afterKey)
+	default:
+		n, err = db.Export(f, prefix)
+	}
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// printExportResult prints the outcome of an export and, if it was cut
+// short, how to import what was written and resume the rest. It returns the
+// export's error.
+func printExportResult(out io.Writer, n int, err error) error {
+	var interrupted *nokhal.ErrExportInterrupted
+	switch {
+	case errors.As(err, &interrupted):
+		if interrupted.ResumeAfter == "" {
+			fmt.Fprintln(out, "No checkpoint was written; export again from the start")
+			return err
+		}
+		fmt.Fprintf(out, "%d records were written up to the last checkpoint; import them with import --allow-partial\n", interrupted.Written)
+		fmt.Fprintf(out, "Resume cursor: %s\n", interrupted.ResumeAfter)
+		fmt.Fprintln(out, "Continue with: export --resume <prefix> <resume cursor> <new file>")
+	case err == nil:
+		fmt.Fprintf(out, "Exported %d records\n", n)
+	}
+	return err
+}
+
+func importFrom(db *nokhal.DB, path, passphrase string, opts nokhal.ImportOptions) (nokhal.ImportReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nokhal.ImportReport{}, err
+	}
+	defer f.Close()
+	if passphrase != "" {
+		return db.ImportEncryptedWithOptions(f, passphrase, opts)
+	}
+	return db.ImportWithOptions(f, opts)
+}
+
+// printImportReport prints what an import did, including the keys it
+// skipped as expired and every malformed line.
+func printImportReport(out io.Writer, r nokhal.ImportReport) {
+	fmt.Fprintf(out, "Imported %d records\n", r.Applied)
+	if !r.ExportedAt.IsZero() {
+		fmt.Fprintf(out, "Exported at %s", r.ExportedAt.Format(time.RFC3339))
+		if r.Shift != 0 {
+			fmt.Fprintf(out, ", expiry shifted by %s", r.Shift.Round(time.Second))
+		}
+		fmt.Fprintln(out)
+	}
+	if r.SkippedExisting > 0 {
+		fmt.Fprintf(out, "Kept %d existing keys\n", r.SkippedExisting)
+	}
+	if r.SkippedInternal > 0 {
+		fmt.Fprintf(out, "Skipped %d internal records\n", r.SkippedInternal)
+	}
+	if len(r.SkippedExpired) > 0 {
+		fmt.Fprintf(out, "Skipped %d expired records: %s\n", len(r.SkippedExpired), strings.Join(r.SkippedExpired, ", "))
+	}
+	// The first error is the one the import returned
+	if len(r.Errors) > 1 {
+		for _, e := range r.Errors[1:] {
+			fmt.Fprintf(out, "Error: %v\n", e)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wesleyyan-sb/nokhal"
+)
+
+func TestExecute(t *testing.T) {
+	dir := t.TempDir()
+	db, err := nokhal.Open(filepath.Join(dir, "db.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sh := New(db)
+
+	cases := []struct {
+		line string
+		want string // Output, or a substring of it when prefixed with ~
+		err  error
+	}{
+		{"", "", nil},
+		{"# only a comment", "", nil},
+		{"put users alice 42", "OK\n", nil},
+		{`put users bob "two  words"`, "OK\n", nil},
+		{"PUT users carol three words", "OK\n", nil},
+		{"get users bob", "two  words\n", nil},
+		{"get users carol", "three words\n", nil},
+		{"scan users:", "users:alice\t42\nusers:bob\ttwo  words\nusers:carol\tthree words\n", nil},
+		{"scan users:b", "users:bob\ttwo  words\n", nil},
+		{"del users alice", "OK\n", nil},
+		{"del users carol", "OK\n", nil},
+		{"get users alice", "", nokhal.ErrNotFound},
+		{"list users", "bob\n", nil},
+		{"collections", "users\n", nil},
+		{"collections -v", "~COLLECTION  KEYS", nil},
+		{"stats", "~Keys:                1\n", nil},
+		{"stats -v", "~Advice:", nil},
+		{"stats --by-collection", "~users       3     3     2        ", nil},
+		{"compact", "Compaction complete\n", nil},
+		{"unfreeze", "Not frozen\n", nil},
+		{"freeze 1m", "Writes frozen for up to 1m0s; run unfreeze when done\n", nil},
+		{"unfreeze", "Unfrozen\n", nil},
+		{"reindex", "Reindex complete: 1 keys\n", nil},
+		{"get users", "", ErrUsage},
+		{"put users alice", "", ErrUsage},
+		{"freeze soon", "", ErrUsage},
+		{"stats -x", "", ErrUsage},
+		{"export --encrypt users: " + filepath.Join(dir, "out.json"), "", ErrNoPrompt},
+		{`put users "open`, "", ErrUnterminatedQuote},
+		{"frobnicate", "", ErrUnknownCommand},
+	}
+	for _, tc := range cases {
+		var out bytes.Buffer
+		err := sh.Execute(tc.line, &out)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("Execute(%q): %v, want %v", tc.line, err, tc.err)
+			continue
+		}
+		got := out.String()
+		if sub, ok := strings.CutPrefix(tc.want, "~"); ok {
+			if !strings.Contains(got, sub) {
+				t.Errorf("Execute(%q) wrote %q, want it to contain %q", tc.line, got, sub)
+			}
+		} else if got != tc.want {
+			t.Errorf("Execute(%q) wrote %q, want %q", tc.line, got, tc.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.json")); !os.IsNotExist(err) {
+		t.Errorf("export without a passphrase created its file: %v", err)
+	}
+}
+
+func TestExecuteFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	src, err := nokhal.Open(path("src.nok"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := nokhal.Open(path("dst.nok"), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	from, to := New(src), New(dst)
+	from.Password = "pass"
+	secrets := func(s ...string) func(string) (string, error) {
+		return func(string) (string, error) {
+			next := s[0]
+			s = s[1:]
+			return next, nil
+		}
+	}
+
+	cases := []struct {
+		sh     *Shell
+		prompt func(string) (string, error)
+		line   string
+		want   string // Output prefix; empty with a nil err for any error
+		err    error
+	}{
+		{from, nil, "put users alice 42", "OK\n", nil},
+		{from, nil, "put users bob 7", "OK\n", nil},
+		{from, nil, "backup " + path("backup.nok"), "Backup complete\n", nil},
+		{from, nil, "backup " + path("backup.nok"), "", os.ErrExist},
+		{from, nil, "verify-backup -decrypt " + path("backup.nok"), "Records: 2 (2 puts, 0 deletes)", nil},
+		{from, nil, "export users: " + path("plain.json"), "Exported 2 records\n", nil},
+		{from, secrets("secret", "typo"), "export --encrypt users: " + path("sealed.json"), "", nil},
+		{from, secrets("secret", "secret"), "export --encrypt users: " + path("sealed.json"), "Exported 2 records\n", nil},
+		{to, nil, "import " + path("plain.json"), "Imported 2 records\n", nil},
+		{to, secrets("secret"), "import --encrypt --overwrite " + path("sealed.json"), "Imported 2 records\n", nil},
+		{to, nil, "get users bob", "7\n", nil},
+	}
+	for _, tc := range cases {
+		tc.sh.Prompt = tc.prompt
+		var out bytes.Buffer
+		err := tc.sh.Execute(tc.line, &out)
+		switch {
+		case tc.err == nil && tc.want == "":
+			if err == nil {
+				t.Errorf("Execute(%q) succeeded", tc.line)
+			}
+		case !errors.Is(err, tc.err):
+			t.Errorf("Execute(%q): %v, want %v", tc.line, err, tc.err)
+		case !strings.HasPrefix(out.String(), tc.want):
+			t.Errorf("Execute(%q) wrote %q, want %q", tc.line, out.String(), tc.want)
+		}
+	}
+
+	// Without a database only hint runs
+	if err := New(nil).Execute("get users alice", &bytes.Buffer{}); err != ErrNoDatabase {
+		t.Errorf("Execute without a database: %v", err)
+	}
+	var out bytes.Buffer
+	if err := New(nil).Execute("hint "+path("missing.nok"), &out); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("hint of a missing file: %v", err)
+	}
+}